@@ -0,0 +1,341 @@
+// Package aferofs allows using a VFS as an afero.Fs and vice versa,
+// so VFS implementations can be passed to libraries using
+// github.com/spf13/afero and afero filesystems can be mounted in
+// a vfs.Mounter.
+package aferofs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rainycape/vfs"
+	"github.com/spf13/afero"
+)
+
+// ErrNotSupported is returned, wrapped in an *os.PathError, by the
+// operations which can't be performed on the underlying VFS. It's
+// the same error as vfs.ErrNotSupported.
+var ErrNotSupported = vfs.ErrNotSupported
+
+type aferoFs struct {
+	fs vfs.VFS
+}
+
+func (a *aferoFs) Create(name string) (afero.File, error) {
+	return a.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (a *aferoFs) Mkdir(name string, perm os.FileMode) error {
+	return vfs.WrapPathError("mkdir", name, a.fs.Mkdir(name, perm))
+}
+
+func (a *aferoFs) MkdirAll(p string, perm os.FileMode) error {
+	return vfs.WrapPathError("mkdir", p, vfs.MkdirAll(a.fs, p, perm))
+}
+
+func (a *aferoFs) Open(name string) (afero.File, error) {
+	return a.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (a *aferoFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		info, err := a.fs.Stat(name)
+		if err != nil {
+			return nil, vfs.WrapPathError("open", name, err)
+		}
+		if info.IsDir() {
+			return &aferoFile{a: a, name: name, dir: true}, nil
+		}
+		f, err := a.fs.Open(name)
+		if err != nil {
+			return nil, vfs.WrapPathError("open", name, err)
+		}
+		return &aferoFile{a: a, name: name, rf: f}, nil
+	}
+	f, err := a.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, vfs.WrapPathError("open", name, err)
+	}
+	return &aferoFile{a: a, name: name, flag: flag, rf: f, wf: f}, nil
+}
+
+func (a *aferoFs) Remove(name string) error {
+	return vfs.WrapPathError("remove", name, a.fs.Remove(name))
+}
+
+func (a *aferoFs) RemoveAll(p string) error {
+	return vfs.WrapPathError("removeall", p, vfs.RemoveAll(a.fs, p))
+}
+
+// Rename moves the files with vfs.Rename, returning its errors
+// wrapped in an *os.LinkError like os.Rename does.
+func (a *aferoFs) Rename(oldname string, newname string) error {
+	if err := vfs.Rename(a.fs, oldname, newname); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (a *aferoFs) Stat(name string) (os.FileInfo, error) {
+	info, err := a.fs.Stat(name)
+	return info, vfs.WrapPathError("stat", name, err)
+}
+
+func (a *aferoFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	info, err := a.fs.Lstat(name)
+	return info, true, vfs.WrapPathError("lstat", name, err)
+}
+
+func (a *aferoFs) Name() string {
+	return a.fs.String()
+}
+
+// entry returns the in-memory entry for the given file, if the
+// VFS stores its files in memory.
+func (a *aferoFs) entry(op string, name string) (vfs.Entry, error) {
+	info, err := a.fs.Stat(name)
+	if err != nil {
+		return nil, vfs.WrapPathError(op, name, err)
+	}
+	switch e := info.Sys().(type) {
+	case *vfs.File:
+		return e, nil
+	case *vfs.Dir:
+		return e, nil
+	}
+	return nil, vfs.WrapPathError(op, name, ErrNotSupported)
+}
+
+// Chmod uses vfs.Chmod, so it returns ErrNotSupported unless the
+// VFS keeps its files in memory.
+func (a *aferoFs) Chmod(name string, mode os.FileMode) error {
+	return vfs.WrapPathError("chmod", name, vfs.Chmod(a.fs, name, mode))
+}
+
+// Chown is not supported, since VFS has no notion of file owners.
+func (a *aferoFs) Chown(name string, uid int, gid int) error {
+	return vfs.WrapPathError("chown", name, ErrNotSupported)
+}
+
+// Chtimes is only supported by the same VFS implementations as
+// Chmod. Only the modification time is stored.
+func (a *aferoFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	e, err := a.entry("chtimes", name)
+	if err != nil {
+		return err
+	}
+	switch e := e.(type) {
+	case *vfs.File:
+		e.Lock()
+		e.ModTime = mtime
+		e.Unlock()
+	case *vfs.Dir:
+		e.Lock()
+		e.ModTime = mtime
+		e.Unlock()
+	}
+	return nil
+}
+
+// ToAfero returns an afero.Fs which accesses the files in the given VFS.
+// See the documentation on the methods of the returned afero.Fs for
+// the operations which can't be always mapped to a VFS.
+func ToAfero(fs vfs.VFS) afero.Fs {
+	return &aferoFs{fs: fs}
+}
+
+// aferoFile implements afero.File on top of a VFS file or directory.
+type aferoFile struct {
+	mu   sync.Mutex
+	a    *aferoFs
+	name string
+	flag int
+	rf   vfs.RFile
+	// wf is non-nil only for files opened for writing
+	wf vfs.WFile
+	// dir is true for directories, which have no rf
+	dir     bool
+	entries []os.FileInfo
+	read    bool
+}
+
+func (f *aferoFile) errIsDir(op string) error {
+	return &os.PathError{Op: op, Path: f.name, Err: fmt.Errorf("is a directory")}
+}
+
+func (f *aferoFile) Close() error {
+	if f.dir {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rf == nil {
+		return os.ErrClosed
+	}
+	return f.rf.Close()
+}
+
+func (f *aferoFile) Read(p []byte) (int, error) {
+	if f.dir {
+		return 0, f.errIsDir("read")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rf == nil {
+		return 0, os.ErrClosed
+	}
+	return f.rf.Read(p)
+}
+
+func (f *aferoFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.dir {
+		return 0, f.errIsDir("read")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rf == nil {
+		return 0, os.ErrClosed
+	}
+	return vfs.ReadAt(f.rf, p, off)
+}
+
+func (f *aferoFile) Seek(offset int64, whence int) (int64, error) {
+	if f.dir {
+		return 0, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rf == nil {
+		return 0, os.ErrClosed
+	}
+	return f.rf.Seek(offset, whence)
+}
+
+// writable returns the error for writing to f, if any. It must
+// be called with f.mu held.
+func (f *aferoFile) writable() error {
+	if f.rf == nil {
+		return os.ErrClosed
+	}
+	if f.wf == nil {
+		return vfs.ErrReadOnly
+	}
+	return nil
+}
+
+func (f *aferoFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.writable(); err != nil {
+		return 0, err
+	}
+	return f.wf.Write(p)
+}
+
+func (f *aferoFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		return 0, errors.New("aferofs: WriteAt is not allowed on files opened with O_APPEND")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.writable(); err != nil {
+		return 0, err
+	}
+	pos, err := f.wf.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	defer f.wf.Seek(pos, io.SeekStart)
+	// Not all files support seeking past the end, so
+	// fill the gap with zeroes.
+	size, err := f.wf.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if off > size {
+		if _, err := f.wf.Write(make([]byte, off-size)); err != nil {
+			return 0, err
+		}
+	} else if _, err := f.wf.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return f.wf.Write(p)
+}
+
+func (f *aferoFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *aferoFile) Name() string {
+	return f.name
+}
+
+func (f *aferoFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.dir {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: fmt.Errorf("not a directory")}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.read {
+		entries, err := f.a.fs.ReadDir(f.name)
+		if err != nil {
+			return nil, vfs.WrapPathError("readdir", f.name, err)
+		}
+		f.entries = entries
+		f.read = true
+	}
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+	return entries, nil
+}
+
+func (f *aferoFile) Readdirnames(n int) ([]string, error) {
+	infos, err := f.Readdir(n)
+	names := make([]string, len(infos))
+	for ii, v := range infos {
+		names[ii] = v.Name()
+	}
+	return names, err
+}
+
+func (f *aferoFile) Stat() (os.FileInfo, error) {
+	return f.a.Stat(f.name)
+}
+
+func (f *aferoFile) Sync() error {
+	return nil
+}
+
+// Truncate is implemented with vfs.TruncateFile, so the file is
+// closed and opened again. If it can't be opened again, f is left
+// closed and the next calls return os.ErrClosed.
+func (f *aferoFile) Truncate(size int64) error {
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.writable(); err != nil {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: err}
+	}
+	wf, err := vfs.TruncateFile(f.a.fs, f.name, f.wf, f.flag, size)
+	f.rf, f.wf = wf, wf
+	return vfs.WrapPathError("truncate", f.name, err)
+}
+
+var _ afero.Lstater = (*aferoFs)(nil)
@@ -0,0 +1,219 @@
+package aferofs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rainycape/vfs"
+	"github.com/spf13/afero"
+)
+
+func TestToAfero(t *testing.T) {
+	mem := vfs.Memory()
+	fs := ToAfero(mem)
+	if err := fs.MkdirAll("/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/a/b/file.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := vfs.ReadFile(mem, "/a/b/file.txt")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected contents in VFS %q, %v", string(data), err)
+	}
+	if _, err := fs.Stat("/missing"); !os.IsNotExist(err) {
+		t.Errorf("expecting not exist error, got %v", err)
+	}
+	if err := fs.Rename("/a/b", "/a/c"); err != nil {
+		t.Fatal(err)
+	}
+	data, err = afero.ReadFile(fs, "/a/c/file.txt")
+	if err != nil || string(data) != "hello" {
+		t.Errorf("unexpected contents after rename %q, %v", string(data), err)
+	}
+	if _, err := mem.Stat("/a/b"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting /a/b to be removed after rename, got %v", err)
+	}
+	if err := fs.Rename("/a", "/a/c/d"); err == nil {
+		t.Error("expecting an error when renaming a directory into itself")
+	}
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := fs.Chtimes("/a/c/file.txt", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chmod("/a/c/file.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, err := mem.Stat("/a/c/file.txt")
+	if err != nil || !info.ModTime().Equal(mtime) || info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected info after Chmod and Chtimes %v, %v", info, err)
+	}
+	if err := fs.Chown("/a/c/file.txt", 0, 0); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expecting ErrNotSupported, got %v", err)
+	}
+	var walked []string
+	err = afero.Walk(fs, "/", func(path string, info os.FileInfo, err error) error {
+		walked = append(walked, path)
+		return err
+	})
+	if exp := []string{"/", "/a", "/a/c", "/a/c/file.txt"}; err != nil || !reflect.DeepEqual(walked, exp) {
+		t.Errorf("expecting walked %v, got %v (%v)", exp, walked, err)
+	}
+}
+
+func TestToAferoFile(t *testing.T) {
+	fs := ToAfero(vfs.Memory())
+	f, err := fs.Create("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("hello world"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("W"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("!"), 13); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := f.ReadAt(buf, 6); err != nil || string(buf) != "World" {
+		t.Errorf("unexpected ReadAt result %q, %v", string(buf), err)
+	}
+	if err := f.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("!"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := afero.ReadFile(fs, "/file")
+	if err != nil || string(data) != "hello!" {
+		t.Errorf("unexpected contents after truncating %q, %v", string(data), err)
+	}
+	for _, name := range []string{"c", "b", "a"} {
+		if err := fs.MkdirAll("/dir/"+name, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := fs.Open("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(2)
+	if err != nil || !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("unexpected names %v, %v", names, err)
+	}
+	names, err = d.Readdirnames(2)
+	if err != nil || !reflect.DeepEqual(names, []string{"c"}) {
+		t.Errorf("unexpected names %v, %v", names, err)
+	}
+	if _, err := d.Readdirnames(2); err != io.EOF {
+		t.Errorf("expecting io.EOF, got %v", err)
+	}
+}
+
+func TestToAferoTruncateError(t *testing.T) {
+	errFault := errors.New("fault")
+	// The second OpenFile is the one from vfs.Truncate and the
+	// third one opens the file again.
+	for _, nth := range []int{2, 3} {
+		mem := vfs.Memory()
+		fs := ToAfero(vfs.Faulty(mem, []vfs.FaultRule{{Op: vfs.OpOpenFile, Nth: nth, Err: errFault}}, 1))
+		f, err := fs.Create("/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString("hello"); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Truncate(2); !errors.Is(err, errFault) {
+			t.Errorf("expecting the fault from Truncate, got %v", err)
+		}
+		_, err = f.WriteString("!")
+		if nth == 2 && err != nil {
+			t.Errorf("expecting the file to be usable after failing to truncate it, got %v", err)
+		}
+		if nth == 3 && err != os.ErrClosed {
+			t.Errorf("expecting os.ErrClosed after failing to open the file again, got %v", err)
+		}
+		f.Close()
+	}
+}
+
+func TestZipToAfero(t *testing.T) {
+	zfs, err := vfs.Open(filepath.Join("..", "testdata", "fs.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := afero.NewReadOnlyFs(ToAfero(zfs))
+	var files int
+	err = afero.Walk(fs, "/", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			if _, err := afero.ReadFile(fs, path); err != nil {
+				return err
+			}
+			files++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files == 0 {
+		t.Error("no files found in zip")
+	}
+}
+
+func TestFromAfero(t *testing.T) {
+	afs := afero.NewMemMapFs()
+	fs := FromAfero(afs)
+	m := &vfs.Mounter{}
+	mem := vfs.Memory()
+	if err := mem.Mkdir("/afero", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(mem, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(fs, "/afero"); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.MkdirAll(m, "/afero/x/y", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(m, "/afero/x/b", []byte("B"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(m, "/afero/x/a", []byte("A"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := afero.ReadFile(afs, "/x/a")
+	if err != nil || string(data) != "A" {
+		t.Errorf("unexpected contents in afero fs %q, %v", string(data), err)
+	}
+	infos, err := m.ReadDir("/afero/x")
+	if err != nil || len(infos) != 3 || infos[0].Name() != "a" || infos[1].Name() != "b" || infos[2].Name() != "y" {
+		t.Errorf("unexpected entries %v, %v", infos, err)
+	}
+	if _, err := m.Stat("/afero/missing"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting not exist error, got %v", err)
+	}
+	if err := vfs.RemoveAll(m, "/afero/x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := afs.Stat("/x"); !os.IsNotExist(err) {
+		t.Errorf("expecting /x to be removed, got %v", err)
+	}
+}
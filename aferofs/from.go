@@ -0,0 +1,64 @@
+package aferofs
+
+import (
+	"fmt"
+	"os"
+	pathpkg "path"
+
+	"github.com/rainycape/vfs"
+	"github.com/spf13/afero"
+)
+
+// absPath returns p as an absolute path, since VFS paths are always
+// relative to the root while afero might interpret them relative to
+// its working directory.
+func absPath(p string) string {
+	return pathpkg.Clean("/" + p)
+}
+
+type fromAfero struct {
+	fs afero.Fs
+}
+
+func (f *fromAfero) Open(path string) (vfs.RFile, error) {
+	return f.fs.Open(absPath(path))
+}
+
+func (f *fromAfero) OpenFile(path string, flag int, perm os.FileMode) (vfs.WFile, error) {
+	return f.fs.OpenFile(absPath(path), flag, perm)
+}
+
+func (f *fromAfero) Lstat(path string) (os.FileInfo, error) {
+	if l, ok := f.fs.(afero.Lstater); ok {
+		info, _, err := l.LstatIfPossible(absPath(path))
+		return info, err
+	}
+	return f.fs.Stat(absPath(path))
+}
+
+func (f *fromAfero) Stat(path string) (os.FileInfo, error) {
+	return f.fs.Stat(absPath(path))
+}
+
+func (f *fromAfero) ReadDir(path string) ([]os.FileInfo, error) {
+	// afero.ReadDir sorts the entries by name
+	return afero.ReadDir(f.fs, absPath(path))
+}
+
+func (f *fromAfero) Mkdir(path string, perm os.FileMode) error {
+	return f.fs.Mkdir(absPath(path), perm)
+}
+
+func (f *fromAfero) Remove(path string) error {
+	return f.fs.Remove(absPath(path))
+}
+
+func (f *fromAfero) String() string {
+	return fmt.Sprintf("Afero %s", f.fs.Name())
+}
+
+// FromAfero returns a VFS which accesses the files in the given
+// afero.Fs.
+func FromAfero(fs afero.Fs) vfs.VFS {
+	return &fromAfero{fs: fs}
+}
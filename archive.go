@@ -0,0 +1,168 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveOptions specifies the options for reading the built-in archive
+// formats with ReadZip, ReadTar and its compressed variants, like
+// ReadTarGzip, or with OpenWithOptions and OpenReaderWithOptions. A nil
+// *ArchiveOptions is valid and represents the default options.
+type ArchiveOptions struct {
+	// RejectExternalLinks makes reading fail if the archive contains
+	// a symbolic or hard link pointing outside of it, either with an
+	// absolute path or with too many "..". Otherwise, absolute symlink
+	// targets are interpreted as relative to the root of the archive.
+	RejectExternalLinks bool
+}
+
+func (o *ArchiveOptions) withDefaults() ArchiveOptions {
+	var opts ArchiveOptions
+	if o != nil {
+		opts = *o
+	}
+	return opts
+}
+
+// archive accumulates the entries read from an archive and
+// creates an in-memory VFS from them.
+type archive struct {
+	opts  ArchiveOptions
+	files map[string]*File
+	dirs  map[string]*Dir
+}
+
+func newArchive(opts *ArchiveOptions) *archive {
+	return &archive{
+		opts:  opts.withDefaults(),
+		files: make(map[string]*File),
+		dirs:  make(map[string]*Dir),
+	}
+}
+
+// archiveName returns the cleaned name of an archive entry, relative
+// to the root, or an empty string for the root itself.
+func archiveName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// isExternal returns true iff the target, relative to the
+// given directory, points outside of the archive.
+func isExternal(dir string, target string) bool {
+	if path.IsAbs(target) {
+		return true
+	}
+	p := path.Join(dir, target)
+	return p == ".." || strings.HasPrefix(p, "../")
+}
+
+// relPath returns the path of target, which must be absolute,
+// relative to dir.
+func relPath(dir string, target string) string {
+	dirParts := strings.Split(strings.Trim(dir, "/"), "/")
+	targetParts := strings.Split(strings.Trim(path.Clean(target), "/"), "/")
+	if dirParts[0] == "" {
+		dirParts = nil
+	}
+	if targetParts[0] == "" {
+		targetParts = nil
+	}
+	common := 0
+	for common < len(dirParts) && common < len(targetParts) && dirParts[common] == targetParts[common] {
+		common++
+	}
+	var parts []string
+	for ii := common; ii < len(dirParts); ii++ {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, targetParts[common:]...)
+	if len(parts) == 0 {
+		return "."
+	}
+	return path.Join(parts...)
+}
+
+func (a *archive) addDir(name string, mode os.FileMode, modTime time.Time) {
+	if name = archiveName(name); name == "" {
+		return
+	}
+	a.dirs[name] = &Dir{
+		Mode:    os.ModeDir | mode.Perm(),
+		ModTime: modTime,
+	}
+}
+
+func (a *archive) addFile(name string, data []byte, mode os.FileMode, modTime time.Time) {
+	a.files[archiveName(name)] = &File{
+		Data:    data,
+		Mode:    mode,
+		ModTime: modTime,
+	}
+}
+
+func (a *archive) addSymlink(name string, target string, mode os.FileMode, modTime time.Time) error {
+	name = archiveName(name)
+	dir := path.Dir(name)
+	if a.opts.RejectExternalLinks && isExternal(dir, target) {
+		return fmt.Errorf("symlink %s points outside the archive to %s", name, target)
+	}
+	if path.IsAbs(target) {
+		// Interpret it as relative to the root of the archive
+		target = relPath(dir, target)
+	}
+	a.files[name] = &File{
+		Data:    []byte(target),
+		Mode:    os.ModeSymlink | mode.Perm(),
+		ModTime: modTime,
+	}
+	return nil
+}
+
+// addHardLink adds a file sharing its data with target, which is
+// relative to the root of the archive and must have been already
+// added.
+func (a *archive) addHardLink(name string, target string) error {
+	name = archiveName(name)
+	if a.opts.RejectExternalLinks && isExternal("", target) {
+		return fmt.Errorf("hard link %s points outside the archive to %s", name, target)
+	}
+	f := a.files[archiveName(target)]
+	if f == nil {
+		return fmt.Errorf("hard link %s points to missing file %s", name, target)
+	}
+	a.files[name] = f
+	return nil
+}
+
+// VFS returns an in-memory VFS with the entries in the archive.
+func (a *archive) VFS() (VFS, error) {
+	fs, err := Map(a.files)
+	if err != nil {
+		return nil, err
+	}
+	mem := fs.(*memoryFileSystem)
+	names := make([]string, 0, len(a.dirs))
+	for k := range a.dirs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, v := range names {
+		if err := MkdirAll(fs, v, 0755); err != nil {
+			return nil, err
+		}
+		d, err := mem.dirEntry(v, false)
+		if err != nil {
+			return nil, err
+		}
+		d.Lock()
+		d.Mode = a.dirs[v].Mode
+		d.ModTime = a.dirs[v].ModTime
+		d.Unlock()
+	}
+	return fs, nil
+}
@@ -0,0 +1,226 @@
+package vfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+)
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx which carries the given identity.
+// When a VFS returned by AuditedVFS.WithContext is used, the identity
+// is included in the audit records.
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity stored in ctx by
+// WithIdentity, or an empty string if there's none.
+func IdentityFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(identityKey{}).(string)
+	return id
+}
+
+// AuditOptions specifies the options for Audited.
+type AuditOptions struct {
+	// LogReads indicates wheter calls which only read (Open,
+	// OpenFile without write flags and ReadDir) should be logged
+	// too. By default, only calls which modify the VFS are logged.
+	LogReads bool
+}
+
+// AuditedVFS is the interface implemented by the VFS returned from
+// Audited.
+type AuditedVFS interface {
+	VFS
+	// WithContext returns a VFS which logs using ctx, including
+	// the identity stored in it by WithIdentity, if any.
+	WithContext(ctx context.Context) VFS
+}
+
+type auditedFileSystem struct {
+	fs     VFS
+	logger *slog.Logger
+	reads  bool
+	ctx    context.Context
+}
+
+func (fs *auditedFileSystem) VFS() VFS {
+	return fs.fs
+}
+
+func (fs *auditedFileSystem) WithContext(ctx context.Context) VFS {
+	cp := *fs
+	cp.ctx = ctx
+	return &cp
+}
+
+func (fs *auditedFileSystem) log(op string, path string, err error, attrs ...slog.Attr) {
+	level := slog.LevelInfo
+	attrs = append(attrs, slog.String("path", path))
+	if id := IdentityFromContext(fs.ctx); id != "" {
+		attrs = append(attrs, slog.String("identity", id))
+	}
+	if err != nil {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	fs.logger.LogAttrs(fs.ctx, level, "vfs."+op, attrs...)
+}
+
+func (fs *auditedFileSystem) Open(path string) (RFile, error) {
+	f, err := fs.fs.Open(path)
+	if fs.reads {
+		fs.log("Open", path, err)
+	}
+	return f, err
+}
+
+func (fs *auditedFileSystem) OpenFile(path string, flag int, perm os.FileMode) (WFile, error) {
+	f, err := fs.fs.OpenFile(path, flag, perm)
+	write := flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0
+	if write || fs.reads {
+		fs.log("OpenFile", path, err, slog.Int("flag", flag), slog.String("perm", perm.String()))
+	}
+	if err != nil || !write {
+		return f, err
+	}
+	af := &auditedFile{WFile: f, fs: fs, path: path}
+	if flag&os.O_TRUNC != 0 || flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		af.hash = sha256.New()
+	}
+	return af, nil
+}
+
+func (fs *auditedFileSystem) Lstat(path string) (os.FileInfo, error) {
+	return fs.fs.Lstat(path)
+}
+
+func (fs *auditedFileSystem) Stat(path string) (os.FileInfo, error) {
+	return fs.fs.Stat(path)
+}
+
+func (fs *auditedFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	infos, err := fs.fs.ReadDir(path)
+	if fs.reads {
+		fs.log("ReadDir", path, err)
+	}
+	return infos, err
+}
+
+func (fs *auditedFileSystem) Mkdir(path string, perm os.FileMode) error {
+	err := fs.fs.Mkdir(path, perm)
+	fs.log("Mkdir", path, err, slog.String("perm", perm.String()))
+	return err
+}
+
+func (fs *auditedFileSystem) Remove(path string) error {
+	err := fs.fs.Remove(path)
+	fs.log("Remove", path, err)
+	return err
+}
+
+func (fs *auditedFileSystem) String() string {
+	return fmt.Sprintf("Audited %s", fs.fs.String())
+}
+
+// auditedFile logs the final size and hash of the file when closing
+// it, as long as anything was written to it.
+type auditedFile struct {
+	WFile
+	fs      *auditedFileSystem
+	path    string
+	written bool
+	// hash and size are updated by Write while the written data
+	// is known to be the whole file, which requires OpenFile to
+	// have truncated or created it and no Seek to have moved the
+	// offset away from its end. Otherwise hash is nil and the file
+	// is read back when closing it.
+	hash hash.Hash
+	size int64
+}
+
+func (f *auditedFile) Write(p []byte) (int, error) {
+	f.written = true
+	n, err := f.WFile.Write(p)
+	if f.hash != nil && n > 0 {
+		f.hash.Write(p[:n])
+		f.size += int64(n)
+	}
+	return n, err
+}
+
+func (f *auditedFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.WFile.Seek(offset, whence)
+	if err != nil || pos != f.size {
+		f.hash = nil
+	}
+	return pos, err
+}
+
+func (f *auditedFile) Close() error {
+	err := f.WFile.Close()
+	if !f.written {
+		return err
+	}
+	if err != nil {
+		f.fs.log("Close", f.path, err)
+		return err
+	}
+	size, sum := f.size, ""
+	if f.hash != nil {
+		sum = hex.EncodeToString(f.hash.Sum(nil))
+	} else {
+		// The file might have been written with arbitrary seeks, so
+		// read it back to know its final contents.
+		var herr error
+		size, sum, herr = hashFile(f.fs.fs, f.path)
+		if herr != nil {
+			// The file was closed fine, so only the record
+			// reflects the error.
+			f.fs.log("Close", f.path, fmt.Errorf("error hashing %s: %v", f.path, herr))
+			return nil
+		}
+	}
+	f.fs.log("Close", f.path, nil, slog.Int64("size", size), slog.String("sha256", sum))
+	return nil
+}
+
+func hashFile(fs VFS, path string) (int64, string, error) {
+	r, err := fs.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Audited returns a VFS which emits a record to the given logger for
+// every call which modifies fs: OpenFile with any flags which allow
+// writing, Mkdir and Remove. Closing a file which has been written to
+// also emits a record, including its final size and its SHA-256 hash.
+// Records are logged at the Info level, or at the Warn level if the
+// call failed. Use WithContext to include the caller identity in the
+// records. The opts argument might be nil.
+func Audited(fs VFS, logger *slog.Logger, opts *AuditOptions) AuditedVFS {
+	afs := &auditedFileSystem{
+		fs:     fs,
+		logger: logger,
+		ctx:    context.Background(),
+	}
+	if opts != nil {
+		afs.reads = opts.LogReads
+	}
+	return afs
+}
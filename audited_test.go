@@ -0,0 +1,179 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func auditRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	buf.Reset()
+	return records
+}
+
+func TestAudited(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	fs := Audited(Memory(), logger, nil)
+	ctx := WithIdentity(context.Background(), "alice")
+	if err := WriteFile(fs.WithContext(ctx), "a", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	records := auditRecords(t, &buf)
+	if len(records) != 2 {
+		t.Fatalf("expecting 2 records, got %d", len(records))
+	}
+	if msg := records[0]["msg"]; msg != "vfs.OpenFile" {
+		t.Errorf("expecting vfs.OpenFile, got %v", msg)
+	}
+	closeRec := records[1]
+	if closeRec["msg"] != "vfs.Close" || closeRec["identity"] != "alice" || closeRec["path"] != "a" {
+		t.Errorf("unexpected close record %v", closeRec)
+	}
+	if closeRec["size"] != float64(5) || closeRec["sha256"] != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("unexpected size or hash in close record %v", closeRec)
+	}
+	if _, err := ReadFile(fs, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("a", 0755); err == nil {
+		t.Fatal("expecting an error")
+	}
+	records = auditRecords(t, &buf)
+	if len(records) != 1 || records[0]["msg"] != "vfs.Mkdir" || records[0]["level"] != "WARN" {
+		t.Errorf("expecting a single failed Mkdir record, got %v", records)
+	}
+	if _, ok := records[0]["identity"]; ok {
+		t.Error("record without context should not have an identity")
+	}
+}
+
+func TestAuditedReads(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	fs := Audited(Memory(), logger, &AuditOptions{LogReads: true})
+	if err := WriteFile(fs, "a", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if _, err := ReadFile(fs, "a"); err != nil {
+		t.Fatal(err)
+	}
+	records := auditRecords(t, &buf)
+	if len(records) != 1 || records[0]["msg"] != "vfs.Open" {
+		t.Errorf("expecting a single Open record, got %v", records)
+	}
+}
+
+func TestAuditedHash(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	obs := &recordingObserver{}
+	fs := Audited(Instrumented(Memory(), obs), logger, nil)
+	closeRecord := func() map[string]interface{} {
+		records := auditRecords(t, &buf)
+		if len(records) != 2 || records[1]["msg"] != "vfs.Close" {
+			t.Fatalf("expecting OpenFile and Close records, got %v", records)
+		}
+		return records[1]
+	}
+	// Truncated files are hashed while they're written
+	if err := WriteFile(fs, "a", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rec := closeRecord(); rec["sha256"] != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("unexpected hash in close record %v", rec)
+	}
+	if c, _, _ := obs.count(OpOpen); c != 0 {
+		t.Errorf("expecting no reads after writing a truncated file, got %d", c)
+	}
+	// After a Seek, the file is read back
+	f, err := fs.OpenFile("a", os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("j")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// sha256("jello")
+	if rec := closeRecord(); rec["size"] != float64(5) || rec["sha256"] != "187c9bceeb919e1b3e6d20fa50ecabf7d9d50b5343e8f9a3d912abb13929102e" {
+		t.Errorf("unexpected size or hash in close record %v", rec)
+	}
+	// Writing to an existing file without truncating it
+	// also requires reading it back
+	f, err = fs.OpenFile("a", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// sha256("!ello")
+	if rec := closeRecord(); rec["size"] != float64(5) || rec["sha256"] != "09d3d97135f6a7c688f34fc6a5c9f64a000ebceb941c899e555be41811ad9277" {
+		t.Errorf("unexpected size or hash in close record %v", rec)
+	}
+}
+
+func TestAuditedHashError(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	mem := Memory()
+	if err := WriteFile(mem, "a", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	faulty := Faulty(mem, []FaultRule{{Op: OpOpen, Err: errors.New("can't open")}}, 1)
+	fs := Audited(faulty, logger, nil)
+	f, err := fs.OpenFile("a", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("j")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("expecting no error from Close when hashing fails, got %v", err)
+	}
+	records := auditRecords(t, &buf)
+	if len(records) != 2 {
+		t.Fatalf("expecting OpenFile and Close records, got %v", records)
+	}
+	if rec := records[1]; rec["level"] != "WARN" || !strings.Contains(rec["error"].(string), "can't open") {
+		t.Errorf("expecting the hash error in the close record, got %v", rec)
+	}
+	data, err := ReadFile(mem, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "jello" {
+		t.Errorf("expecting jello, got %q", data)
+	}
+}
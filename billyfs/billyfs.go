@@ -0,0 +1,200 @@
+// Package billyfs implements github.com/go-git/go-billy/v5 filesystems
+// on top of a VFS, so an in-memory VFS or a vfs.Mounter can be used
+// as a go-git worktree or object storage.
+package billyfs
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/rainycape/vfs"
+)
+
+var errNotSymlink = errors.New("not a symbolic link")
+
+type billyFs struct {
+	fs vfs.VFS
+	// locks contains the mutexes used by File.Lock, keyed
+	// by the cleaned file path.
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func (b *billyFs) lock(name string) *sync.Mutex {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	name = cleanPath(name)
+	m := b.locks[name]
+	if m == nil {
+		m = new(sync.Mutex)
+		b.locks[name] = m
+	}
+	return m
+}
+
+// createDir creates the parent directories of the given path, like
+// the billy implementations do when creating files.
+func (b *billyFs) createDir(name string) error {
+	dir := path.Dir(cleanPath(name))
+	if dir == "/" {
+		return nil
+	}
+	return vfs.MkdirAll(b.fs, dir, 0755)
+}
+
+func (b *billyFs) Create(filename string) (billy.File, error) {
+	return b.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (b *billyFs) Open(filename string) (billy.File, error) {
+	return b.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (b *billyFs) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		f, err := b.fs.Open(filename)
+		if err != nil {
+			return nil, vfs.WrapPathError("open", filename, err)
+		}
+		return &file{b: b, name: filename, flag: flag, rf: f}, nil
+	}
+	if flag&os.O_CREATE != 0 {
+		if err := b.createDir(filename); err != nil {
+			return nil, vfs.WrapPathError("open", filename, err)
+		}
+	}
+	f, err := b.fs.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, vfs.WrapPathError("open", filename, err)
+	}
+	return &file{b: b, name: filename, flag: flag, rf: f, wf: f}, nil
+}
+
+func (b *billyFs) Stat(filename string) (os.FileInfo, error) {
+	info, err := b.fs.Stat(filename)
+	return info, vfs.WrapPathError("stat", filename, err)
+}
+
+func (b *billyFs) rename(from string, to string) error {
+	if err := b.createDir(to); err != nil {
+		return err
+	}
+	return vfs.Rename(b.fs, from, to)
+}
+
+// Rename creates the parent directories of to, like the billy
+// implementations do, before moving the files with vfs.Rename.
+func (b *billyFs) Rename(from string, to string) error {
+	if err := b.rename(from, to); err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	return nil
+}
+
+func (b *billyFs) Remove(filename string) error {
+	return vfs.WrapPathError("remove", filename, b.fs.Remove(filename))
+}
+
+func (b *billyFs) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+func (b *billyFs) TempFile(dir string, prefix string) (billy.File, error) {
+	if err := vfs.MkdirAll(b.fs, cleanPath(dir), 0755); err != nil {
+		return nil, vfs.WrapPathError("tempfile", dir, err)
+	}
+	for {
+		name := path.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := b.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil && os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+}
+
+func (b *billyFs) ReadDir(p string) ([]os.FileInfo, error) {
+	infos, err := b.fs.ReadDir(p)
+	return infos, vfs.WrapPathError("readdir", p, err)
+}
+
+func (b *billyFs) MkdirAll(filename string, perm os.FileMode) error {
+	return vfs.WrapPathError("mkdir", filename, vfs.MkdirAll(b.fs, filename, perm))
+}
+
+func (b *billyFs) Lstat(filename string) (os.FileInfo, error) {
+	info, err := b.fs.Lstat(filename)
+	return info, vfs.WrapPathError("lstat", filename, err)
+}
+
+// Symlink creates the parent directories of link and then the link
+// itself with vfs.Symlink, so it returns billy.ErrNotSupported unless
+// the VFS keeps its files in memory, like vfs.Memory or a vfs.Mounter
+// using it.
+func (b *billyFs) Symlink(target string, link string) error {
+	if err := b.createDir(link); err != nil {
+		return vfs.WrapPathError("symlink", link, err)
+	}
+	err := vfs.Symlink(b.fs, target, link)
+	if err == vfs.ErrNotSupported {
+		err = billy.ErrNotSupported
+	}
+	return vfs.WrapPathError("symlink", link, err)
+}
+
+func (b *billyFs) Readlink(link string) (string, error) {
+	info, err := b.fs.Lstat(link)
+	if err != nil {
+		return "", vfs.WrapPathError("readlink", link, err)
+	}
+	e, ok := info.Sys().(*vfs.File)
+	if !ok || info.Mode()&os.ModeSymlink == 0 {
+		return "", vfs.WrapPathError("readlink", link, errNotSymlink)
+	}
+	e.RLock()
+	defer e.RUnlock()
+	return string(e.Data), nil
+}
+
+// Chmod returns billy.ErrNotSupported when vfs.Chmod can't
+// change the mode because the VFS doesn't keep its files in
+// memory.
+func (b *billyFs) Chmod(name string, mode os.FileMode) error {
+	err := vfs.Chmod(b.fs, name, mode)
+	if err == vfs.ErrNotSupported {
+		err = billy.ErrNotSupported
+	}
+	return vfs.WrapPathError("chmod", name, err)
+}
+
+func (b *billyFs) Capabilities() billy.Capability {
+	return billy.DefaultCapabilities
+}
+
+func (b *billyFs) String() string {
+	return fmt.Sprintf("Billy %s", b.fs)
+}
+
+// New returns a billy.Filesystem which accesses the files in the given
+// VFS. Chroot is supported for any VFS, and doesn't require the new root
+// to exist, while symbolic links and Chmod are fully supported only by
+// VFS implementations which keep their files in memory. Renaming is
+// implemented by copying and then removing the original files.
+func New(fs vfs.VFS) billy.Filesystem {
+	b := &billyFs{
+		fs:    fs,
+		locks: make(map[string]*sync.Mutex),
+	}
+	return chroot.New(b, "/")
+}
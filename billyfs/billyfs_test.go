@@ -0,0 +1,306 @@
+package billyfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/rainycape/vfs"
+)
+
+func TestBasic(t *testing.T) {
+	mem := vfs.Memory()
+	fs := New(mem)
+	// Parent directories are created on demand
+	if err := util.WriteFile(fs, "/a/b/file.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := vfs.ReadFile(mem, "/a/b/file.txt")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected contents in VFS %q, %v", string(data), err)
+	}
+	if _, err := fs.Stat("missing"); !os.IsNotExist(err) {
+		t.Errorf("expecting not exist error, got %v", err)
+	}
+	if err := fs.Rename("a/b/file.txt", "c/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	data, err = util.ReadFile(fs, "c/file.txt")
+	if err != nil || string(data) != "hello" {
+		t.Errorf("unexpected contents after rename %q, %v", string(data), err)
+	}
+	if _, err := mem.Stat("/a/b/file.txt"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting file to be removed after rename, got %v", err)
+	}
+	infos, err := fs.ReadDir("/")
+	if err != nil || len(infos) != 2 || infos[0].Name() != "a" || infos[1].Name() != "c" {
+		t.Errorf("unexpected entries %v, %v", infos, err)
+	}
+	if err := fs.(billy.Chmod).Chmod("c/file.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := mem.Stat("/c/file.txt"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected info after Chmod %v, %v", info, err)
+	}
+	if c := billy.Capabilities(fs); c != billy.DefaultCapabilities {
+		t.Errorf("unexpected capabilities %v", c)
+	}
+}
+
+func TestFile(t *testing.T) {
+	fs := New(vfs.Memory())
+	f, err := fs.Create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := f.ReadAt(buf, 6); err != nil || string(buf) != "world" {
+		t.Errorf("unexpected ReadAt result %q, %v", string(buf), err)
+	}
+	if err := f.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = fs.Open("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Name() != "file" {
+		t.Errorf("unexpected name %q", f.Name())
+	}
+	data, err := io.ReadAll(f)
+	if err != nil || string(data) != "hello!" {
+		t.Errorf("unexpected contents after truncating %q, %v", string(data), err)
+	}
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Error("allowed writing to read only file")
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	mem := vfs.Memory()
+	fs := New(mem)
+	if err := util.WriteFile(fs, "dir/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Symlink("dir/file", "rel"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Symlink("/dir/file", "links/abs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Symlink("dir", "dirlink"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Symlink("dir", "rel"); !os.IsExist(err) {
+		t.Errorf("expecting exist error, got %v", err)
+	}
+	for _, v := range []string{"rel", "links/abs", "dirlink/file"} {
+		data, err := util.ReadFile(fs, v)
+		if err != nil || string(data) != "data" {
+			t.Errorf("unexpected contents in %s %q, %v", v, string(data), err)
+		}
+	}
+	info, err := fs.Lstat("links/abs")
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expecting links/abs to be a symlink, got %v, %v", info, err)
+	}
+	if target, err := fs.Readlink("links/abs"); err != nil || target != "../dir/file" {
+		t.Errorf("unexpected target %q, %v", target, err)
+	}
+	if _, err := fs.Readlink("dir/file"); err == nil {
+		t.Error("expecting an error when reading a regular file as a link")
+	}
+	// Symlinks are followed by the underlying VFS too
+	data, err := vfs.ReadFile(mem, "/rel")
+	if err != nil || string(data) != "data" {
+		t.Errorf("unexpected contents in VFS %q, %v", string(data), err)
+	}
+	if err := fs.Rename("rel", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := fs.Readlink("renamed"); err != nil || target != "dir/file" {
+		t.Errorf("unexpected target after rename %q, %v", target, err)
+	}
+}
+
+func TestSymlinkNotSupported(t *testing.T) {
+	tmp, err := vfs.TmpFS("billyfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmp.Close()
+	fs := New(tmp)
+	if err := fs.Symlink("target", "link"); !errors.Is(err, billy.ErrNotSupported) {
+		t.Errorf("expecting billy.ErrNotSupported, got %v", err)
+	}
+	if _, err := tmp.Lstat("link"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting link to not be created, got %v", err)
+	}
+	if err := util.WriteFile(fs, "file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.(billy.Chmod).Chmod("file", 0600); !errors.Is(err, billy.ErrNotSupported) {
+		t.Errorf("expecting billy.ErrNotSupported from Chmod, got %v", err)
+	}
+}
+
+func TestTruncateError(t *testing.T) {
+	errFault := errors.New("fault")
+	// The third OpenFile is the one opening the file again
+	fs := New(vfs.Faulty(vfs.Memory(), []vfs.FaultRule{{Op: vfs.OpOpenFile, Nth: 3, Err: errFault}}, 1))
+	f, err := fs.Create("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(2); !errors.Is(err, errFault) {
+		t.Errorf("expecting the fault from Truncate, got %v", err)
+	}
+	if _, err := f.Write([]byte("!")); err != os.ErrClosed {
+		t.Errorf("expecting os.ErrClosed after failing to open the file again, got %v", err)
+	}
+	f.Close()
+	// Closing must have released the lock
+	f, err = fs.Open("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Lock()
+	f.Close()
+}
+
+func TestChroot(t *testing.T) {
+	mem := vfs.Memory()
+	fs := New(mem)
+	// The new root doesn't need to exist
+	sub, err := fs.Chroot("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root := sub.Root(); root != "/a/b" {
+		t.Errorf("unexpected root %q", root)
+	}
+	if err := util.WriteFile(sub, "file", []byte("sub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := vfs.ReadFile(mem, "/a/b/file")
+	if err != nil || string(data) != "sub" {
+		t.Errorf("unexpected contents in VFS %q, %v", string(data), err)
+	}
+	if _, err := sub.Open("../../file"); err != billy.ErrCrossedBoundary {
+		t.Errorf("expecting ErrCrossedBoundary, got %v", err)
+	}
+	if err := sub.Symlink("/file", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := sub.Readlink("link"); err != nil || target != "file" {
+		t.Errorf("unexpected target %q, %v", target, err)
+	}
+	// Chroot also works on top of other VFS implementations
+	root := vfs.Memory()
+	if err := root.Mkdir("/mnt", 0755); err != nil {
+		t.Fatal(err)
+	}
+	m := &vfs.Mounter{}
+	if err := m.Mount(root, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(mem, "/mnt"); err != nil {
+		t.Fatal(err)
+	}
+	sub, err = New(m).Chroot("mnt/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = util.ReadFile(sub, "b/file")
+	if err != nil || string(data) != "sub" {
+		t.Errorf("unexpected contents through Mounter %q, %v", string(data), err)
+	}
+}
+
+func TestTempFile(t *testing.T) {
+	fs := New(vfs.Memory())
+	seen := make(map[string]bool)
+	for ii := 0; ii < 10; ii++ {
+		f, err := fs.TempFile("tmp/dir", "pack-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := f.Name()
+		if !strings.HasPrefix(name, "tmp/dir/pack-") || seen[name] {
+			t.Errorf("unexpected temporary file name %q", name)
+		}
+		seen[name] = true
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	infos, err := fs.ReadDir("tmp/dir")
+	if err != nil || len(infos) != 10 {
+		t.Errorf("expecting 10 temporary files, got %d, %v", len(infos), err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	fs := New(vfs.Memory())
+	f1, err := fs.Create("index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := fs.Open("/index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f1.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	done := make(chan struct{})
+	go func() {
+		f2.Lock()
+		events = append(events, "locked")
+		f2.Unlock()
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	events = append(events, "unlocked")
+	if err := f1.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if exp := []string{"unlocked", "locked"}; !reflect.DeepEqual(events, exp) {
+		t.Errorf("expecting events %v, got %v", exp, events)
+	}
+	if err := f1.Unlock(); err == nil {
+		t.Error("expecting an error when unlocking an unlocked file")
+	}
+	// Closing releases the lock
+	if err := f1.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f2.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	f2.Close()
+}
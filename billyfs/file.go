@@ -0,0 +1,140 @@
+package billyfs
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/rainycape/vfs"
+)
+
+var errNotLocked = errors.New("file is not locked")
+
+// file implements billy.File on top of a VFS file.
+type file struct {
+	mu   sync.Mutex
+	b    *billyFs
+	name string
+	flag int
+	rf   vfs.RFile
+	// wf is non-nil only for files opened for writing
+	wf vfs.WFile
+	// lock is non-nil while the file is locked
+	lock *sync.Mutex
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rf == nil {
+		return 0, os.ErrClosed
+	}
+	return f.rf.Read(p)
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rf == nil {
+		return 0, os.ErrClosed
+	}
+	return vfs.ReadAt(f.rf, p, off)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rf == nil {
+		return 0, os.ErrClosed
+	}
+	return f.rf.Seek(offset, whence)
+}
+
+// writable returns the error for writing to f, if any. It must
+// be called with f.mu held.
+func (f *file) writable() error {
+	if f.rf == nil {
+		return os.ErrClosed
+	}
+	if f.wf == nil {
+		return vfs.ErrReadOnly
+	}
+	return nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.writable(); err != nil {
+		return 0, err
+	}
+	return f.wf.Write(p)
+}
+
+// Lock blocks until no other file with the same path in the same
+// billy.Filesystem is locked. Locks are not visible to other users
+// of the underlying VFS.
+func (f *file) Lock() error {
+	f.mu.Lock()
+	locked := f.lock != nil
+	f.mu.Unlock()
+	if locked {
+		return nil
+	}
+	m := f.b.lock(f.name)
+	m.Lock()
+	f.mu.Lock()
+	f.lock = m
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *file) Unlock() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.unlock()
+}
+
+// unlock must be called with f.mu held.
+func (f *file) unlock() error {
+	if f.lock == nil {
+		return &os.PathError{Op: "unlock", Path: f.name, Err: errNotLocked}
+	}
+	f.lock.Unlock()
+	f.lock = nil
+	return nil
+}
+
+// Close also releases the lock, if the file is locked.
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lock != nil {
+		f.unlock()
+	}
+	if f.rf == nil {
+		return os.ErrClosed
+	}
+	return f.rf.Close()
+}
+
+// Truncate uses vfs.TruncateFile, which opens the file again. If that
+// fails, the file can't be used anymore and its methods return
+// os.ErrClosed, but it still needs to be closed to release its lock.
+func (f *file) Truncate(size int64) error {
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.writable(); err != nil {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: err}
+	}
+	wf, err := vfs.TruncateFile(f.b.fs, f.name, f.wf, f.flag, size)
+	f.rf, f.wf = wf, wf
+	return vfs.WrapPathError("truncate", f.name, err)
+}
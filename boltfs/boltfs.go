@@ -0,0 +1,530 @@
+// Package boltfs implements a VFS stored in a bbolt database, which
+// allows keeping many small files in a single durable file on disk.
+//
+// Directory entries are stored in a bucket, keyed by the path of their
+// parent directory and their name, while file contents are split into
+// fixed size chunks stored in another bucket. Operations on the VFS are
+// atomic and several of them can be grouped in a single transaction
+// with BoltVFS.Update.
+package boltfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	pathpkg "path"
+	"time"
+
+	"github.com/rainycape/vfs"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultBucket    = "vfs"
+	defaultChunkSize = 64 * 1024
+	entrySize        = 28
+)
+
+var (
+	entriesBucket = []byte("entries")
+	chunksBucket  = []byte("chunks")
+	metaBucket    = []byte("meta")
+	chunkSizeKey  = []byte("chunk-size")
+
+	errFileClosed = errors.New("file is closed")
+)
+
+// Options specifies the options for a BoltVFS.
+type Options struct {
+	// Bucket is the name of the top level bucket where the VFS
+	// is stored, which allows storing multiple filesystems or other
+	// data in the same database. If empty, "vfs" is used.
+	Bucket string
+	// ChunkSize is the size of the chunks used to store the file
+	// contents. It's only used when the VFS is created, existing ones
+	// keep the chunk size they were created with. If zero, 64KiB is
+	// used.
+	ChunkSize int
+	// Bolt contains the options passed to bolt.Open. It's ignored
+	// by New.
+	Bolt *bolt.Options
+}
+
+func (o *Options) withDefaults() Options {
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	if opts.Bucket == "" {
+		opts.Bucket = defaultBucket
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultChunkSize
+	}
+	return opts
+}
+
+// BoltVFS is the interface implemented by the VFS returned from
+// Open and New.
+type BoltVFS interface {
+	vfs.VFS
+	// Update runs fn in a read-write transaction. All the changes made
+	// with the VFS passed to fn are committed atomically if fn returns
+	// nil, or discarded otherwise. Files opened with the VFS passed to
+	// fn must not be used after fn returns, any of them still open is
+	// closed before committing. The VFS passed to fn must not be used
+	// concurrently.
+	Update(fn func(fs vfs.VFS) error) error
+	// View runs fn in a read-only transaction, which sees a consistent
+	// snapshot of the VFS. Any attempt to modify it returns
+	// vfs.ErrReadOnlyFileSystem. The same restrictions as in Update
+	// apply.
+	View(fn func(fs vfs.VFS) error) error
+	// DB returns the underlying database.
+	DB() *bolt.DB
+	// Close closes the underlying database.
+	Close() error
+}
+
+// entry is the value stored for each file and directory.
+type entry struct {
+	mode    os.FileMode
+	modTime time.Time
+	size    int64
+	// id identifies the file contents in the chunks bucket
+	id uint64
+}
+
+func (e *entry) marshal() []byte {
+	buf := make([]byte, entrySize)
+	binary.BigEndian.PutUint32(buf, uint32(e.mode))
+	binary.BigEndian.PutUint64(buf[4:], uint64(e.modTime.UnixNano()))
+	binary.BigEndian.PutUint64(buf[12:], uint64(e.size))
+	binary.BigEndian.PutUint64(buf[20:], e.id)
+	return buf
+}
+
+func unmarshalEntry(data []byte) (*entry, error) {
+	if len(data) != entrySize {
+		return nil, errors.New("boltfs: corrupted entry")
+	}
+	return &entry{
+		mode:    os.FileMode(binary.BigEndian.Uint32(data)),
+		modTime: time.Unix(0, int64(binary.BigEndian.Uint64(data[4:]))),
+		size:    int64(binary.BigEndian.Uint64(data[12:])),
+		id:      binary.BigEndian.Uint64(data[20:]),
+	}, nil
+}
+
+// entryInfo implements os.FileInfo.
+type entryInfo struct {
+	name  string
+	entry *entry
+}
+
+func (i *entryInfo) Name() string       { return i.name }
+func (i *entryInfo) Size() int64        { return i.entry.size }
+func (i *entryInfo) Mode() os.FileMode  { return i.entry.mode }
+func (i *entryInfo) ModTime() time.Time { return i.entry.modTime }
+func (i *entryInfo) IsDir() bool        { return i.entry.mode.IsDir() }
+func (i *entryInfo) Sys() interface{}   { return nil }
+
+func cleanPath(p string) string {
+	return pathpkg.Clean("/" + p)
+}
+
+// childrenPrefix returns the key prefix for the entries in dir.
+func childrenPrefix(dir string) []byte {
+	return append([]byte(dir), 0)
+}
+
+// entryKey returns the key for the entry at p, which must be clean
+// and not the root directory.
+func entryKey(p string) []byte {
+	dir, name := pathpkg.Split(p)
+	return append(childrenPrefix(cleanPath(dir)), name...)
+}
+
+func chunkKey(id uint64, index int64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, id)
+	binary.BigEndian.PutUint64(key[8:], uint64(index))
+	return key
+}
+
+// txn implements the operations on the VFS on top of a transaction.
+type txn struct {
+	entries   *bolt.Bucket
+	chunks    *bolt.Bucket
+	chunkSize int
+}
+
+func (t *txn) lookup(p string) (*entry, error) {
+	if p == "/" {
+		return &entry{mode: os.ModeDir | 0755}, nil
+	}
+	data := t.entries.Get(entryKey(p))
+	if data == nil {
+		return nil, os.ErrNotExist
+	}
+	return unmarshalEntry(data)
+}
+
+func (t *txn) put(p string, e *entry) error {
+	return t.entries.Put(entryKey(p), e.marshal())
+}
+
+// checkParent returns an error if the parent of p is not
+// an existing directory.
+func (t *txn) checkParent(p string) error {
+	dir := pathpkg.Dir(p)
+	e, err := t.lookup(dir)
+	if err != nil {
+		return err
+	}
+	if !e.mode.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+func (t *txn) chunk(id uint64, index int64) []byte {
+	return t.chunks.Get(chunkKey(id, index))
+}
+
+// deleteChunks removes all the chunks for the given file id starting
+// at the given index.
+func (t *txn) deleteChunks(id uint64, from int64) error {
+	c := t.chunks.Cursor()
+	prefix := chunkKey(id, 0)[:8]
+	for k, _ := c.Seek(chunkKey(id, from)); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(chunkKey(id, from)) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *txn) readDir(p string) ([]os.FileInfo, error) {
+	e, err := t.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if !e.mode.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", p)
+	}
+	var infos []os.FileInfo
+	prefix := childrenPrefix(p)
+	c := t.entries.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		child, err := unmarshalEntry(v)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, &entryInfo{name: string(k[len(prefix):]), entry: child})
+	}
+	// Keys are sorted by name, so infos are already sorted
+	return infos, nil
+}
+
+func (t *txn) mkdir(p string, perm os.FileMode) error {
+	if _, err := t.lookup(p); err == nil {
+		return os.ErrExist
+	}
+	if err := t.checkParent(p); err != nil {
+		return err
+	}
+	return t.put(p, &entry{mode: os.ModeDir | perm.Perm(), modTime: time.Now()})
+}
+
+func (t *txn) remove(p string) error {
+	if p == "/" {
+		return fmt.Errorf("can't remove %s", p)
+	}
+	e, err := t.lookup(p)
+	if err != nil {
+		return err
+	}
+	if e.mode.IsDir() {
+		prefix := childrenPrefix(p)
+		if k, _ := t.entries.Cursor().Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+			return fmt.Errorf("directory %s not empty", p)
+		}
+	} else if err := t.deleteChunks(e.id, 0); err != nil {
+		return err
+	}
+	return t.entries.Delete(entryKey(p))
+}
+
+// open returns the entry for the file at p, creating or truncating
+// it as indicated by flag.
+func (t *txn) open(p string, flag int, perm os.FileMode) (*entry, error) {
+	e, err := t.lookup(p)
+	if err != nil {
+		if !vfs.IsNotExist(err) || flag&os.O_CREATE == 0 {
+			return nil, err
+		}
+		if err := t.checkParent(p); err != nil {
+			return nil, err
+		}
+		id, err := t.chunks.NextSequence()
+		if err != nil {
+			return nil, err
+		}
+		e = &entry{mode: perm.Perm(), modTime: time.Now(), id: id}
+		return e, t.put(p, e)
+	}
+	if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, os.ErrExist
+	}
+	if e.mode.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", p)
+	}
+	if flag&os.O_TRUNC != 0 && e.size > 0 {
+		if err := t.deleteChunks(e.id, 0); err != nil {
+			return nil, err
+		}
+		e.size = 0
+		e.modTime = time.Now()
+		return e, t.put(p, e)
+	}
+	return e, nil
+}
+
+// runner runs functions inside transactions, either creating a new
+// one for each call or using an existing one.
+type runner interface {
+	view(fn func(tx *bolt.Tx) error) error
+	update(fn func(tx *bolt.Tx) error) error
+}
+
+type dbRunner struct {
+	db *bolt.DB
+}
+
+func (r *dbRunner) view(fn func(tx *bolt.Tx) error) error {
+	return r.db.View(fn)
+}
+
+func (r *dbRunner) update(fn func(tx *bolt.Tx) error) error {
+	return r.db.Update(fn)
+}
+
+type txRunner struct {
+	tx    *bolt.Tx
+	files []*file
+}
+
+func (r *txRunner) view(fn func(tx *bolt.Tx) error) error {
+	return fn(r.tx)
+}
+
+func (r *txRunner) update(fn func(tx *bolt.Tx) error) error {
+	if !r.tx.Writable() {
+		return vfs.ErrReadOnlyFileSystem
+	}
+	return fn(r.tx)
+}
+
+type fileSystem struct {
+	run       runner
+	db        *bolt.DB
+	bucket    []byte
+	chunkSize int
+}
+
+func (fs *fileSystem) txn(tx *bolt.Tx) *txn {
+	b := tx.Bucket(fs.bucket)
+	return &txn{
+		entries:   b.Bucket(entriesBucket),
+		chunks:    b.Bucket(chunksBucket),
+		chunkSize: fs.chunkSize,
+	}
+}
+
+func (fs *fileSystem) view(fn func(t *txn) error) error {
+	return fs.run.view(func(tx *bolt.Tx) error {
+		return fn(fs.txn(tx))
+	})
+}
+
+func (fs *fileSystem) update(fn func(t *txn) error) error {
+	return fs.run.update(func(tx *bolt.Tx) error {
+		return fn(fs.txn(tx))
+	})
+}
+
+func (fs *fileSystem) Open(path string) (vfs.RFile, error) {
+	return fs.OpenFile(path, os.O_RDONLY, 0)
+}
+
+func (fs *fileSystem) OpenFile(path string, flag int, perm os.FileMode) (vfs.WFile, error) {
+	path = cleanPath(path)
+	var e *entry
+	var err error
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		err = fs.update(func(t *txn) error {
+			e, err = t.open(path, flag, perm)
+			return err
+		})
+	} else {
+		err = fs.view(func(t *txn) error {
+			e, err = t.open(path, flag&^(os.O_CREATE|os.O_TRUNC), perm)
+			return err
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := &file{
+		fs:       fs,
+		path:     path,
+		id:       e.id,
+		size:     e.size,
+		readable: flag&os.O_WRONLY == 0,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+		append:   flag&os.O_APPEND != 0,
+		dirty:    make(map[int64][]byte),
+	}
+	if r, ok := fs.run.(*txRunner); ok {
+		r.files = append(r.files, f)
+	}
+	return f, nil
+}
+
+func (fs *fileSystem) Lstat(path string) (os.FileInfo, error) {
+	return fs.Stat(path)
+}
+
+func (fs *fileSystem) Stat(path string) (os.FileInfo, error) {
+	path = cleanPath(path)
+	var info os.FileInfo
+	err := fs.view(func(t *txn) error {
+		e, err := t.lookup(path)
+		if err != nil {
+			return err
+		}
+		info = &entryInfo{name: pathpkg.Base(path), entry: e}
+		return nil
+	})
+	return info, err
+}
+
+func (fs *fileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	err := fs.view(func(t *txn) error {
+		var err error
+		infos, err = t.readDir(cleanPath(path))
+		return err
+	})
+	return infos, err
+}
+
+func (fs *fileSystem) Mkdir(path string, perm os.FileMode) error {
+	return fs.update(func(t *txn) error {
+		return t.mkdir(cleanPath(path), perm)
+	})
+}
+
+func (fs *fileSystem) Remove(path string) error {
+	return fs.update(func(t *txn) error {
+		return t.remove(cleanPath(path))
+	})
+}
+
+func (fs *fileSystem) String() string {
+	return fmt.Sprintf("Bolt %s", fs.db.Path())
+}
+
+func (fs *fileSystem) transaction(tx *bolt.Tx, fn func(fs vfs.VFS) error) error {
+	r := &txRunner{tx: tx}
+	err := fn(&fileSystem{
+		run:       r,
+		db:        fs.db,
+		bucket:    fs.bucket,
+		chunkSize: fs.chunkSize,
+	})
+	for _, v := range r.files {
+		if cerr := v.Close(); err == nil && cerr != errFileClosed {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (fs *fileSystem) Update(fn func(fs vfs.VFS) error) error {
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		return fs.transaction(tx, fn)
+	})
+}
+
+func (fs *fileSystem) View(fn func(fs vfs.VFS) error) error {
+	return fs.db.View(func(tx *bolt.Tx) error {
+		return fs.transaction(tx, fn)
+	})
+}
+
+func (fs *fileSystem) DB() *bolt.DB {
+	return fs.db
+}
+
+func (fs *fileSystem) Close() error {
+	return fs.db.Close()
+}
+
+// New returns a BoltVFS stored in the given database, creating it
+// if it doesn't exist yet. If opts is nil, the default options are
+// used.
+func New(db *bolt.DB, opts *Options) (BoltVFS, error) {
+	o := opts.withDefaults()
+	fs := &fileSystem{
+		run:    &dbRunner{db: db},
+		db:     db,
+		bucket: []byte(o.Bucket),
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(fs.bucket)
+		if err != nil {
+			return err
+		}
+		for _, v := range [][]byte{entriesBucket, chunksBucket, metaBucket} {
+			if _, err := b.CreateBucketIfNotExists(v); err != nil {
+				return err
+			}
+		}
+		meta := b.Bucket(metaBucket)
+		if data := meta.Get(chunkSizeKey); data != nil {
+			fs.chunkSize = int(binary.BigEndian.Uint32(data))
+			return nil
+		}
+		fs.chunkSize = o.ChunkSize
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(fs.chunkSize))
+		return meta.Put(chunkSizeKey, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Open opens or creates the database at the given path and returns
+// a BoltVFS stored in it. See New for the details.
+func Open(path string, opts *Options) (BoltVFS, error) {
+	var boltOpts *bolt.Options
+	if opts != nil {
+		boltOpts = opts.Bolt
+	}
+	db, err := bolt.Open(path, 0600, boltOpts)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := New(db, opts)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return fs, nil
+}
@@ -0,0 +1,198 @@
+package boltfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rainycape/vfs"
+	"github.com/rainycape/vfs/vfstest"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestFS(t *testing.T, opts *Options) (BoltVFS, string) {
+	filename := filepath.Join(t.TempDir(), "vfs.db")
+	fs, err := Open(filename, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return fs, filename
+}
+
+func TestBoltFS(t *testing.T) {
+	fs, _ := newTestFS(t, nil)
+	vfstest.TestVFS(t, fs)
+}
+
+func TestMemoryBehavior(t *testing.T) {
+	// Cloning the same tree into both filesystems must produce
+	// the same result
+	mem := vfs.Memory()
+	fs, _ := newTestFS(t, nil)
+	src, err := vfs.Open(filepath.Join("..", "testdata", "fs.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.Clone(mem, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.Clone(fs, src); err != nil {
+		t.Fatal(err)
+	}
+	if m, b := dump(t, mem), dump(t, fs); !reflect.DeepEqual(m, b) {
+		t.Errorf("memory and bolt filesystems differ:\n%v\n%v", m, b)
+	}
+}
+
+// dump returns a map with the paths in the fs as keys and their
+// contents as values. Directories have a trailing slash.
+func dump(t *testing.T, fs vfs.VFS) map[string]string {
+	m := make(map[string]string)
+	err := vfs.Walk(fs, "/", func(fs vfs.VFS, path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			m[path+"/"] = ""
+			return nil
+		}
+		data, err := vfs.ReadFile(fs, path)
+		m[path] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestChunks(t *testing.T) {
+	fs, filename := newTestFS(t, &Options{ChunkSize: 10})
+	data := make([]byte, 1234)
+	for ii := range data {
+		data[ii] = byte(ii * 7)
+	}
+	if err := vfs.WriteFile(fs, "/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(95, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(bytes.Repeat([]byte("x"), 20)); err != nil {
+		t.Fatal(err)
+	}
+	copy(data[95:], bytes.Repeat([]byte("x"), 20))
+	if _, err := f.Seek(-5, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if n, err := f.Read(buf); n != 5 || err != nil || !bytes.Equal(buf[:n], data[len(data)-5:]) {
+		t.Errorf("unexpected read at the end %v, %d, %v", buf[:n], n, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+	// Reopen with a different chunk size, which must be ignored
+	fs, err = Open(filename, &Options{ChunkSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	read, err := vfs.ReadFile(fs, "/file")
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("unexpected contents after reopening, %v", err)
+	}
+	if err := vfs.WriteFile(fs, "/file", []byte("short"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var chunks int
+	fs.DB().View(func(tx *bolt.Tx) error {
+		chunks = tx.Bucket([]byte(defaultBucket)).Bucket(chunksBucket).Stats().KeyN
+		return nil
+	})
+	if chunks != 1 {
+		t.Errorf("expecting 1 chunk after truncating, got %d", chunks)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	fs, _ := newTestFS(t, nil)
+	errAbort := errors.New("abort")
+	err := fs.Update(func(tx vfs.VFS) error {
+		if err := tx.Mkdir("/dir", 0755); err != nil {
+			return err
+		}
+		if err := vfs.WriteFile(tx, "/dir/file", []byte("data"), 0644); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("expecting errAbort, got %v", err)
+	}
+	if _, err := fs.Stat("/dir"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting /dir to not exist after rollback, got %v", err)
+	}
+	err = fs.Update(func(tx vfs.VFS) error {
+		if err := tx.Mkdir("/dir", 0755); err != nil {
+			return err
+		}
+		f, err := tx.OpenFile("/dir/file", os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		// Left open, must be closed by Update
+		_, err = f.Write([]byte("committed"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := vfs.ReadFile(fs, "/dir/file")
+	if err != nil || string(data) != "committed" {
+		t.Errorf("unexpected contents after commit %q, %v", string(data), err)
+	}
+	err = fs.View(func(tx vfs.VFS) error {
+		data, err := vfs.ReadFile(tx, "/dir/file")
+		if err != nil || string(data) != "committed" {
+			t.Errorf("unexpected contents in View %q, %v", string(data), err)
+		}
+		return tx.Mkdir("/other", 0755)
+	})
+	if err != vfs.ErrReadOnlyFileSystem {
+		t.Errorf("expecting ErrReadOnlyFileSystem, got %v", err)
+	}
+}
+
+func TestMultipleFileSystems(t *testing.T) {
+	fs1, filename := newTestFS(t, nil)
+	fs2, err := New(fs1.DB(), &Options{Bucket: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(fs1, "/file", []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs2.Stat("/file"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting file to not exist in %s other bucket, got %v", filename, err)
+	}
+	f, err := fs1.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if data, err := ioutil.ReadAll(f); err != nil || string(data) != "1" {
+		t.Errorf("unexpected contents %q, %v", string(data), err)
+	}
+}
@@ -0,0 +1,190 @@
+package boltfs
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rainycape/vfs"
+)
+
+// maxDirtyChunks is the maximum number of modified chunks kept in
+// memory by a file before writing them to the database.
+const maxDirtyChunks = 256
+
+// file implements vfs.WFile. Reads go directly to the database, while
+// writes are kept in memory until the file is closed, so they're
+// committed atomically unless the file grows beyond maxDirtyChunks.
+type file struct {
+	mu       sync.Mutex
+	fs       *fileSystem
+	path     string
+	id       uint64
+	size     int64
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	dirty    map[int64][]byte
+	modified bool
+	closed   bool
+}
+
+// chunk returns the data for the chunk at the given index, which
+// might be shorter than the chunk size. The returned slice can be
+// modified by the caller.
+func (f *file) chunk(index int64) ([]byte, error) {
+	if data, ok := f.dirty[index]; ok {
+		return data, nil
+	}
+	var data []byte
+	err := f.fs.view(func(t *txn) error {
+		data = append(data, t.chunk(f.id, index)...)
+		return nil
+	})
+	return data, err
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if !f.readable {
+		return 0, vfs.ErrWriteOnly
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, errFileClosed
+	}
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	chunkSize := int64(f.fs.chunkSize)
+	n := 0
+	for n < len(p) && f.offset < f.size {
+		index := f.offset / chunkSize
+		data, err := f.chunk(index)
+		if err != nil {
+			return n, err
+		}
+		start := f.offset - index*chunkSize
+		end := chunkSize
+		if rem := f.size - index*chunkSize; rem < end {
+			end = rem
+		}
+		if int64(len(data)) < end {
+			// Missing data is read as zeroes
+			data = append(data, make([]byte, end-int64(len(data)))...)
+		}
+		c := copy(p[n:], data[start:end])
+		n += c
+		f.offset += int64(c)
+	}
+	return n, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if !f.writable {
+		return 0, vfs.ErrReadOnly
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, errFileClosed
+	}
+	if f.append {
+		f.offset = f.size
+	}
+	chunkSize := int64(f.fs.chunkSize)
+	n := 0
+	for n < len(p) {
+		index := f.offset / chunkSize
+		data, err := f.chunk(index)
+		if err != nil {
+			return n, err
+		}
+		start := f.offset - index*chunkSize
+		end := start + int64(len(p)-n)
+		if end > chunkSize {
+			end = chunkSize
+		}
+		if int64(len(data)) < end {
+			data = append(data, make([]byte, end-int64(len(data)))...)
+		}
+		c := copy(data[start:end], p[n:])
+		f.dirty[index] = data
+		n += c
+		f.offset += int64(c)
+	}
+	if f.offset > f.size {
+		f.size = f.offset
+	}
+	f.modified = true
+	if len(f.dirty) > maxDirtyChunks {
+		if err := f.flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, errFileClosed
+	}
+	switch whence {
+	case io.SeekStart:
+		f.offset = offset
+	case io.SeekCurrent:
+		f.offset += offset
+	case io.SeekEnd:
+		f.offset = f.size + offset
+	default:
+		return f.offset, os.ErrInvalid
+	}
+	if f.offset > f.size {
+		f.offset = f.size
+	} else if f.offset < 0 {
+		f.offset = 0
+	}
+	return f.offset, nil
+}
+
+// flush writes the modified chunks to the database. If the file has
+// been removed or replaced, the changes are discarded.
+func (f *file) flush() error {
+	if !f.modified {
+		return nil
+	}
+	err := f.fs.update(func(t *txn) error {
+		e, err := t.lookup(f.path)
+		if err != nil || e.id != f.id {
+			return nil
+		}
+		for index, data := range f.dirty {
+			if err := t.chunks.Put(chunkKey(f.id, index), data); err != nil {
+				return err
+			}
+		}
+		e.size = f.size
+		e.modTime = time.Now()
+		return t.put(f.path, e)
+	})
+	if err != nil {
+		return err
+	}
+	f.dirty = make(map[int64][]byte)
+	f.modified = false
+	return nil
+}
+
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errFileClosed
+	}
+	f.closed = true
+	return f.flush()
+}
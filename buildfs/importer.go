@@ -0,0 +1,184 @@
+package buildfs
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path"
+)
+
+// Package is a package loaded by an Importer.
+type Package struct {
+	// Build contains the information returned by go/build.
+	Build *build.Package
+	// Files contains the parsed Go files, including the ones
+	// using cgo.
+	Files []*ast.File
+	// Types is the type checked package.
+	Types *types.Package
+	// Info contains the information recorded by the type checker.
+	Info *types.Info
+}
+
+// ImporterOptions specifies the options for NewImporter. A nil
+// *ImporterOptions is valid and represents the default options.
+type ImporterOptions struct {
+	// ParserMode is passed to go/parser when parsing the files.
+	ParserMode parser.Mode
+	// Sizes is used by the type checker. If nil, the sizes for
+	// the compiler and architecture in the build.Context are used.
+	Sizes types.Sizes
+	// IgnoreFuncBodies skips type checking function bodies, which
+	// is faster but records less information in Package.Info.
+	IgnoreFuncBodies bool
+	// Modules, if non-nil, is used for resolving the imports outside
+	// of the standard library in module mode. The build.Context must
+	// be the one returned by Modules.Context.
+	Modules *Modules
+}
+
+func (o *ImporterOptions) withDefaults(ctx *build.Context) ImporterOptions {
+	var opts ImporterOptions
+	if o != nil {
+		opts = *o
+	}
+	if opts.Sizes == nil {
+		opts.Sizes = types.SizesFor(ctx.Compiler, ctx.GOARCH)
+	}
+	return opts
+}
+
+// Importer implements types.ImporterFrom by loading packages from
+// source using a build.Context, which will usually be configured
+// with Setup to read from a VFS. GOROOT and GOPATH trees can be
+// assembled with a vfs.Mounter, e.g. mounting an archive with the
+// Go sources at ctx.GOROOT.
+//
+// Loaded packages are cached, so importing a package again or
+// from another package returns the same *types.Package. An
+// Importer is not safe for concurrent use.
+type Importer struct {
+	ctx  *build.Context
+	fset *token.FileSet
+	opts ImporterOptions
+	// packages contains the loaded packages, keyed by
+	// their directory.
+	packages map[string]*Package
+	// loading contains the directories of the packages
+	// being loaded, to detect import cycles.
+	loading map[string]bool
+}
+
+// NewImporter returns a new Importer which resolves imports using the
+// given build.Context and records the positions in fset.
+func NewImporter(ctx *build.Context, fset *token.FileSet, opts *ImporterOptions) *Importer {
+	return &Importer{
+		ctx:      ctx,
+		fset:     fset,
+		opts:     opts.withDefaults(ctx),
+		packages: make(map[string]*Package),
+		loading:  make(map[string]bool),
+	}
+}
+
+// Import implements types.Importer. Since it has no source directory,
+// relative and vendored imports are not resolved.
+func (imp *Importer) Import(path string) (*types.Package, error) {
+	return imp.ImportFrom(path, "", 0)
+}
+
+// ImportFrom implements types.ImporterFrom.
+func (imp *Importer) ImportFrom(path string, dir string, mode types.ImportMode) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+	pkg, err := imp.Load(path, dir)
+	if err != nil {
+		return nil, err
+	}
+	return pkg.Types, nil
+}
+
+// Load loads, parses and type checks the package with the given import
+// path, as seen from the source directory srcDir, which might be empty.
+func (imp *Importer) Load(importPath string, srcDir string) (*Package, error) {
+	bp, err := imp.importPackage(importPath, srcDir)
+	if err != nil {
+		return nil, err
+	}
+	if pkg := imp.packages[bp.Dir]; pkg != nil {
+		return pkg, nil
+	}
+	if imp.loading[bp.Dir] {
+		return nil, fmt.Errorf("import cycle through package %s", bp.ImportPath)
+	}
+	imp.loading[bp.Dir] = true
+	defer delete(imp.loading, bp.Dir)
+	var files []*ast.File
+	for _, list := range [][]string{bp.GoFiles, bp.CgoFiles} {
+		for _, v := range list {
+			f, err := imp.parseFile(path.Join(bp.Dir, v))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f)
+		}
+	}
+	info := &types.Info{
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Implicits:  make(map[ast.Node]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+		Scopes:     make(map[ast.Node]*types.Scope),
+	}
+	conf := &types.Config{
+		Importer:         imp,
+		Sizes:            imp.opts.Sizes,
+		FakeImportC:      true,
+		IgnoreFuncBodies: imp.opts.IgnoreFuncBodies,
+	}
+	tpkg, err := conf.Check(bp.ImportPath, imp.fset, files, info)
+	if err != nil {
+		return nil, err
+	}
+	pkg := &Package{
+		Build: bp,
+		Files: files,
+		Types: tpkg,
+		Info:  info,
+	}
+	imp.packages[bp.Dir] = pkg
+	return pkg, nil
+}
+
+func (imp *Importer) importPackage(importPath string, srcDir string) (*build.Package, error) {
+	if imp.opts.Modules == nil || isStandardImportPath(importPath) {
+		return imp.ctx.Import(importPath, srcDir, 0)
+	}
+	dir, err := imp.opts.Modules.Resolve(importPath)
+	if err != nil {
+		return nil, err
+	}
+	bp, err := imp.ctx.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	bp.ImportPath = importPath
+	return bp, nil
+}
+
+func (imp *Importer) parseFile(filename string) (*ast.File, error) {
+	if imp.ctx.OpenFile == nil {
+		return parser.ParseFile(imp.fset, filename, nil, imp.opts.ParserMode)
+	}
+	f, err := imp.ctx.OpenFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parser.ParseFile(imp.fset, filename, f, imp.opts.ParserMode)
+}
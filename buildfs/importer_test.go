@@ -0,0 +1,176 @@
+package buildfs
+
+import (
+	"go/build"
+	"go/token"
+	"go/types"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rainycape/vfs"
+)
+
+func newTestContext(fs vfs.VFS) *build.Context {
+	ctx := build.Default
+	ctx.GOROOT = "/goroot"
+	ctx.GOPATH = "/gopath"
+	ctx.GOOS = "linux"
+	ctx.GOARCH = "amd64"
+	ctx.CgoEnabled = false
+	Setup(&ctx, fs)
+	return &ctx
+}
+
+func writeFiles(t *testing.T, fs vfs.VFS, files map[string]string) {
+	for k, v := range files {
+		if err := vfs.MkdirAll(fs, path.Dir(k), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := vfs.WriteFile(fs, k, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestImporter(t *testing.T) {
+	fs := vfs.Memory()
+	writeFiles(t, fs, map[string]string{
+		"/goroot/src/errors/errors.go": `package errors
+type errorString struct { s string }
+func (e *errorString) Error() string { return e.s }
+func New(s string) error { return &errorString{s} }
+`,
+		"/goroot/src/errors/errors_test.go": `package errors
+import "missing"
+`,
+		"/gopath/src/example.com/greet/greet.go": `package greet
+import "errors"
+var ErrEmpty = errors.New("empty")
+func Greet(name string) (string, error) {
+	if name == "" {
+		return "", ErrEmpty
+	}
+	return "hello " + name, nil
+}
+`,
+		"/gopath/src/example.com/greet/greet_windows.go": `package greet
+func Windows() {}
+`,
+		"/gopath/src/example.com/cmd/main.go": `package main
+import (
+	"errors"
+	"example.com/greet"
+)
+func main() {
+	_, err := greet.Greet("")
+	_ = errors.New(err.Error())
+}
+`,
+		"/gopath/src/example.com/cycle/a/a.go": `package a
+import _ "example.com/cycle/b"
+`,
+		"/gopath/src/example.com/cycle/b/b.go": `package b
+import _ "example.com/cycle/a"
+`,
+		"/gopath/src/example.com/bad/bad.go": `package bad
+var x int = "string"
+`,
+	})
+	fset := token.NewFileSet()
+	imp := NewImporter(newTestContext(fs), fset, nil)
+	pkg, err := imp.Load("example.com/cmd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Types.Name() != "main" || len(pkg.Files) != 1 {
+		t.Errorf("unexpected package %v with %d files", pkg.Types, len(pkg.Files))
+	}
+	var greet *types.Package
+	for _, v := range pkg.Types.Imports() {
+		if v.Path() == "example.com/greet" {
+			greet = v
+		}
+	}
+	if greet == nil {
+		t.Fatal("example.com/greet not imported")
+	}
+	if greet.Scope().Lookup("Windows") != nil {
+		t.Error("files for other GOOS should be ignored")
+	}
+	// Packages are cached
+	tpkg, err := imp.ImportFrom("example.com/greet", "/gopath/src/example.com/cmd", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tpkg != greet {
+		t.Error("expecting the same *types.Package after importing again")
+	}
+	obj := greet.Scope().Lookup("ErrEmpty")
+	if obj == nil || obj.Type().String() != "error" {
+		t.Errorf("unexpected ErrEmpty %v", obj)
+	}
+	if _, err := imp.Import("example.com/cycle/a"); err == nil || !strings.Contains(err.Error(), "import cycle") {
+		t.Errorf("expecting an import cycle error, got %v", err)
+	}
+	if _, err := imp.Import("example.com/bad"); err == nil {
+		t.Error("expecting a type checking error")
+	}
+	if _, err := imp.Import("example.com/missing"); err == nil {
+		t.Error("expecting an error when importing a missing package")
+	}
+}
+
+func TestImporterGo13(t *testing.T) {
+	f, err := os.Open(filepath.Join("..", "testdata", "go1.3.src.tar.gz"))
+	if err != nil {
+		t.Skip("go1.3.src.tar.gz test file not found, use testdata/download-data.sh to fetch it")
+	}
+	defer f.Close()
+	src, err := vfs.TarGzip(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// go1.3 kept the standard library in src/pkg
+	goroot, err := vfs.Chroot("/go/src/pkg", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gopath := vfs.Memory()
+	writeFiles(t, gopath, map[string]string{
+		"/src/example.com/num/num.go": `package num
+import (
+	"sort"
+	"strconv"
+)
+func Sorted(s []string) []string {
+	sort.Strings(s)
+	return s
+}
+func Itoa(n int) string { return strconv.Itoa(n) }
+`,
+	})
+	root := vfs.Memory()
+	if err := vfs.MkdirAll(root, "/goroot/src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Mkdir("/gopath", 0755); err != nil {
+		t.Fatal(err)
+	}
+	m := &vfs.Mounter{}
+	for p, fs := range map[string]vfs.VFS{"/": root, "/goroot/src": goroot, "/gopath": gopath} {
+		if err := m.Mount(fs, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	imp := NewImporter(newTestContext(m), token.NewFileSet(), nil)
+	pkg, err := imp.Load("example.com/num", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj := pkg.Types.Scope().Lookup("Itoa"); obj == nil || obj.Type().String() != "func(n int) string" {
+		t.Errorf("unexpected Itoa %v", obj)
+	}
+}
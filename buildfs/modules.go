@@ -0,0 +1,171 @@
+package buildfs
+
+import (
+	"fmt"
+	"go/build"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rainycape/vfs"
+	"github.com/rainycape/vfs/modfs"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+const (
+	mainDir   = "/main"
+	modDir    = "/mod"
+	gorootDir = "/goroot"
+)
+
+type mod struct {
+	path string
+	dir  string
+}
+
+// Modules resolves imports in module mode, using the requirements from
+// the go.mod file of the main module and the modules stored in a module
+// cache, which are opened with modfs.OpenCache. All the modules are
+// exposed in a single VFS, returned by the VFS method, which has the
+// following layout:
+//
+//	/main                  main module
+//	/mod/<path>@<version>  required modules
+//	/goroot                GOROOT, if provided
+//
+// Only the versions listed in go.mod are used, which is enough for
+// modules declaring go 1.17 or later, since they list all the
+// modules which provide packages imported by the main module.
+type Modules struct {
+	fs   *vfs.Mounter
+	main string
+	// mods is sorted by path length, longest first
+	mods []mod
+}
+
+// LoadModules reads the go.mod file at the root of main and loads the
+// required modules from modcache, which must have the same layout as
+// the directory pointed by GOMODCACHE. Replacements using another module
+// version or a directory inside main are supported. If goroot is not
+// nil, it's exposed at /goroot, so the standard library can be imported.
+func LoadModules(main vfs.VFS, modcache vfs.VFS, goroot vfs.VFS) (*Modules, error) {
+	data, err := vfs.ReadFile(main, "/go.mod")
+	if err != nil {
+		return nil, err
+	}
+	mf, err := modfile.Parse("go.mod", data, nil)
+	if err != nil {
+		return nil, err
+	}
+	if mf.Module == nil {
+		return nil, fmt.Errorf("go.mod has no module directive")
+	}
+	replacements := make(map[string]module.Version)
+	for _, v := range mf.Replace {
+		// Replacements without version apply to all versions
+		key := v.Old.Path
+		if v.Old.Version != "" {
+			key += "@" + v.Old.Version
+		}
+		replacements[key] = v.New
+	}
+	root := vfs.Memory()
+	m := &Modules{
+		fs:   &vfs.Mounter{},
+		main: mf.Module.Mod.Path,
+	}
+	if err := m.fs.Mount(root, "/"); err != nil {
+		return nil, err
+	}
+	mount := func(fs vfs.VFS, dir string) error {
+		if err := vfs.MkdirAll(root, dir, 0755); err != nil {
+			return err
+		}
+		return m.fs.Mount(fs, dir)
+	}
+	if err := mount(main, mainDir); err != nil {
+		return nil, err
+	}
+	m.mods = append(m.mods, mod{path: m.main, dir: mainDir})
+	if goroot != nil {
+		if err := mount(goroot, gorootDir); err != nil {
+			return nil, err
+		}
+	}
+	for _, req := range mf.Require {
+		v := req.Mod
+		dir := path.Join(modDir, v.Path+"@"+v.Version)
+		var fs vfs.VFS
+		r, ok := replacements[v.Path+"@"+v.Version]
+		if !ok {
+			r, ok = replacements[v.Path]
+		}
+		switch {
+		case ok && modfile.IsDirectoryPath(r.Path):
+			fs, err = vfs.Chroot(r.Path, main)
+		case ok:
+			fs, err = modfs.OpenCache(modcache, r)
+		default:
+			fs, err = modfs.OpenCache(modcache, v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := mount(fs, dir); err != nil {
+			return nil, err
+		}
+		m.mods = append(m.mods, mod{path: v.Path, dir: dir})
+	}
+	sort.SliceStable(m.mods, func(i, j int) bool {
+		return len(m.mods[i].path) > len(m.mods[j].path)
+	})
+	return m, nil
+}
+
+// MainModule returns the path of the main module.
+func (m *Modules) MainModule() string {
+	return m.main
+}
+
+// VFS returns a VFS with all the modules. See Modules for its layout.
+func (m *Modules) VFS() vfs.VFS {
+	return m.fs
+}
+
+// Context returns a copy of ctx with Setup applied to the modules VFS
+// and its GOROOT set to /goroot.
+func (m *Modules) Context(ctx *build.Context) *build.Context {
+	c := *ctx
+	c.GOROOT = gorootDir
+	c.GOPATH = ""
+	Setup(&c, m.fs)
+	return &c
+}
+
+// Resolve returns the directory in the modules VFS for the package with
+// the given import path, which must be provided by the main module or
+// one of its requirements. If several modules provide the package, the
+// one with the longest path is used.
+func (m *Modules) Resolve(importPath string) (string, error) {
+	for _, v := range m.mods {
+		if importPath != v.path && !strings.HasPrefix(importPath, v.path+"/") {
+			continue
+		}
+		dir := path.Join(v.dir, importPath[len(v.path):])
+		if info, err := m.fs.Stat(dir); err == nil && info.IsDir() {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("no required module provides package %s", importPath)
+}
+
+// isStandardImportPath reports whether the import path belongs to the
+// standard library, using the same heuristic as the go command.
+func isStandardImportPath(importPath string) bool {
+	elem := importPath
+	if i := strings.IndexByte(elem, '/'); i >= 0 {
+		elem = elem[:i]
+	}
+	return !strings.Contains(elem, ".")
+}
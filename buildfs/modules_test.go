@@ -0,0 +1,122 @@
+package buildfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"go/build"
+	"go/token"
+	"testing"
+
+	"github.com/rainycape/vfs"
+)
+
+func moduleZip(t *testing.T, prefix string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for k, v := range files {
+		f, err := w.Create(prefix + "/" + k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestModules(t *testing.T) {
+	main := vfs.Memory()
+	writeFiles(t, main, map[string]string{
+		"/go.mod": `module example.com/main
+
+go 1.21
+
+require (
+	example.com/dep v1.0.0
+	github.com/Upper/pkg v0.1.0
+	example.com/local v0.0.0
+	example.com/old v1.0.0
+)
+
+replace example.com/local => ./local
+
+replace example.com/old v1.0.0 => example.com/new v1.1.0
+`,
+		"/main.go": `package main
+import (
+	"example.com/dep/sub"
+	"example.com/local"
+	"example.com/main/internal/util"
+	"example.com/old"
+	"github.com/Upper/pkg"
+)
+var _ = sub.Sub + local.Local + util.Util + old.Old + pkg.Pkg
+`,
+		"/internal/util/util.go": `package util
+const Util = "util"
+`,
+		"/local/go.mod":   "module example.com/local\n",
+		"/local/local.go": "package local\nconst Local = \"local\"\n",
+	})
+	modcache := vfs.Memory()
+	writeFiles(t, modcache, map[string]string{
+		"/cache/download/example.com/dep/@v/v1.0.0.zip": string(moduleZip(t, "example.com/dep@v1.0.0", map[string]string{
+			"go.mod":     "module example.com/dep\n",
+			"sub/sub.go": "package sub\nimport \"errors\"\nvar Sub = errors.New(\"sub\").Error()\n",
+		})),
+		"/cache/download/example.com/new/@v/v1.1.0.zip": string(moduleZip(t, "example.com/new@v1.1.0", map[string]string{
+			"go.mod": "module example.com/old\n",
+			"old.go": "package old\nconst Old = \"new\"\n",
+		})),
+		// Extracted module, without zip
+		"/github.com/!upper/pkg@v0.1.0/go.mod": "module github.com/Upper/pkg\n",
+		"/github.com/!upper/pkg@v0.1.0/pkg.go": "package pkg\nconst Pkg = \"pkg\"\n",
+	})
+	goroot := vfs.Memory()
+	writeFiles(t, goroot, map[string]string{
+		"/src/errors/errors.go": `package errors
+type errorString struct { s string }
+func (e *errorString) Error() string { return e.s }
+func New(s string) error { return &errorString{s} }
+`,
+	})
+	mods, err := LoadModules(main, modcache, goroot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp := mods.MainModule(); mp != "example.com/main" {
+		t.Errorf("unexpected main module %q", mp)
+	}
+	resolved := map[string]string{
+		"example.com/main":               "/main",
+		"example.com/main/internal/util": "/main/internal/util",
+		"example.com/dep/sub":            "/mod/example.com/dep@v1.0.0/sub",
+		"example.com/old":                "/mod/example.com/old@v1.0.0",
+		"github.com/Upper/pkg":           "/mod/github.com/Upper/pkg@v0.1.0",
+	}
+	for k, v := range resolved {
+		if dir, err := mods.Resolve(k); err != nil || dir != v {
+			t.Errorf("expecting %s to resolve to %s, got %s (%v)", k, v, dir, err)
+		}
+	}
+	if _, err := mods.Resolve("example.com/dep/missing"); err == nil {
+		t.Error("expecting an error when resolving a missing package")
+	}
+	ctx := build.Default
+	ctx.CgoEnabled = false
+	imp := NewImporter(mods.Context(&ctx), token.NewFileSet(), &ImporterOptions{Modules: mods})
+	pkg, err := imp.Load("example.com/main", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(pkg.Types.Imports()); n != 5 {
+		t.Errorf("expecting 5 imports, got %d", n)
+	}
+	if _, err := LoadModules(vfs.Memory(), modcache, nil); !vfs.IsNotExist(err) {
+		t.Errorf("expecting not exist error without go.mod, got %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package buildfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rainycape/vfs"
+)
+
+// Overlay is a configuration for the -overlay flag of the go command,
+// which makes it see the files in a VFS instead of the ones on disk.
+// The modified files are written to a temporary directory, which is
+// removed by Close.
+type Overlay struct {
+	// Replace maps the absolute paths of the files on disk to the
+	// paths of their replacements. Files which were removed map
+	// to an empty string. This is the same format used by the
+	// overlay file.
+	Replace map[string]string
+	tmp     vfs.TemporaryVFS
+}
+
+// File returns the path of the file which should be passed to the
+// -overlay flag.
+func (o *Overlay) File() string {
+	return filepath.Join(o.tmp.Root(), "overlay.json")
+}
+
+// Close removes the temporary files.
+func (o *Overlay) Close() error {
+	return o.tmp.Close()
+}
+
+// sameFile returns true iff the file at p in fs has the given data.
+func sameFile(fs vfs.VFS, p string, data []byte) bool {
+	info, err := fs.Stat(p)
+	if err != nil || info.IsDir() || info.Size() != int64(len(data)) {
+		return false
+	}
+	diskData, err := vfs.ReadFile(fs, p)
+	return err == nil && bytes.Equal(data, diskData)
+}
+
+// NewOverlay compares the files in fs with the ones in the directory dir
+// on disk, which fs is supposed to mirror, and returns an Overlay which
+// replaces the files which were created or modified in fs and removes the
+// ones which are missing from it. Files inside directories starting with a
+// dot, like .git, are never removed.
+func NewOverlay(fs vfs.VFS, dir string) (*Overlay, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	disk, err := vfs.FS(dir)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := vfs.TmpFS("buildfs-overlay")
+	if err != nil {
+		return nil, err
+	}
+	o := &Overlay{
+		Replace: make(map[string]string),
+		tmp:     tmp,
+	}
+	if err := o.build(fs, disk, dir); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *Overlay) build(fs vfs.VFS, disk vfs.VFS, dir string) error {
+	if err := o.tmp.Mkdir("/files", 0755); err != nil {
+		return err
+	}
+	diskPath := func(p string) string {
+		return filepath.Join(dir, filepath.FromSlash(p))
+	}
+	err := vfs.Walk(fs, "/", func(fs vfs.VFS, p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		data, err := vfs.ReadFile(fs, p)
+		if err != nil {
+			return err
+		}
+		if sameFile(disk, p, data) {
+			return nil
+		}
+		tmpPath := path.Join("/files", p)
+		if err := vfs.MkdirAll(o.tmp, path.Dir(tmpPath), 0755); err != nil {
+			return err
+		}
+		if err := vfs.WriteFile(o.tmp, tmpPath, data, 0644); err != nil {
+			return err
+		}
+		o.Replace[diskPath(p)] = filepath.Join(o.tmp.Root(), filepath.FromSlash(tmpPath))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = vfs.Walk(disk, "/", func(disk vfs.VFS, p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if strings.HasPrefix(info.Name(), ".") && p != "/" {
+				return vfs.SkipDir
+			}
+			return nil
+		}
+		if _, err := fs.Lstat(p); vfs.IsNotExist(err) {
+			o.Replace[diskPath(p)] = ""
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(struct{ Replace map[string]string }{o.Replace}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return vfs.WriteFile(o.tmp, "/overlay.json", data, 0644)
+}
@@ -0,0 +1,79 @@
+package buildfs
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rainycape/vfs"
+)
+
+func TestOverlay(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := vfs.FS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, disk, map[string]string{
+		"/go.mod":      "module example.com/overlay\n\ngo 1.21\n",
+		"/main.go":     "package main\n\nfunc main() { println(message) }\n",
+		"/message.go":  "package main\n\nconst message = \"disk\"\n",
+		"/removed.go":  "package main\n\nconst message = \"duplicate\"\n",
+		"/.git/config": "",
+	})
+	fs := vfs.Memory()
+	if err := vfs.Clone(fs, disk); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.RemoveAll(fs, "/.git"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/removed.go"); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, fs, map[string]string{
+		"/message.go":      "package main\n\nconst message = prefix + \"memory\"\n",
+		"/prefix/const.go": "package main\n\nconst prefix = \"\"\n",
+		"/prefix.go":       "package main\n\nconst prefix = \"in \"\n",
+	})
+	o, err := NewOverlay(fs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	exp := map[string]string{
+		filepath.Join(dir, "message.go"):      filepath.Join(o.tmp.Root(), "files", "message.go"),
+		filepath.Join(dir, "prefix.go"):       filepath.Join(o.tmp.Root(), "files", "prefix.go"),
+		filepath.Join(dir, "prefix/const.go"): filepath.Join(o.tmp.Root(), "files", "prefix", "const.go"),
+		filepath.Join(dir, "removed.go"):      "",
+	}
+	if !reflect.DeepEqual(o.Replace, exp) {
+		t.Errorf("expecting Replace = %v, got %v", exp, o.Replace)
+	}
+	data, err := os.ReadFile(o.File())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct{ Replace map[string]string }
+	if err := json.Unmarshal(data, &decoded); err != nil || !reflect.DeepEqual(decoded.Replace, exp) {
+		t.Errorf("unexpected overlay file %s, %v", string(data), err)
+	}
+	gocmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	bin := filepath.Join(t.TempDir(), "overlay")
+	cmd := exec.Command(gocmd, "build", "-overlay", o.File(), "-o", bin, ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod -buildvcs=false", "GOWORK=off")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("error building with overlay: %v\n%s", err, string(out))
+	}
+	out, err := exec.Command(bin).CombinedOutput()
+	if err != nil || string(out) != "in memory\n" {
+		t.Errorf("unexpected output %q, %v", string(out), err)
+	}
+}
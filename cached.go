@@ -0,0 +1,361 @@
+package vfs
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	pathpkg "path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheOptions specifies the options for Cached.
+type CacheOptions struct {
+	// MaxBytes is the maximum total size of the cached file
+	// contents. When it's exceeded, the least recently used files
+	// are evicted. Files bigger than MaxBytes are never cached. If
+	// zero, there's no limit.
+	MaxBytes int64
+	// TTL is the maximum time a cached entry (file contents or the
+	// results of Stat, Lstat and ReadDir) is used before it's
+	// requested again from the backing VFS. If zero, entries
+	// don't expire.
+	TTL time.Duration
+	// Validate indicates wheter cached file contents should be
+	// validated against the modification time and the size reported
+	// by the backing VFS every time the file is opened.
+	Validate bool
+}
+
+type cachedContent struct {
+	path    string
+	file    *File
+	size    int64
+	modTime time.Time
+	fetched time.Time
+}
+
+type cachedInfo struct {
+	info    os.FileInfo
+	fetched time.Time
+}
+
+type cachedDir struct {
+	infos   []os.FileInfo
+	fetched time.Time
+}
+
+type cachedFileSystem struct {
+	fs       VFS
+	opts     CacheOptions
+	mu       sync.Mutex
+	lru      *list.List
+	contents map[string]*list.Element
+	bytes    int64
+	stats    map[string]*cachedInfo
+	lstats   map[string]*cachedInfo
+	dirs     map[string]*cachedDir
+	// gen is incremented by every invalidation. Results fetched
+	// from fs are only stored if gen didn't change while they
+	// were being fetched, since otherwise they might be stale.
+	gen uint64
+}
+
+// generation returns the current invalidation generation.
+func (fs *cachedFileSystem) generation() uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.gen
+}
+
+func (fs *cachedFileSystem) VFS() VFS {
+	return fs.fs
+}
+
+func (fs *cachedFileSystem) expired(fetched time.Time) bool {
+	return fs.opts.TTL > 0 && time.Since(fetched) > fs.opts.TTL
+}
+
+// removeContent must be called with the lock held
+func (fs *cachedFileSystem) removeContent(el *list.Element) {
+	c := el.Value.(*cachedContent)
+	fs.lru.Remove(el)
+	delete(fs.contents, c.path)
+	fs.bytes -= c.size
+}
+
+func (fs *cachedFileSystem) cachedContent(p string) *cachedContent {
+	fs.mu.Lock()
+	el := fs.contents[p]
+	if el == nil {
+		fs.mu.Unlock()
+		return nil
+	}
+	c := el.Value.(*cachedContent)
+	if fs.expired(c.fetched) {
+		fs.removeContent(el)
+		fs.mu.Unlock()
+		return nil
+	}
+	fs.lru.MoveToFront(el)
+	fs.mu.Unlock()
+	if fs.opts.Validate {
+		st, err := fs.fs.Stat(p)
+		if err != nil || st.Size() != c.size || !st.ModTime().Equal(c.modTime) {
+			fs.mu.Lock()
+			if el := fs.contents[p]; el != nil && el.Value == c {
+				fs.removeContent(el)
+			}
+			fs.mu.Unlock()
+			return nil
+		}
+	}
+	return c
+}
+
+func (fs *cachedFileSystem) fetch(p string) (*File, error) {
+	gen := fs.generation()
+	st, err := fs.fs.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !st.Mode().IsRegular() || (fs.opts.MaxBytes > 0 && st.Size() > fs.opts.MaxBytes) || fs.viaSymlink(p, true) {
+		return nil, nil
+	}
+	data, err := ReadFile(fs.fs, p)
+	if err != nil {
+		return nil, err
+	}
+	// data has been already decompressed by ReadFile
+	f := &File{Data: data, Mode: st.Mode() &^ ModeCompress, ModTime: st.ModTime()}
+	c := &cachedContent{
+		path:    p,
+		file:    f,
+		size:    int64(len(data)),
+		modTime: st.ModTime(),
+		fetched: time.Now(),
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.gen != gen {
+		return f, nil
+	}
+	if el := fs.contents[p]; el != nil {
+		fs.removeContent(el)
+	}
+	fs.contents[p] = fs.lru.PushFront(c)
+	fs.bytes += c.size
+	for fs.opts.MaxBytes > 0 && fs.bytes > fs.opts.MaxBytes {
+		fs.removeContent(fs.lru.Back())
+	}
+	return f, nil
+}
+
+// viaSymlink returns wheter looking up p in the backing VFS follows
+// a symlink, either in its parents or, if last is true, in p itself.
+// Writes to the target of a symlink only invalidate the target, so
+// results found through symlinks are never cached.
+func (fs *cachedFileSystem) viaSymlink(p string, last bool) bool {
+	if p == "" {
+		return false
+	}
+	parts := strings.Split(p, "/")
+	if !last {
+		parts = parts[:len(parts)-1]
+	}
+	cur := ""
+	for _, v := range parts {
+		cur += "/" + v
+		info, err := fs.fs.Lstat(cur)
+		if err != nil || info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidate removes any cached data about p and its descendants,
+// as well as the cached contents of its parent directory.
+func (fs *cachedFileSystem) invalidate(p string) {
+	p = cleanPath(p)
+	prefix := p + "/"
+	matches := func(k string) bool {
+		return p == "" || k == p || strings.HasPrefix(k, prefix)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
+	for k, el := range fs.contents {
+		if matches(k) {
+			fs.removeContent(el)
+		}
+	}
+	for k := range fs.stats {
+		if matches(k) {
+			delete(fs.stats, k)
+		}
+	}
+	for k := range fs.lstats {
+		if matches(k) {
+			delete(fs.lstats, k)
+		}
+	}
+	for k := range fs.dirs {
+		if matches(k) {
+			delete(fs.dirs, k)
+		}
+	}
+	// Stat results for directories include their modification time
+	parent := cleanPath(pathpkg.Dir("/" + p))
+	delete(fs.dirs, parent)
+	delete(fs.stats, parent)
+	delete(fs.lstats, parent)
+}
+
+func (fs *cachedFileSystem) Open(path string) (RFile, error) {
+	p := cleanPath(path)
+	if c := fs.cachedContent(p); c != nil {
+		return NewRFile(c.file)
+	}
+	f, err := fs.fetch(p)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return fs.fs.Open(path)
+	}
+	return NewRFile(f)
+}
+
+func (fs *cachedFileSystem) OpenFile(path string, flag int, perm os.FileMode) (WFile, error) {
+	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR|os.O_TRUNC) == 0 {
+		p := cleanPath(path)
+		c := fs.cachedContent(p)
+		if c != nil {
+			return NewWFile(c.file, true, false)
+		}
+		f, err := fs.fetch(p)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			return NewWFile(f, true, false)
+		}
+		return fs.fs.OpenFile(path, flag, perm)
+	}
+	fs.invalidate(path)
+	f, err := fs.fs.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedWFile{WFile: f, fs: fs, path: path}, nil
+}
+
+func (fs *cachedFileSystem) stat(cache map[string]*cachedInfo, path string, follow bool, stat func(string) (os.FileInfo, error)) (os.FileInfo, error) {
+	p := cleanPath(path)
+	fs.mu.Lock()
+	c := cache[p]
+	fs.mu.Unlock()
+	if c != nil && !fs.expired(c.fetched) {
+		return c.info, nil
+	}
+	gen := fs.generation()
+	info, err := stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fs.viaSymlink(p, follow) {
+		return info, nil
+	}
+	fs.mu.Lock()
+	if fs.gen == gen {
+		cache[p] = &cachedInfo{info: info, fetched: time.Now()}
+	}
+	fs.mu.Unlock()
+	return info, nil
+}
+
+func (fs *cachedFileSystem) Lstat(path string) (os.FileInfo, error) {
+	return fs.stat(fs.lstats, path, false, fs.fs.Lstat)
+}
+
+func (fs *cachedFileSystem) Stat(path string) (os.FileInfo, error) {
+	return fs.stat(fs.stats, path, true, fs.fs.Stat)
+}
+
+func (fs *cachedFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	p := cleanPath(path)
+	fs.mu.Lock()
+	c := fs.dirs[p]
+	fs.mu.Unlock()
+	if c == nil || fs.expired(c.fetched) {
+		gen := fs.generation()
+		infos, err := fs.fs.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		c = &cachedDir{infos: infos, fetched: time.Now()}
+		if !fs.viaSymlink(p, true) {
+			fs.mu.Lock()
+			if fs.gen == gen {
+				fs.dirs[p] = c
+			}
+			fs.mu.Unlock()
+		}
+	}
+	// Return a copy, since callers might modify the slice
+	infos := make([]os.FileInfo, len(c.infos))
+	copy(infos, c.infos)
+	return infos, nil
+}
+
+func (fs *cachedFileSystem) Mkdir(path string, perm os.FileMode) error {
+	defer fs.invalidate(path)
+	return fs.fs.Mkdir(path, perm)
+}
+
+func (fs *cachedFileSystem) Remove(path string) error {
+	defer fs.invalidate(path)
+	return fs.fs.Remove(path)
+}
+
+func (fs *cachedFileSystem) String() string {
+	return fmt.Sprintf("Cached %s", fs.fs.String())
+}
+
+type cachedWFile struct {
+	WFile
+	fs   *cachedFileSystem
+	path string
+}
+
+func (f *cachedWFile) Close() error {
+	// Invalidate again, since the file might have been read
+	// while it was being written.
+	defer f.fs.invalidate(f.path)
+	return f.WFile.Close()
+}
+
+// Cached returns a read-through caching VFS on top of fs. File contents are
+// stored in memory when files are opened for reading, while the results of
+// Stat, Lstat and ReadDir are stored when they're called. Writes, Mkdir and
+// Remove go straight to fs and invalidate the affected entries, but changes
+// made to fs without going through the returned VFS are only noticed when
+// entries expire or, for file contents, when Validate is set. Results
+// found by following symlinks are not cached. The opts argument might
+// be nil.
+func Cached(fs VFS, opts *CacheOptions) VFS {
+	cfs := &cachedFileSystem{
+		fs:       fs,
+		lru:      list.New(),
+		contents: make(map[string]*list.Element),
+		stats:    make(map[string]*cachedInfo),
+		lstats:   make(map[string]*cachedInfo),
+		dirs:     make(map[string]*cachedDir),
+	}
+	if opts != nil {
+		cfs.opts = *opts
+	}
+	return cfs
+}
@@ -0,0 +1,251 @@
+package vfs
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestCached(t *testing.T, opts *CacheOptions) (VFS, VFS, *recordingObserver) {
+	backing := Memory()
+	obs := &recordingObserver{}
+	return Cached(Instrumented(backing, obs), opts), backing, obs
+}
+
+func TestCached(t *testing.T) {
+	fs, _, _ := newTestCached(t, nil)
+	testVFS(t, fs)
+}
+
+func TestCachedHits(t *testing.T) {
+	fs, _, obs := newTestCached(t, nil)
+	if err := WriteFile(fs, "a", []byte("A"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for ii := 0; ii < 3; ii++ {
+		data, err := ReadFile(fs, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "A" {
+			t.Fatalf("expecting \"A\", got %q", string(data))
+		}
+		if _, err := fs.ReadDir("/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c, _, _ := obs.count(OpOpen); c != 1 {
+		t.Errorf("expecting 1 Open on the backing VFS, got %d", c)
+	}
+	if c, _, _ := obs.count(OpReadDir); c != 1 {
+		t.Errorf("expecting 1 ReadDir on the backing VFS, got %d", c)
+	}
+	// Writing must invalidate the cached contents and listing
+	if err := WriteFile(fs, "a", []byte("B"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "b", []byte("B"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ReadFile(fs, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "B" {
+		t.Errorf("expecting \"B\" after writing, got %q", string(data))
+	}
+	infos, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Errorf("expecting 2 entries after writing, got %d", len(infos))
+	}
+}
+
+func TestCachedExpiration(t *testing.T) {
+	fs, backing, _ := newTestCached(t, &CacheOptions{TTL: 20 * time.Millisecond})
+	if err := WriteFile(fs, "a", []byte("A"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFile(fs, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(backing, "a", []byte("B"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ReadFile(fs, "a"); string(data) != "A" {
+		t.Errorf("expecting cached \"A\", got %q", string(data))
+	}
+	time.Sleep(30 * time.Millisecond)
+	if data, _ := ReadFile(fs, "a"); string(data) != "B" {
+		t.Errorf("expecting \"B\" after expiration, got %q", string(data))
+	}
+}
+
+func TestCachedValidation(t *testing.T) {
+	fs, backing, _ := newTestCached(t, &CacheOptions{Validate: true})
+	if err := WriteFile(fs, "a", []byte("A"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFile(fs, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(backing, "a", []byte("BB"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ReadFile(fs, "a"); string(data) != "BB" {
+		t.Errorf("expecting \"BB\" after validation, got %q", string(data))
+	}
+}
+
+func TestCachedEviction(t *testing.T) {
+	fs, _, obs := newTestCached(t, &CacheOptions{MaxBytes: 4})
+	for _, v := range []string{"a", "b", "c"} {
+		if err := WriteFile(fs, v, []byte("12"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range []string{"a", "b", "a", "c", "a", "b"} {
+		if _, err := ReadFile(fs, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a, b, c (evicts b), b (evicts c)
+	if c, _, _ := obs.count(OpOpen); c != 4 {
+		t.Errorf("expecting 4 Open calls on the backing VFS, got %d", c)
+	}
+}
+
+func TestCachedCompressed(t *testing.T) {
+	backing := Memory()
+	data := bytes.Repeat([]byte("compressible "), 100)
+	if err := WriteFile(backing, "a", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Compress(backing); err != nil {
+		t.Fatal(err)
+	}
+	fs := Cached(backing, nil)
+	for ii := 0; ii < 2; ii++ {
+		read, err := ReadFile(fs, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Errorf("unexpected data %q", string(read))
+		}
+	}
+}
+
+// blockingVFS blocks closing the first file opened after block
+// is called, until release is closed.
+type blockingVFS struct {
+	VFS
+	mu      sync.Mutex
+	closing chan struct{}
+	release chan struct{}
+}
+
+func (fs *blockingVFS) block() (closing chan struct{}, release chan struct{}) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.closing = make(chan struct{})
+	fs.release = make(chan struct{})
+	return fs.closing, fs.release
+}
+
+type blockingFile struct {
+	RFile
+	closing chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingFile) Close() error {
+	err := f.RFile.Close()
+	close(f.closing)
+	<-f.release
+	return err
+}
+
+func (fs *blockingVFS) Open(path string) (RFile, error) {
+	f, err := fs.VFS.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closing != nil {
+		f = &blockingFile{RFile: f, closing: fs.closing, release: fs.release}
+		fs.closing, fs.release = nil, nil
+	}
+	return f, nil
+}
+
+func TestCachedStaleFetch(t *testing.T) {
+	backing := &blockingVFS{VFS: Memory()}
+	fs := Cached(backing, nil)
+	if err := WriteFile(fs, "a", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	closing, release := backing.block()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := ReadFile(fs, "a"); err != nil {
+			t.Error(err)
+		}
+	}()
+	// Write after the fetch has read the old data, but
+	// before it stores it
+	<-closing
+	if err := WriteFile(fs, "a", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	<-done
+	data, err := ReadFile(fs, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" {
+		t.Errorf("expecting \"new\", got stale %q", string(data))
+	}
+}
+
+func TestCachedSymlink(t *testing.T) {
+	backing, err := Open("testdata/fs2.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := Cached(backing, nil)
+	data, err := ReadFile(fs, "f3.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1000 {
+		t.Fatalf("expecting 1000 bytes in f3.bin, got %d", len(data))
+	}
+	if _, err := fs.Stat("f3.bin"); err != nil {
+		t.Fatal(err)
+	}
+	// f3.bin is a symlink to f2.bin
+	if err := WriteFile(fs, "f2.bin", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ReadFile(fs, "f3.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" {
+		t.Errorf("expecting \"new\" in f3.bin after writing f2.bin, got %d bytes", len(data))
+	}
+	st, err := fs.Stat("f3.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != 3 {
+		t.Errorf("expecting f3.bin to have 3 bytes after writing f2.bin, got %d", st.Size())
+	}
+}
@@ -0,0 +1,576 @@
+package vfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strings"
+)
+
+const (
+	// EncryptedChunkSize is the number of plaintext bytes stored in
+	// each authenticated chunk of a file in an encrypted VFS.
+	EncryptedChunkSize = 64 * 1024
+
+	encryptedMagic      = "vfse"
+	encryptedIDSize     = 16
+	encryptedHeaderSize = len(encryptedMagic) + encryptedIDSize
+	encryptedNonceSize  = 12
+	encryptedOverhead   = encryptedNonceSize + 16
+	encryptedChunkSize  = EncryptedChunkSize + encryptedOverhead
+)
+
+var (
+	// ErrIntegrity is returned by encrypted file systems when the data
+	// or the names stored in the underlying VFS fail authentication,
+	// either because they were tampered with or because the wrong key
+	// was used.
+	ErrIntegrity = errors.New("encrypted data failed integrity check")
+)
+
+// EncryptedOptions specifies the options for Encrypted.
+type EncryptedOptions struct {
+	// Names indicates wheter file and directory names should be
+	// encrypted too. Note that encrypted names are longer than their
+	// plaintext versions, so the underlying VFS might reject very
+	// long names.
+	Names bool
+}
+
+type encryptedFileSystem struct {
+	fs      VFS
+	content cipher.AEAD
+	names   cipher.AEAD
+	nameIV  []byte
+}
+
+func (fs *encryptedFileSystem) VFS() VFS {
+	return fs.fs
+}
+
+func (fs *encryptedFileSystem) encryptName(dir string, name string) string {
+	mac := hmac.New(sha256.New, fs.nameIV)
+	mac.Write([]byte(dir))
+	mac.Write([]byte{0})
+	mac.Write([]byte(name))
+	// Names are encrypted deterministically, using a synthetic nonce
+	// derived from the name itself, so lookups are possible.
+	nonce := mac.Sum(nil)[:encryptedNonceSize]
+	sealed := fs.names.Seal(nonce, nonce, []byte(name), []byte(dir))
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func (fs *encryptedFileSystem) decryptName(dir string, name string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || len(sealed) < encryptedOverhead {
+		return "", ErrIntegrity
+	}
+	plain, err := fs.names.Open(nil, sealed[:encryptedNonceSize], sealed[encryptedNonceSize:], []byte(dir))
+	if err != nil {
+		return "", ErrIntegrity
+	}
+	return string(plain), nil
+}
+
+func (fs *encryptedFileSystem) path(p string) string {
+	p = cleanPath(p)
+	if fs.names == nil || p == "" {
+		return "/" + p
+	}
+	parts := strings.Split(p, "/")
+	dir := "/"
+	for ii, v := range parts {
+		parts[ii] = fs.encryptName(dir, v)
+		dir = pathpkg.Join(dir, v)
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+func (fs *encryptedFileSystem) fileInfo(p string, info os.FileInfo) os.FileInfo {
+	name := info.Name()
+	if fs.names != nil {
+		name = pathpkg.Base("/" + cleanPath(p))
+	}
+	size := info.Size()
+	if info.Mode().IsRegular() {
+		size = encryptedPlainSize(size)
+	}
+	return &encryptedFileInfo{FileInfo: info, name: name, size: size}
+}
+
+func (fs *encryptedFileSystem) openFile(f RFile, w io.Writer, readable bool) (*encryptedFile, error) {
+	ef := &encryptedFile{
+		fs:       fs,
+		f:        f,
+		w:        w,
+		chunkIdx: -1,
+		readable: readable,
+		writable: w != nil,
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		if w == nil {
+			// Files written by us always have a header and
+			// a chunk, so the file has been truncated.
+			return nil, ErrIntegrity
+		}
+		if err := ef.writeHeader(); err != nil {
+			return nil, err
+		}
+		return ef, nil
+	}
+	if size < int64(encryptedHeaderSize+encryptedOverhead) {
+		return nil, ErrIntegrity
+	}
+	hdr := make([]byte, encryptedHeaderSize)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrIntegrity
+		}
+		return nil, err
+	}
+	if string(hdr[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, ErrIntegrity
+	}
+	ef.id = hdr[len(encryptedMagic):]
+	ef.size = encryptedPlainSize(size)
+	if ef.size == 0 {
+		// Read never loads a chunk for empty files, so check the
+		// first one here to detect truncations down to it.
+		if _, err := ef.readChunk(0, 0); err != nil {
+			return nil, err
+		}
+	}
+	return ef, nil
+}
+
+func (fs *encryptedFileSystem) Open(path string) (RFile, error) {
+	f, err := fs.fs.Open(fs.path(path))
+	if err != nil {
+		return nil, err
+	}
+	ef, err := fs.openFile(f, nil, true)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return ef, nil
+}
+
+func (fs *encryptedFileSystem) OpenFile(path string, flag int, perm os.FileMode) (WFile, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	readable := flag&os.O_WRONLY == 0
+	appending := writable && flag&os.O_APPEND != 0
+	if writable {
+		// Chunks need to be read back in order to modify them, and
+		// appending is handled by the encrypted file itself.
+		flag = (flag &^ (os.O_WRONLY | os.O_APPEND)) | os.O_RDWR
+	}
+	f, err := fs.fs.OpenFile(fs.path(path), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	var w io.Writer
+	if writable {
+		w = f
+	}
+	ef, err := fs.openFile(f, w, readable)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ef.append = appending
+	return ef, nil
+}
+
+func (fs *encryptedFileSystem) Lstat(path string) (os.FileInfo, error) {
+	info, err := fs.fs.Lstat(fs.path(path))
+	if err != nil {
+		return nil, err
+	}
+	return fs.fileInfo(path, info), nil
+}
+
+func (fs *encryptedFileSystem) Stat(path string) (os.FileInfo, error) {
+	info, err := fs.fs.Stat(fs.path(path))
+	if err != nil {
+		return nil, err
+	}
+	return fs.fileInfo(path, info), nil
+}
+
+func (fs *encryptedFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	infos, err := fs.fs.ReadDir(fs.path(path))
+	if err != nil {
+		return nil, err
+	}
+	dir := "/" + cleanPath(path)
+	for ii, v := range infos {
+		name := v.Name()
+		if fs.names != nil {
+			if name, err = fs.decryptName(dir, name); err != nil {
+				return nil, err
+			}
+		}
+		infos[ii] = fs.fileInfo(pathpkg.Join(dir, name), v)
+	}
+	if fs.names != nil {
+		sort.Sort(FileInfos(infos))
+	}
+	return infos, nil
+}
+
+func (fs *encryptedFileSystem) Mkdir(path string, perm os.FileMode) error {
+	return fs.fs.Mkdir(fs.path(path), perm)
+}
+
+func (fs *encryptedFileSystem) Remove(path string) error {
+	return fs.fs.Remove(fs.path(path))
+}
+
+func (fs *encryptedFileSystem) String() string {
+	return fmt.Sprintf("Encrypted %s", fs.fs.String())
+}
+
+type encryptedFileInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (info *encryptedFileInfo) Name() string {
+	return info.name
+}
+
+func (info *encryptedFileInfo) Size() int64 {
+	return info.size
+}
+
+// encryptedPlainSize returns the plaintext size of an encrypted
+// file which takes size bytes in the underlying VFS.
+func encryptedPlainSize(size int64) int64 {
+	body := size - int64(encryptedHeaderSize)
+	if body < encryptedOverhead {
+		return 0
+	}
+	full := body / encryptedChunkSize
+	rem := body % encryptedChunkSize
+	plain := full * EncryptedChunkSize
+	if rem > encryptedOverhead {
+		plain += rem - encryptedOverhead
+	}
+	return plain
+}
+
+func lastChunk(size int64) int64 {
+	if size == 0 {
+		return 0
+	}
+	return (size - 1) / EncryptedChunkSize
+}
+
+// encryptedFile implements RFile and WFile on top of a file in the
+// underlying VFS. Data is stored as a header followed by chunks of
+// EncryptedChunkSize bytes, each one sealed with its own random nonce.
+// The file ID, the chunk index and wheter the chunk is the last one are
+// authenticated too, so reordering or truncating chunks is detected.
+type encryptedFile struct {
+	fs       *encryptedFileSystem
+	f        RFile
+	w        io.Writer
+	id       []byte
+	size     int64
+	offset   int64
+	chunk    []byte
+	chunkIdx int64
+	dirty    bool
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (ef *encryptedFile) writeHeader() error {
+	ef.id = make([]byte, encryptedIDSize)
+	if _, err := rand.Read(ef.id); err != nil {
+		return err
+	}
+	if _, err := ef.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := ef.w.Write([]byte(encryptedMagic)); err != nil {
+		return err
+	}
+	if _, err := ef.w.Write(ef.id); err != nil {
+		return err
+	}
+	// Always store at least one chunk, so truncating a file to
+	// its header is detected.
+	return ef.writeChunk(0, nil, true)
+}
+
+func (ef *encryptedFile) additionalData(idx int64, final bool) []byte {
+	ad := make([]byte, encryptedIDSize+9)
+	copy(ad, ef.id)
+	binary.BigEndian.PutUint64(ad[encryptedIDSize:], uint64(idx))
+	if final {
+		ad[len(ad)-1] = 1
+	}
+	return ad
+}
+
+func (ef *encryptedFile) seekChunk(idx int64) error {
+	_, err := ef.f.Seek(int64(encryptedHeaderSize)+idx*encryptedChunkSize, io.SeekStart)
+	return err
+}
+
+func (ef *encryptedFile) readChunk(idx int64, size int64) ([]byte, error) {
+	n := size - idx*EncryptedChunkSize
+	if n > EncryptedChunkSize {
+		n = EncryptedChunkSize
+	}
+	if err := ef.seekChunk(idx); err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, n+encryptedOverhead)
+	if _, err := io.ReadFull(ef.f, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrIntegrity
+		}
+		return nil, err
+	}
+	nonce := sealed[:encryptedNonceSize]
+	ad := ef.additionalData(idx, idx == lastChunk(size))
+	data, err := ef.fs.content.Open(nil, nonce, sealed[encryptedNonceSize:], ad)
+	if err != nil {
+		return nil, ErrIntegrity
+	}
+	return data, nil
+}
+
+func (ef *encryptedFile) writeChunk(idx int64, data []byte, final bool) error {
+	nonce := make([]byte, encryptedNonceSize, len(data)+encryptedOverhead)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := ef.fs.content.Seal(nonce, nonce, data, ef.additionalData(idx, final))
+	if err := ef.seekChunk(idx); err != nil {
+		return err
+	}
+	_, err := ef.w.Write(sealed)
+	return err
+}
+
+func (ef *encryptedFile) flush() error {
+	if !ef.dirty {
+		return nil
+	}
+	if err := ef.writeChunk(ef.chunkIdx, ef.chunk, ef.chunkIdx == lastChunk(ef.size)); err != nil {
+		return err
+	}
+	ef.dirty = false
+	return nil
+}
+
+// loadChunk makes idx the current chunk. If end is greater than
+// the current size, the file is grown to end before flushing the
+// previous chunk, so the chunk which used to be the last one is
+// stored with the right flags.
+func (ef *encryptedFile) loadChunk(idx int64, end int64) error {
+	if idx == ef.chunkIdx {
+		if end > ef.size {
+			ef.size = end
+		}
+		return nil
+	}
+	size := ef.size
+	if end > size {
+		last := lastChunk(size)
+		if size > 0 && lastChunk(end) > last {
+			// The chunk which was the last one must be sealed again
+			if ef.chunkIdx == last {
+				ef.dirty = true
+			} else {
+				data, err := ef.readChunk(last, size)
+				if err != nil {
+					return err
+				}
+				if err := ef.writeChunk(last, data, false); err != nil {
+					return err
+				}
+			}
+		}
+		ef.size = end
+	}
+	if err := ef.flush(); err != nil {
+		return err
+	}
+	var data []byte
+	if idx*EncryptedChunkSize < size {
+		var err error
+		if data, err = ef.readChunk(idx, size); err != nil {
+			return err
+		}
+	}
+	ef.chunk = data
+	ef.chunkIdx = idx
+	return nil
+}
+
+func (ef *encryptedFile) Read(p []byte) (int, error) {
+	if !ef.readable {
+		return 0, ErrWriteOnly
+	}
+	if ef.closed {
+		return 0, errFileClosed
+	}
+	if ef.offset >= ef.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && ef.offset < ef.size {
+		idx := ef.offset / EncryptedChunkSize
+		if err := ef.loadChunk(idx, 0); err != nil {
+			return n, err
+		}
+		c := copy(p[n:], ef.chunk[ef.offset-idx*EncryptedChunkSize:])
+		n += c
+		ef.offset += int64(c)
+	}
+	return n, nil
+}
+
+func (ef *encryptedFile) write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		idx := ef.offset / EncryptedChunkSize
+		pos := int(ef.offset - idx*EncryptedChunkSize)
+		count := len(p) - n
+		if rem := EncryptedChunkSize - pos; count > rem {
+			count = rem
+		}
+		if err := ef.loadChunk(idx, ef.offset+int64(count)); err != nil {
+			return n, err
+		}
+		if end := pos + count; end > len(ef.chunk) {
+			chunk := make([]byte, end)
+			copy(chunk, ef.chunk)
+			ef.chunk = chunk
+		}
+		copy(ef.chunk[pos:], p[n:n+count])
+		ef.dirty = true
+		n += count
+		ef.offset += int64(count)
+	}
+	return n, nil
+}
+
+func (ef *encryptedFile) Write(p []byte) (int, error) {
+	if !ef.writable {
+		return 0, ErrReadOnly
+	}
+	if ef.closed {
+		return 0, errFileClosed
+	}
+	if ef.append {
+		ef.offset = ef.size
+	}
+	if gap := ef.offset - ef.size; gap > 0 {
+		// Fill the hole with zeroes, like sparse files in most
+		// OS file systems.
+		ef.offset = ef.size
+		if _, err := ef.write(make([]byte, gap)); err != nil {
+			return 0, err
+		}
+	}
+	return ef.write(p)
+}
+
+func (ef *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	if ef.closed {
+		return 0, errFileClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += ef.offset
+	case io.SeekEnd:
+		offset += ef.size
+	default:
+		return 0, fmt.Errorf("Seek: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Seek: negative position %d", offset)
+	}
+	ef.offset = offset
+	return offset, nil
+}
+
+func (ef *encryptedFile) Close() error {
+	if ef.closed {
+		return errFileClosed
+	}
+	ef.closed = true
+	err := ef.flush()
+	if cerr := ef.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypted returns a VFS which encrypts all the files stored in fs
+// using AES-GCM. The key must be either 16, 24 or 32 bytes long. Files
+// are split into authenticated chunks of EncryptedChunkSize bytes, so
+// seeking and reading only part of a file only needs to decrypt the
+// chunks involved. Stat, Lstat and ReadDir report the plaintext sizes.
+// Reading data which has been modified in the underlying VFS returns
+// ErrIntegrity. The opts argument might be nil.
+func Encrypted(fs VFS, key []byte, opts *EncryptedOptions) (VFS, error) {
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	content, err := newGCM(deriveKey(key, "vfs content"))
+	if err != nil {
+		return nil, err
+	}
+	efs := &encryptedFileSystem{fs: fs, content: content}
+	if opts != nil && opts.Names {
+		names, err := newGCM(deriveKey(key, "vfs names"))
+		if err != nil {
+			return nil, err
+		}
+		efs.names = names
+		efs.nameIV = deriveKey(key, "vfs name nonces")
+	}
+	return efs, nil
+}
@@ -0,0 +1,216 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var testEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestEncrypted(t *testing.T, names bool) (VFS, VFS) {
+	mem := Memory()
+	fs, err := Encrypted(mem, testEncryptionKey, &EncryptedOptions{Names: names})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, mem
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for ii := range data {
+		data[ii] = byte(ii * 7)
+	}
+	return data
+}
+
+func TestEncrypted(t *testing.T) {
+	fs, _ := newTestEncrypted(t, false)
+	testVFS(t, fs)
+}
+
+func TestEncryptedNames(t *testing.T) {
+	fs, mem := newTestEncrypted(t, true)
+	testVFS(t, fs)
+	if err := WriteFile(fs, "secret.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := mem.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range infos {
+		if strings.Contains(v.Name(), "secret") {
+			t.Errorf("name %q was not encrypted", v.Name())
+		}
+	}
+	st, err := fs.Stat("secret.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Name() != "secret.txt" || st.Size() != 5 {
+		t.Errorf("expecting secret.txt with size 5, got %s with size %d", st.Name(), st.Size())
+	}
+}
+
+func TestEncryptedChunks(t *testing.T) {
+	fs, mem := newTestEncrypted(t, false)
+	data := testData(3*EncryptedChunkSize + 123)
+	if err := WriteFile(fs, "large", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ReadFile(mem, "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, data[:64]) {
+		t.Error("plaintext found in underlying file")
+	}
+	st, err := fs.Stat("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != int64(len(data)) {
+		t.Errorf("expecting size %d, got %d", len(data), st.Size())
+	}
+	read, err := ReadFile(fs, "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("read data does not match written data")
+	}
+	f, err := fs.Open("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	off := int64(2*EncryptedChunkSize - 10)
+	if _, err := f.Seek(off, os.SEEK_SET); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 20)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[off:off+20]) {
+		t.Error("partial read across chunks returned wrong data")
+	}
+}
+
+func TestEncryptedModify(t *testing.T) {
+	fs, _ := newTestEncrypted(t, false)
+	data := testData(EncryptedChunkSize)
+	if err := WriteFile(fs, "f", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("f", os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("appended")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(10, os.SEEK_SET); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = fs.OpenFile("f", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(5, os.SEEK_SET); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("xyz")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expect := append(append([]byte{}, data...), "appended"...)
+	copy(expect[5:], "xyz")
+	read, err := ReadFile(fs, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, expect) {
+		t.Error("modified data does not match")
+	}
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	fs, mem := newTestEncrypted(t, false)
+	data := testData(2*EncryptedChunkSize + 1)
+	if err := WriteFile(fs, "f", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ReadFile(mem, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, raw...)
+	tampered[len(tampered)/2] ^= 1
+	if err := WriteFile(mem, "f", tampered, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFile(fs, "f"); err != ErrIntegrity {
+		t.Errorf("expecting ErrIntegrity after flipping a bit, got %v", err)
+	}
+	// Drop the last chunk
+	if err := WriteFile(mem, "f", raw[:len(raw)-encryptedOverhead-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFile(fs, "f"); err != ErrIntegrity {
+		t.Errorf("expecting ErrIntegrity after truncating, got %v", err)
+	}
+	other, err := Encrypted(mem, []byte("fedcba9876543210"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(mem, "f", raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := other.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := ioutil.ReadAll(f); err != ErrIntegrity {
+		t.Errorf("expecting ErrIntegrity with the wrong key, got %v", err)
+	}
+}
+
+func TestEncryptedTruncated(t *testing.T) {
+	fs, mem := newTestEncrypted(t, false)
+	if err := WriteFile(fs, "empty", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "f", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ReadFile(mem, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFile(fs, "empty"); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{encryptedHeaderSize, encryptedHeaderSize + encryptedOverhead, 0} {
+		if err := WriteFile(mem, "f", raw[:size], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadFile(fs, "f"); err != ErrIntegrity {
+			t.Errorf("expecting ErrIntegrity after truncating to %d bytes, got %v", size, err)
+		}
+	}
+}
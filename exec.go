@@ -0,0 +1,240 @@
+package vfs
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// Changes lists the files which were created, modified or removed
+// by a command run with Exec. All paths are absolute paths in the
+// source VFS. Directories are only reported when they're created
+// or removed.
+type Changes struct {
+	Created  []string
+	Modified []string
+	Removed  []string
+}
+
+// Empty returns true iff there are no changes.
+func (c *Changes) Empty() bool {
+	return len(c.Created) == 0 && len(c.Modified) == 0 && len(c.Removed) == 0
+}
+
+// walkTree calls fn for all the files and directories in fs, excluding
+// the root. Symlinks to files are reported as regular files, while
+// symlinks to directories and broken symlinks are ignored.
+func walkTree(fs VFS, fn func(p string, info os.FileInfo) error) error {
+	return Walk(fs, "/", func(fs VFS, p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == "/" {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			st, err := fs.Stat(p)
+			if err != nil || st.IsDir() {
+				return nil
+			}
+			info = st
+		}
+		return fn(p, info)
+	})
+}
+
+// filePerm returns the permissions used for the copy of the
+// file or directory described by info in the temporary directory.
+func filePerm(info os.FileInfo) os.FileMode {
+	perm := info.Mode().Perm()
+	if perm == 0 {
+		if info.IsDir() {
+			return 0755
+		}
+		return 0644
+	}
+	return perm
+}
+
+// materialize copies the files in src to dst, preserving their
+// permissions. The permissions of the directories are set once all
+// the files have been copied, so read-only directories can be filled.
+func materialize(dst TemporaryVFS, src VFS) error {
+	var dirs []string
+	var perms []os.FileMode
+	err := walkTree(src, func(p string, info os.FileInfo) error {
+		if info.IsDir() {
+			dirs = append(dirs, p)
+			perms = append(perms, filePerm(info))
+			return dst.Mkdir(p, 0700)
+		}
+		data, err := ReadFile(src, p)
+		if err != nil {
+			return err
+		}
+		if err := WriteFile(dst, p, data, 0600); err != nil {
+			return err
+		}
+		// Use os.Chmod rather than the WriteFile perm, which is
+		// subject to the umask.
+		return os.Chmod(localPath(dst, p), filePerm(info))
+	})
+	if err != nil {
+		return err
+	}
+	for ii := len(dirs) - 1; ii >= 0; ii-- {
+		if err := os.Chmod(localPath(dst, dirs[ii]), perms[ii]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func localPath(fs TemporaryVFS, p string) string {
+	return filepath.Join(fs.Root(), filepath.FromSlash(path.Clean("/"+p)))
+}
+
+// removeTmp makes all the directories in tmp writable, since
+// materialize might have copied read-only ones, and then removes it.
+func removeTmp(tmp TemporaryVFS) error {
+	filepath.Walk(tmp.Root(), func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(p, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+	return tmp.Close()
+}
+
+// applyChanges applies the differences between tmp and src to src,
+// returning them.
+func applyChanges(src VFS, tmp VFS) (*Changes, error) {
+	changes := new(Changes)
+	seen := make(map[string]bool)
+	err := walkTree(tmp, func(p string, info os.FileInfo) error {
+		seen[p] = true
+		srcInfo, err := src.Stat(p)
+		if err != nil && !IsNotExist(err) {
+			return err
+		}
+		if srcInfo != nil && srcInfo.IsDir() != info.IsDir() {
+			// Type changed, remove the old entry first
+			if err := RemoveAll(src, p); err != nil {
+				return err
+			}
+			changes.Removed = append(changes.Removed, p)
+			srcInfo = nil
+		}
+		if info.IsDir() {
+			if srcInfo == nil {
+				if err := src.Mkdir(p, info.Mode().Perm()); err != nil {
+					return err
+				}
+				changes.Created = append(changes.Created, p)
+			}
+			return nil
+		}
+		data, err := ReadFile(tmp, p)
+		if err != nil {
+			return err
+		}
+		perm := info.Mode().Perm()
+		if srcInfo != nil {
+			srcData, err := ReadFile(src, p)
+			if err != nil {
+				return err
+			}
+			sameData := bytes.Equal(data, srcData)
+			samePerm := filePerm(srcInfo) == perm
+			if sameData && samePerm {
+				return nil
+			}
+			changes.Modified = append(changes.Modified, p)
+			if !samePerm {
+				// WriteFile doesn't change the permissions of existing
+				// files, so remove the file when they can't be changed.
+				err := Chmod(src, p, perm)
+				if err == ErrNotSupported {
+					err = src.Remove(p)
+				} else if err == nil && sameData {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			changes.Created = append(changes.Created, p)
+		}
+		return WriteFile(src, p, data, perm)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	err = walkTree(src, func(p string, info os.FileInfo) error {
+		if !seen[p] {
+			removed = append(removed, p)
+			if info.IsDir() {
+				return SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range removed {
+		if err := RemoveAll(src, v); err != nil {
+			return nil, err
+		}
+	}
+	changes.Removed = append(changes.Removed, removed...)
+	sort.Strings(changes.Removed)
+	return changes, nil
+}
+
+// Exec copies the files at root in fs to a temporary directory in the
+// local file system and runs cmd there. If cmd.Dir is not empty, it's
+// interpreted as a path relative to root. Once the command finishes
+// successfully, the files created, modified or removed by it are applied
+// back to fs and reported in the returned Changes. Files whose
+// permissions were changed are reported as modified. If the command
+// fails, fs is not modified. However, if applying the changes fails
+// part-way, the changes applied before the error are kept in fs. The
+// temporary files are always removed before returning.
+//
+// Note that symlinks in fs are copied as regular files, while symlinks
+// to directories are not copied at all.
+func Exec(fs VFS, root string, cmd *exec.Cmd) (*Changes, error) {
+	src, err := Chroot(root, fs)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := TmpFS("vfs-exec")
+	if err != nil {
+		return nil, err
+	}
+	defer removeTmp(tmp)
+	if err := materialize(tmp, src); err != nil {
+		return nil, err
+	}
+	cmd.Dir = localPath(tmp, cmd.Dir)
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	changes, err := applyChanges(src, tmp)
+	if err != nil {
+		return nil, err
+	}
+	root = path.Clean("/" + root)
+	for _, list := range [][]string{changes.Created, changes.Modified, changes.Removed} {
+		for ii, v := range list {
+			list[ii] = path.Join(root, v)
+		}
+	}
+	return changes, nil
+}
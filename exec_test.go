@@ -0,0 +1,107 @@
+package vfs
+
+import (
+	"os/exec"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestExec(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	fs := Memory()
+	files := map[string]string{
+		"/other/file":        "other",
+		"/src/a.txt":         "a",
+		"/src/b.txt":         "b",
+		"/src/sub/c.txt":     "c",
+		"/src/sub/old/d.txt": "d",
+	}
+	for k, v := range files {
+		if err := MkdirAll(fs, path.Dir(k), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteFile(fs, k, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command("sh", "-c", "printf A > ../a.txt && printf e > e.txt && rm -r old && mkdir new && printf f > new/f.txt")
+	cmd.Dir = "sub"
+	changes, err := Exec(fs, "/src", cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &Changes{
+		Created:  []string{"/src/sub/e.txt", "/src/sub/new", "/src/sub/new/f.txt"},
+		Modified: []string{"/src/a.txt"},
+		Removed:  []string{"/src/sub/old"},
+	}
+	if !reflect.DeepEqual(changes, exp) {
+		t.Errorf("expecting changes %+v, got %+v", exp, changes)
+	}
+	expected := map[string]string{
+		"/other/file":        "other",
+		"/src/a.txt":         "A",
+		"/src/b.txt":         "b",
+		"/src/sub/c.txt":     "c",
+		"/src/sub/e.txt":     "e",
+		"/src/sub/new/f.txt": "f",
+	}
+	for k, v := range expected {
+		if data, err := ReadFile(fs, k); err != nil || string(data) != v {
+			t.Errorf("expecting %s to contain %q, got %q (%v)", k, v, string(data), err)
+		}
+	}
+	if _, err := fs.Stat("/src/sub/old"); !IsNotExist(err) {
+		t.Errorf("expecting /src/sub/old to be removed, got %v", err)
+	}
+	// Failed commands don't modify the VFS
+	if _, err := Exec(fs, "/src", exec.Command("sh", "-c", "rm b.txt && exit 1")); err == nil {
+		t.Error("expecting an error from failed command")
+	}
+	if _, err := fs.Stat("/src/b.txt"); err != nil {
+		t.Errorf("b.txt should not be removed after a failed command, got %v", err)
+	}
+	changes, err = Exec(fs, "/src", exec.Command("true"))
+	if err != nil || !changes.Empty() {
+		t.Errorf("expecting no changes, got %+v, %v", changes, err)
+	}
+}
+
+func TestExecPerm(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	tmp, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmp.Close()
+	for _, fs := range []VFS{Memory(), tmp} {
+		if err := fs.Mkdir("/ro", 0555); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []string{"/run.sh", "/plain"} {
+			if err := WriteFile(fs, v, []byte("true"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cmd := exec.Command("sh", "-c", "ls -ld ro | grep -q '^dr-xr-xr-x' && chmod +x run.sh")
+		changes, err := Exec(fs, "/", cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := &Changes{Modified: []string{"/run.sh"}}
+		if !reflect.DeepEqual(changes, exp) {
+			t.Errorf("expecting changes %+v, got %+v", exp, changes)
+		}
+		if info, err := fs.Stat("/run.sh"); err != nil || info.Mode().Perm() != 0755 {
+			t.Errorf("expecting /run.sh to have mode 0755, got %v (%v)", info.Mode(), err)
+		}
+		if data, err := ReadFile(fs, "/run.sh"); err != nil || string(data) != "true" {
+			t.Errorf("expecting /run.sh to contain %q, got %q (%v)", "true", string(data), err)
+		}
+	}
+}
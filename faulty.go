@@ -0,0 +1,251 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	pathpkg "path"
+	"sync"
+	"time"
+)
+
+// FaultRule describes a fault injected by Faulty. A rule applies to the
+// calls matching its Op and Path. Among the matching calls, Nth and
+// Probability determine which ones trigger the fault. If both are
+// zero, the fault is triggered on every matching call.
+type FaultRule struct {
+	// Op is the operation the rule applies to. If empty, the rule
+	// applies to all the operations.
+	Op Op
+	// Path is a pattern, in the format used by path.Match, which
+	// the cleaned path (without the leading slash) must match. If
+	// empty, the rule applies to all the paths.
+	Path string
+	// Nth, if greater than zero, triggers the fault only on the
+	// nth matching call (starting at 1).
+	Nth int
+	// Probability, if greater than zero, is the probability of
+	// triggering the fault on each matching call.
+	Probability float64
+	// Latency is added before performing the operation.
+	Latency time.Duration
+	// Err is the error returned. For Read and Write, it's returned
+	// after performing the short read or write if Short is non-zero
+	// and without transferring any data otherwise. For Close, the
+	// file is closed before returning the error.
+	Err error
+	// Short limits the number of bytes transferred by Read or Write.
+	// Short writes return io.ErrShortWrite if Err is nil.
+	Short int
+	// Panic makes the operation panic rather than returning.
+	Panic bool
+}
+
+type faultRule struct {
+	FaultRule
+	calls int
+}
+
+func (r *faultRule) matches(op Op, path string) bool {
+	if r.Op != "" && r.Op != op {
+		return false
+	}
+	if r.Path != "" {
+		if ok, _ := pathpkg.Match(r.Path, cleanPath(path)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+type faultyFileSystem struct {
+	fs    VFS
+	mu    sync.Mutex
+	rand  *rand.Rand
+	rules []*faultRule
+}
+
+func (fs *faultyFileSystem) VFS() VFS {
+	return fs.fs
+}
+
+// fault returns the first rule triggered by the given call, after
+// applying its latency, or nil if no rules were triggered.
+func (fs *faultyFileSystem) fault(op Op, path string) *FaultRule {
+	var rule *FaultRule
+	fs.mu.Lock()
+	for _, v := range fs.rules {
+		if !v.matches(op, path) {
+			continue
+		}
+		v.calls++
+		triggered := true
+		if v.Nth > 0 {
+			triggered = v.calls == v.Nth
+		}
+		if triggered && v.Probability > 0 {
+			triggered = fs.rand.Float64() < v.Probability
+		}
+		if triggered && rule == nil {
+			rule = &v.FaultRule
+		}
+	}
+	fs.mu.Unlock()
+	if rule == nil {
+		return nil
+	}
+	if rule.Latency > 0 {
+		time.Sleep(rule.Latency)
+	}
+	if rule.Panic {
+		if rule.Err != nil {
+			panic(rule.Err)
+		}
+		panic(fmt.Errorf("injected panic in %s %s", op, path))
+	}
+	return rule
+}
+
+func (fs *faultyFileSystem) Open(path string) (RFile, error) {
+	if r := fs.fault(OpOpen, path); r != nil && r.Err != nil {
+		return nil, r.Err
+	}
+	f, err := fs.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{fs: fs, path: path, f: f}, nil
+}
+
+func (fs *faultyFileSystem) OpenFile(path string, flag int, perm os.FileMode) (WFile, error) {
+	if r := fs.fault(OpOpenFile, path); r != nil && r.Err != nil {
+		return nil, r.Err
+	}
+	f, err := fs.fs.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyWFile{faultyFile{fs: fs, path: path, f: f}, f}, nil
+}
+
+func (fs *faultyFileSystem) Lstat(path string) (os.FileInfo, error) {
+	if r := fs.fault(OpLstat, path); r != nil && r.Err != nil {
+		return nil, r.Err
+	}
+	return fs.fs.Lstat(path)
+}
+
+func (fs *faultyFileSystem) Stat(path string) (os.FileInfo, error) {
+	if r := fs.fault(OpStat, path); r != nil && r.Err != nil {
+		return nil, r.Err
+	}
+	return fs.fs.Stat(path)
+}
+
+func (fs *faultyFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	if r := fs.fault(OpReadDir, path); r != nil && r.Err != nil {
+		return nil, r.Err
+	}
+	return fs.fs.ReadDir(path)
+}
+
+func (fs *faultyFileSystem) Mkdir(path string, perm os.FileMode) error {
+	if r := fs.fault(OpMkdir, path); r != nil && r.Err != nil {
+		return r.Err
+	}
+	return fs.fs.Mkdir(path, perm)
+}
+
+func (fs *faultyFileSystem) Remove(path string) error {
+	if r := fs.fault(OpRemove, path); r != nil && r.Err != nil {
+		return r.Err
+	}
+	return fs.fs.Remove(path)
+}
+
+func (fs *faultyFileSystem) String() string {
+	return fmt.Sprintf("Faulty %s", fs.fs.String())
+}
+
+type faultyFile struct {
+	fs   *faultyFileSystem
+	path string
+	f    RFile
+}
+
+func (f *faultyFile) Read(p []byte) (int, error) {
+	r := f.fs.fault(OpRead, f.path)
+	if r == nil {
+		return f.f.Read(p)
+	}
+	if r.Short > 0 && r.Short < len(p) {
+		p = p[:r.Short]
+	} else if r.Err != nil {
+		return 0, r.Err
+	}
+	n, err := f.f.Read(p)
+	if err == nil && r.Err != nil {
+		err = r.Err
+	}
+	return n, err
+}
+
+func (f *faultyFile) Seek(offset int64, whence int) (int64, error) {
+	if r := f.fs.fault(OpSeek, f.path); r != nil && r.Err != nil {
+		return 0, r.Err
+	}
+	return f.f.Seek(offset, whence)
+}
+
+func (f *faultyFile) Close() error {
+	r := f.fs.fault(OpClose, f.path)
+	err := f.f.Close()
+	if r != nil && r.Err != nil {
+		return r.Err
+	}
+	return err
+}
+
+type faultyWFile struct {
+	faultyFile
+	w WFile
+}
+
+func (f *faultyWFile) Write(p []byte) (int, error) {
+	r := f.fs.fault(OpWrite, f.path)
+	if r == nil {
+		return f.w.Write(p)
+	}
+	if r.Short > 0 && r.Short < len(p) {
+		n, err := f.w.Write(p[:r.Short])
+		if err == nil {
+			err = r.Err
+			if err == nil {
+				err = io.ErrShortWrite
+			}
+		}
+		return n, err
+	}
+	if r.Err != nil {
+		return 0, r.Err
+	}
+	return f.w.Write(p)
+}
+
+// Faulty returns a VFS which injects faults into the operations performed
+// on fs and on the files returned by it, according to the given rules.
+// When several rules are triggered by the same call, only the first one
+// is applied. Random decisions are taken using a generator initialized
+// with the given seed, so failures are reproducible as long as the same
+// calls are performed in the same order.
+func Faulty(fs VFS, rules []FaultRule, seed int64) VFS {
+	ffs := &faultyFileSystem{
+		fs:   fs,
+		rand: rand.New(rand.NewSource(seed)),
+	}
+	for _, v := range rules {
+		ffs.rules = append(ffs.rules, &faultRule{FaultRule: v})
+	}
+	return ffs
+}
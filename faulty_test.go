@@ -0,0 +1,106 @@
+package vfs
+
+import (
+	"io"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFaultyNth(t *testing.T) {
+	fs := Faulty(Memory(), []FaultRule{
+		{Op: OpOpenFile, Path: "*.log", Nth: 2, Err: syscall.ENOSPC},
+	}, 1)
+	for ii := 0; ii < 3; ii++ {
+		err := WriteFile(fs, "a.log", []byte("A"), 0644)
+		if ii == 1 {
+			if err != syscall.ENOSPC {
+				t.Errorf("expecting ENOSPC on the second call, got %v", err)
+			}
+		} else if err != nil {
+			t.Errorf("call %d failed: %s", ii+1, err)
+		}
+	}
+	if err := WriteFile(fs, "a.txt", []byte("A"), 0644); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFaultyShort(t *testing.T) {
+	fs := Faulty(Memory(), []FaultRule{
+		{Op: OpWrite, Short: 2},
+		{Op: OpRead, Short: 1},
+		{Op: OpClose, Path: "b", Err: syscall.EIO},
+	}, 1)
+	if err := WriteFile(fs, "a", []byte("hello"), 0644); err != io.ErrShortWrite {
+		t.Errorf("expecting io.ErrShortWrite, got %v", err)
+	}
+	f, err := fs.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if n, err := f.Read(buf); n != 1 || err != nil {
+		t.Errorf("expecting short read of 1 byte, got %d (%v)", n, err)
+	}
+	f.Close()
+	data, err := ReadFile(fs, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "he" {
+		t.Errorf("expecting \"he\", got %q", string(data))
+	}
+	if err := WriteFile(fs, "b", nil, 0644); err != syscall.EIO {
+		t.Errorf("expecting EIO from Close, got %v", err)
+	}
+}
+
+func TestFaultyProbability(t *testing.T) {
+	run := func() []bool {
+		fs := Faulty(Memory(), []FaultRule{
+			{Op: OpMkdir, Probability: 0.5, Err: syscall.EIO},
+		}, 42)
+		var failed []bool
+		for ii := 0; ii < 64; ii++ {
+			err := fs.Mkdir("d", 0755)
+			failed = append(failed, err == syscall.EIO)
+			if err == nil {
+				fs.Remove("d")
+			}
+		}
+		return failed
+	}
+	first := run()
+	second := run()
+	count := 0
+	for ii := range first {
+		if first[ii] != second[ii] {
+			t.Fatalf("call %d differs between runs with the same seed", ii)
+		}
+		if first[ii] {
+			count++
+		}
+	}
+	if count == 0 || count == len(first) {
+		t.Errorf("expecting some calls to fail, %d of %d failed", count, len(first))
+	}
+}
+
+func TestFaultyLatencyAndPanic(t *testing.T) {
+	fs := Faulty(Memory(), []FaultRule{
+		{Op: OpStat, Latency: 10 * time.Millisecond},
+		{Op: OpRemove, Panic: true},
+	}, 1)
+	start := time.Now()
+	fs.Stat("/")
+	if d := time.Since(start); d < 10*time.Millisecond {
+		t.Errorf("expecting Stat to take at least 10ms, took %s", d)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expecting a panic")
+		}
+	}()
+	fs.Remove("a")
+}
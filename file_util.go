@@ -40,6 +40,8 @@ func closeFile(f *file) {
 }
 
 func fileData(f *File) ([]byte, error) {
+	f.RLock()
+	defer f.RUnlock()
 	if len(f.Data) == 0 || f.Mode&ModeCompress == 0 {
 		return f.Data, nil
 	}
@@ -0,0 +1,34 @@
+package vfs
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConcurrentReadWrite(t *testing.T) {
+	fs := Memory()
+	if err := WriteFile(fs, "/file", []byte("initial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for ii := 0; ii < 100; ii++ {
+			if err := WriteFile(fs, "/file", []byte("updated"), 0644); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for ii := 0; ii < 100; ii++ {
+			if _, err := ReadFile(fs, "/file"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,241 @@
+package vfs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FormatReader is the function type used for reading archives.
+// If the size of the data is not known, size will be <= 0.
+type FormatReader func(r io.Reader, size int64) (VFS, error)
+
+// FormatWriter is the function type used for writing archives.
+type FormatWriter func(w io.Writer, fs VFS) error
+
+// archiveReader is the function type used for reading the built-in
+// formats, which also accept an *ArchiveOptions.
+type archiveReader func(r io.Reader, size int64, opts *ArchiveOptions) (VFS, error)
+
+type format struct {
+	name       string
+	magic      string
+	extensions []string
+	reader     FormatReader
+	// archiveReader is only set for the built-in formats
+	archiveReader archiveReader
+	writer        FormatWriter
+}
+
+// read reads the archive in r. Since the readers registered with
+// RegisterFormat can't receive any options, it returns an error when
+// opts is not nil and f is not a built-in format.
+func (f *format) read(r io.Reader, size int64, opts *ArchiveOptions) (VFS, error) {
+	if opts == nil {
+		return f.reader(r, size)
+	}
+	if f.archiveReader == nil {
+		return nil, fmt.Errorf("format %s does not support ArchiveOptions", f.name)
+	}
+	return f.archiveReader(r, size, opts)
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   []*format
+)
+
+// RegisterFormat registers an archive format for use by Open, OpenReader
+// and Save. Name is the name of the format, like "zip" or "tar.gz". Magic
+// is the magic prefix that identifies the format's encoding and might
+// contain "?" wildcards, each one matching any byte. Extensions lists the
+// file extensions, including the leading dot, used by files in this format.
+// Either reader or writer might be nil if the format can't be read or
+// written. Formats registered later take precedence over the previous
+// ones when both match.
+func RegisterFormat(name string, magic string, extensions []string, reader FormatReader, writer FormatWriter) {
+	exts := make([]string, len(extensions))
+	for ii, v := range extensions {
+		exts[ii] = strings.ToLower(v)
+	}
+	formatsMu.Lock()
+	formats = append(formats, &format{
+		name:       name,
+		magic:      magic,
+		extensions: exts,
+		reader:     reader,
+		writer:     writer,
+	})
+	formatsMu.Unlock()
+}
+
+// registerArchiveFormat registers a built-in format, whose reader
+// accepts an *ArchiveOptions.
+func registerArchiveFormat(name string, magic string, extensions []string, reader archiveReader, writer FormatWriter) {
+	RegisterFormat(name, magic, extensions, func(r io.Reader, size int64) (VFS, error) {
+		return reader(r, size, nil)
+	}, writer)
+	formatsMu.Lock()
+	formats[len(formats)-1].archiveReader = reader
+	formatsMu.Unlock()
+}
+
+func init() {
+	registerArchiveFormat("zip", "PK\x03\x04", []string{".zip", ".jar", ".whl"}, ReadZip, WriteZip)
+	registerArchiveFormat("tar", strings.Repeat("?", 257)+"ustar", []string{".tar"}, func(r io.Reader, _ int64, opts *ArchiveOptions) (VFS, error) {
+		return ReadTar(r, opts)
+	}, WriteTar)
+	registerArchiveFormat("tar.gz", "\x1f\x8b", []string{".tar.gz", ".tgz"}, func(r io.Reader, _ int64, opts *ArchiveOptions) (VFS, error) {
+		return ReadTarGzip(r, opts)
+	}, WriteTarGzip)
+	registerArchiveFormat("tar.bz2", "BZh", []string{".tar.bz2", ".tbz2", ".tbz"}, func(r io.Reader, _ int64, opts *ArchiveOptions) (VFS, error) {
+		return ReadTarBzip2(r, opts)
+	}, nil)
+	registerArchiveFormat("tar.xz", "\xfd7zXZ\x00", []string{".tar.xz", ".txz"}, func(r io.Reader, _ int64, opts *ArchiveOptions) (VFS, error) {
+		return ReadTarXz(r, opts)
+	}, WriteTarXz)
+	registerArchiveFormat("tar.zst", "\x28\xb5\x2f\xfd", []string{".tar.zst", ".tar.zstd", ".tzst"}, func(r io.Reader, _ int64, opts *ArchiveOptions) (VFS, error) {
+		return ReadTarZstd(r, opts)
+	}, WriteTarZstd)
+}
+
+// formatByExtension returns the format with the longest extension
+// matching the given filename, or nil if there's none.
+func formatByExtension(filename string) *format {
+	name := strings.ToLower(filepath.Base(filename))
+	var found *format
+	var foundLen int
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	for ii := len(formats) - 1; ii >= 0; ii-- {
+		for _, ext := range formats[ii].extensions {
+			if len(ext) > foundLen && strings.HasSuffix(name, ext) {
+				found = formats[ii]
+				foundLen = len(ext)
+			}
+		}
+	}
+	return found
+}
+
+func matchMagic(magic string, data []byte) bool {
+	if len(magic) > len(data) {
+		return false
+	}
+	for ii := 0; ii < len(magic); ii++ {
+		if magic[ii] != '?' && magic[ii] != data[ii] {
+			return false
+		}
+	}
+	return true
+}
+
+// maxMagicLen returns the length of the longest magic prefix.
+func maxMagicLen() int {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	n := 0
+	for _, v := range formats {
+		if len(v.magic) > n {
+			n = len(v.magic)
+		}
+	}
+	return n
+}
+
+// formatByMagic returns the readable format matching the given
+// data, or nil if there's none.
+func formatByMagic(data []byte) *format {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	for ii := len(formats) - 1; ii >= 0; ii-- {
+		if f := formats[ii]; f.reader != nil && f.magic != "" && matchMagic(f.magic, data) {
+			return f
+		}
+	}
+	return nil
+}
+
+// OpenReader returns an in-memory VFS initialized with the contents of the
+// archive read from r, whose format is detected from its first bytes. See
+// RegisterFormat for adding support for additional formats.
+func OpenReader(r io.Reader) (VFS, error) {
+	return OpenReaderWithOptions(r, nil)
+}
+
+// OpenReaderWithOptions works like OpenReader, but accepts an
+// *ArchiveOptions. Only the built-in formats support options, so
+// if opts is not nil, reading other formats returns an error.
+func OpenReaderWithOptions(r io.Reader, opts *ArchiveOptions) (VFS, error) {
+	br := bufio.NewReaderSize(r, maxMagicLen())
+	// Peek returns an error if there's less data, but
+	// we might still get a match.
+	data, _ := br.Peek(maxMagicLen())
+	f := formatByMagic(data)
+	if f == nil {
+		return nil, fmt.Errorf("can't open a VFS from an unknown format")
+	}
+	return f.read(br, 0, opts)
+}
+
+// Open returns an in-memory VFS initialized with the contents of the given
+// filename. Its format is determined from the file extension or, if there's
+// no registered format for it, from the file contents. The following formats
+// are supported by default, but others can be added with RegisterFormat:
+//
+//   - zip (.zip, .jar, .whl)
+//   - tar (.tar)
+//   - tar.gz (.tar.gz, .tgz)
+//   - tar.bz2 (.tar.bz2, .tbz2, .tbz)
+//   - tar.xz (.tar.xz, .txz)
+//   - tar.zst (.tar.zst, .tar.zstd, .tzst)
+func Open(filename string) (VFS, error) {
+	return OpenWithOptions(filename, nil)
+}
+
+// OpenWithOptions works like Open, but accepts an *ArchiveOptions.
+// Like OpenReaderWithOptions, it returns an error if opts is not nil
+// and the file is not in one of the built-in formats.
+func OpenWithOptions(filename string, opts *ArchiveOptions) (VFS, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	format := formatByExtension(filename)
+	if format == nil || format.reader == nil {
+		data := make([]byte, maxMagicLen())
+		n, _ := f.ReadAt(data, 0)
+		if format = formatByMagic(data[:n]); format == nil {
+			return nil, fmt.Errorf("can't open a VFS from a %s file", filepath.Base(filename))
+		}
+	}
+	return format.read(f, st.Size(), opts)
+}
+
+// Save writes the given VFS to filename, using the archive format
+// determined by its extension. The file is truncated if it
+// already exists. See Open for the supported formats.
+func Save(filename string, fs VFS) error {
+	format := formatByExtension(filename)
+	if format == nil || format.writer == nil {
+		return fmt.Errorf("can't write a VFS to a %s file", filepath.Base(filename))
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := format.writer(f, fs); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,21 @@
+module github.com/rainycape/vfs
+
+go 1.26.0
+
+require (
+	github.com/go-git/go-billy/v5 v5.9.2
+	github.com/klauspost/compress v1.20.1
+	github.com/pkg/sftp v1.13.11
+	github.com/spf13/afero v1.15.0
+	github.com/ulikunitz/xz v0.5.17
+	go.etcd.io/bbolt v1.5.0
+	golang.org/x/mod v0.41.0
+	golang.org/x/net v0.60.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/crypto v0.57.0 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
+)
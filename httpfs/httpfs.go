@@ -0,0 +1,435 @@
+// Package httpfs allows serving a VFS over HTTP.
+package httpfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rainycape/vfs"
+)
+
+const (
+	defaultIndex     = "index.html"
+	defaultCacheSize = 1024
+	sniffLen         = 512
+)
+
+// Options specifies the options for Handler.
+type Options struct {
+	// Listings enables directory listings for directories
+	// without an index file.
+	Listings bool
+	// Index is the name of the file served for requests to a
+	// directory. If empty, index.html is used.
+	Index string
+	// CacheSize is the maximum number of files whose ETags and
+	// checksums are kept in memory. When it's exceeded, the least
+	// recently served files are evicted. If zero, 1024 is used.
+	CacheSize int
+}
+
+// content holds the information about a file which is expensive
+// to compute, so it can be reused as long as the file doesn't change.
+type content struct {
+	path    string
+	size    int64
+	modTime time.Time
+	etag    string
+	// crc and length of the uncompressed data, used for serving
+	// files with vfs.ModeCompress as gzip.
+	crc    uint32
+	length int64
+}
+
+type handler struct {
+	fs        vfs.VFS
+	listings  bool
+	index     string
+	cacheSize int
+	mu        sync.Mutex
+	lru       *list.List
+	contents  map[string]*list.Element
+}
+
+// cachedContent returns the cached content for p if it's still
+// valid for the file described by info, or nil otherwise.
+func (h *handler) cachedContent(p string, info os.FileInfo) *content {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	el := h.contents[p]
+	if el == nil {
+		return nil
+	}
+	c := el.Value.(*content)
+	if c.size != info.Size() || !c.modTime.Equal(info.ModTime()) {
+		h.lru.Remove(el)
+		delete(h.contents, p)
+		return nil
+	}
+	h.lru.MoveToFront(el)
+	return c
+}
+
+func (h *handler) content(p string, info os.FileInfo) (*content, error) {
+	if c := h.cachedContent(p, info); c != nil {
+		return c, nil
+	}
+	f, err := h.fs.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sha := sha256.New()
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(sha, crc), f)
+	if err != nil {
+		return nil, err
+	}
+	c := &content{
+		path:    p,
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		etag:    hex.EncodeToString(sha.Sum(nil)),
+		crc:     crc.Sum32(),
+		length:  n,
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if el := h.contents[p]; el != nil {
+		h.lru.Remove(el)
+	}
+	h.contents[p] = h.lru.PushFront(c)
+	for h.lru.Len() > h.cacheSize {
+		el := h.lru.Back()
+		h.lru.Remove(el)
+		delete(h.contents, el.Value.(*content).path)
+	}
+	return c, nil
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc := strings.TrimSpace(v)
+		if p := strings.IndexByte(enc, ';'); p >= 0 {
+			if strings.TrimSpace(enc[p+1:]) == "q=0" {
+				continue
+			}
+			enc = strings.TrimSpace(enc[:p])
+		}
+		if enc == "gzip" || enc == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// compressedFile returns the data stored in a *vfs.File with
+// vfs.ModeCompress, or nil if info does not represent such a file.
+func compressedFile(info os.FileInfo) []byte {
+	if info.Mode()&vfs.ModeCompress == 0 {
+		return nil
+	}
+	f, ok := info.Sys().(*vfs.File)
+	if !ok {
+		return nil
+	}
+	f.RLock()
+	defer f.RUnlock()
+	if f.Mode&vfs.ModeCompress == 0 {
+		return nil
+	}
+	return f.Data
+}
+
+// zlibToGzip converts zlib compressed data to gzip, reusing the
+// deflate stream. The crc and the length of the uncompressed data
+// are required for the gzip trailer.
+func zlibToGzip(data []byte, crc uint32, length int64) []byte {
+	// 2 bytes header, 4 bytes adler32 checksum. Don't handle
+	// preset dictionaries, vfs never uses them.
+	if len(data) < 6 || data[1]&0x20 != 0 {
+		return nil
+	}
+	deflate := data[2 : len(data)-4]
+	out := make([]byte, 0, len(deflate)+18)
+	out = append(out, 0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255)
+	out = append(out, deflate...)
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], crc)
+	binary.LittleEndian.PutUint32(trailer[4:], uint32(length))
+	return append(out, trailer[:]...)
+}
+
+func (h *handler) contentType(p string, r io.Reader) string {
+	if ctype := mime.TypeByExtension(path.Ext(p)); ctype != "" {
+		return ctype
+	}
+	var buf [sniffLen]byte
+	n, _ := io.ReadFull(r, buf[:])
+	return http.DetectContentType(buf[:n])
+}
+
+func (h *handler) serveGzip(w http.ResponseWriter, r *http.Request, p string, info os.FileInfo) bool {
+	gzPath := p + ".gz"
+	if gzInfo, err := h.fs.Stat(gzPath); err == nil && gzInfo.Mode().IsRegular() {
+		c, err := h.content(gzPath, gzInfo)
+		if err != nil {
+			return false
+		}
+		f, err := h.fs.Open(gzPath)
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+		ctype := mime.TypeByExtension(path.Ext(p))
+		if ctype == "" {
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				return false
+			}
+			ctype = h.contentType(p, zr)
+			if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+				return false
+			}
+		}
+		hdr := w.Header()
+		hdr.Set("Content-Type", ctype)
+		hdr.Set("Content-Encoding", "gzip")
+		hdr.Set("Etag", `"`+c.etag+`"`)
+		http.ServeContent(w, r, p, info.ModTime(), f)
+		return true
+	}
+	if data := compressedFile(info); data != nil {
+		c, err := h.content(p, info)
+		if err != nil {
+			return false
+		}
+		gz := zlibToGzip(data, c.crc, c.length)
+		if gz == nil {
+			return false
+		}
+		f, err := h.fs.Open(p)
+		if err != nil {
+			return false
+		}
+		ctype := h.contentType(p, f)
+		f.Close()
+		hdr := w.Header()
+		hdr.Set("Content-Type", ctype)
+		hdr.Set("Content-Encoding", "gzip")
+		hdr.Set("Etag", `"`+c.etag+`-gzip"`)
+		http.ServeContent(w, r, p, info.ModTime(), bytes.NewReader(gz))
+		return true
+	}
+	return false
+}
+
+func (h *handler) serveFile(w http.ResponseWriter, r *http.Request, p string, info os.FileInfo) {
+	if _, err := h.fs.Stat(p + ".gz"); err == nil || compressedFile(info) != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if acceptsGzip(r) && h.serveGzip(w, r, p, info) {
+		return
+	}
+	c, err := h.content(p, info)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	f, err := h.fs.Open(p)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Etag", `"`+c.etag+`"`)
+	http.ServeContent(w, r, p, info.ModTime(), f)
+}
+
+func (h *handler) serveListing(w http.ResponseWriter, r *http.Request, p string) {
+	infos, err := h.fs.ReadDir(p)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString("<pre>\n")
+	for _, v := range infos {
+		name := v.Name()
+		if v.IsDir() {
+			name += "/"
+		}
+		u := url.URL{Path: name}
+		fmt.Fprintf(&buf, "<a href=\"%s\">%s</a>\n", u.String(), html.EscapeString(name))
+	}
+	buf.WriteString("</pre>\n")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method != "HEAD" {
+		w.Write(buf.Bytes())
+	}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := path.Clean("/" + r.URL.Path)
+	info, err := h.fs.Stat(p)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			u := *r.URL
+			u.Path = path.Base(r.URL.Path) + "/"
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
+		index := path.Join(p, h.index)
+		if indexInfo, err := h.fs.Stat(index); err == nil && indexInfo.Mode().IsRegular() {
+			h.serveFile(w, r, index, indexInfo)
+			return
+		}
+		if !h.listings {
+			http.Error(w, "403 forbidden", http.StatusForbidden)
+			return
+		}
+		h.serveListing(w, r, p)
+		return
+	}
+	h.serveFile(w, r, p, info)
+}
+
+func serveError(w http.ResponseWriter, err error) {
+	if vfs.IsNotExist(err) {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, "500 internal server error", http.StatusInternalServerError)
+}
+
+// Handler returns an http.Handler which serves the files in the given
+// VFS. It supports range requests and conditional requests, using
+// strong ETags derived from the SHA-256 hash of the contents. The
+// Content-Type is determined from the file extension or, if that's
+// not possible, by sniffing the file contents. When the client accepts
+// gzip encoding and there's a sibling file with the .gz extension, its
+// contents are served instead. Files compressed with vfs.ModeCompress
+// are served without decompressing them, also with gzip encoding.
+// The opts argument might be nil.
+func Handler(fs vfs.VFS, opts *Options) http.Handler {
+	h := &handler{
+		fs:        fs,
+		index:     defaultIndex,
+		cacheSize: defaultCacheSize,
+		lru:       list.New(),
+		contents:  make(map[string]*list.Element),
+	}
+	if opts != nil {
+		h.listings = opts.Listings
+		if opts.Index != "" {
+			h.index = opts.Index
+		}
+		if opts.CacheSize > 0 {
+			h.cacheSize = opts.CacheSize
+		}
+	}
+	return h
+}
+
+type httpFile struct {
+	vfs.RFile
+	fs   vfs.VFS
+	name string
+	dir  []os.FileInfo
+}
+
+func (f *httpFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.dir == nil {
+		infos, err := f.fs.ReadDir(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.dir = infos
+	}
+	if count <= 0 {
+		infos := f.dir
+		f.dir = f.dir[len(f.dir):]
+		return infos, nil
+	}
+	if len(f.dir) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.dir) {
+		count = len(f.dir)
+	}
+	infos := f.dir[:count]
+	f.dir = f.dir[count:]
+	return infos, nil
+}
+
+func (f *httpFile) Stat() (os.FileInfo, error) {
+	return f.fs.Stat(f.name)
+}
+
+type dirFile struct {
+	*bytes.Reader
+}
+
+func (d dirFile) Close() error {
+	return nil
+}
+
+type httpFileSystem struct {
+	fs vfs.VFS
+}
+
+func (fs *httpFileSystem) Open(name string) (http.File, error) {
+	info, err := fs.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	var f vfs.RFile
+	if !info.IsDir() {
+		if f, err = fs.fs.Open(name); err != nil {
+			return nil, err
+		}
+	}
+	return NewFile(fs.fs, name, f), nil
+}
+
+// NewFile returns an http.File for the file or directory with the given
+// name in fs. For files, f must have been opened from fs and it's used
+// for reading, seeking and closing. For directories, f must be nil and
+// Readdir lists the directory contents.
+func NewFile(fs vfs.VFS, name string, f vfs.RFile) http.File {
+	if f == nil {
+		f = dirFile{bytes.NewReader(nil)}
+	}
+	return &httpFile{RFile: f, fs: fs, name: name}
+}
+
+// FileSystem returns an http.FileSystem which uses the given VFS, so
+// it can be used with http.FileServer.
+func FileSystem(fs vfs.VFS) http.FileSystem {
+	return &httpFileSystem{fs: fs}
+}
@@ -0,0 +1,209 @@
+package httpfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rainycape/vfs"
+)
+
+var (
+	testContents = strings.Repeat("hello world\n", 100)
+	testHTML     = "<html><body>" + strings.Repeat("hi ", 100) + "</body></html>"
+)
+
+func newTestServer(t *testing.T, opts *Options) (*httptest.Server, vfs.VFS) {
+	fs := vfs.Memory()
+	if err := vfs.MkdirAll(fs, "dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(fs, "a.txt", []byte(testContents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(fs, "dir/noext", []byte(testHTML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(Handler(fs, opts))
+	t.Cleanup(srv.Close)
+	return srv, fs
+}
+
+func get(t *testing.T, url string, headers map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Disable transparent decompression
+	req.Header.Set("Accept-Encoding", "identity")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+func TestServe(t *testing.T) {
+	srv, _ := newTestServer(t, nil)
+	resp, data := get(t, srv.URL+"/a.txt", nil)
+	if resp.StatusCode != http.StatusOK || string(data) != testContents {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, string(data))
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expecting text/plain, got %q", ct)
+	}
+	etag := resp.Header.Get("Etag")
+	lastMod := resp.Header.Get("Last-Modified")
+	if !strings.HasPrefix(etag, `"`) || len(etag) != 66 {
+		t.Errorf("expecting a strong ETag, got %q", etag)
+	}
+	resp, _ = get(t, srv.URL+"/a.txt", map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expecting 304 with If-None-Match, got %d", resp.StatusCode)
+	}
+	resp, _ = get(t, srv.URL+"/a.txt", map[string]string{"If-Modified-Since": lastMod})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expecting 304 with If-Modified-Since, got %d", resp.StatusCode)
+	}
+	resp, data = get(t, srv.URL+"/a.txt", map[string]string{"Range": "bytes=6-10"})
+	if resp.StatusCode != http.StatusPartialContent || string(data) != "world" {
+		t.Errorf("unexpected range response %d %q", resp.StatusCode, string(data))
+	}
+	resp, _ = get(t, srv.URL+"/dir/noext", nil)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("expecting sniffed text/html, got %q", ct)
+	}
+	resp, _ = get(t, srv.URL+"/missing", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expecting 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestListings(t *testing.T) {
+	srv, fs := newTestServer(t, nil)
+	resp, _ := get(t, srv.URL+"/dir/", nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expecting 403 without listings, got %d", resp.StatusCode)
+	}
+	srv, fs = newTestServer(t, &Options{Listings: true})
+	resp, _ = get(t, srv.URL+"/dir", nil)
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/dir/" {
+		t.Errorf("expecting redirect to /dir/, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	resp, data := get(t, srv.URL+"/dir/", nil)
+	if !strings.Contains(string(data), `<a href="sub/">sub/</a>`) || !strings.Contains(string(data), `<a href="noext">noext</a>`) {
+		t.Errorf("unexpected listing %q", string(data))
+	}
+	if err := vfs.WriteFile(fs, "dir/index.html", []byte("index"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resp, data = get(t, srv.URL+"/dir/", nil)
+	if string(data) != "index" {
+		t.Errorf("expecting index.html, got %q", string(data))
+	}
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plain)
+}
+
+func TestGzip(t *testing.T) {
+	srv, fs := newTestServer(t, nil)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(testContents))
+	zw.Close()
+	if err := vfs.WriteFile(fs, "a.txt.gz", buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gzipHeaders := map[string]string{"Accept-Encoding": "gzip, deflate"}
+	resp, data := get(t, srv.URL+"/a.txt", gzipHeaders)
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("expecting gzip encoding")
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expecting text/plain, got %q", ct)
+	}
+	if gunzip(t, data) != testContents {
+		t.Error("unexpected contents from .gz sibling")
+	}
+	resp, data = get(t, srv.URL+"/a.txt", nil)
+	if resp.Header.Get("Content-Encoding") != "" || string(data) != testContents {
+		t.Error("expecting uncompressed contents without Accept-Encoding")
+	}
+	if err := vfs.Compress(fs); err != nil {
+		t.Fatal(err)
+	}
+	resp, data = get(t, srv.URL+"/dir/noext", gzipHeaders)
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("expecting gzip encoding for compressed file")
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("expecting text/html, got %q", ct)
+	}
+	if gunzip(t, data) != testHTML {
+		t.Error("unexpected contents from compressed file")
+	}
+}
+
+func TestFileSystem(t *testing.T) {
+	_, fs := newTestServer(t, nil)
+	srv := httptest.NewServer(http.FileServer(FileSystem(fs)))
+	defer srv.Close()
+	_, data := get(t, srv.URL+"/a.txt", nil)
+	if string(data) != testContents {
+		t.Error("unexpected contents from http.FileServer")
+	}
+	_, data = get(t, srv.URL+"/dir/", nil)
+	if !strings.Contains(string(data), "noext") {
+		t.Errorf("unexpected listing from http.FileServer %q", string(data))
+	}
+}
+
+func TestContentCacheSize(t *testing.T) {
+	fs := vfs.Memory()
+	for _, v := range []string{"a", "b", "c"} {
+		if err := vfs.WriteFile(fs, v, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := Handler(fs, &Options{CacheSize: 2}).(*handler)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	for _, v := range []string{"a", "b", "a", "c"} {
+		if resp, _ := get(t, srv.URL+"/"+v, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %d for %s", resp.StatusCode, v)
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.contents) != 2 || h.lru.Len() != 2 {
+		t.Fatalf("expecting 2 cached contents, got %d", len(h.contents))
+	}
+	// b is the least recently served file
+	for _, v := range []string{"/a", "/c"} {
+		if h.contents[v] == nil {
+			t.Errorf("expecting %s to be cached", v)
+		}
+	}
+}
@@ -0,0 +1,584 @@
+package httpfs
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rainycape/vfs"
+)
+
+const (
+	// ManifestName is the name of the file, at the root of a tree
+	// served over HTTP, which describes the files in the tree. See
+	// WriteManifest and Remote.
+	ManifestName = ".vfs-manifest.json"
+
+	defaultBlockSize   = 64 * 1024
+	defaultCacheBlocks = 64
+	defaultRetries     = 3
+	defaultRetryDelay  = 100 * time.Millisecond
+)
+
+var (
+	// ErrRangeNotSupported is returned when the HTTP server does not
+	// support range requests.
+	ErrRangeNotSupported = errors.New("server does not support range requests")
+	// ErrRemoteChanged is returned when the remote file changes while
+	// it's being read.
+	ErrRemoteChanged = errors.New("remote file changed")
+)
+
+// RemoteOptions specifies the options for reading remote files.
+type RemoteOptions struct {
+	// Client is the HTTP client used to make the requests. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+	// BlockSize is the size of the blocks requested from the server.
+	// If zero, 64KiB blocks are used.
+	BlockSize int
+	// CacheBlocks is the number of blocks kept in memory for each
+	// RangeReader or, for Remote, shared by all the files in the
+	// VFS. If zero, 64 blocks are cached.
+	CacheBlocks int
+	// Retries is the number of times a failed request is retried.
+	// Only network errors and 5xx responses are retried. If zero,
+	// requests are retried 3 times. Use a negative value to
+	// disable retries.
+	Retries int
+	// RetryDelay is the time to wait before the first retry, which
+	// is doubled for every subsequent retry. If zero, 100ms is used.
+	RetryDelay time.Duration
+}
+
+func (o *RemoteOptions) withDefaults() RemoteOptions {
+	var opts RemoteOptions
+	if o != nil {
+		opts = *o
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = defaultBlockSize
+	}
+	if opts.CacheBlocks <= 0 {
+		opts.CacheBlocks = defaultCacheBlocks
+	}
+	if opts.Retries == 0 {
+		opts.Retries = defaultRetries
+	} else if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = defaultRetryDelay
+	}
+	return opts
+}
+
+type statusError struct {
+	url    string
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("GET %s: unexpected status %d", e.url, e.status)
+}
+
+// remoteGet performs a GET request with the given headers, retrying it
+// if needed. The caller must close the response body.
+func remoteGet(opts *RemoteOptions, u string, headers map[string]string) (*http.Response, error) {
+	delay := opts.RetryDelay
+	var err error
+	for ii := 0; ii <= opts.Retries; ii++ {
+		if ii > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var req *http.Request
+		req, err = http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		var resp *http.Response
+		resp, err = opts.Client.Do(req)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			err = &statusError{url: u, status: resp.StatusCode}
+			continue
+		}
+		return resp, nil
+	}
+	return nil, err
+}
+
+// RangeReader implements io.ReaderAt on top of a file served over
+// HTTP, using range requests. Data is requested in blocks, which
+// are cached in memory.
+type RangeReader struct {
+	url   string
+	opts  RemoteOptions
+	size  int64
+	etag  string
+	cache *blockCache
+}
+
+type blockKey struct {
+	url   string
+	index int64
+}
+
+type rangeBlock struct {
+	key  blockKey
+	data []byte
+}
+
+// blockCache is an LRU cache of blocks, which might be shared
+// by several RangeReaders.
+type blockCache struct {
+	size   int
+	mu     sync.Mutex
+	lru    *list.List
+	blocks map[blockKey]*list.Element
+}
+
+func newBlockCache(size int) *blockCache {
+	return &blockCache{
+		size:   size,
+		lru:    list.New(),
+		blocks: make(map[blockKey]*list.Element),
+	}
+}
+
+func (c *blockCache) get(key blockKey) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el := c.blocks[key]; el != nil {
+		c.lru.MoveToFront(el)
+		return el.Value.(*rangeBlock).data
+	}
+	return nil
+}
+
+func (c *blockCache) add(key blockKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.blocks[key] != nil {
+		return
+	}
+	c.blocks[key] = c.lru.PushFront(&rangeBlock{key: key, data: data})
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.blocks, el.Value.(*rangeBlock).key)
+	}
+}
+
+func parseContentRange(s string) (int64, int64, error) {
+	// bytes start-end/size or bytes */size
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	s = s[len("bytes "):]
+	p := strings.IndexByte(s, '/')
+	if p < 0 {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	size, err := strconv.ParseInt(s[p+1:], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range size in %q", s)
+	}
+	if s[:p] == "*" {
+		return -1, size, nil
+	}
+	q := strings.IndexByte(s[:p], '-')
+	if q < 0 {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	start, err := strconv.ParseInt(s[:q], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range start in %q", s)
+	}
+	return start, size, nil
+}
+
+func newRangeReader(u string, size int64, etag string, opts RemoteOptions, cache *blockCache) *RangeReader {
+	return &RangeReader{
+		url:   u,
+		opts:  opts,
+		size:  size,
+		etag:  etag,
+		cache: cache,
+	}
+}
+
+// NewRangeReader returns a RangeReader for the file at the given URL,
+// performing a request to determine its size and to check that the
+// server supports range requests. The opts argument might be nil.
+func NewRangeReader(u string, opts *RemoteOptions) (*RangeReader, error) {
+	o := opts.withDefaults()
+	resp, err := remoteGet(&o, u, map[string]string{"Range": "bytes=0-0"})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+	case http.StatusOK:
+		return nil, ErrRangeNotSupported
+	default:
+		return nil, &statusError{url: u, status: resp.StatusCode}
+	}
+	_, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+	etag := resp.Header.Get("Etag")
+	if strings.HasPrefix(etag, "W/") {
+		// Weak ETags can't be used with If-Range
+		etag = ""
+	}
+	return newRangeReader(u, size, etag, o, newBlockCache(o.CacheBlocks)), nil
+}
+
+// Size returns the size of the remote file.
+func (r *RangeReader) Size() int64 {
+	return r.size
+}
+
+func (r *RangeReader) fetch(index int64) ([]byte, error) {
+	start := index * int64(r.opts.BlockSize)
+	end := start + int64(r.opts.BlockSize)
+	if end > r.size {
+		end = r.size
+	}
+	headers := map[string]string{
+		"Range": fmt.Sprintf("bytes=%d-%d", start, end-1),
+	}
+	if r.etag != "" {
+		headers["If-Range"] = r.etag
+	}
+	resp, err := remoteGet(&r.opts, r.url, headers)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if r.etag != "" {
+			return nil, ErrRemoteChanged
+		}
+		return nil, ErrRangeNotSupported
+	default:
+		return nil, &statusError{url: r.url, status: resp.StatusCode}
+	}
+	rstart, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+	if rstart != start || size != r.size {
+		return nil, ErrRemoteChanged
+	}
+	data := make([]byte, end-start)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (r *RangeReader) block(index int64) ([]byte, error) {
+	key := blockKey{url: r.url, index: index}
+	if data := r.cache.get(key); data != nil {
+		return data, nil
+	}
+	data, err := r.fetch(index)
+	if err != nil {
+		return nil, err
+	}
+	r.cache.add(key, data)
+	return data, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *RangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("ReadAt: negative offset %d", off)
+	}
+	n := 0
+	bs := int64(r.opts.BlockSize)
+	for n < len(p) && off < r.size {
+		index := off / bs
+		data, err := r.block(index)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], data[off-index*bs:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// OpenZip returns a read-only VFS with the contents of the .zip file
+// at the given URL. Only the parts of the file which are needed are
+// requested from the server. See vfs.LazyZip for more details. The
+// opts argument might be nil.
+func OpenZip(u string, opts *RemoteOptions) (vfs.VFS, error) {
+	r, err := NewRangeReader(u, opts)
+	if err != nil {
+		return nil, err
+	}
+	return vfs.LazyZip(r, r.Size())
+}
+
+// ManifestEntry represents a file or a directory in a Manifest.
+type ManifestEntry struct {
+	// Path is the slash separated path of the entry, relative
+	// to the manifest.
+	Path    string      `json:"path"`
+	Size    int64       `json:"size,omitempty"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+}
+
+// Manifest describes the files in a tree served over HTTP, so it
+// can be used as a VFS by Remote.
+type Manifest struct {
+	Entries []*ManifestEntry `json:"entries"`
+}
+
+// WriteManifest writes a manifest describing the files in fs, as JSON, to
+// the given io.Writer. The manifest should be served as ManifestName at the
+// root of the tree. Symlinks are followed, so they are seen as regular files
+// or directories by Remote.
+func WriteManifest(w io.Writer, fs vfs.VFS) error {
+	var m Manifest
+	err := vfs.Walk(fs, "/", func(fs vfs.VFS, p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		p = strings.TrimPrefix(p, "/")
+		if p == "" || p == ManifestName {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = fs.Stat(p); err != nil {
+				return err
+			}
+		}
+		entry := &ManifestEntry{
+			Path:    p,
+			Mode:    info.Mode() &^ vfs.ModeCompress,
+			ModTime: info.ModTime(),
+		}
+		if !info.IsDir() {
+			entry.Size = info.Size()
+		}
+		m.Entries = append(m.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(&m)
+}
+
+type remoteInfo struct {
+	entry *ManifestEntry
+}
+
+func (info *remoteInfo) Name() string {
+	return path.Base("/" + info.entry.Path)
+}
+
+func (info *remoteInfo) Size() int64 {
+	return info.entry.Size
+}
+
+func (info *remoteInfo) Mode() os.FileMode {
+	return info.entry.Mode
+}
+
+func (info *remoteInfo) ModTime() time.Time {
+	return info.entry.ModTime
+}
+
+func (info *remoteInfo) IsDir() bool {
+	return info.entry.Mode.IsDir()
+}
+
+// Sys returns the *ManifestEntry.
+func (info *remoteInfo) Sys() interface{} {
+	return info.entry
+}
+
+type remoteFileSystem struct {
+	base    *url.URL
+	opts    RemoteOptions
+	entries map[string]*remoteInfo
+	dirs    map[string][]os.FileInfo
+	// cache is shared by all the files, so blocks are
+	// reused when a file is opened again.
+	cache *blockCache
+}
+
+func cleanPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+func (fs *remoteFileSystem) entry(p string) (*remoteInfo, error) {
+	info := fs.entries[cleanPath(p)]
+	if info == nil {
+		return nil, os.ErrNotExist
+	}
+	return info, nil
+}
+
+func (fs *remoteFileSystem) Open(p string) (vfs.RFile, error) {
+	info, err := fs.entry(p)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is not a file", p)
+	}
+	u := fs.base.JoinPath(info.entry.Path).String()
+	r := newRangeReader(u, info.entry.Size, "", fs.opts, fs.cache)
+	return &remoteFile{io.NewSectionReader(r, 0, info.entry.Size)}, nil
+}
+
+func (fs *remoteFileSystem) OpenFile(p string, flag int, perm os.FileMode) (vfs.WFile, error) {
+	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0 {
+		return nil, vfs.ErrReadOnlyFileSystem
+	}
+	f, err := fs.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*remoteFile), nil
+}
+
+func (fs *remoteFileSystem) Lstat(p string) (os.FileInfo, error) {
+	return fs.Stat(p)
+}
+
+func (fs *remoteFileSystem) Stat(p string) (os.FileInfo, error) {
+	info, err := fs.entry(p)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (fs *remoteFileSystem) ReadDir(p string) ([]os.FileInfo, error) {
+	info, err := fs.entry(p)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", p)
+	}
+	infos := fs.dirs[cleanPath(p)]
+	res := make([]os.FileInfo, len(infos))
+	copy(res, infos)
+	return res, nil
+}
+
+func (fs *remoteFileSystem) Mkdir(p string, perm os.FileMode) error {
+	return vfs.ErrReadOnlyFileSystem
+}
+
+func (fs *remoteFileSystem) Remove(p string) error {
+	return vfs.ErrReadOnlyFileSystem
+}
+
+func (fs *remoteFileSystem) String() string {
+	return fmt.Sprintf("Remote %s", fs.base)
+}
+
+type remoteFile struct {
+	*io.SectionReader
+}
+
+func (f *remoteFile) Write(p []byte) (int, error) {
+	return 0, vfs.ErrReadOnly
+}
+
+func (f *remoteFile) Close() error {
+	return nil
+}
+
+// Remote returns a read-only VFS with the files in the tree served over
+// plain HTTP at the given base URL. The files in the tree are determined
+// by the manifest at ManifestName (see WriteManifest), while the contents
+// of the files are read using range requests when the files are read.
+// The blocks read from all the files share the same cache, so opening
+// a file again reuses them. The opts argument might be nil.
+func Remote(base string, opts *RemoteOptions) (vfs.VFS, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	o := opts.withDefaults()
+	manifestURL := u.JoinPath(ManifestName).String()
+	resp, err := remoteGet(&o, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{url: manifestURL, status: resp.StatusCode}
+	}
+	var m Manifest
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+	fs := &remoteFileSystem{
+		base:    u,
+		opts:    o,
+		entries: make(map[string]*remoteInfo),
+		dirs:    make(map[string][]os.FileInfo),
+		cache:   newBlockCache(o.CacheBlocks),
+	}
+	fs.entries[""] = &remoteInfo{&ManifestEntry{Mode: os.ModeDir | 0755}}
+	for _, v := range m.Entries {
+		v.Path = cleanPath(v.Path)
+		if v.Path == "" {
+			continue
+		}
+		info := &remoteInfo{v}
+		fs.entries[v.Path] = info
+		dir := cleanPath(path.Dir(v.Path))
+		fs.dirs[dir] = append(fs.dirs[dir], info)
+	}
+	for k, v := range fs.dirs {
+		if parent := fs.entries[k]; parent == nil || !parent.IsDir() {
+			return nil, fmt.Errorf("invalid manifest: %s is not a directory", k)
+		}
+		sort.Sort(vfs.FileInfos(v))
+	}
+	return fs, nil
+}
@@ -0,0 +1,219 @@
+package httpfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rainycape/vfs"
+)
+
+// flakyHandler fails the first failures requests with a 503 and
+// counts the requests it receives.
+type flakyHandler struct {
+	http.Handler
+	failures int32
+	requests int32
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&h.requests, 1)
+	if atomic.AddInt32(&h.failures, -1) >= 0 {
+		http.Error(w, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestRangeReader(t *testing.T) {
+	srv, _ := newTestServer(t, nil)
+	opts := &RemoteOptions{BlockSize: 100, CacheBlocks: 2}
+	r, err := NewRangeReader(srv.URL+"/a.txt", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(testContents)) {
+		t.Fatalf("expecting size %d, got %d", len(testContents), r.Size())
+	}
+	data, err := ioutil.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != testContents {
+		t.Error("unexpected contents from RangeReader")
+	}
+	buf := make([]byte, 20)
+	n, err := r.ReadAt(buf, 190)
+	if err != nil || string(buf[:n]) != testContents[190:210] {
+		t.Errorf("unexpected ReadAt across blocks %q, %v", string(buf[:n]), err)
+	}
+	n, err = r.ReadAt(buf, r.Size()-5)
+	if n != 5 || err != io.EOF {
+		t.Errorf("expecting 5 bytes and io.EOF at the end, got %d, %v", n, err)
+	}
+	if _, err := NewRangeReader(srv.URL+"/missing", nil); err == nil {
+		t.Error("expecting an error for missing file")
+	}
+}
+
+func TestRangeReaderRetries(t *testing.T) {
+	_, fs := newTestServer(t, nil)
+	h := &flakyHandler{Handler: Handler(fs, nil), failures: 2}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	opts := &RemoteOptions{RetryDelay: time.Millisecond}
+	r, err := NewRangeReader(srv.URL+"/a.txt", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := r.ReadAt(buf, 6); err != nil || string(buf) != "world" {
+		t.Fatalf("unexpected ReadAt %q, %v", string(buf), err)
+	}
+	requests := atomic.LoadInt32(&h.requests)
+	if requests != 4 {
+		t.Errorf("expecting 4 requests, got %d", requests)
+	}
+	// Cached block
+	if _, err := r.ReadAt(buf, 0); err != nil || string(buf) != "hello" {
+		t.Fatalf("unexpected ReadAt %q, %v", string(buf), err)
+	}
+	if r := atomic.LoadInt32(&h.requests); r != requests {
+		t.Errorf("expecting cached block, got %d requests", r-requests)
+	}
+	atomic.StoreInt32(&h.failures, 10)
+	opts.Retries = -1
+	if _, err := NewRangeReader(srv.URL+"/a.txt", opts); err == nil {
+		t.Error("expecting an error without retries")
+	}
+}
+
+func TestRangeReaderChanged(t *testing.T) {
+	srv, fs := newTestServer(t, nil)
+	r, err := NewRangeReader(srv.URL+"/a.txt", &RemoteOptions{BlockSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(fs, "a.txt", bytes.ToUpper([]byte(testContents)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := r.ReadAt(buf, 0); err != ErrRemoteChanged {
+		t.Errorf("expecting ErrRemoteChanged, got %v", err)
+	}
+}
+
+func TestOpenZip(t *testing.T) {
+	data, err := ioutil.ReadFile("../testdata/fs.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := vfs.Zip(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := vfs.Memory()
+	if err := vfs.WriteFile(fs, "fs.zip", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(Handler(fs, nil))
+	defer srv.Close()
+	remote, err := OpenZip(srv.URL+"/fs.zip", &RemoteOptions{BlockSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vfs.Walk(local, "/", func(_ vfs.VFS, p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		expect, err := vfs.ReadFile(local, p)
+		if err != nil {
+			return err
+		}
+		got, err := vfs.ReadFile(remote, p)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(expect, got) {
+			t.Errorf("unexpected contents for %s", p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemote(t *testing.T) {
+	_, fs := newTestServer(t, nil)
+	var buf bytes.Buffer
+	if err := WriteManifest(&buf, fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(fs, ManifestName, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(Handler(fs, nil))
+	defer srv.Close()
+	remote, err := Remote(srv.URL, &RemoteOptions{BlockSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := vfs.ReadFile(remote, "a.txt")
+	if err != nil || string(data) != testContents {
+		t.Errorf("unexpected contents for a.txt, %v", err)
+	}
+	data, err = vfs.ReadFile(remote, "/dir/noext")
+	if err != nil || string(data) != testHTML {
+		t.Errorf("unexpected contents for dir/noext, %v", err)
+	}
+	infos, err := remote.ReadDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name() != "noext" || infos[1].Name() != "sub" || !infos[1].IsDir() {
+		t.Errorf("unexpected entries in dir %v", infos)
+	}
+	if _, err := remote.Stat("missing"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting not exist error, got %v", err)
+	}
+	if err := vfs.WriteFile(remote, "b.txt", nil, 0644); err != vfs.ErrReadOnlyFileSystem {
+		t.Errorf("expecting ErrReadOnlyFileSystem, got %v", err)
+	}
+}
+
+func TestRemoteCache(t *testing.T) {
+	_, fs := newTestServer(t, nil)
+	var buf bytes.Buffer
+	if err := WriteManifest(&buf, fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(fs, ManifestName, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := &flakyHandler{Handler: Handler(fs, nil)}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	remote, err := Remote(srv.URL, &RemoteOptions{BlockSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vfs.ReadFile(remote, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	requests := atomic.LoadInt32(&h.requests)
+	// Opening the file again must use the cached blocks
+	data, err := vfs.ReadFile(remote, "a.txt")
+	if err != nil || string(data) != testContents {
+		t.Fatalf("unexpected contents for a.txt, %v", err)
+	}
+	if n := atomic.LoadInt32(&h.requests); n != requests {
+		t.Errorf("expecting no requests when reading a.txt again, got %d", n-requests)
+	}
+}
@@ -0,0 +1,232 @@
+package vfs
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Op identifies an operation reported by Instrumented.
+type Op string
+
+// Operations reported by Instrumented, named after the method
+// which performs them.
+const (
+	OpOpen     Op = "Open"
+	OpOpenFile Op = "OpenFile"
+	OpLstat    Op = "Lstat"
+	OpStat     Op = "Stat"
+	OpReadDir  Op = "ReadDir"
+	OpMkdir    Op = "Mkdir"
+	OpRemove   Op = "Remove"
+	OpRead     Op = "Read"
+	OpWrite    Op = "Write"
+	OpSeek     Op = "Seek"
+	OpClose    Op = "Close"
+)
+
+// Event represents an operation performed on an instrumented VFS or on
+// one of the files returned by it.
+type Event struct {
+	// Op is the operation performed.
+	Op Op
+	// Path is the path of the file or directory involved. For
+	// operations on files, it's the path the file was opened with.
+	Path string
+	// Duration is the time it took to complete the operation.
+	Duration time.Duration
+	// Bytes is the number of bytes read or written. It's always
+	// zero for operations other than Read and Write.
+	Bytes int64
+	// Err is the error returned by the operation, if any. Note that
+	// io.EOF returned from Read is not considered an error.
+	Err error
+}
+
+// Observer is the interface used by Instrumented for reporting
+// operations. Observe might be called from multiple goroutines
+// at the same time.
+type Observer interface {
+	Observe(e *Event)
+}
+
+// ObserverFunc is an adapter which allows using an ordinary function
+// as an Observer.
+type ObserverFunc func(e *Event)
+
+// Observe calls f(e).
+func (f ObserverFunc) Observe(e *Event) {
+	f(e)
+}
+
+// expvarMu serializes the calls to ExpvarObserver, so
+// concurrent calls with the same name don't panic.
+var expvarMu sync.Mutex
+
+type expvarObserver struct {
+	m *expvar.Map
+}
+
+func (o *expvarObserver) Observe(e *Event) {
+	op := string(e.Op)
+	o.m.Add(op+".count", 1)
+	o.m.Add(op+".nanoseconds", int64(e.Duration))
+	if e.Bytes > 0 {
+		o.m.Add(op+".bytes", e.Bytes)
+	}
+	if e.Err != nil {
+		o.m.Add(op+".errors", 1)
+	}
+}
+
+// ExpvarObserver returns an Observer which publishes its metrics as an
+// expvar.Map with the given name. For each operation, the map contains
+// the keys <op>.count, <op>.errors, <op>.nanoseconds (the total time spent
+// in the operation) and <op>.bytes. To tell apart the VFSs mounted on a
+// Mounter, use a different ExpvarObserver for each one of them. Calling
+// ExpvarObserver again with the same name returns an Observer which
+// publishes to the same map. If name is already in use by an expvar.Var
+// which is not an *expvar.Map, this function panics.
+func ExpvarObserver(name string) Observer {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if v := expvar.Get(name); v != nil {
+		m, ok := v.(*expvar.Map)
+		if !ok {
+			panic(fmt.Errorf("expvar %s is a %T, not an *expvar.Map", name, v))
+		}
+		return &expvarObserver{m: m}
+	}
+	return &expvarObserver{m: expvar.NewMap(name)}
+}
+
+type instrumentedFileSystem struct {
+	fs       VFS
+	observer Observer
+}
+
+func (fs *instrumentedFileSystem) VFS() VFS {
+	return fs.fs
+}
+
+func (fs *instrumentedFileSystem) observe(op Op, path string, start time.Time, n int, err error) {
+	fs.observer.Observe(&Event{
+		Op:       op,
+		Path:     path,
+		Duration: time.Since(start),
+		Bytes:    int64(n),
+		Err:      err,
+	})
+}
+
+func (fs *instrumentedFileSystem) Open(path string) (RFile, error) {
+	start := time.Now()
+	f, err := fs.fs.Open(path)
+	fs.observe(OpOpen, path, start, 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedFile{fs: fs, path: path, f: f}, nil
+}
+
+func (fs *instrumentedFileSystem) OpenFile(path string, flag int, perm os.FileMode) (WFile, error) {
+	start := time.Now()
+	f, err := fs.fs.OpenFile(path, flag, perm)
+	fs.observe(OpOpenFile, path, start, 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedWFile{instrumentedFile{fs: fs, path: path, f: f}, f}, nil
+}
+
+func (fs *instrumentedFileSystem) Lstat(path string) (os.FileInfo, error) {
+	start := time.Now()
+	info, err := fs.fs.Lstat(path)
+	fs.observe(OpLstat, path, start, 0, err)
+	return info, err
+}
+
+func (fs *instrumentedFileSystem) Stat(path string) (os.FileInfo, error) {
+	start := time.Now()
+	info, err := fs.fs.Stat(path)
+	fs.observe(OpStat, path, start, 0, err)
+	return info, err
+}
+
+func (fs *instrumentedFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	start := time.Now()
+	infos, err := fs.fs.ReadDir(path)
+	fs.observe(OpReadDir, path, start, 0, err)
+	return infos, err
+}
+
+func (fs *instrumentedFileSystem) Mkdir(path string, perm os.FileMode) error {
+	start := time.Now()
+	err := fs.fs.Mkdir(path, perm)
+	fs.observe(OpMkdir, path, start, 0, err)
+	return err
+}
+
+func (fs *instrumentedFileSystem) Remove(path string) error {
+	start := time.Now()
+	err := fs.fs.Remove(path)
+	fs.observe(OpRemove, path, start, 0, err)
+	return err
+}
+
+func (fs *instrumentedFileSystem) String() string {
+	return fmt.Sprintf("Instrumented %s", fs.fs.String())
+}
+
+type instrumentedFile struct {
+	fs   *instrumentedFileSystem
+	path string
+	f    RFile
+}
+
+func (f *instrumentedFile) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := f.f.Read(p)
+	oerr := err
+	if oerr == io.EOF {
+		oerr = nil
+	}
+	f.fs.observe(OpRead, f.path, start, n, oerr)
+	return n, err
+}
+
+func (f *instrumentedFile) Seek(offset int64, whence int) (int64, error) {
+	start := time.Now()
+	off, err := f.f.Seek(offset, whence)
+	f.fs.observe(OpSeek, f.path, start, 0, err)
+	return off, err
+}
+
+func (f *instrumentedFile) Close() error {
+	start := time.Now()
+	err := f.f.Close()
+	f.fs.observe(OpClose, f.path, start, 0, err)
+	return err
+}
+
+type instrumentedWFile struct {
+	instrumentedFile
+	w WFile
+}
+
+func (f *instrumentedWFile) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := f.w.Write(p)
+	f.fs.observe(OpWrite, f.path, start, n, err)
+	return n, err
+}
+
+// Instrumented returns a VFS which reports every operation performed
+// on fs, as well as the ones performed on the files it returns, to the
+// given Observer. See also ExpvarObserver.
+func Instrumented(fs VFS, observer Observer) VFS {
+	return &instrumentedFileSystem{fs: fs, observer: observer}
+}
@@ -0,0 +1,99 @@
+package vfs
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []*Event
+}
+
+func (o *recordingObserver) Observe(e *Event) {
+	o.mu.Lock()
+	o.events = append(o.events, e)
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) count(op Op) (int, int64, int) {
+	var count, errors int
+	var bytes int64
+	for _, v := range o.events {
+		if v.Op == op {
+			count++
+			bytes += v.Bytes
+			if v.Err != nil {
+				errors++
+			}
+		}
+	}
+	return count, bytes, errors
+}
+
+func TestInstrumented(t *testing.T) {
+	fs := Instrumented(Memory(), &recordingObserver{})
+	testVFS(t, fs)
+	obs := &recordingObserver{}
+	fs = Instrumented(Memory(), obs)
+	if err := fs.Mkdir("a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("a", 0755); err == nil {
+		t.Error("expecting an error when creating a again")
+	}
+	if err := WriteFile(fs, "a/b", []byte("123"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "c", []byte("4"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFile(fs, "a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if c, b, _ := obs.count(OpWrite); c != 2 || b != 4 {
+		t.Errorf("expecting 2 writes with 4 bytes, got %d writes with %d bytes", c, b)
+	}
+	if c, b, _ := obs.count(OpRead); c == 0 || b != 3 {
+		t.Errorf("expecting reads with 3 bytes, got %d reads with %d bytes", c, b)
+	}
+	if c, _, e := obs.count(OpMkdir); c != 2 || e != 1 {
+		t.Errorf("expecting 2 Mkdir with 1 failure, got %d with %d failures", c, e)
+	}
+	if c, _, _ := obs.count(OpClose); c != 3 {
+		t.Errorf("expecting 3 closes, got %d", c)
+	}
+}
+
+func TestExpvarObserver(t *testing.T) {
+	// expvar names can't be unregistered, so use a new
+	// one on every run (e.g. with -count=2)
+	name := fmt.Sprintf("vfs-test-expvar-%d", time.Now().UnixNano())
+	fs := Instrumented(Memory(), ExpvarObserver(name))
+	if err := WriteFile(fs, "a", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("nonexistent"); err == nil {
+		t.Fatal("expecting an error")
+	}
+	// Observers with the same name share the map
+	fs2 := Instrumented(Memory(), ExpvarObserver(name))
+	if _, err := fs2.Stat("nonexistent"); err == nil {
+		t.Fatal("expecting an error")
+	}
+	m := expvar.Get(name).(*expvar.Map)
+	expect := map[string]string{
+		"OpenFile.count": "1",
+		"Write.bytes":    "5",
+		"Stat.count":     "2",
+		"Stat.errors":    "2",
+	}
+	for k, v := range expect {
+		if val := m.Get(k); val == nil || val.String() != v {
+			t.Errorf("expecting %s = %s, got %v", k, v, val)
+		}
+	}
+}
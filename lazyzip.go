@@ -0,0 +1,340 @@
+package vfs
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errTooManySymlinks = errors.New("too many levels of symbolic links")
+)
+
+type zipDirInfo struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (info *zipDirInfo) Name() string {
+	return info.name
+}
+
+func (info *zipDirInfo) Size() int64 {
+	return 0
+}
+
+func (info *zipDirInfo) Mode() os.FileMode {
+	return info.mode
+}
+
+func (info *zipDirInfo) ModTime() time.Time {
+	return info.modTime
+}
+
+func (info *zipDirInfo) IsDir() bool {
+	return true
+}
+
+func (info *zipDirInfo) Sys() interface{} {
+	return nil
+}
+
+type zipDir struct {
+	info    os.FileInfo
+	entries map[string]os.FileInfo
+	sorted  []os.FileInfo
+}
+
+type lazyZipFileSystem struct {
+	r     io.ReaderAt
+	files map[string]*zip.File
+	dirs  map[string]*zipDir
+}
+
+func (fs *lazyZipFileSystem) dir(p string) *zipDir {
+	if d := fs.dirs[p]; d != nil {
+		return d
+	}
+	d := &zipDir{
+		info:    &zipDirInfo{name: pathpkg.Base("/" + p), mode: os.ModeDir | 0755},
+		entries: make(map[string]os.FileInfo),
+	}
+	fs.dirs[p] = d
+	if p != "" {
+		parent := fs.dir(cleanPath(pathpkg.Dir(p)))
+		parent.entries[pathpkg.Base(p)] = d.info
+	}
+	return d
+}
+
+func (fs *lazyZipFileSystem) readLink(f *zip.File) (string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// lookup returns either the file or the directory at p. Symlinks in
+// any path component but the last one are always followed, while the
+// ones in the last component are only followed if follow is true.
+func (fs *lazyZipFileSystem) lookup(p string, follow bool) (*zip.File, *zipDir, error) {
+	parts := strings.Split(cleanPath(p), "/")
+	// cur is the resolved path of the directory
+	// containing the current component
+	cur := ""
+	links := 0
+	for len(parts) > 0 {
+		name := parts[0]
+		parts = parts[1:]
+		if name == "" {
+			continue
+		}
+		next := name
+		if cur != "" {
+			next = cur + "/" + name
+		}
+		if fs.dirs[next] != nil {
+			cur = next
+			continue
+		}
+		f := fs.files[next]
+		if f == nil {
+			return nil, nil, os.ErrNotExist
+		}
+		last := len(parts) == 0
+		if f.Mode()&os.ModeSymlink == 0 || (last && !follow) {
+			if !last {
+				return nil, nil, os.ErrNotExist
+			}
+			return f, nil, nil
+		}
+		if links++; links > 40 {
+			return nil, nil, errTooManySymlinks
+		}
+		target, err := fs.readLink(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !pathpkg.IsAbs(target) {
+			target = pathpkg.Join("/"+cur, target)
+		}
+		// Resolve the target from the root, followed by
+		// the remaining components
+		parts = append(strings.Split(cleanPath(target), "/"), parts...)
+		cur = ""
+	}
+	return nil, fs.dirs[cur], nil
+}
+
+func (fs *lazyZipFileSystem) Open(path string) (RFile, error) {
+	f, d, err := fs.lookup(path, true)
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		return nil, fmt.Errorf("%s is not a file", path)
+	}
+	zf := &lazyZipFile{f: f, size: int64(f.UncompressedSize64)}
+	if f.Method == zip.Store {
+		off, err := f.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		zf.section = io.NewSectionReader(fs.r, off, zf.size)
+	}
+	return zf, nil
+}
+
+func (fs *lazyZipFileSystem) OpenFile(path string, flag int, perm os.FileMode) (WFile, error) {
+	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0 {
+		return nil, ErrReadOnlyFileSystem
+	}
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*lazyZipFile), nil
+}
+
+func (fs *lazyZipFileSystem) stat(path string, follow bool) (os.FileInfo, error) {
+	f, d, err := fs.lookup(path, follow)
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		return d.info, nil
+	}
+	return f.FileInfo(), nil
+}
+
+func (fs *lazyZipFileSystem) Lstat(path string) (os.FileInfo, error) {
+	return fs.stat(path, false)
+}
+
+func (fs *lazyZipFileSystem) Stat(path string) (os.FileInfo, error) {
+	return fs.stat(path, true)
+}
+
+func (fs *lazyZipFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	_, d, err := fs.lookup(path, true)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, fmt.Errorf("%s is not a directory", path)
+	}
+	infos := make([]os.FileInfo, len(d.sorted))
+	copy(infos, d.sorted)
+	return infos, nil
+}
+
+func (fs *lazyZipFileSystem) Mkdir(path string, perm os.FileMode) error {
+	return ErrReadOnlyFileSystem
+}
+
+func (fs *lazyZipFileSystem) Remove(path string) error {
+	return ErrReadOnlyFileSystem
+}
+
+func (fs *lazyZipFileSystem) String() string {
+	return "LazyZip"
+}
+
+// lazyZipFile reads stored files directly from the underlying
+// io.ReaderAt. Compressed files are decompressed as they're read,
+// reopening them when seeking backwards.
+type lazyZipFile struct {
+	f       *zip.File
+	section *io.SectionReader
+	r       io.ReadCloser
+	size    int64
+	offset  int64
+	pos     int64
+	closed  bool
+}
+
+func (f *lazyZipFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, errFileClosed
+	}
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if f.section != nil {
+		n, err := f.section.ReadAt(p, f.offset)
+		f.offset += int64(n)
+		return n, err
+	}
+	if f.r == nil || f.pos > f.offset {
+		if f.r != nil {
+			f.r.Close()
+		}
+		r, err := f.f.Open()
+		if err != nil {
+			return 0, err
+		}
+		f.r = r
+		f.pos = 0
+	}
+	if f.pos < f.offset {
+		n, err := io.CopyN(ioutil.Discard, f.r, f.offset-f.pos)
+		f.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.r.Read(p)
+	f.pos += int64(n)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *lazyZipFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, errFileClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, fmt.Errorf("Seek: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Seek: negative position %d", offset)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *lazyZipFile) Write(p []byte) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (f *lazyZipFile) Close() error {
+	if f.closed {
+		return errFileClosed
+	}
+	f.closed = true
+	if f.r != nil {
+		return f.r.Close()
+	}
+	return nil
+}
+
+// LazyZip returns a read-only VFS with the contents of the .zip file
+// read from the given io.ReaderAt, which must have the given size.
+// Unlike Zip, only the zip directory is read when calling LazyZip,
+// while the file contents are read from r when the files are read.
+// Files stored without compression support seeking without reading
+// the data before the new offset, which makes LazyZip a good fit for
+// io.ReaderAt implementations with high latency.
+func LazyZip(r io.ReaderAt, size int64) (VFS, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	fs := &lazyZipFileSystem{
+		r:     r,
+		files: make(map[string]*zip.File),
+		dirs:  make(map[string]*zipDir),
+	}
+	fs.dir("")
+	for _, file := range zr.File {
+		p := cleanPath(file.Name)
+		if p == "" {
+			continue
+		}
+		if file.Mode().IsDir() {
+			d := fs.dir(p)
+			d.info = file.FileInfo()
+			fs.dir(cleanPath(pathpkg.Dir(p))).entries[pathpkg.Base(p)] = d.info
+			continue
+		}
+		fs.files[p] = file
+		fs.dir(cleanPath(pathpkg.Dir(p))).entries[pathpkg.Base(p)] = file.FileInfo()
+	}
+	for _, d := range fs.dirs {
+		for _, v := range d.entries {
+			d.sorted = append(d.sorted, v)
+		}
+		sort.Sort(FileInfos(d.sorted))
+	}
+	return fs, nil
+}
@@ -221,7 +221,7 @@ func (fs *memoryFileSystem) Mkdir(path string, perm os.FileMode) error {
 }
 
 func (fs *memoryFileSystem) Remove(path string) error {
-	entry, dir, pos, err := fs.entry(path, true)
+	entry, dir, pos, err := fs.entry(path, false)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,120 @@
+// Package modfs implements access to Go module zip files, as served
+// by module proxies and stored in the module cache, using VFS.
+//
+// Module zips contain all their files inside a directory named after
+// the module path and version, like example.com/m@v1.2.3/. The VFS
+// returned by Open has that directory as its root, while Write adds
+// it back. Both enforce the rules in golang.org/x/mod/zip.
+package modfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/rainycape/vfs"
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// prefix returns the directory where the files of m are stored
+// inside its zip file.
+func prefix(m module.Version) string {
+	return m.Path + "@" + m.Version
+}
+
+// check validates the module zip at filename using modzip.CheckZip.
+func check(m module.Version, filename string) error {
+	_, err := modzip.CheckZip(m, filename)
+	return err
+}
+
+// checkData validates the module zip in data. Since modzip.CheckZip only
+// works with files on disk, the data is written to a temporary file.
+func checkData(m module.Version, data []byte) error {
+	f, err := ioutil.TempFile("", "modfs-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return check(m, f.Name())
+}
+
+// Open returns an in-memory VFS with the contents of the zip for the
+// module m read from r, after checking that it's a valid module zip.
+// See vfs.Zip for the meaning of size. If r is an *os.File, it's
+// validated in place. Otherwise, its contents are written to a
+// temporary file for validating them.
+func Open(r io.Reader, size int64, m module.Version) (vfs.VFS, error) {
+	var data []byte
+	if f, ok := r.(*os.File); ok {
+		if err := check(m, f.Name()); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+		if err := checkData(m, data); err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+		size = int64(len(data))
+	}
+	fs, err := vfs.Zip(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return rootFS(fs, m)
+}
+
+// rootFS returns a VFS with the module directory in fs as its root.
+func rootFS(fs vfs.VFS, m module.Version) (vfs.VFS, error) {
+	p := prefix(m)
+	if _, err := fs.Stat(p); vfs.IsNotExist(err) {
+		// Module zips with no files are valid
+		return vfs.Memory(), nil
+	}
+	return vfs.Chroot(p, fs)
+}
+
+// OpenCache returns a VFS with the contents of the module m stored in
+// modcache, which must have the same layout as the directory pointed by
+// GOMODCACHE. The module zip is read from the download cache and validated
+// like in Open. If there's no zip, the directory where the go command
+// extracts the module is used, without any validation.
+func OpenCache(modcache vfs.VFS, m module.Version) (vfs.VFS, error) {
+	escPath, err := module.EscapePath(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	escVersion, err := module.EscapeVersion(m.Version)
+	if err != nil {
+		return nil, err
+	}
+	zipPath := path.Join("/cache/download", escPath, "@v", escVersion+".zip")
+	f, err := modcache.Open(zipPath)
+	if err == nil {
+		defer f.Close()
+		return Open(f, 0, m)
+	}
+	if !vfs.IsNotExist(err) {
+		return nil, err
+	}
+	fs, err := vfs.Chroot(escPath+"@"+escVersion, modcache)
+	if err != nil {
+		return nil, fmt.Errorf("module %s not found in module cache: %v", m, err)
+	}
+	return fs, nil
+}
@@ -0,0 +1,203 @@
+package modfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rainycape/vfs"
+	"golang.org/x/mod/module"
+)
+
+var testModule = module.Version{Path: "example.com/m", Version: "v1.2.3"}
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	var names []string
+	for k := range files {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, v := range names {
+		f, err := w.Create(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(files[v])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpen(t *testing.T) {
+	data := makeZip(t, map[string]string{
+		"example.com/m@v1.2.3/go.mod":    "module example.com/m\n",
+		"example.com/m@v1.2.3/m.go":      "package m\n",
+		"example.com/m@v1.2.3/sub/s.go":  "package sub\n",
+		"example.com/m@v1.2.3/README.md": "readme",
+	})
+	fs, err := Open(bytes.NewReader(data), int64(len(data)), testModule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"/go.mod": "module example.com/m\n", "/sub/s.go": "package sub\n"} {
+		if data, err := vfs.ReadFile(fs, k); err != nil || string(data) != v {
+			t.Errorf("unexpected contents in %s %q, %v", k, string(data), err)
+		}
+	}
+	// Same data, wrong version
+	if _, err := Open(bytes.NewReader(data), int64(len(data)), module.Version{Path: "example.com/m", Version: "v1.2.4"}); err == nil {
+		t.Error("expecting an error when opening a zip with the wrong prefix")
+	}
+	invalid := map[string]map[string]string{
+		"collision": {
+			"example.com/m@v1.2.3/a.go": "",
+			"example.com/m@v1.2.3/A.go": "",
+		},
+		"go.mod in subdirectory": {
+			"example.com/m@v1.2.3/sub/go.mod": "",
+		},
+		"no prefix": {
+			"m.go": "",
+		},
+	}
+	for k, v := range invalid {
+		data := makeZip(t, v)
+		if _, err := Open(bytes.NewReader(data), 0, testModule); err == nil {
+			t.Errorf("expecting an error for %s", k)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	fs := vfs.Memory()
+	files := map[string]string{
+		"/src/go.mod":              "module example.com/m\n",
+		"/src/m.go":                "package m\n",
+		"/src/internal/i.go":       "package internal\n",
+		"/src/nested/go.mod":       "module example.com/m/nested\n",
+		"/src/nested/n.go":         "package nested\n",
+		"/src/vendor/modules.txt":  "",
+		"/src/vendor/x.com/y/y.go": "package y\n",
+		"/src/testdata/in.txt":     "input",
+		"/other/ignored.go":        "package other\n",
+	}
+	for k, v := range files {
+		if err := vfs.MkdirAll(fs, path.Dir(k), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := vfs.WriteFile(fs, k, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, fs, "/src", testModule); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range zr.File {
+		names = append(names, v.Name)
+	}
+	sort.Strings(names)
+	exp := []string{
+		"example.com/m@v1.2.3/go.mod",
+		"example.com/m@v1.2.3/internal/i.go",
+		"example.com/m@v1.2.3/m.go",
+		"example.com/m@v1.2.3/testdata/in.txt",
+		// modules.txt is the only file kept from vendor
+		"example.com/m@v1.2.3/vendor/modules.txt",
+	}
+	if !reflect.DeepEqual(names, exp) {
+		t.Errorf("expecting files %v, got %v", exp, names)
+	}
+	// The result must be readable by Open, validating it from a file
+	filename := filepath.Join(t.TempDir(), "m.zip")
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	mfs, err := Open(f, 0, testModule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := vfs.ReadFile(mfs, "/testdata/in.txt"); err != nil || string(data) != "input" {
+		t.Errorf("unexpected contents %q, %v", string(data), err)
+	}
+	if err := Write(&buf, fs, "/src", module.Version{Path: "example.com/m", Version: "1.2.3"}); err == nil {
+		t.Error("expecting an error with a non canonical version")
+	}
+	if err := vfs.WriteFile(fs, "/src/GO.MOD", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(&buf, fs, "/src", testModule); err == nil {
+		t.Error("expecting an error with an invalid file")
+	}
+}
+
+func TestWriteCompressed(t *testing.T) {
+	fs := vfs.Memory()
+	contents := "package m\n\n" + strings.Repeat("// compressible\n", 100)
+	if err := vfs.WriteFile(fs, "/go.mod", []byte("module example.com/m\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(fs, "/m.go", []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.Compress(fs); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, fs, "/", testModule); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := Open(bytes.NewReader(buf.Bytes()), int64(buf.Len()), testModule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := vfs.ReadFile(mfs, "/m.go"); err != nil || string(data) != contents {
+		t.Errorf("unexpected contents for m.go %q, %v", string(data), err)
+	}
+}
+
+func TestOpenCache(t *testing.T) {
+	modcache := vfs.Memory()
+	up := module.Version{Path: "github.com/Upper/m", Version: "v0.1.0"}
+	data := makeZip(t, map[string]string{
+		"github.com/Upper/m@v0.1.0/go.mod": "module github.com/Upper/m\n",
+	})
+	if err := vfs.MkdirAll(modcache, "/cache/download/github.com/!upper/m/@v", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(modcache, "/cache/download/github.com/!upper/m/@v/v0.1.0.zip", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := OpenCache(modcache, up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := vfs.ReadFile(fs, "/go.mod"); err != nil || string(data) != "module github.com/Upper/m\n" {
+		t.Errorf("unexpected go.mod %q, %v", string(data), err)
+	}
+	if _, err := OpenCache(modcache, testModule); err == nil {
+		t.Error("expecting an error for a missing module")
+	}
+}
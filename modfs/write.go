@@ -0,0 +1,103 @@
+package modfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	pathpkg "path"
+	"strings"
+
+	"github.com/rainycape/vfs"
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// file implements modzip.File for a file in a VFS.
+type file struct {
+	fs   vfs.VFS
+	path string
+	info os.FileInfo
+}
+
+func (f *file) Path() string {
+	return strings.TrimPrefix(f.path, "/")
+}
+
+func (f *file) Lstat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Open() (io.ReadCloser, error) {
+	return f.fs.Open(f.path)
+}
+
+// Files returns the files in fs which would be included in a zip for
+// a module rooted at its root directory, as well as the omitted and
+// invalid ones, using the same rules as modzip.CheckFiles. If any file
+// is invalid, a non-nil error is returned too.
+func Files(fs vfs.VFS) (modzip.CheckedFiles, error) {
+	files, err := listFiles(fs)
+	if err != nil {
+		return modzip.CheckedFiles{}, err
+	}
+	return modzip.CheckFiles(files)
+}
+
+func listFiles(fs vfs.VFS) ([]modzip.File, error) {
+	var files []modzip.File
+	err := vfs.Walk(fs, "/", func(fs vfs.VFS, p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, &file{fs: fs, path: p, info: info})
+		}
+		return nil
+	})
+	return files, err
+}
+
+// Write writes a zip file for the module m to w, containing the files
+// at root in fs. Files which don't belong in a module zip, like the
+// ones in vendor directories or nested modules, are omitted. If fs
+// contains files which can't be included in a module zip or m is
+// not a valid module version, an error is returned.
+func Write(w io.Writer, fs vfs.VFS, root string, m module.Version) error {
+	if vers := module.CanonicalVersion(m.Version); vers != m.Version {
+		return fmt.Errorf("version %q is not canonical (should be %q)", m.Version, vers)
+	}
+	if err := module.Check(m.Path, m.Version); err != nil {
+		return err
+	}
+	src, err := vfs.Chroot(root, fs)
+	if err != nil {
+		return err
+	}
+	cf, err := Files(src)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]*vfs.File, len(cf.Valid))
+	p := prefix(m)
+	for _, v := range cf.Valid {
+		data, err := vfs.ReadFile(src, v)
+		if err != nil {
+			return err
+		}
+		info, err := src.Stat(v)
+		if err != nil {
+			return err
+		}
+		// data is already decompressed
+		files[pathpkg.Join(p, v)] = &vfs.File{
+			Data:    data,
+			Mode:    info.Mode() &^ vfs.ModeCompress,
+			ModTime: info.ModTime(),
+		}
+	}
+	zfs, err := vfs.Map(files)
+	if err != nil {
+		return err
+	}
+	return vfs.WriteZip(w, zfs)
+}
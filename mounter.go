@@ -40,7 +40,11 @@ type Mounter struct {
 }
 
 func (m *Mounter) fs(p string) (VFS, string, error) {
+	p = path.Clean("/" + p)
 	for ii := len(m.points) - 1; ii >= 0; ii-- {
+		if p == m.points[ii].point {
+			return m.points[ii].fs, separator, nil
+		}
 		if rel, ok := hasSubdir(m.points[ii].point, p); ok {
 			return m.points[ii].fs, rel, nil
 		}
@@ -0,0 +1,654 @@
+package ninep
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rainycape/vfs"
+)
+
+var (
+	// ErrClientClosed is returned when using a client which has
+	// been closed or whose connection has failed.
+	ErrClientClosed = errors.New("9p: client closed")
+	errUnexpected   = errors.New("9p: unexpected response")
+)
+
+// ClientVFS is the interface implemented by the VFS returned
+// from NewClient and Dial.
+type ClientVFS interface {
+	vfs.VFS
+	// Close closes the connection to the server.
+	Close() error
+}
+
+type response struct {
+	typ uint8
+	d   *decoder
+}
+
+type client struct {
+	conn  io.ReadWriteCloser
+	name  string
+	msize uint32
+	root  uint32
+	wmu   sync.Mutex
+	mu    sync.Mutex
+	tags  map[uint16]chan *response
+	tag   uint16
+	fid   uint32
+	free  []uint32
+	err   error
+}
+
+func (c *client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for k, v := range c.tags {
+		close(v)
+		delete(c.tags, k)
+	}
+}
+
+func (c *client) readLoop() {
+	for {
+		typ, tag, d, err := readMessage(c.conn, c.msize)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		ch := c.tags[tag]
+		delete(c.tags, tag)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- &response{typ: typ, d: d}
+		}
+	}
+}
+
+func (c *client) rpc(m *encoder, expect uint8) (*decoder, error) {
+	ch := make(chan *response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	for {
+		c.tag++
+		if c.tag != noTag && c.tags[c.tag] == nil {
+			break
+		}
+	}
+	tag := c.tag
+	c.tags[tag] = ch
+	c.mu.Unlock()
+	m.setTag(tag)
+	c.wmu.Lock()
+	_, err := c.conn.Write(m.bytes())
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	resp := <-ch
+	if resp == nil {
+		return nil, ErrClientClosed
+	}
+	if resp.typ == rlerror {
+		errno := Errno(resp.d.u32())
+		if resp.d.err != nil {
+			return nil, resp.d.err
+		}
+		return nil, fromErrno(errno)
+	}
+	if resp.typ != expect {
+		return nil, errUnexpected
+	}
+	return resp.d, nil
+}
+
+func (c *client) allocFid() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := len(c.free); n > 0 {
+		fid := c.free[n-1]
+		c.free = c.free[:n-1]
+		return fid
+	}
+	c.fid++
+	return c.fid
+}
+
+func (c *client) releaseFid(fid uint32) {
+	c.mu.Lock()
+	c.free = append(c.free, fid)
+	c.mu.Unlock()
+}
+
+func (c *client) clunk(fid uint32) error {
+	m := newMessage(tclunk, 0)
+	m.u32(fid)
+	_, err := c.rpc(m, rclunk)
+	c.releaseFid(fid)
+	return err
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// walk returns a new fid for the given path.
+func (c *client) walk(p string) (uint32, error) {
+	return c.walkFrom(c.root, splitPath(p))
+}
+
+func (c *client) walkFrom(from uint32, names []string) (uint32, error) {
+	fid := c.allocFid()
+	created := false
+	for {
+		chunk := names
+		if len(chunk) > maxWalk {
+			chunk = chunk[:maxWalk]
+		}
+		names = names[len(chunk):]
+		m := newMessage(twalk, 0)
+		m.u32(from)
+		m.u32(fid)
+		m.u16(uint16(len(chunk)))
+		for _, v := range chunk {
+			m.str(v)
+		}
+		d, err := c.rpc(m, rwalk)
+		if err == nil {
+			if n := int(d.u16()); d.err != nil {
+				err = d.err
+			} else if n != len(chunk) {
+				err = os.ErrNotExist
+			}
+		}
+		if err != nil {
+			if created {
+				c.clunk(fid)
+			} else {
+				c.releaseFid(fid)
+			}
+			return 0, err
+		}
+		created = true
+		if len(names) == 0 {
+			return fid, nil
+		}
+		from = fid
+	}
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (f *fileInfo) Name() string {
+	return f.name
+}
+
+func (f *fileInfo) Size() int64 {
+	return f.size
+}
+
+func (f *fileInfo) Mode() os.FileMode {
+	return f.mode
+}
+
+func (f *fileInfo) ModTime() time.Time {
+	return f.modTime
+}
+
+func (f *fileInfo) IsDir() bool {
+	return f.mode.IsDir()
+}
+
+func (f *fileInfo) Sys() interface{} {
+	return nil
+}
+
+func (c *client) getattr(fid uint32, name string) (*fileInfo, error) {
+	m := newMessage(tgetattr, 0)
+	m.u32(fid)
+	m.u64(getattrBasic)
+	d, err := c.rpc(m, rgetattr)
+	if err != nil {
+		return nil, err
+	}
+	d.u64() // valid
+	d.qid()
+	mode := d.u32()
+	d.u32() // uid
+	d.u32() // gid
+	d.u64() // nlink
+	d.u64() // rdev
+	size := d.u64()
+	d.u64() // blksize
+	d.u64() // blocks
+	d.u64() // atime
+	d.u64()
+	sec := d.u64()
+	nsec := d.u64()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &fileInfo{
+		name:    name,
+		size:    int64(size),
+		mode:    fromLinuxMode(mode),
+		modTime: time.Unix(int64(sec), int64(nsec)),
+	}, nil
+}
+
+func (c *client) open(fid uint32, flags uint32) (qid, uint32, error) {
+	m := newMessage(tlopen, 0)
+	m.u32(fid)
+	m.u32(flags)
+	d, err := c.rpc(m, rlopen)
+	if err != nil {
+		return qid{}, 0, err
+	}
+	q := d.qid()
+	iounit := d.u32()
+	return q, iounit, d.err
+}
+
+// openFile opens the given fid with the given flags, checking
+// that it's not a directory.
+func (c *client) openFile(p string, fid uint32, flags uint32) (uint32, error) {
+	q, iounit, err := c.open(fid, flags)
+	if err != nil {
+		return 0, err
+	}
+	if q.typ&qtDir != 0 {
+		return 0, fmt.Errorf("%s is not a file", p)
+	}
+	return iounit, nil
+}
+
+func (c *client) newFile(fid uint32, iounit uint32, flag int) *clientFile {
+	if iounit == 0 || iounit > c.msize-ioHeaderSize {
+		iounit = c.msize - ioHeaderSize
+	}
+	return &clientFile{
+		c:      c,
+		fid:    fid,
+		iounit: iounit,
+		read:   flag&os.O_WRONLY == 0,
+		write:  flag&(os.O_WRONLY|os.O_RDWR) != 0,
+	}
+}
+
+func (c *client) Open(p string) (vfs.RFile, error) {
+	fid, err := c.walk(p)
+	if err != nil {
+		return nil, err
+	}
+	iounit, err := c.openFile(p, fid, lORdonly)
+	if err != nil {
+		c.clunk(fid)
+		return nil, err
+	}
+	return c.newFile(fid, iounit, os.O_RDONLY), nil
+}
+
+func (c *client) OpenFile(p string, flag int, perm os.FileMode) (vfs.WFile, error) {
+	var fid, iounit uint32
+	var err error
+	if flag&os.O_CREATE != 0 {
+		names := splitPath(p)
+		if len(names) == 0 {
+			return nil, fmt.Errorf("%s is not a file", p)
+		}
+		if fid, err = c.walkFrom(c.root, names[:len(names)-1]); err != nil {
+			return nil, err
+		}
+		m := newMessage(tlcreate, 0)
+		m.u32(fid)
+		m.str(names[len(names)-1])
+		m.u32(toLinuxFlags(flag))
+		m.u32(uint32(perm.Perm()))
+		m.u32(0) // gid
+		var d *decoder
+		if d, err = c.rpc(m, rlcreate); err == nil {
+			d.qid()
+			iounit = d.u32()
+			err = d.err
+		}
+	} else {
+		if fid, err = c.walk(p); err != nil {
+			return nil, err
+		}
+		iounit, err = c.openFile(p, fid, toLinuxFlags(flag))
+	}
+	if err != nil {
+		c.clunk(fid)
+		return nil, err
+	}
+	f := c.newFile(fid, iounit, flag)
+	if flag&os.O_APPEND != 0 {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (c *client) Lstat(p string) (os.FileInfo, error) {
+	// Symlinks are followed by the server
+	return c.Stat(p)
+}
+
+func (c *client) Stat(p string) (os.FileInfo, error) {
+	fid, err := c.walk(p)
+	if err != nil {
+		return nil, err
+	}
+	defer c.clunk(fid)
+	return c.getattr(fid, path.Base(path.Clean("/"+p)))
+}
+
+func (c *client) ReadDir(p string) ([]os.FileInfo, error) {
+	fid, err := c.walk(p)
+	if err != nil {
+		return nil, err
+	}
+	defer c.clunk(fid)
+	if _, _, err := c.open(fid, lORdonly); err != nil {
+		return nil, err
+	}
+	var names []string
+	var offset uint64
+	for {
+		m := newMessage(treaddir, 0)
+		m.u32(fid)
+		m.u64(offset)
+		m.u32(c.msize - ioHeaderSize)
+		d, err := c.rpc(m, rreaddir)
+		if err != nil {
+			return nil, err
+		}
+		entries := &decoder{buf: d.data()}
+		if d.err != nil {
+			return nil, d.err
+		}
+		if len(entries.buf) == 0 {
+			break
+		}
+		for len(entries.buf) > 0 {
+			entries.qid()
+			offset = entries.u64()
+			entries.u8() // type
+			name := entries.str()
+			if entries.err != nil {
+				return nil, entries.err
+			}
+			if name != "." && name != ".." {
+				names = append(names, name)
+			}
+		}
+	}
+	// Opened fids can't be walked, so walk each entry from the root
+	dir := splitPath(p)
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, v := range names {
+		efid, err := c.walkFrom(c.root, append(dir[:len(dir):len(dir)], v))
+		if err != nil {
+			if vfs.IsNotExist(err) {
+				// Removed while reading the directory
+				continue
+			}
+			return nil, err
+		}
+		info, err := c.getattr(efid, v)
+		c.clunk(efid)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Sort(vfs.FileInfos(infos))
+	return infos, nil
+}
+
+func (c *client) Mkdir(p string, perm os.FileMode) error {
+	names := splitPath(p)
+	if len(names) == 0 {
+		return os.ErrExist
+	}
+	fid, err := c.walkFrom(c.root, names[:len(names)-1])
+	if err != nil {
+		return err
+	}
+	defer c.clunk(fid)
+	m := newMessage(tmkdir, 0)
+	m.u32(fid)
+	m.str(names[len(names)-1])
+	m.u32(uint32(perm.Perm()))
+	m.u32(0) // gid
+	_, err = c.rpc(m, rmkdir)
+	return err
+}
+
+func (c *client) Remove(p string) error {
+	fid, err := c.walk(p)
+	if err != nil {
+		return err
+	}
+	m := newMessage(tremove, 0)
+	m.u32(fid)
+	_, err = c.rpc(m, rremove)
+	// Tremove clunks the fid, even if the remove fails
+	c.releaseFid(fid)
+	return err
+}
+
+func (c *client) String() string {
+	return fmt.Sprintf("9P client %s", c.name)
+}
+
+func (c *client) Close() error {
+	c.fail(ErrClientClosed)
+	return c.conn.Close()
+}
+
+type clientFile struct {
+	c      *client
+	fid    uint32
+	iounit uint32
+	offset int64
+	read   bool
+	write  bool
+	closed bool
+}
+
+func (f *clientFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.read {
+		return 0, vfs.ErrWriteOnly
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	count := uint32(len(p))
+	if count > f.iounit {
+		count = f.iounit
+	}
+	m := newMessage(tread, 0)
+	m.u32(f.fid)
+	m.u64(uint64(f.offset))
+	m.u32(count)
+	d, err := f.c.rpc(m, rread)
+	if err != nil {
+		return 0, err
+	}
+	data := d.data()
+	if d.err != nil {
+		return 0, d.err
+	}
+	if len(data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, data)
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *clientFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.write {
+		return 0, vfs.ErrReadOnly
+	}
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if uint32(len(chunk)) > f.iounit {
+			chunk = chunk[:f.iounit]
+		}
+		m := newMessage(twrite, 0)
+		m.u32(f.fid)
+		m.u64(uint64(f.offset))
+		m.data(chunk)
+		d, err := f.c.rpc(m, rwrite)
+		if err != nil {
+			return written, err
+		}
+		n := int(d.u32())
+		if d.err != nil {
+			return written, d.err
+		}
+		written += n
+		f.offset += int64(n)
+		if n < len(chunk) {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+func (f *clientFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		info, err := f.c.getattr(f.fid, "")
+		if err != nil {
+			return 0, err
+		}
+		offset += info.size
+	default:
+		return 0, fmt.Errorf("Seek: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Seek: negative position %d", offset)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *clientFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return f.c.clunk(f.fid)
+}
+
+// NewClient returns a VFS which uses the 9P2000.L server at the other
+// end of the given connection, negotiating the protocol version and
+// attaching to the root of the served tree. The client can be used
+// concurrently, requests are multiplexed over the connection.
+func NewClient(conn io.ReadWriteCloser) (ClientVFS, error) {
+	c := &client{
+		conn:  conn,
+		msize: DefaultMsize,
+		tags:  make(map[uint16]chan *response),
+	}
+	if nc, ok := conn.(net.Conn); ok && nc.RemoteAddr() != nil {
+		c.name = nc.RemoteAddr().String()
+	}
+	m := newMessage(tversion, noTag)
+	m.u32(c.msize)
+	m.str(Version)
+	if _, err := conn.Write(m.bytes()); err != nil {
+		return nil, err
+	}
+	typ, _, d, err := readMessage(conn, c.msize)
+	if err != nil {
+		return nil, err
+	}
+	msize := d.u32()
+	version := d.str()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if typ != rversion || version != Version {
+		return nil, fmt.Errorf("9p: unsupported server version %q", version)
+	}
+	if msize < minMsize {
+		return nil, fmt.Errorf("9p: server msize %d is too small", msize)
+	}
+	if msize < c.msize {
+		c.msize = msize
+	}
+	go c.readLoop()
+	c.root = c.allocFid()
+	m = newMessage(tattach, 0)
+	m.u32(c.root)
+	m.u32(noFid) // afid
+	m.str("")    // uname
+	m.str("")    // aname
+	m.u32(noFid) // n_uname
+	if _, err := c.rpc(m, rattach); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Dial connects to the 9P2000.L server at the given address and
+// returns a VFS which uses it. See NewClient.
+func Dial(network, address string) (ClientVFS, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,342 @@
+package ninep
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/rainycape/vfs"
+	"github.com/rainycape/vfs/vfstest"
+)
+
+func newTestClient(t *testing.T, fs vfs.VFS) ClientVFS {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go Serve(l, fs)
+	c, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClient(t *testing.T) {
+	fs := vfs.Memory()
+	c := newTestClient(t, fs)
+	if err := vfs.MkdirAll(c, "/a/b/c", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(c, "/a/b/file.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := vfs.ReadFile(fs, "/a/b/file.txt")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected contents in backing fs %q, %v", string(data), err)
+	}
+	data, err = vfs.ReadFile(c, "/a/b/file.txt")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected contents %q, %v", string(data), err)
+	}
+	info, err := c.Stat("/a/b/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "file.txt" || info.Size() != 5 || info.IsDir() {
+		t.Errorf("unexpected info %s %d %v", info.Name(), info.Size(), info.Mode())
+	}
+	infos, err := c.ReadDir("/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name() != "c" || !infos[0].IsDir() || infos[1].Name() != "file.txt" {
+		t.Errorf("unexpected entries %v", infos)
+	}
+	if _, err := c.Stat("/missing"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting not exist error, got %v", err)
+	}
+	if err := c.Mkdir("/a", 0755); !vfs.IsExist(err) {
+		t.Errorf("expecting exist error, got %v", err)
+	}
+	if _, err := c.OpenFile("/a/b/file.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); !vfs.IsExist(err) {
+		t.Errorf("expecting exist error with O_EXCL, got %v", err)
+	}
+	if err := c.Remove("/a/b"); err == nil {
+		t.Error("expecting an error removing non-empty directory")
+	}
+	if err := vfs.RemoveAll(c, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/a"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting /a to be removed, got %v", err)
+	}
+}
+
+func TestVFS(t *testing.T) {
+	vfstest.TestVFS(t, newTestClient(t, vfs.Memory()))
+}
+
+func TestLargeFile(t *testing.T) {
+	c := newTestClient(t, vfs.Memory())
+	data := make([]byte, 3*DefaultMsize+123)
+	for ii := range data {
+		data[ii] = byte(ii * 7)
+	}
+	if err := vfs.WriteFile(c, "large", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.Open("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	read, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("unexpected contents for large file")
+	}
+	if pos, err := f.Seek(-10, io.SeekEnd); err != nil || pos != int64(len(data)-10) {
+		t.Fatalf("unexpected Seek result %d, %v", pos, err)
+	}
+	buf := make([]byte, 20)
+	n, err := io.ReadFull(f, buf)
+	if n != 10 || err != io.ErrUnexpectedEOF || !bytes.Equal(buf[:n], data[len(data)-10:]) {
+		t.Errorf("unexpected read at the end %d, %v", n, err)
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	c := newTestClient(t, vfs.Memory())
+	if err := vfs.WriteFile(c, "f", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.OpenFile("f", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" world"))
+	if _, err := f.Read(make([]byte, 1)); err != vfs.ErrWriteOnly {
+		t.Errorf("expecting ErrWriteOnly, got %v", err)
+	}
+	f.Close()
+	data, _ := vfs.ReadFile(c, "f")
+	if string(data) != "hello world" {
+		t.Errorf("unexpected contents after append %q", string(data))
+	}
+	rf, err := c.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rf.(vfs.WFile).Write([]byte("x")); err != vfs.ErrReadOnly {
+		t.Errorf("expecting ErrReadOnly, got %v", err)
+	}
+	rf.Close()
+	if _, err := c.Open("/"); err == nil {
+		t.Error("expecting an error opening a directory as a file")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	fs := vfs.Memory()
+	if err := vfs.WriteFile(fs, "f", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, vfs.ReadOnly(fs))
+	if err := vfs.WriteFile(c, "f", nil, 0644); err != vfs.ErrReadOnlyFileSystem {
+		t.Errorf("expecting ErrReadOnlyFileSystem, got %v", err)
+	}
+	if err := c.Remove("f"); err != vfs.ErrReadOnlyFileSystem {
+		t.Errorf("expecting ErrReadOnlyFileSystem, got %v", err)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	fs := vfs.Memory()
+	client, server := net.Pipe()
+	go ServeConn(server, fs)
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for ii := 0; ii < 10; ii++ {
+		wg.Add(1)
+		go func(ii int) {
+			defer wg.Done()
+			name := fmt.Sprintf("file%d", ii)
+			contents := bytes.Repeat([]byte(name), 1000)
+			if err := vfs.WriteFile(c, name, contents, 0644); err != nil {
+				errs <- err
+				return
+			}
+			data, err := vfs.ReadFile(c, name)
+			if err == nil && !bytes.Equal(data, contents) {
+				err = fmt.Errorf("unexpected contents for %s", name)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(ii)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	infos, err := c.ReadDir("/")
+	if err != nil || len(infos) != 10 {
+		t.Errorf("expecting 10 files, got %d, %v", len(infos), err)
+	}
+	c.Close()
+	if _, err := c.Stat("/"); err != ErrClientClosed {
+		t.Errorf("expecting ErrClientClosed, got %v", err)
+	}
+}
+
+// rawConn sends hand-crafted messages to a server.
+type rawConn struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func newRawConn(t *testing.T, fs vfs.VFS) *rawConn {
+	client, server := net.Pipe()
+	go ServeConn(server, fs)
+	t.Cleanup(func() { client.Close() })
+	return &rawConn{t: t, conn: client}
+}
+
+func (c *rawConn) send(typ uint8, fn func(m *encoder)) (uint8, *decoder) {
+	m := newMessage(typ, 1)
+	fn(m)
+	if _, err := c.conn.Write(m.bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+	rtyp, _, d, err := readMessage(c.conn, DefaultMsize)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return rtyp, d
+}
+
+// rpc is like send, but fails the test if the response is
+// an Rlerror.
+func (c *rawConn) rpc(typ uint8, fn func(m *encoder)) *decoder {
+	rtyp, d := c.send(typ, fn)
+	if rtyp == rlerror {
+		c.t.Fatalf("unexpected error for message type %d: %v", typ, Errno(d.u32()))
+	}
+	return d
+}
+
+func TestMsize(t *testing.T) {
+	c := newRawConn(t, vfs.Memory())
+	typ, d := c.send(tversion, func(m *encoder) {
+		m.u32(ioHeaderSize - 1)
+		m.str(Version)
+	})
+	if typ != rlerror || Errno(d.u32()) != EINVAL {
+		t.Errorf("expecting EINVAL for a too small msize, got message type %d", typ)
+	}
+	// Server replying with a too small msize
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		if _, _, _, err := readMessage(server, DefaultMsize); err != nil {
+			return
+		}
+		m := newMessage(tversion+1, noTag)
+		m.u32(ioHeaderSize - 1)
+		m.str(Version)
+		server.Write(m.bytes())
+		// Reply to Tattach, if the client sends it
+		_, tag, _, err := readMessage(server, DefaultMsize)
+		if err != nil {
+			return
+		}
+		m = newMessage(tattach+1, tag)
+		m.qid(qid{typ: qtDir})
+		server.Write(m.bytes())
+	}()
+	if _, err := NewClient(client); err == nil {
+		t.Error("expecting an error with a too small msize")
+	}
+}
+
+func TestTruncateOpenFile(t *testing.T) {
+	fs := vfs.Memory()
+	c := newRawConn(t, fs)
+	c.rpc(tversion, func(m *encoder) {
+		m.u32(DefaultMsize)
+		m.str(Version)
+	})
+	c.rpc(tattach, func(m *encoder) {
+		m.u32(0)
+		m.u32(noFid)
+		m.str("")
+		m.str("")
+		m.u32(noFid)
+	})
+	// fid 1 is open for writing, while fid 2 is used for truncating
+	for _, fid := range []uint32{1, 2} {
+		c.rpc(twalk, func(m *encoder) {
+			m.u32(0)
+			m.u32(fid)
+			m.u16(0)
+		})
+	}
+	c.rpc(tlcreate, func(m *encoder) {
+		m.u32(1)
+		m.str("f")
+		m.u32(lORdwr)
+		m.u32(0644)
+		m.u32(0)
+	})
+	c.rpc(twrite, func(m *encoder) {
+		m.u32(1)
+		m.u64(0)
+		m.data([]byte("hello world"))
+	})
+	c.rpc(twalk, func(m *encoder) {
+		m.u32(2)
+		m.u32(3)
+		m.u16(1)
+		m.str("f")
+	})
+	c.rpc(tsetattr, func(m *encoder) {
+		m.u32(3)
+		m.u32(setattrSize)
+		m.u32(0) // mode
+		m.u32(0) // uid
+		m.u32(0) // gid
+		m.u64(5)
+		for ii := 0; ii < 4; ii++ {
+			m.u64(0) // atime, mtime
+		}
+	})
+	// Writing after the truncation must not restore the old data
+	c.rpc(twrite, func(m *encoder) {
+		m.u32(1)
+		m.u64(5)
+		m.data([]byte("!"))
+	})
+	c.rpc(tclunk, func(m *encoder) {
+		m.u32(1)
+	})
+	if data, err := vfs.ReadFile(fs, "f"); err != nil || string(data) != "hello!" {
+		t.Errorf("expecting f to contain \"hello!\", got %q (%v)", string(data), err)
+	}
+}
@@ -0,0 +1,426 @@
+// Package ninep implements a 9P2000.L server which serves a VFS, as well
+// as a client which implements the VFS interface on top of a 9P2000.L
+// connection.
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rainycape/vfs"
+)
+
+const (
+	// Version is the protocol version implemented by this package.
+	Version = "9P2000.L"
+
+	noTag   = 0xffff
+	noFid   = 0xffffffff
+	maxWalk = 16
+	// Space reserved for the headers in Tread/Twrite messages,
+	// matching the value used by Linux.
+	ioHeaderSize = 24
+	// Smallest msize accepted, enough for the largest fixed size
+	// message (Rgetattr, 160 bytes) plus ioHeaderSize.
+	minMsize = 160 + ioHeaderSize
+	// DefaultMsize is the default maximum message size.
+	DefaultMsize = 64*1024 + ioHeaderSize
+)
+
+// Message types
+const (
+	tlerror    = 6
+	rlerror    = 7
+	tstatfs    = 8
+	rstatfs    = 9
+	tlopen     = 12
+	rlopen     = 13
+	tlcreate   = 14
+	rlcreate   = 15
+	treadlink  = 22
+	rreadlink  = 23
+	tgetattr   = 24
+	rgetattr   = 25
+	tsetattr   = 26
+	rsetattr   = 27
+	txattrwalk = 30
+	rxattrwalk = 31
+	treaddir   = 40
+	rreaddir   = 41
+	tfsync     = 50
+	rfsync     = 51
+	tmkdir     = 72
+	rmkdir     = 73
+	tunlinkat  = 76
+	runlinkat  = 77
+	tversion   = 100
+	rversion   = 101
+	tattach    = 104
+	rattach    = 105
+	tflush     = 108
+	rflush     = 109
+	twalk      = 110
+	rwalk      = 111
+	tread      = 116
+	rread      = 117
+	twrite     = 118
+	rwrite     = 119
+	tclunk     = 120
+	rclunk     = 121
+	tremove    = 122
+	rremove    = 123
+)
+
+// Qid types
+const (
+	qtDir  = 0x80
+	qtFile = 0x00
+)
+
+// Linux open flags, used by Tlopen and Tlcreate
+const (
+	lORdonly = 00
+	lOWronly = 01
+	lORdwr   = 02
+	lOAccess = 03
+	lOCreat  = 0100
+	lOExcl   = 0200
+	lOTrunc  = 01000
+	lOAppend = 02000
+)
+
+// Linux file modes
+const (
+	sIFMT  = 0170000
+	sIFDIR = 0040000
+	sIFREG = 0100000
+	sIFLNK = 0120000
+)
+
+const (
+	getattrBasic = 0x7ff
+	setattrSize  = 0x8
+	atRemoveDir  = 0x200
+	dtDir        = 4
+	dtReg        = 8
+	v9fsMagic    = 0x01021997
+)
+
+var (
+	errShortMessage = errors.New("9p: short message")
+	errInvalidSize  = errors.New("9p: invalid message size")
+)
+
+// Errno represents a Linux error number, as sent in Rlerror messages.
+type Errno uint32
+
+// Error numbers used by this package.
+const (
+	EPERM     Errno = 1
+	ENOENT    Errno = 2
+	EIO       Errno = 5
+	EBADF     Errno = 9
+	EACCES    Errno = 13
+	EBUSY     Errno = 16
+	EEXIST    Errno = 17
+	ENOTDIR   Errno = 20
+	EISDIR    Errno = 21
+	EINVAL    Errno = 22
+	EROFS     Errno = 30
+	ENOSYS    Errno = 38
+	ENOTEMPTY Errno = 39
+	EPROTO    Errno = 71
+	ENOTSUP   Errno = 95
+)
+
+var errnoNames = map[Errno]string{
+	EPERM:     "operation not permitted",
+	ENOENT:    "no such file or directory",
+	EIO:       "input/output error",
+	EBADF:     "bad file descriptor",
+	EACCES:    "permission denied",
+	EBUSY:     "device or resource busy",
+	EEXIST:    "file exists",
+	ENOTDIR:   "not a directory",
+	EISDIR:    "is a directory",
+	EINVAL:    "invalid argument",
+	EROFS:     "read-only file system",
+	ENOSYS:    "function not implemented",
+	ENOTEMPTY: "directory not empty",
+	EPROTO:    "protocol error",
+	ENOTSUP:   "operation not supported",
+}
+
+func (e Errno) Error() string {
+	if s := errnoNames[e]; s != "" {
+		return s
+	}
+	return fmt.Sprintf("errno %d", uint32(e))
+}
+
+// toErrno converts an error returned by a VFS to an Errno.
+func toErrno(err error) Errno {
+	var errno Errno
+	switch {
+	case errors.As(err, &errno):
+		return errno
+	case vfs.IsNotExist(err):
+		return ENOENT
+	case vfs.IsExist(err):
+		return EEXIST
+	case errors.Is(err, vfs.ErrReadOnlyFileSystem):
+		return EROFS
+	case errors.Is(err, vfs.ErrReadOnly), errors.Is(err, vfs.ErrWriteOnly):
+		return EBADF
+	case os.IsPermission(err):
+		return EACCES
+	}
+	s := err.Error()
+	switch {
+	case strings.Contains(s, "not a directory"):
+		return ENOTDIR
+	case strings.Contains(s, "not a file"):
+		return EISDIR
+	case strings.Contains(s, "not empty"):
+		return ENOTEMPTY
+	}
+	return EIO
+}
+
+// fromErrno converts an Errno received from a server to the error
+// a VFS would return.
+func fromErrno(errno Errno) error {
+	switch errno {
+	case ENOENT:
+		return os.ErrNotExist
+	case EEXIST:
+		return os.ErrExist
+	case EROFS:
+		return vfs.ErrReadOnlyFileSystem
+	case EACCES, EPERM:
+		return os.ErrPermission
+	}
+	return errno
+}
+
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+// encoder builds a message. The size is filled in by bytes.
+type encoder struct {
+	buf []byte
+}
+
+func newMessage(typ uint8, tag uint16) *encoder {
+	e := &encoder{buf: make([]byte, 4, 64)}
+	e.u8(typ)
+	e.u16(tag)
+	return e
+}
+
+func (e *encoder) u8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) u16(v uint16) {
+	e.buf = binary.LittleEndian.AppendUint16(e.buf, v)
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) u64(v uint64) {
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+}
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) qid(q qid) {
+	e.u8(q.typ)
+	e.u32(q.version)
+	e.u64(q.path)
+}
+
+func (e *encoder) data(p []byte) {
+	e.u32(uint32(len(p)))
+	e.buf = append(e.buf, p...)
+}
+
+func (e *encoder) setTag(tag uint16) {
+	binary.LittleEndian.PutUint16(e.buf[5:], tag)
+}
+
+func (e *encoder) bytes() []byte {
+	binary.LittleEndian.PutUint32(e.buf, uint32(len(e.buf)))
+	return e.buf
+}
+
+// decoder reads the fields from a message body. Once an error
+// happens, all subsequent calls return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = errShortMessage
+		d.buf = nil
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) u16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) u32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) u64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) str() string {
+	return string(d.next(int(d.u16())))
+}
+
+func (d *decoder) qid() qid {
+	return qid{typ: d.u8(), version: d.u32(), path: d.u64()}
+}
+
+func (d *decoder) data() []byte {
+	return d.next(int(d.u32()))
+}
+
+// readMessage reads a message from r, returning its type, tag and body.
+func readMessage(r io.Reader, msize uint32) (uint8, uint16, *decoder, error) {
+	var hdr [7]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[:])
+	if size < 7 || size > msize {
+		return 0, 0, nil, errInvalidSize
+	}
+	body := make([]byte, size-7)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, nil, err
+	}
+	return hdr[4], binary.LittleEndian.Uint16(hdr[5:]), &decoder{buf: body}, nil
+}
+
+// toLinuxMode converts an os.FileMode to a Linux file mode.
+func toLinuxMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		m |= sIFDIR
+	case mode&os.ModeSymlink != 0:
+		m |= sIFLNK
+	default:
+		m |= sIFREG
+	}
+	return m
+}
+
+// fromLinuxMode converts a Linux file mode to an os.FileMode.
+func fromLinuxMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	switch m & sIFMT {
+	case sIFDIR:
+		mode |= os.ModeDir
+	case sIFLNK:
+		mode |= os.ModeSymlink
+	}
+	return mode
+}
+
+// toLinuxFlags converts os.OpenFile flags to Linux open flags.
+func toLinuxFlags(flag int) uint32 {
+	var f uint32
+	switch {
+	case flag&os.O_RDWR != 0:
+		f = lORdwr
+	case flag&os.O_WRONLY != 0:
+		f = lOWronly
+	default:
+		f = lORdonly
+	}
+	if flag&os.O_CREATE != 0 {
+		f |= lOCreat
+	}
+	if flag&os.O_EXCL != 0 {
+		f |= lOExcl
+	}
+	if flag&os.O_TRUNC != 0 {
+		f |= lOTrunc
+	}
+	if flag&os.O_APPEND != 0 {
+		f |= lOAppend
+	}
+	return f
+}
+
+// fromLinuxFlags converts Linux open flags to os.OpenFile flags.
+func fromLinuxFlags(f uint32) int {
+	var flag int
+	switch f & lOAccess {
+	case lOWronly:
+		flag = os.O_WRONLY
+	case lORdwr:
+		flag = os.O_RDWR
+	default:
+		flag = os.O_RDONLY
+	}
+	if f&lOCreat != 0 {
+		flag |= os.O_CREATE
+	}
+	if f&lOExcl != 0 {
+		flag |= os.O_EXCL
+	}
+	if f&lOTrunc != 0 {
+		flag |= os.O_TRUNC
+	}
+	if f&lOAppend != 0 {
+		flag |= os.O_APPEND
+	}
+	return flag
+}
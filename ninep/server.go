@@ -0,0 +1,679 @@
+package ninep
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"path"
+
+	"github.com/rainycape/vfs"
+)
+
+type serverFid struct {
+	path   string
+	isDir  bool
+	opened bool
+	// flag is the flag passed to OpenFile for files
+	// opened for writing
+	flag int
+	rf   vfs.RFile
+	// wf is non-nil only for files opened for writing
+	wf  vfs.WFile
+	pos int64
+	dir []os.FileInfo
+}
+
+func (f *serverFid) close() {
+	if f.rf != nil {
+		f.rf.Close()
+		f.rf = nil
+		f.wf = nil
+	}
+}
+
+type serverConn struct {
+	fs    vfs.VFS
+	msize uint32
+	fids  map[uint32]*serverFid
+}
+
+func qidFor(p string, info os.FileInfo) qid {
+	h := fnv.New64a()
+	h.Write([]byte(p))
+	q := qid{typ: qtFile, path: h.Sum64()}
+	if info != nil {
+		if info.IsDir() {
+			q.typ = qtDir
+		}
+		q.version = uint32(info.ModTime().UnixNano())
+	}
+	return q
+}
+
+func (s *serverConn) fid(d *decoder) (*serverFid, error) {
+	f := s.fids[d.u32()]
+	if d.err != nil {
+		return nil, d.err
+	}
+	if f == nil {
+		return nil, EBADF
+	}
+	return f, nil
+}
+
+func (s *serverConn) newFid(fid uint32) error {
+	if fid == noFid || s.fids[fid] != nil {
+		return EBADF
+	}
+	return nil
+}
+
+func (s *serverConn) clunkAll() {
+	for _, v := range s.fids {
+		v.close()
+	}
+	s.fids = make(map[uint32]*serverFid)
+}
+
+func (s *serverConn) version(d *decoder, r *encoder) error {
+	msize := d.u32()
+	version := d.str()
+	if d.err != nil {
+		return d.err
+	}
+	if msize < minMsize {
+		return EINVAL
+	}
+	if msize < s.msize {
+		s.msize = msize
+	}
+	s.clunkAll()
+	r.u32(s.msize)
+	if version != Version {
+		version = "unknown"
+	}
+	r.str(version)
+	return nil
+}
+
+func (s *serverConn) attach(d *decoder, r *encoder) error {
+	fid := d.u32()
+	d.u32() // afid
+	d.str() // uname
+	aname := d.str()
+	if d.err != nil {
+		return d.err
+	}
+	if err := s.newFid(fid); err != nil {
+		return err
+	}
+	p := path.Clean("/" + aname)
+	info, err := s.fs.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return ENOTDIR
+	}
+	s.fids[fid] = &serverFid{path: p, isDir: true}
+	r.qid(qidFor(p, info))
+	return nil
+}
+
+func (s *serverConn) walk(d *decoder, r *encoder) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	newfid := d.u32()
+	names := make([]string, d.u16())
+	for ii := range names {
+		names[ii] = d.str()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(names) > maxWalk {
+		return EINVAL
+	}
+	if f.opened {
+		return EBADF
+	}
+	if s.fids[newfid] != f {
+		if err := s.newFid(newfid); err != nil {
+			return err
+		}
+	}
+	p := f.path
+	isDir := f.isDir
+	var qids []qid
+	for ii, v := range names {
+		if !isDir {
+			err = ENOTDIR
+		} else {
+			p = path.Join(p, v)
+			var info os.FileInfo
+			if info, err = s.fs.Stat(p); err == nil {
+				isDir = info.IsDir()
+				qids = append(qids, qidFor(p, info))
+			}
+		}
+		if err != nil {
+			if ii == 0 {
+				return err
+			}
+			break
+		}
+	}
+	if len(qids) == len(names) {
+		s.fids[newfid] = &serverFid{path: p, isDir: isDir}
+	}
+	r.u16(uint16(len(qids)))
+	for _, v := range qids {
+		r.qid(v)
+	}
+	return nil
+}
+
+func (s *serverConn) iounit() uint32 {
+	return s.msize - ioHeaderSize
+}
+
+func (s *serverConn) open(f *serverFid, p string, flag int, perm os.FileMode) (os.FileInfo, error) {
+	flag &^= os.O_APPEND
+	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR|os.O_TRUNC) == 0 {
+		rf, err := s.fs.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		f.rf = rf
+	} else {
+		wf, err := s.fs.OpenFile(p, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		f.rf = wf
+		f.wf = wf
+		f.flag = flag
+	}
+	f.path = p
+	f.opened = true
+	f.pos = 0
+	info, _ := s.fs.Stat(p)
+	return info, nil
+}
+
+func (s *serverConn) lopen(d *decoder, r *encoder) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	flags := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	if f.opened {
+		return EBADF
+	}
+	if f.isDir {
+		if flags&lOAccess != lORdonly {
+			return EISDIR
+		}
+		info, err := s.fs.Stat(f.path)
+		if err != nil {
+			return err
+		}
+		f.opened = true
+		f.dir = nil
+		r.qid(qidFor(f.path, info))
+		r.u32(s.iounit())
+		return nil
+	}
+	info, err := s.open(f, f.path, fromLinuxFlags(flags)&^(os.O_CREATE|os.O_EXCL), 0)
+	if err != nil {
+		return err
+	}
+	r.qid(qidFor(f.path, info))
+	r.u32(s.iounit())
+	return nil
+}
+
+func (s *serverConn) lcreate(d *decoder, r *encoder) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	name := d.str()
+	flags := d.u32()
+	mode := d.u32()
+	d.u32() // gid
+	if d.err != nil {
+		return d.err
+	}
+	if !f.isDir || f.opened {
+		return ENOTDIR
+	}
+	p := path.Join(f.path, name)
+	info, err := s.open(f, p, fromLinuxFlags(flags)|os.O_CREATE, os.FileMode(mode&0777))
+	if err != nil {
+		return err
+	}
+	f.isDir = false
+	r.qid(qidFor(p, info))
+	r.u32(s.iounit())
+	return nil
+}
+
+func (s *serverConn) seek(f *serverFid, offset int64) error {
+	if f.pos != offset {
+		if _, err := f.rf.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		f.pos = offset
+	}
+	return nil
+}
+
+func (s *serverConn) read(d *decoder, r *encoder) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	offset := int64(d.u64())
+	count := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	if f.isDir {
+		return EISDIR
+	}
+	if !f.opened {
+		return EBADF
+	}
+	if count > s.iounit() {
+		count = s.iounit()
+	}
+	if err := s.seek(f, offset); err != nil {
+		return err
+	}
+	buf := make([]byte, count)
+	n, err := io.ReadFull(f.rf, buf)
+	f.pos += int64(n)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	r.data(buf[:n])
+	return nil
+}
+
+func (s *serverConn) write(d *decoder, r *encoder) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	offset := int64(d.u64())
+	data := d.data()
+	if d.err != nil {
+		return d.err
+	}
+	if !f.opened || f.wf == nil {
+		return EBADF
+	}
+	if err := s.seek(f, offset); err != nil {
+		return err
+	}
+	n, err := f.wf.Write(data)
+	f.pos += int64(n)
+	if err != nil && n == 0 {
+		return err
+	}
+	r.u32(uint32(n))
+	return nil
+}
+
+func (s *serverConn) clunk(d *decoder, r *encoder) error {
+	fid := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	f := s.fids[fid]
+	if f == nil {
+		return EBADF
+	}
+	delete(s.fids, fid)
+	if f.rf != nil {
+		err := f.rf.Close()
+		f.rf = nil
+		return err
+	}
+	return nil
+}
+
+func (s *serverConn) remove(d *decoder, r *encoder) error {
+	fid := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	f := s.fids[fid]
+	if f == nil {
+		return EBADF
+	}
+	delete(s.fids, fid)
+	f.close()
+	if f.path == "/" {
+		return EBUSY
+	}
+	return s.fs.Remove(f.path)
+}
+
+func (s *serverConn) getattr(d *decoder, r *encoder) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	d.u64() // request mask
+	if d.err != nil {
+		return d.err
+	}
+	info, err := s.fs.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	size := uint64(info.Size())
+	if info.IsDir() {
+		size = 0
+	}
+	mtime := info.ModTime()
+	sec := uint64(mtime.Unix())
+	nsec := uint64(mtime.Nanosecond())
+	r.u64(getattrBasic)
+	r.qid(qidFor(f.path, info))
+	r.u32(toLinuxMode(info.Mode()))
+	r.u32(0) // uid
+	r.u32(0) // gid
+	r.u64(1) // nlink
+	r.u64(0) // rdev
+	r.u64(size)
+	r.u64(4096)               // blksize
+	r.u64((size + 511) / 512) // blocks
+	for ii := 0; ii < 3; ii++ {
+		// atime, mtime, ctime
+		r.u64(sec)
+		r.u64(nsec)
+	}
+	r.u64(0) // btime
+	r.u64(0)
+	r.u64(0) // gen
+	r.u64(0) // data version
+	return nil
+}
+
+func (s *serverConn) setattr(d *decoder, r *encoder) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	valid := d.u32()
+	d.u32() // mode
+	d.u32() // uid
+	d.u32() // gid
+	size := int64(d.u64())
+	if d.err != nil {
+		return d.err
+	}
+	// Only truncation is supported, other attributes are ignored.
+	if valid&setattrSize == 0 {
+		return nil
+	}
+	info, err := s.fs.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return EISDIR
+	}
+	return s.truncate(f.path, size)
+}
+
+// truncate truncates the file at p, closing the files open for
+// writing at p first and reopening them afterwards. Otherwise,
+// closing them later would overwrite the truncated file.
+func (s *serverConn) truncate(p string, size int64) error {
+	var open []*serverFid
+	for _, v := range s.fids {
+		if v.wf != nil && v.path == p {
+			if err := v.wf.Close(); err != nil {
+				return err
+			}
+			v.rf = nil
+			v.wf = nil
+			open = append(open, v)
+		}
+	}
+	err := vfs.Truncate(s.fs, p, size)
+	for _, v := range open {
+		// The offset is restored by the next read or write
+		wf, oerr := s.fs.OpenFile(p, v.flag&^(os.O_CREATE|os.O_EXCL|os.O_TRUNC), 0)
+		if oerr != nil {
+			if err == nil {
+				err = oerr
+			}
+			// Reads and writes will fail with EBADF
+			v.opened = false
+			continue
+		}
+		v.rf = wf
+		v.wf = wf
+		v.pos = 0
+	}
+	return err
+}
+
+func (s *serverConn) readdir(d *decoder, r *encoder) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	offset := d.u64()
+	count := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	if !f.isDir {
+		return ENOTDIR
+	}
+	if !f.opened {
+		return EBADF
+	}
+	if offset == 0 || f.dir == nil {
+		if f.dir, err = s.fs.ReadDir(f.path); err != nil {
+			return err
+		}
+	}
+	if count > s.iounit() {
+		count = s.iounit()
+	}
+	entries := &encoder{}
+	for ii := offset; ii < uint64(len(f.dir)); ii++ {
+		info := f.dir[ii]
+		name := info.Name()
+		if uint32(len(entries.buf)+13+8+1+2+len(name)) > count {
+			break
+		}
+		p := path.Join(f.path, name)
+		entries.qid(qidFor(p, info))
+		entries.u64(ii + 1)
+		if info.IsDir() {
+			entries.u8(dtDir)
+		} else {
+			entries.u8(dtReg)
+		}
+		entries.str(name)
+	}
+	r.data(entries.buf)
+	return nil
+}
+
+func (s *serverConn) mkdir(d *decoder, r *encoder) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	name := d.str()
+	mode := d.u32()
+	d.u32() // gid
+	if d.err != nil {
+		return d.err
+	}
+	if !f.isDir {
+		return ENOTDIR
+	}
+	p := path.Join(f.path, name)
+	if err := s.fs.Mkdir(p, os.FileMode(mode&0777)); err != nil {
+		return err
+	}
+	info, _ := s.fs.Stat(p)
+	r.qid(qidFor(p, info))
+	return nil
+}
+
+func (s *serverConn) unlinkat(d *decoder, r *encoder) error {
+	f, err := s.fid(d)
+	if err != nil {
+		return err
+	}
+	name := d.str()
+	flags := d.u32()
+	if d.err != nil {
+		return d.err
+	}
+	if !f.isDir {
+		return ENOTDIR
+	}
+	p := path.Join(f.path, name)
+	info, err := s.fs.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if flags&atRemoveDir != 0 && !info.IsDir() {
+		return ENOTDIR
+	}
+	if flags&atRemoveDir == 0 && info.IsDir() {
+		return EISDIR
+	}
+	return s.fs.Remove(p)
+}
+
+func (s *serverConn) statfs(d *decoder, r *encoder) error {
+	if _, err := s.fid(d); err != nil {
+		return err
+	}
+	r.u32(v9fsMagic)
+	r.u32(4096) // bsize
+	r.u64(0)    // blocks
+	r.u64(0)    // bfree
+	r.u64(0)    // bavail
+	r.u64(0)    // files
+	r.u64(0)    // ffree
+	r.u64(0)    // fsid
+	r.u32(255)  // namelen
+	return nil
+}
+
+func (s *serverConn) handle(typ uint8, d *decoder, r *encoder) error {
+	switch typ {
+	case tversion:
+		return s.version(d, r)
+	case tattach:
+		return s.attach(d, r)
+	case twalk:
+		return s.walk(d, r)
+	case tlopen:
+		return s.lopen(d, r)
+	case tlcreate:
+		return s.lcreate(d, r)
+	case tread:
+		return s.read(d, r)
+	case twrite:
+		return s.write(d, r)
+	case tclunk:
+		return s.clunk(d, r)
+	case tremove:
+		return s.remove(d, r)
+	case tgetattr:
+		return s.getattr(d, r)
+	case tsetattr:
+		return s.setattr(d, r)
+	case treaddir:
+		return s.readdir(d, r)
+	case tmkdir:
+		return s.mkdir(d, r)
+	case tunlinkat:
+		return s.unlinkat(d, r)
+	case tstatfs:
+		return s.statfs(d, r)
+	case tfsync:
+		_, err := s.fid(d)
+		return err
+	case tflush:
+		// Requests are handled sequentially, so there's never
+		// a pending request to flush.
+		return nil
+	case treadlink:
+		// Symlinks are always followed
+		return EINVAL
+	case txattrwalk:
+		return ENOTSUP
+	}
+	return ENOSYS
+}
+
+// ServeConn serves the given VFS over 9P2000.L on the given connection,
+// until it's closed. Requests are handled sequentially, in the order they
+// were received. Since the VFS interface does not provide a way to read
+// symlinks, symlinks are always followed and presented as the files or
+// directories they point to.
+func ServeConn(conn io.ReadWriteCloser, fs vfs.VFS) error {
+	defer conn.Close()
+	s := &serverConn{
+		fs:    fs,
+		msize: DefaultMsize,
+		fids:  make(map[uint32]*serverFid),
+	}
+	defer s.clunkAll()
+	for {
+		typ, tag, d, err := readMessage(conn, s.msize)
+		if err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		r := newMessage(typ+1, tag)
+		if err := s.handle(typ, d, r); err != nil {
+			r = newMessage(rlerror, tag)
+			if err == errShortMessage {
+				err = EPROTO
+			}
+			r.u32(uint32(toErrno(err)))
+		}
+		if _, err := conn.Write(r.bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+// Serve accepts connections on the given net.Listener and serves the
+// given VFS over 9P2000.L on each of them, using ServeConn. It returns
+// when l.Accept fails.
+func Serve(l net.Listener, fs vfs.VFS) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go ServeConn(conn, fs)
+	}
+}
@@ -6,12 +6,12 @@ import (
 	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"path/filepath"
-	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 )
 
 // Zip returns an in-memory VFS initialized with the
@@ -21,6 +21,13 @@ import (
 // into memory and provide its own buffering if r does not
 // implement io.ReaderAt or size is <= 0.
 func Zip(r io.Reader, size int64) (VFS, error) {
+	return ReadZip(r, size, nil)
+}
+
+// ReadZip works like Zip, but accepts an *ArchiveOptions. Directories
+// keep their archived mode and modification time, while entries with
+// os.ModeSymlink set are created as symbolic links.
+func ReadZip(r io.Reader, size int64, opts *ArchiveOptions) (VFS, error) {
 	rat, _ := r.(io.ReaderAt)
 	if rat == nil || size <= 0 {
 		data, err := ioutil.ReadAll(r)
@@ -34,9 +41,11 @@ func Zip(r io.Reader, size int64) (VFS, error) {
 	if err != nil {
 		return nil, err
 	}
-	files := make(map[string]*File)
+	a := newArchive(opts)
 	for _, file := range zr.File {
-		if file.Mode().IsDir() {
+		mode := file.Mode()
+		if mode.IsDir() {
+			a.addDir(file.Name, mode, file.ModTime())
 			continue
 		}
 		f, err := file.Open()
@@ -48,19 +57,28 @@ func Zip(r io.Reader, size int64) (VFS, error) {
 		if err != nil {
 			return nil, err
 		}
-		files[file.Name] = &File{
-			Data:    data,
-			Mode:    file.Mode(),
-			ModTime: file.ModTime(),
+		if mode&os.ModeSymlink != 0 {
+			if err := a.addSymlink(file.Name, string(data), mode, file.ModTime()); err != nil {
+				return nil, err
+			}
+			continue
 		}
+		a.addFile(file.Name, data, mode, file.ModTime())
 	}
-	return Map(files)
+	return a.VFS()
 }
 
 // Tar returns an in-memory VFS initialized with the
 // contents of the .tar file read from the given io.Reader.
 func Tar(r io.Reader) (VFS, error) {
-	files := make(map[string]*File)
+	return ReadTar(r, nil)
+}
+
+// ReadTar works like Tar, but accepts an *ArchiveOptions. Directories
+// keep their archived mode and modification time, symbolic links are
+// preserved and hard links share their data with the linked file.
+func ReadTar(r io.Reader, opts *ArchiveOptions) (VFS, error) {
+	a := newArchive(opts)
 	tr := tar.NewReader(r)
 	for {
 		hdr, err := tr.Next()
@@ -70,73 +88,84 @@ func Tar(r io.Reader) (VFS, error) {
 			}
 			return nil, err
 		}
-		if hdr.FileInfo().IsDir() {
-			continue
-		}
-		data, err := ioutil.ReadAll(tr)
-		if err != nil {
-			return nil, err
-		}
-		files[hdr.Name] = &File{
-			Data:    data,
-			Mode:    hdr.FileInfo().Mode(),
-			ModTime: hdr.ModTime,
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			a.addDir(hdr.Name, mode, hdr.ModTime)
+		case tar.TypeSymlink:
+			if err := a.addSymlink(hdr.Name, hdr.Linkname, mode, hdr.ModTime); err != nil {
+				return nil, err
+			}
+		case tar.TypeLink:
+			if err := a.addHardLink(hdr.Name, hdr.Linkname); err != nil {
+				return nil, err
+			}
+		default:
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			a.addFile(hdr.Name, data, mode, hdr.ModTime)
 		}
 	}
-	return Map(files)
+	return a.VFS()
 }
 
 // TarGzip returns an in-memory VFS initialized with the
 // contents of the .tar.gz file read from the given io.Reader.
 func TarGzip(r io.Reader) (VFS, error) {
+	return ReadTarGzip(r, nil)
+}
+
+// ReadTarGzip works like TarGzip, but accepts an *ArchiveOptions.
+func ReadTarGzip(r io.Reader, opts *ArchiveOptions) (VFS, error) {
 	zr, err := gzip.NewReader(r)
 	if err != nil {
 		return nil, err
 	}
 	defer zr.Close()
-	return Tar(zr)
+	return ReadTar(zr, opts)
 }
 
 // TarBzip2 returns an in-memory VFS initialized with the
 // contents of then .tar.bz2 file read from the given io.Reader.
 func TarBzip2(r io.Reader) (VFS, error) {
+	return ReadTarBzip2(r, nil)
+}
+
+// ReadTarBzip2 works like TarBzip2, but accepts an *ArchiveOptions.
+func ReadTarBzip2(r io.Reader, opts *ArchiveOptions) (VFS, error) {
 	bzr := bzip2.NewReader(r)
-	return Tar(bzr)
+	return ReadTar(bzr, opts)
+}
+
+// TarXz returns an in-memory VFS initialized with the
+// contents of the .tar.xz file read from the given io.Reader.
+func TarXz(r io.Reader) (VFS, error) {
+	return ReadTarXz(r, nil)
 }
 
-// Open returns an in-memory VFS initialized with the contents
-// of the given filename, which must have one of the following
-// extensions:
-//
-//  - .zip
-//  - .tar
-//  - .tar.gz
-//  - .tar.bz2
-func Open(filename string) (VFS, error) {
-	f, err := os.Open(filename)
+// ReadTarXz works like TarXz, but accepts an *ArchiveOptions.
+func ReadTarXz(r io.Reader, opts *ArchiveOptions) (VFS, error) {
+	xzr, err := xz.NewReader(r)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	base := filepath.Base(filename)
-	ext := strings.ToLower(filepath.Ext(base))
-	nonExt := filename[:len(filename)-len(ext)]
-	if strings.ToLower(filepath.Ext(nonExt)) == ".tar" {
-		ext = ".tar" + ext
-	}
-	switch ext {
-	case ".zip":
-		st, err := f.Stat()
-		if err != nil {
-			return nil, err
-		}
-		return Zip(f, st.Size())
-	case ".tar":
-		return Tar(f)
-	case ".tar.gz":
-		return TarGzip(f)
-	case ".tar.bz2":
-		return TarBzip2(f)
+	return ReadTar(xzr, opts)
+}
+
+// TarZstd returns an in-memory VFS initialized with the
+// contents of the .tar.zst file read from the given io.Reader.
+func TarZstd(r io.Reader) (VFS, error) {
+	return ReadTarZstd(r, nil)
+}
+
+// ReadTarZstd works like TarZstd, but accepts an *ArchiveOptions.
+func ReadTarZstd(r io.Reader, opts *ArchiveOptions) (VFS, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("can't open a VFS from a %s file", ext)
+	defer zr.Close()
+	return ReadTar(zr, opts)
 }
@@ -1,8 +1,19 @@
 package vfs
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 )
 
 func testOpenedVFS(t *testing.T, fs VFS) {
@@ -29,6 +40,13 @@ func testOpenFilename(t *testing.T, filename string) {
 		t.Fatal(err)
 	}
 	testOpenedVFS(t, fs)
+	info, err := fs.Stat("/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0775 {
+		t.Errorf("expecting a/b to be a directory with mode 0775, got %s", info.Mode())
+	}
 }
 
 func TestOpenZip(t *testing.T) {
@@ -46,3 +64,510 @@ func TestOpenTarGzip(t *testing.T) {
 func TestOpenTarBzip2(t *testing.T) {
 	testOpenFilename(t, "fs.tar.bz2")
 }
+
+func TestOpenTarXz(t *testing.T) {
+	testOpenFilename(t, "fs.tar.xz")
+}
+
+func TestOpenTarZstd(t *testing.T) {
+	testOpenFilename(t, "fs.tar.zst")
+}
+
+func openLazyZip(t *testing.T, filename string) VFS {
+	f, err := os.Open(filepath.Join("testdata", filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := LazyZip(f, st.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestLazyZip(t *testing.T) {
+	fs := openLazyZip(t, "fs.zip")
+	testOpenedVFS(t, fs)
+	files, dirs, err := countFileSystem(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 2 || dirs != 4 {
+		t.Errorf("expecting 2 files and 4 directories, got %d and %d", files, dirs)
+	}
+	if err := WriteFile(fs, "a", nil, 0644); err != ErrReadOnlyFileSystem {
+		t.Errorf("expecting ErrReadOnlyFileSystem, got %v", err)
+	}
+}
+
+func TestLazyZipSymlinks(t *testing.T) {
+	fs := openLazyZip(t, "fs2.zip")
+	testHashes(t, fs, map[string]string{
+		"f1.bin": "sha1:b98c6a155dc7a778874dfc6023be2bacc2e495dd",
+		"f3.bin": "sha1:989c1dda053300c5d2c101240acb2e6678f0319a",
+	})
+	st, err := fs.Lstat("f3.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&os.ModeSymlink == 0 {
+		t.Error("f3.bin isn't a symlink, it should be")
+	}
+}
+
+func TestLazyZipSymlinkedDir(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	entries := []struct {
+		name string
+		mode os.FileMode
+		data string
+	}{
+		{"real/", os.ModeDir | 0755, ""},
+		{"real/f", 0644, "go"},
+		{"link", os.ModeSymlink | 0777, "real"},
+		{"a/", os.ModeDir | 0755, ""},
+		{"a/l2", os.ModeSymlink | 0777, "../link"},
+	}
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name}
+		hdr.SetMode(e.mode)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := LazyZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"link/f", "a/l2/f"} {
+		data, err := ReadFile(fs, p)
+		if err != nil || string(data) != "go" {
+			t.Errorf("expecting %s to contain \"go\", got %q (%v)", p, string(data), err)
+		}
+	}
+	st, err := fs.Lstat("a/l2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&os.ModeSymlink == 0 {
+		t.Error("a/l2 isn't a symlink, it should be")
+	}
+	if infos, err := fs.ReadDir("a/l2"); err != nil || len(infos) != 1 || infos[0].Name() != "f" {
+		t.Errorf("unexpected entries in a/l2 %v (%v)", infos, err)
+	}
+}
+
+func TestLazyZipSeek(t *testing.T) {
+	fs := openLazyZip(t, "fs2.zip")
+	data, err := ReadFile(fs, "f1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("f1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 16)
+	for _, off := range []int64{int64(len(data)) / 2, 3, int64(len(data)) - 16} {
+		if _, err := f.Seek(off, os.SEEK_SET); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data[off:off+16]) {
+			t.Errorf("unexpected data at offset %d", off)
+		}
+	}
+}
+
+func TestOpenReader(t *testing.T) {
+	for _, v := range []string{"fs.zip", "fs.tar", "fs.tar.gz", "fs.tar.bz2", "fs.tar.xz", "fs.tar.zst"} {
+		f, err := os.Open(filepath.Join("testdata", v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Hide the io.ReaderAt implementation
+		fs, err := OpenReader(struct{ io.Reader }{f})
+		f.Close()
+		if err != nil {
+			t.Errorf("error opening %s: %v", v, err)
+			continue
+		}
+		testOpenedVFS(t, fs)
+	}
+	if _, err := OpenReader(bytes.NewReader([]byte("not an archive"))); err == nil {
+		t.Error("expecting an error for an unknown format")
+	}
+}
+
+func TestOpenSniff(t *testing.T) {
+	dir := t.TempDir()
+	for _, v := range []string{"fs.zip", "fs.tar.gz", "fs.tar.xz", "fs.tar.zst"} {
+		data, err := os.ReadFile(filepath.Join("testdata", v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Extensionless and unknown extensions
+		for _, name := range []string{"download", "archive.bin"} {
+			p := filepath.Join(dir, name)
+			if err := os.WriteFile(p, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			fs, err := Open(p)
+			if err != nil {
+				t.Errorf("error opening %s as %s: %v", v, name, err)
+				continue
+			}
+			testOpenedVFS(t, fs)
+		}
+	}
+}
+
+func TestRegisterFormat(t *testing.T) {
+	src, err := Open(filepath.Join("testdata", "fs.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, v := range []string{"fs.JAR", "fs.tgz", "fs.tar"} {
+		p := filepath.Join(dir, v)
+		if err := Save(p, src); err != nil {
+			t.Fatal(err)
+		}
+		fs, err := Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testOpenedVFS(t, fs)
+	}
+	if err := Save(filepath.Join(dir, "fs.tar.bz2"), src); err == nil {
+		t.Error("expecting an error when saving a format without writer")
+	}
+	// Register a format which stores a single file, prefixed by "single\n"
+	var written bool
+	RegisterFormat("single", "single\n", []string{".single"}, func(r io.Reader, size int64) (VFS, error) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		fs := Memory()
+		return fs, WriteFile(fs, "/file", data[len("single\n"):], 0644)
+	}, func(w io.Writer, fs VFS) error {
+		written = true
+		data, err := ReadFile(fs, "/file")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append([]byte("single\n"), data...))
+		return err
+	})
+	fs := Memory()
+	if err := WriteFile(fs, "/file", []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "file.single")
+	if err := Save(p, fs); err != nil || !written {
+		t.Fatalf("error saving single format: %v", err)
+	}
+	for _, v := range []string{p, filepath.Join(dir, "renamed")} {
+		if v != p {
+			if err := os.Rename(p, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		opened, err := Open(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := ReadFile(opened, "/file"); err != nil || string(data) != "contents" {
+			t.Errorf("unexpected contents in %s %q, %v", v, string(data), err)
+		}
+	}
+	// Registered formats can't receive any options
+	if _, err := OpenWithOptions(filepath.Join(dir, "renamed"), &ArchiveOptions{}); err == nil {
+		t.Error("expecting an error when opening a registered format with options")
+	}
+}
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	data     string
+	mode     int64
+}
+
+func writeTestTar(t *testing.T, modTime time.Time, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, v := range entries {
+		hdr := &tar.Header{
+			Name:     v.name,
+			Typeflag: v.typeflag,
+			Mode:     v.mode,
+			ModTime:  modTime,
+		}
+		switch v.typeflag {
+		case tar.TypeSymlink, tar.TypeLink:
+			hdr.Linkname = v.data
+		case tar.TypeReg:
+			hdr.Size = int64(len(v.data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte(v.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testArchiveLinks(t *testing.T, fs VFS) {
+	for _, v := range []string{"/a/rel", "/abs", "/a/b/up"} {
+		info, err := fs.Lstat(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("expecting %s to be a symlink, got mode %s", v, info.Mode())
+		}
+		data, err := ReadFile(fs, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "data" {
+			t.Errorf("expecting %s to contain \"data\", got %q", v, string(data))
+		}
+	}
+}
+
+func TestReadTar(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	data := writeTestTar(t, modTime, []tarEntry{
+		{name: "a/", typeflag: tar.TypeDir, mode: 0750},
+		{name: "a/f", typeflag: tar.TypeReg, data: "data", mode: 0644},
+		{name: "a/rel", typeflag: tar.TypeSymlink, data: "f", mode: 0777},
+		{name: "abs", typeflag: tar.TypeSymlink, data: "/a/f", mode: 0777},
+		{name: "a/b/up", typeflag: tar.TypeSymlink, data: "../f", mode: 0777},
+		{name: "a/hard", typeflag: tar.TypeLink, data: "a/f"},
+		{name: "empty/", typeflag: tar.TypeDir, mode: 0700},
+	})
+	fs, err := ReadTar(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testArchiveLinks(t, fs)
+	for _, v := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"/a", 0750},
+		{"/empty", 0700},
+	} {
+		info, err := fs.Stat(v.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.IsDir() || info.Mode().Perm() != v.mode {
+			t.Errorf("expecting %s to be a directory with mode %s, got %s", v.name, v.mode, info.Mode())
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("expecting %s to have mtime %s, got %s", v.name, modTime, info.ModTime())
+		}
+	}
+	// Hard links share their data
+	if err := WriteFile(fs, "/a/hard", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "/a/f"); err != nil || string(data) != "changed" {
+		t.Errorf("expecting a/f to share its data with a/hard, got %q (%v)", string(data), err)
+	}
+	// Symlinks survive a round trip
+	if err := WriteFile(fs, "/a/hard", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteTar(&buf, fs); err != nil {
+		t.Fatal(err)
+	}
+	fs2, err := Tar(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testArchiveLinks(t, fs2)
+}
+
+func TestReadTarExternalLinks(t *testing.T) {
+	for _, v := range []tarEntry{
+		{name: "abs", typeflag: tar.TypeSymlink, data: "/etc/passwd"},
+		{name: "a/up", typeflag: tar.TypeSymlink, data: "../../etc/passwd"},
+		{name: "hard", typeflag: tar.TypeLink, data: "../f"},
+	} {
+		data := writeTestTar(t, time.Now(), []tarEntry{
+			{name: "f", typeflag: tar.TypeReg, data: "data", mode: 0644},
+			v,
+		})
+		_, err := ReadTar(bytes.NewReader(data), &ArchiveOptions{RejectExternalLinks: true})
+		if err == nil || !strings.Contains(err.Error(), "outside the archive") {
+			t.Errorf("expecting an error for %s -> %s, got %v", v.name, v.data, err)
+		}
+	}
+	// Absolute symlinks are allowed by default
+	data := writeTestTar(t, time.Now(), []tarEntry{
+		{name: "f", typeflag: tar.TypeReg, data: "data", mode: 0644},
+		{name: "a/abs", typeflag: tar.TypeSymlink, data: "/f"},
+	})
+	fs, err := Tar(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "/a/abs"); err != nil || string(data) != "data" {
+		t.Errorf("expecting a/abs to point to f, got %q (%v)", string(data), err)
+	}
+	// Hard links to missing files
+	data = writeTestTar(t, time.Now(), []tarEntry{
+		{name: "hard", typeflag: tar.TypeLink, data: "missing"},
+	})
+	if _, err := Tar(bytes.NewReader(data)); err == nil {
+		t.Error("expecting an error for a hard link to a missing file")
+	}
+}
+
+func TestReadZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, v := range []struct {
+		name string
+		data string
+		mode os.FileMode
+	}{
+		{"a/", "", os.ModeDir | 0750},
+		{"a/f", "data", 0644},
+		{"a/rel", "f", os.ModeSymlink | 0777},
+		{"abs", "/a/f", os.ModeSymlink | 0777},
+		{"a/b/up", "../f", os.ModeSymlink | 0777},
+		{"empty/", "", os.ModeDir | 0700},
+	} {
+		hdr := &zip.FileHeader{Name: v.name}
+		hdr.SetMode(v.mode)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, v.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := ReadZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testArchiveLinks(t, fs)
+	info, err := fs.Stat("/empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0700 {
+		t.Errorf("expecting empty to be a directory with mode 0700, got %s", info.Mode())
+	}
+	_, err = ReadZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), &ArchiveOptions{RejectExternalLinks: true})
+	if err == nil {
+		t.Error("expecting an error for an absolute symlink")
+	}
+	// Symlinks survive a round trip
+	var out bytes.Buffer
+	if err := WriteZip(&out, fs); err != nil {
+		t.Fatal(err)
+	}
+	fs2, err := Zip(&out, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testArchiveLinks(t, fs2)
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	data := writeTestTar(t, time.Now(), []tarEntry{
+		{name: "f", typeflag: tar.TypeReg, data: "data", mode: 0644},
+		{name: "abs", typeflag: tar.TypeSymlink, data: "/etc/passwd"},
+	})
+	compressed := map[string]func(w io.Writer) (io.WriteCloser, error){
+		"tar": func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		"tar.gz": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		"tar.xz": func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+		"tar.zst": func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	}
+	opts := &ArchiveOptions{RejectExternalLinks: true}
+	dir := t.TempDir()
+	for k, v := range compressed {
+		var buf bytes.Buffer
+		w, err := v(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenReader(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Errorf("error opening %s: %v", k, err)
+		}
+		_, err = OpenReaderWithOptions(bytes.NewReader(buf.Bytes()), opts)
+		if err == nil || !strings.Contains(err.Error(), "outside the archive") {
+			t.Errorf("expecting an error for an external link in %s, got %v", k, err)
+		}
+		p := filepath.Join(dir, "archive."+k)
+		if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err = OpenWithOptions(p, opts)
+		if err == nil || !strings.Contains(err.Error(), "outside the archive") {
+			t.Errorf("expecting an error for an external link in %s, got %v", p, err)
+		}
+	}
+	// The archives without external links are still readable
+	fs, err := OpenWithOptions(filepath.Join("testdata", "fs.tar.bz2"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testOpenedVFS(t, fs)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,278 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	// ErrQuotaExceeded is returned by file systems with quotas from calls
+	// which would result in any of its limits being exceeded. It plays
+	// the same role as ENOSPC or EDQUOT in OS file systems, so errors.Is
+	// reports it as matching both of them.
+	ErrQuotaExceeded error = quotaError{}
+)
+
+type quotaError struct{}
+
+func (quotaError) Error() string {
+	return "disk quota exceeded"
+}
+
+func (quotaError) Is(target error) bool {
+	return target == syscall.EDQUOT || target == syscall.ENOSPC
+}
+
+// Limits specifies the limits enforced by Quota. A zero value in any
+// of its fields means there's no limit.
+type Limits struct {
+	// MaxBytes is the maximum total size of all the files.
+	MaxBytes int64
+	// MaxFiles is the maximum number of entries, including both
+	// files and directories (but not the root directory).
+	MaxFiles int64
+	// MaxFileSize is the maximum size of a single file.
+	MaxFileSize int64
+	// MaxDepth is the maximum number of path components of any
+	// entry, so a MaxDepth of 1 only allows entries in the root
+	// directory.
+	MaxDepth int
+}
+
+// Usage represents the resources used by a VFS with quotas.
+type Usage struct {
+	// Bytes is the total size of all the files.
+	Bytes int64
+	// Files is the number of files and directories, excluding
+	// the root directory.
+	Files int64
+}
+
+// QuotaVFS is the interface implemented by the VFS returned from Quota.
+type QuotaVFS interface {
+	VFS
+	// Limits returns the limits enforced by the VFS.
+	Limits() Limits
+	// Usage returns the resources currently used by the VFS.
+	Usage() Usage
+}
+
+type quotaFileSystem struct {
+	fs     VFS
+	limits Limits
+	mu     sync.Mutex
+	usage  Usage
+}
+
+func (fs *quotaFileSystem) VFS() VFS {
+	return fs.fs
+}
+
+func (fs *quotaFileSystem) Limits() Limits {
+	return fs.limits
+}
+
+func (fs *quotaFileSystem) Usage() Usage {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.usage
+}
+
+func pathDepth(p string) int {
+	p = cleanPath(p)
+	if p == "" {
+		return 0
+	}
+	return strings.Count(p, "/") + 1
+}
+
+// create must be called with the lock held
+func (fs *quotaFileSystem) create(p string) error {
+	if fs.limits.MaxDepth > 0 && pathDepth(p) > fs.limits.MaxDepth {
+		return ErrQuotaExceeded
+	}
+	if fs.limits.MaxFiles > 0 && fs.usage.Files >= fs.limits.MaxFiles {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// grow reserves n more bytes for a file which will have the given
+// size once written.
+func (fs *quotaFileSystem) grow(n int64, size int64) error {
+	if fs.limits.MaxFileSize > 0 && size > fs.limits.MaxFileSize {
+		return ErrQuotaExceeded
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.limits.MaxBytes > 0 && fs.usage.Bytes+n > fs.limits.MaxBytes {
+		return ErrQuotaExceeded
+	}
+	fs.usage.Bytes += n
+	return nil
+}
+
+func (fs *quotaFileSystem) release(n int64) {
+	fs.mu.Lock()
+	fs.usage.Bytes -= n
+	fs.mu.Unlock()
+}
+
+func (fs *quotaFileSystem) Open(path string) (RFile, error) {
+	return fs.fs.Open(path)
+}
+
+func (fs *quotaFileSystem) OpenFile(path string, flag int, perm os.FileMode) (WFile, error) {
+	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR) == 0 {
+		return fs.fs.OpenFile(path, flag, perm)
+	}
+	// Hold the lock while opening, so concurrent creations
+	// can't go past the limits.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var size int64
+	created := false
+	st, err := fs.fs.Stat(path)
+	if err == nil {
+		size = st.Size()
+	} else if IsNotExist(err) && flag&os.O_CREATE != 0 {
+		if err := fs.create(path); err != nil {
+			return nil, err
+		}
+		created = true
+	}
+	f, err := fs.fs.OpenFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		fs.usage.Files++
+	}
+	if flag&os.O_TRUNC != 0 && size > 0 {
+		fs.usage.Bytes -= size
+		size = 0
+	}
+	return &quotaFile{
+		WFile:  f,
+		fs:     fs,
+		size:   size,
+		append: flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (fs *quotaFileSystem) Lstat(path string) (os.FileInfo, error) {
+	return fs.fs.Lstat(path)
+}
+
+func (fs *quotaFileSystem) Stat(path string) (os.FileInfo, error) {
+	return fs.fs.Stat(path)
+}
+
+func (fs *quotaFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	return fs.fs.ReadDir(path)
+}
+
+func (fs *quotaFileSystem) Mkdir(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.create(path); err != nil {
+		return err
+	}
+	if err := fs.fs.Mkdir(path, perm); err != nil {
+		return err
+	}
+	fs.usage.Files++
+	return nil
+}
+
+func (fs *quotaFileSystem) Remove(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	st, err := fs.fs.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if err := fs.fs.Remove(path); err != nil {
+		return err
+	}
+	fs.usage.Files--
+	if st.Mode().IsRegular() {
+		fs.usage.Bytes -= st.Size()
+	}
+	return nil
+}
+
+func (fs *quotaFileSystem) String() string {
+	return fmt.Sprintf("Quota %s", fs.fs.String())
+}
+
+type quotaFile struct {
+	WFile
+	fs     *quotaFileSystem
+	size   int64
+	offset int64
+	append bool
+}
+
+func (f *quotaFile) Write(p []byte) (int, error) {
+	if f.append {
+		f.offset = f.size
+	}
+	end := f.offset + int64(len(p))
+	var growth int64
+	if end > f.size {
+		growth = end - f.size
+		if err := f.fs.grow(growth, end); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.WFile.Write(p)
+	f.offset += int64(n)
+	if f.offset > f.size {
+		f.size = f.offset
+	}
+	if unused := end - f.offset; growth > 0 && unused > 0 {
+		if unused > growth {
+			unused = growth
+		}
+		f.fs.release(unused)
+	}
+	return n, err
+}
+
+func (f *quotaFile) Seek(offset int64, whence int) (int64, error) {
+	off, err := f.WFile.Seek(offset, whence)
+	if err == nil {
+		f.offset = off
+	}
+	return off, err
+}
+
+// Quota returns a VFS which enforces the given limits on top of fs.
+// The current usage is determined by walking fs, so files which were
+// already there count against the limits. Calls which would exceed any
+// of the limits return ErrQuotaExceeded. Note that size limits are
+// enforced when writing, rather than when opening a file.
+func Quota(fs VFS, limits Limits) (QuotaVFS, error) {
+	qfs := &quotaFileSystem{fs: fs, limits: limits}
+	err := Walk(fs, "/", func(fs VFS, p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == "/" {
+			return nil
+		}
+		qfs.usage.Files++
+		if info.Mode().IsRegular() {
+			qfs.usage.Bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return qfs, nil
+}
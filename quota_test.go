@@ -0,0 +1,114 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestQuotaUnlimited(t *testing.T) {
+	fs, err := Quota(Memory(), Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testVFS(t, fs)
+	fs, err = Quota(Memory(), Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "a/b", []byte("123"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "c", []byte("4"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("c"); err != nil {
+		t.Fatal(err)
+	}
+	if u := fs.Usage(); u.Files != 2 || u.Bytes != 3 {
+		t.Errorf("expecting 2 files with 3 bytes, got %+v", u)
+	}
+}
+
+func TestQuotaInitialUsage(t *testing.T) {
+	fs, err := Open("testdata/fs.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qfs, err := Quota(fs, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a, a/b, a/b/c, a/b/c/d and empty
+	if u := qfs.Usage(); u.Files != 5 || u.Bytes != 2 {
+		t.Errorf("expecting 5 files with 2 bytes, got %+v", u)
+	}
+}
+
+func TestQuotaLimits(t *testing.T) {
+	fs, err := Quota(Memory(), Limits{
+		MaxBytes:    10,
+		MaxFiles:    4,
+		MaxFileSize: 6,
+		MaxDepth:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "a", []byte("1234567"), 0644); err != ErrQuotaExceeded {
+		t.Errorf("expecting ErrQuotaExceeded for file over MaxFileSize, got %v", err)
+	}
+	if err := WriteFile(fs, "a", []byte("123456"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = WriteFile(fs, "b", []byte("12345"), 0644)
+	if err != ErrQuotaExceeded {
+		t.Errorf("expecting ErrQuotaExceeded for going over MaxBytes, got %v", err)
+	}
+	if !errors.Is(err, syscall.EDQUOT) || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("expecting %v to match EDQUOT and ENOSPC", err)
+	}
+	if err := MkdirAll(fs, "c/d/e", 0755); err != ErrQuotaExceeded {
+		t.Errorf("expecting ErrQuotaExceeded for going over MaxDepth, got %v", err)
+	}
+	// a, b, c and c/d
+	if u := fs.Usage(); u.Files != 4 || u.Bytes != 6 {
+		t.Errorf("expecting 4 files with 6 bytes, got %+v", u)
+	}
+	if _, err := fs.OpenFile("f", os.O_CREATE|os.O_WRONLY, 0644); err != ErrQuotaExceeded {
+		t.Errorf("expecting ErrQuotaExceeded for going over MaxFiles, got %v", err)
+	}
+	// Overwriting a file must not count its previous size
+	if err := WriteFile(fs, "a", []byte("abcdef"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("a", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, os.SEEK_END); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("g")); err != ErrQuotaExceeded {
+		t.Errorf("expecting ErrQuotaExceeded when growing, got %v", err)
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("ABC")); err != nil {
+		t.Errorf("overwriting should not count against the quota: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if u := fs.Usage(); u.Files != 3 || u.Bytes != 6 {
+		t.Errorf("expecting 3 files with 6 bytes, got %+v", u)
+	}
+}
@@ -0,0 +1,534 @@
+package rpcfs
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rainycape/vfs"
+)
+
+var (
+	// ErrClientClosed is returned when using a client after
+	// closing it.
+	ErrClientClosed = errors.New("rpcfs: client closed")
+	// ErrConnectionLost is returned for requests which were in
+	// flight when the connection to the server was lost, and
+	// which can't be safely retried.
+	ErrConnectionLost = errors.New("rpcfs: connection lost")
+)
+
+// ClientOptions specifies the options for NewClient and Dial.
+type ClientOptions struct {
+	// Timeout is the maximum time to wait for the response to each
+	// request, including the time spent reconnecting. If zero, there's
+	// no timeout, but deadlines can still be set using
+	// ClientVFS.WithContext.
+	Timeout time.Duration
+}
+
+// ClientVFS is the interface implemented by the VFS returned from
+// NewClient and Dial.
+type ClientVFS interface {
+	vfs.VFS
+	// WithContext returns a VFS which uses the same connection, but
+	// sends all its requests, including the ones for the files opened
+	// by it, using the given context. Requests fail as soon as the
+	// context is done.
+	WithContext(ctx context.Context) vfs.VFS
+	// Close closes the connection to the server. Files opened on the
+	// client are closed by the server.
+	Close() error
+}
+
+// clientConn is a single connection to the server. When it fails, the
+// client dials a new one.
+type clientConn struct {
+	conn    net.Conn
+	gen     uint64
+	enc     *gob.Encoder
+	wmu     sync.Mutex
+	mu      sync.Mutex
+	pending map[uint64]chan *response
+	err     error
+}
+
+func (c *clientConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	for k, v := range c.pending {
+		close(v)
+		delete(c.pending, k)
+	}
+}
+
+func (c *clientConn) failed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+func (c *clientConn) readLoop() {
+	dec := gob.NewDecoder(c.conn)
+	for {
+		resp := new(response)
+		if err := dec.Decode(resp); err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		ch := c.pending[resp.ID]
+		delete(c.pending, resp.ID)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- resp
+		}
+	}
+}
+
+func (c *clientConn) call(ctx context.Context, req *request) (*response, error) {
+	ch := make(chan *response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, ErrConnectionLost
+	}
+	c.pending[req.ID] = ch
+	c.mu.Unlock()
+	c.wmu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	} else {
+		c.conn.SetWriteDeadline(time.Time{})
+	}
+	err := c.enc.Encode(req)
+	c.wmu.Unlock()
+	if err != nil {
+		// The connection might have been left in an
+		// inconsistent state, start over.
+		c.fail(err)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, ErrConnectionLost
+	}
+	select {
+	case resp := <-ch:
+		if resp == nil {
+			return nil, ErrConnectionLost
+		}
+		return resp, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, req.ID)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+type client struct {
+	dial   func() (net.Conn, error)
+	opts   ClientOptions
+	id     uint64
+	mu     sync.Mutex
+	conn   *clientConn
+	gen    uint64
+	closed bool
+}
+
+// connect returns the current connection, dialing a new one if
+// there's none or the previous one failed.
+func (c *client) connect() (*clientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	if c.conn != nil && !c.conn.failed() {
+		return c.conn, nil
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.gen++
+	c.conn = &clientConn{
+		conn:    conn,
+		gen:     c.gen,
+		enc:     gob.NewEncoder(conn),
+		pending: make(map[uint64]chan *response),
+	}
+	go c.conn.readLoop()
+	return c.conn, nil
+}
+
+func (c *client) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.opts.Timeout > 0 {
+		return context.WithTimeout(ctx, c.opts.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// call sends the given request to the server. If the connection is lost
+// and the request can be safely retried, it's sent again once using a new
+// connection. If prepare is non-nil, it's called before sending the request
+// with the connection it will be sent on.
+func (c *client) call(ctx context.Context, req *request, retry bool, prepare func(context.Context, *clientConn) error) (*response, error) {
+	ctx, cancel := c.context(ctx)
+	defer cancel()
+	for attempt := 0; ; attempt++ {
+		conn, err := c.connect()
+		if err != nil {
+			return nil, err
+		}
+		if prepare != nil {
+			if err := prepare(ctx, conn); err != nil {
+				if err == ErrConnectionLost && attempt == 0 {
+					continue
+				}
+				return nil, err
+			}
+		}
+		req.ID = atomic.AddUint64(&c.id, 1)
+		resp, err := conn.call(ctx, req)
+		if err == ErrConnectionLost && retry && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return resp, resp.error()
+	}
+}
+
+func (c *client) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+	c.closed = true
+	if c.conn != nil {
+		c.conn.fail(ErrClientClosed)
+	}
+	return nil
+}
+
+type clientInfo struct {
+	*wireInfo
+}
+
+func (info clientInfo) Name() string {
+	return info.wireInfo.Name
+}
+
+func (info clientInfo) Size() int64 {
+	return info.wireInfo.Size
+}
+
+func (info clientInfo) Mode() os.FileMode {
+	return info.wireInfo.Mode
+}
+
+func (info clientInfo) ModTime() time.Time {
+	return info.wireInfo.ModTime
+}
+
+func (info clientInfo) IsDir() bool {
+	return info.wireInfo.Mode.IsDir()
+}
+
+func (info clientInfo) Sys() interface{} {
+	return nil
+}
+
+type clientVFS struct {
+	*client
+	ctx context.Context
+}
+
+func (v *clientVFS) open(p string, flag int, perm os.FileMode, readOnly bool) (*clientFile, error) {
+	f := &clientFile{
+		v:        v,
+		path:     p,
+		flag:     flag &^ os.O_APPEND,
+		perm:     perm,
+		readOnly: readOnly,
+	}
+	// Retrying is only safe when the file doesn't change because of
+	// it being opened.
+	retry := flag&(os.O_CREATE|os.O_TRUNC) == 0
+	ctx, cancel := v.context(v.ctx)
+	defer cancel()
+	for attempt := 0; ; attempt++ {
+		conn, err := v.connect()
+		if err != nil {
+			return nil, err
+		}
+		err = f.prepare(ctx, conn)
+		if err == ErrConnectionLost && retry && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	// Further reopens must not truncate nor fail because the
+	// file already exists.
+	f.flag &^= os.O_TRUNC | os.O_EXCL
+	if flag&os.O_APPEND != 0 {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (v *clientVFS) Open(path string) (vfs.RFile, error) {
+	return v.open(path, os.O_RDONLY, 0, true)
+}
+
+func (v *clientVFS) OpenFile(path string, flag int, perm os.FileMode) (vfs.WFile, error) {
+	return v.open(path, flag, perm, false)
+}
+
+func (v *clientVFS) stat(op vfs.Op, path string) (os.FileInfo, error) {
+	resp, err := v.call(v.ctx, &request{Op: op, Path: path}, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	return clientInfo{resp.Info}, nil
+}
+
+func (v *clientVFS) Lstat(path string) (os.FileInfo, error) {
+	return v.stat(vfs.OpLstat, path)
+}
+
+func (v *clientVFS) Stat(path string) (os.FileInfo, error) {
+	return v.stat(vfs.OpStat, path)
+}
+
+func (v *clientVFS) ReadDir(path string) ([]os.FileInfo, error) {
+	resp, err := v.call(v.ctx, &request{Op: vfs.OpReadDir, Path: path}, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, len(resp.Infos))
+	for ii, v := range resp.Infos {
+		infos[ii] = clientInfo{v}
+	}
+	return infos, nil
+}
+
+func (v *clientVFS) Mkdir(path string, perm os.FileMode) error {
+	_, err := v.call(v.ctx, &request{Op: vfs.OpMkdir, Path: path, Perm: perm}, false, nil)
+	return err
+}
+
+func (v *clientVFS) Remove(path string) error {
+	_, err := v.call(v.ctx, &request{Op: vfs.OpRemove, Path: path}, false, nil)
+	return err
+}
+
+func (v *clientVFS) String() string {
+	return "rpcfs client"
+}
+
+func (v *clientVFS) WithContext(ctx context.Context) vfs.VFS {
+	return &clientVFS{client: v.client, ctx: ctx}
+}
+
+func (v *clientVFS) Close() error {
+	return v.close()
+}
+
+// clientFile keeps the offset on the client and sends it with each
+// request, so files can be transparently reopened after reconnecting.
+type clientFile struct {
+	v        *clientVFS
+	path     string
+	flag     int
+	perm     os.FileMode
+	readOnly bool
+	handle   uint64
+	// gen is the generation of the connection the handle
+	// belongs to.
+	gen    uint64
+	offset int64
+	closed bool
+}
+
+// prepare opens the file on the given connection if it's not
+// already open on it.
+func (f *clientFile) prepare(ctx context.Context, conn *clientConn) error {
+	if f.gen == conn.gen {
+		return nil
+	}
+	req := &request{Op: vfs.OpOpenFile, Path: f.path, Flag: f.flag, Perm: f.perm}
+	if f.readOnly {
+		req.Op = vfs.OpOpen
+	}
+	req.ID = atomic.AddUint64(&f.v.id, 1)
+	resp, err := conn.call(ctx, req)
+	if err != nil {
+		return err
+	}
+	if err := resp.error(); err != nil {
+		return err
+	}
+	f.handle = resp.Handle
+	f.gen = conn.gen
+	return nil
+}
+
+func (f *clientFile) call(req *request) (*response, error) {
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	return f.v.call(f.v.ctx, req, true, func(ctx context.Context, conn *clientConn) error {
+		err := f.prepare(ctx, conn)
+		req.Handle = f.handle
+		return err
+	})
+}
+
+func (f *clientFile) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	count := len(p)
+	if count > maxChunk {
+		count = maxChunk
+	}
+	resp, err := f.call(&request{Op: vfs.OpRead, Offset: f.offset, Count: count})
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, resp.Data)
+	f.offset += int64(n)
+	if n == 0 && resp.EOF {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (f *clientFile) Write(p []byte) (int, error) {
+	if f.readOnly {
+		return 0, vfs.ErrReadOnly
+	}
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		resp, err := f.call(&request{Op: vfs.OpWrite, Offset: f.offset, Data: chunk})
+		if resp != nil {
+			written += resp.N
+			f.offset += int64(resp.N)
+		}
+		if err != nil {
+			return written, err
+		}
+		if resp.N < len(chunk) {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+func (f *clientFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		resp, err := f.call(&request{Op: vfs.OpSeek, Offset: offset, Whence: io.SeekEnd})
+		if err != nil {
+			return 0, err
+		}
+		offset = resp.Offset
+	default:
+		return 0, fmt.Errorf("Seek: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Seek: negative position %d", offset)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *clientFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	conn, err := f.v.connect()
+	if err != nil {
+		return err
+	}
+	if conn.gen != f.gen {
+		// The server closed the file when the connection
+		// it was opened on was lost.
+		return nil
+	}
+	ctx, cancel := f.v.context(f.v.ctx)
+	defer cancel()
+	req := &request{
+		ID:     atomic.AddUint64(&f.v.id, 1),
+		Op:     vfs.OpClose,
+		Handle: f.handle,
+	}
+	resp, err := conn.call(ctx, req)
+	if err != nil {
+		if err == ErrConnectionLost {
+			return nil
+		}
+		return err
+	}
+	return resp.error()
+}
+
+// NewClient returns a VFS which uses a server started with ServeConn or
+// Serve, using the connections returned by dial. A connection is dialed
+// immediately, while new connections are dialed whenever the current
+// one fails. Requests which can be safely retried (i.e. all of them except
+// Mkdir, Remove and OpenFile when creating or truncating files) are sent
+// again when the connection is lost while they're in flight. Files opened
+// before reconnecting are transparently reopened. The opts argument
+// might be nil.
+func NewClient(dial func() (net.Conn, error), opts *ClientOptions) (ClientVFS, error) {
+	c := &client{dial: dial}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if _, err := c.connect(); err != nil {
+		return nil, err
+	}
+	return &clientVFS{client: c, ctx: context.Background()}, nil
+}
+
+// Dial returns a VFS which uses the server listening at the given
+// address. See NewClient for more details.
+func Dial(network, address string, opts *ClientOptions) (ClientVFS, error) {
+	return NewClient(func() (net.Conn, error) {
+		return net.Dial(network, address)
+	}, opts)
+}
@@ -0,0 +1,134 @@
+// Package rpcfs allows using a VFS from another process, exporting it
+// over a stream connection with a simple RPC protocol.
+//
+// Requests and responses are encoded with encoding/gob and carry an ID,
+// so multiple requests can be in flight on the same connection. Files are
+// referenced by handles, which are only valid on the connection that
+// opened them.
+package rpcfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rainycape/vfs"
+)
+
+const (
+	// maxChunk is the maximum number of bytes transferred by a
+	// single read or write request.
+	maxChunk = 1 << 20
+)
+
+type wireInfo struct {
+	Name    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+func newWireInfo(info os.FileInfo) *wireInfo {
+	return &wireInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+	}
+}
+
+type request struct {
+	ID     uint64
+	Op     vfs.Op
+	Path   string
+	Flag   int
+	Perm   os.FileMode
+	Handle uint64
+	Offset int64
+	Whence int
+	Count  int
+	Data   []byte
+}
+
+type errKind uint8
+
+const (
+	errNone errKind = iota
+	errOther
+	errNotExist
+	errExist
+	errPermission
+	errReadOnlyFileSystem
+	errReadOnly
+	errWriteOnly
+	errInvalidHandle
+)
+
+var (
+	// ErrInvalidHandle is returned when a file handle is not valid
+	// on the server.
+	ErrInvalidHandle = errors.New("invalid file handle")
+)
+
+type response struct {
+	ID      uint64
+	ErrKind errKind
+	Err     string
+	Info    *wireInfo
+	Infos   []*wireInfo
+	Handle  uint64
+	Offset  int64
+	N       int
+	Data    []byte
+	EOF     bool
+}
+
+func (r *response) setError(err error) {
+	r.Err = err.Error()
+	switch {
+	case err == ErrInvalidHandle:
+		r.ErrKind = errInvalidHandle
+	case vfs.IsNotExist(err):
+		r.ErrKind = errNotExist
+	case vfs.IsExist(err):
+		r.ErrKind = errExist
+	case os.IsPermission(err):
+		r.ErrKind = errPermission
+	case errors.Is(err, vfs.ErrReadOnlyFileSystem):
+		r.ErrKind = errReadOnlyFileSystem
+	case errors.Is(err, vfs.ErrReadOnly):
+		r.ErrKind = errReadOnly
+	case errors.Is(err, vfs.ErrWriteOnly):
+		r.ErrKind = errWriteOnly
+	default:
+		r.ErrKind = errOther
+	}
+}
+
+// error returns the error sent by the server, converting it to the
+// error returned by the VFS in the server whenever possible.
+func (r *response) error() error {
+	switch r.ErrKind {
+	case errNone:
+		return nil
+	case errNotExist:
+		return os.ErrNotExist
+	case errExist:
+		return os.ErrExist
+	case errPermission:
+		return os.ErrPermission
+	case errReadOnlyFileSystem:
+		return vfs.ErrReadOnlyFileSystem
+	case errReadOnly:
+		return vfs.ErrReadOnly
+	case errWriteOnly:
+		return vfs.ErrWriteOnly
+	case errInvalidHandle:
+		return ErrInvalidHandle
+	}
+	if r.Err == io.EOF.Error() {
+		return io.EOF
+	}
+	return errors.New(r.Err)
+}
@@ -0,0 +1,269 @@
+package rpcfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rainycape/vfs"
+	"github.com/rainycape/vfs/vfstest"
+)
+
+// pipeServer serves a VFS over net.Pipe connections, keeping track
+// of the server side of the connections so tests can drop them.
+type pipeServer struct {
+	fs    vfs.VFS
+	mu    sync.Mutex
+	conns []net.Conn
+	dials int
+}
+
+func (s *pipeServer) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	s.mu.Lock()
+	s.conns = append(s.conns, server)
+	s.dials++
+	s.mu.Unlock()
+	go ServeConn(server, s.fs)
+	return client, nil
+}
+
+func (s *pipeServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.conns {
+		v.Close()
+	}
+	s.conns = nil
+}
+
+func newTestClient(t *testing.T, fs vfs.VFS, opts *ClientOptions) (ClientVFS, *pipeServer) {
+	s := &pipeServer{fs: fs}
+	c, err := NewClient(s.dial, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, s
+}
+
+func TestClient(t *testing.T) {
+	fs := vfs.Memory()
+	c, _ := newTestClient(t, fs, nil)
+	if err := vfs.MkdirAll(c, "/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(c, "/a/b/file.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := vfs.ReadFile(fs, "/a/b/file.txt")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected contents in backing fs %q, %v", string(data), err)
+	}
+	data, err = vfs.ReadFile(c, "/a/b/file.txt")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected contents %q, %v", string(data), err)
+	}
+	info, err := c.Stat("/a/b/file.txt")
+	if err != nil || info.Name() != "file.txt" || info.Size() != 5 || info.IsDir() {
+		t.Errorf("unexpected info %v, %v", info, err)
+	}
+	infos, err := c.ReadDir("/a")
+	if err != nil || len(infos) != 1 || infos[0].Name() != "b" || !infos[0].IsDir() {
+		t.Errorf("unexpected entries %v, %v", infos, err)
+	}
+	if _, err := c.Stat("/missing"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting not exist error, got %v", err)
+	}
+	if err := c.Mkdir("/a", 0755); !vfs.IsExist(err) {
+		t.Errorf("expecting exist error, got %v", err)
+	}
+	f, err := c.OpenFile("/a/b/file.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" world"))
+	if _, err := f.Read(make([]byte, 1)); err != vfs.ErrWriteOnly {
+		t.Errorf("expecting ErrWriteOnly, got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = vfs.ReadFile(c, "/a/b/file.txt")
+	if string(data) != "hello world" {
+		t.Errorf("unexpected contents after append %q", string(data))
+	}
+	if err := vfs.RemoveAll(c, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/a"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting /a to be removed, got %v", err)
+	}
+}
+
+func TestVFS(t *testing.T) {
+	c, _ := newTestClient(t, vfs.Memory(), nil)
+	vfstest.TestVFS(t, c)
+}
+
+func TestLargeFile(t *testing.T) {
+	c, _ := newTestClient(t, vfs.Memory(), nil)
+	data := make([]byte, 2*maxChunk+123)
+	for ii := range data {
+		data[ii] = byte(ii * 7)
+	}
+	if err := vfs.WriteFile(c, "large", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.Open("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	read, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("unexpected contents for large file, %v", err)
+	}
+	if pos, err := f.Seek(-10, io.SeekEnd); err != nil || pos != int64(len(data)-10) {
+		t.Fatalf("unexpected Seek result %d, %v", pos, err)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	c, _ := newTestClient(t, vfs.Memory(), nil)
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for ii := 0; ii < 20; ii++ {
+		wg.Add(1)
+		go func(ii int) {
+			defer wg.Done()
+			name := fmt.Sprintf("file%d", ii)
+			contents := bytes.Repeat([]byte(name), 1000)
+			if err := vfs.WriteFile(c, name, contents, 0644); err != nil {
+				errs <- err
+				return
+			}
+			data, err := vfs.ReadFile(c, name)
+			if err == nil && !bytes.Equal(data, contents) {
+				err = fmt.Errorf("unexpected contents for %s", name)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(ii)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	fs := vfs.Memory()
+	if err := vfs.WriteFile(fs, "f", []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, s := newTestClient(t, fs, nil)
+	f, err := c.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+	s.drop()
+	// The file must be reopened and keep its offset
+	rest, err := ioutil.ReadAll(f)
+	if err != nil || string(rest) != "world" {
+		t.Errorf("unexpected contents after reconnecting %q, %v", string(rest), err)
+	}
+	if err := f.Close(); err != nil {
+		t.Error(err)
+	}
+	s.drop()
+	if _, err := c.Stat("f"); err != nil {
+		t.Errorf("unexpected error after reconnecting %v", err)
+	}
+	if s.dials != 3 {
+		t.Errorf("expecting 3 dials, got %d", s.dials)
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	fs := vfs.Faulty(vfs.Memory(), []vfs.FaultRule{
+		{Op: vfs.OpStat, Latency: 200 * time.Millisecond},
+	}, 0)
+	c, _ := newTestClient(t, fs, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.WithContext(ctx).Stat("/"); err != context.DeadlineExceeded {
+		t.Errorf("expecting context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("call with deadline took %s", elapsed)
+	}
+	// Other calls on the same connection still work
+	if _, err := c.ReadDir("/"); err != nil {
+		t.Error(err)
+	}
+	c, _ = newTestClient(t, fs, &ClientOptions{Timeout: 20 * time.Millisecond})
+	if _, err := c.Stat("/"); err != context.DeadlineExceeded {
+		t.Errorf("expecting context.DeadlineExceeded with Timeout, got %v", err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	c, _ := newTestClient(t, vfs.Memory(), nil)
+	c.Close()
+	if _, err := c.Stat("/"); err != ErrClientClosed {
+		t.Errorf("expecting ErrClientClosed, got %v", err)
+	}
+}
+
+func TestInvalidReadCount(t *testing.T) {
+	fs := vfs.Memory()
+	if err := vfs.WriteFile(fs, "f", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go ServeConn(server, fs)
+	enc := gob.NewEncoder(client)
+	dec := gob.NewDecoder(client)
+	call := func(req *request) *response {
+		if err := enc.Encode(req); err != nil {
+			t.Fatal(err)
+		}
+		resp := new(response)
+		if err := dec.Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp := call(&request{ID: 1, Op: vfs.OpOpen, Path: "f"})
+	if err := resp.error(); err != nil {
+		t.Fatal(err)
+	}
+	h := resp.Handle
+	for _, v := range []int{-1, 0} {
+		if call(&request{ID: 2, Op: vfs.OpRead, Handle: h, Count: v}).error() == nil {
+			t.Errorf("expecting an error reading %d bytes", v)
+		}
+	}
+	// The connection must still work
+	resp = call(&request{ID: 3, Op: vfs.OpRead, Handle: h, Count: 5})
+	if err := resp.error(); err != nil || string(resp.Data) != "hello" {
+		t.Errorf("unexpected read %q, %v", string(resp.Data), err)
+	}
+}
@@ -0,0 +1,211 @@
+package rpcfs
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/rainycape/vfs"
+)
+
+type serverHandle struct {
+	mu sync.Mutex
+	rf vfs.RFile
+	// wf is non-nil only for files opened with OpenFile
+	wf vfs.WFile
+}
+
+type serverConn struct {
+	fs      vfs.VFS
+	enc     *gob.Encoder
+	wmu     sync.Mutex
+	mu      sync.Mutex
+	handles map[uint64]*serverHandle
+	next    uint64
+}
+
+func (s *serverConn) addHandle(h *serverHandle) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	s.handles[s.next] = h
+	return s.next
+}
+
+func (s *serverConn) handle(id uint64, remove bool) (*serverHandle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.handles[id]
+	if h == nil {
+		return nil, ErrInvalidHandle
+	}
+	if remove {
+		delete(s.handles, id)
+	}
+	return h, nil
+}
+
+func (s *serverConn) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.handles {
+		v.mu.Lock()
+		v.rf.Close()
+		v.mu.Unlock()
+		delete(s.handles, k)
+	}
+}
+
+func (s *serverConn) fileOp(req *request, resp *response) error {
+	h, err := s.handle(req.Handle, req.Op == vfs.OpClose)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch req.Op {
+	case vfs.OpRead:
+		count := req.Count
+		if count <= 0 {
+			return os.ErrInvalid
+		}
+		if count > maxChunk {
+			count = maxChunk
+		}
+		if _, err := h.rf.Seek(req.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		buf := make([]byte, count)
+		n, err := io.ReadFull(h.rf, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			resp.EOF = true
+		} else if err != nil {
+			return err
+		}
+		resp.Data = buf[:n]
+	case vfs.OpWrite:
+		if h.wf == nil {
+			return vfs.ErrReadOnly
+		}
+		if _, err := h.wf.Seek(req.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		n, err := h.wf.Write(req.Data)
+		resp.N = n
+		return err
+	case vfs.OpSeek:
+		offset, err := h.rf.Seek(req.Offset, req.Whence)
+		resp.Offset = offset
+		return err
+	case vfs.OpClose:
+		return h.rf.Close()
+	}
+	return nil
+}
+
+func (s *serverConn) do(req *request, resp *response) error {
+	switch req.Op {
+	case vfs.OpOpen:
+		f, err := s.fs.Open(req.Path)
+		if err != nil {
+			return err
+		}
+		resp.Handle = s.addHandle(&serverHandle{rf: f})
+	case vfs.OpOpenFile:
+		f, err := s.fs.OpenFile(req.Path, req.Flag, req.Perm)
+		if err != nil {
+			return err
+		}
+		resp.Handle = s.addHandle(&serverHandle{rf: f, wf: f})
+	case vfs.OpLstat, vfs.OpStat:
+		stat := s.fs.Stat
+		if req.Op == vfs.OpLstat {
+			stat = s.fs.Lstat
+		}
+		info, err := stat(req.Path)
+		if err != nil {
+			return err
+		}
+		resp.Info = newWireInfo(info)
+	case vfs.OpReadDir:
+		infos, err := s.fs.ReadDir(req.Path)
+		if err != nil {
+			return err
+		}
+		resp.Infos = make([]*wireInfo, len(infos))
+		for ii, v := range infos {
+			resp.Infos[ii] = newWireInfo(v)
+		}
+	case vfs.OpMkdir:
+		return s.fs.Mkdir(req.Path, req.Perm)
+	case vfs.OpRemove:
+		return s.fs.Remove(req.Path)
+	case vfs.OpRead, vfs.OpWrite, vfs.OpSeek, vfs.OpClose:
+		return s.fileOp(req, resp)
+	default:
+		return errors.New("unknown operation " + string(req.Op))
+	}
+	return nil
+}
+
+func (s *serverConn) serve(req *request) error {
+	resp := &response{ID: req.ID}
+	if err := s.do(req, resp); err != nil {
+		resp.setError(err)
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.enc.Encode(resp)
+}
+
+// ServeConn serves the given VFS on the given connection, until it's
+// closed or an error occurs while reading from it. Requests are handled
+// concurrently, but requests on the same file handle are serialized.
+// All the files opened on the connection are closed when ServeConn
+// returns.
+func ServeConn(conn net.Conn, fs vfs.VFS) error {
+	defer conn.Close()
+	s := &serverConn{
+		fs:      fs,
+		enc:     gob.NewEncoder(conn),
+		handles: make(map[uint64]*serverHandle),
+	}
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		s.closeAll()
+	}()
+	dec := gob.NewDecoder(conn)
+	for {
+		req := new(request)
+		if err := dec.Decode(req); err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.serve(req); err != nil {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// Serve accepts connections on the given net.Listener and serves the
+// given VFS on each of them, using ServeConn. It returns when l.Accept
+// fails.
+func Serve(l net.Listener, fs vfs.VFS) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go ServeConn(conn, fs)
+	}
+}
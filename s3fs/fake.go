@@ -0,0 +1,383 @@
+package s3fs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fakeMaxKeys = 1000
+
+type fakeObject struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+}
+
+type fakeUpload struct {
+	bucket string
+	key    string
+	parts  map[int]*fakeObject
+}
+
+// FakeServer is an in-memory http.Handler implementing the subset of
+// the S3 REST API used by this package, intended for tests. Buckets
+// must be created with CreateBucket or with a PUT request before
+// using them.
+type FakeServer struct {
+	accessKey string
+	secretKey string
+	mu        sync.Mutex
+	buckets   map[string]map[string]*fakeObject
+	uploads   map[string]*fakeUpload
+	nextID    int
+	requests  int
+}
+
+// NewFakeServer returns a new FakeServer. If accessKey is not empty,
+// requests must be signed with SigV4 using the given credentials.
+func NewFakeServer(accessKey string, secretKey string) *FakeServer {
+	return &FakeServer{
+		accessKey: accessKey,
+		secretKey: secretKey,
+		buckets:   make(map[string]map[string]*fakeObject),
+		uploads:   make(map[string]*fakeUpload),
+	}
+}
+
+// CreateBucket creates an empty bucket with the given name. If the
+// bucket already exists, it's left untouched.
+func (s *FakeServer) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[name] == nil {
+		s.buckets[name] = make(map[string]*fakeObject)
+	}
+}
+
+// Keys returns the sorted keys of all the objects in the given bucket.
+func (s *FakeServer) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Requests returns the number of requests handled by the server.
+func (s *FakeServer) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func newFakeObject(data []byte) *fakeObject {
+	sum := md5.Sum(data)
+	return &fakeObject{
+		data:    data,
+		etag:    `"` + hex.EncodeToString(sum[:]) + `"`,
+		modTime: time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+func (s *FakeServer) authenticate(r *http.Request, body []byte) error {
+	if s.accessKey == "" {
+		return nil
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, signAlgorithm+" ") {
+		return errors.New("missing SigV4 authorization")
+	}
+	fields := make(map[string]string)
+	for _, v := range strings.Split(strings.TrimPrefix(auth, signAlgorithm+" "), ",") {
+		if p := strings.IndexByte(v, '='); p > 0 {
+			fields[strings.TrimSpace(v[:p])] = v[p+1:]
+		}
+	}
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[0] != s.accessKey {
+		return errors.New("invalid credential")
+	}
+	t, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return errors.New("invalid X-Amz-Date")
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash != "UNSIGNED-PAYLOAD" && payloadHash != hashHex(body) {
+		return errors.New("payload hash does not match")
+	}
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	expected := signature(s.secretKey, credential[2], signService, t, r.Method, uriEncode(r.URL.Path, false),
+		r.URL.Query(), r.Host, r.Header, signedHeaders, payloadHash)
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+func writeFakeError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		xml.NewEncoder(w).Encode(&Error{Code: code, Message: message, Resource: r.URL.Path})
+	}
+}
+
+func writeFakeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (s *FakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeFakeError(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if err := s.authenticate(r, body); err != nil {
+		writeFakeError(w, r, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	bucketName, key := p, ""
+	if sep := strings.IndexByte(p, '/'); sep >= 0 {
+		bucketName, key = p[:sep], p[sep+1:]
+	}
+	bucket := s.buckets[bucketName]
+	if key == "" && r.Method == "PUT" {
+		if bucket == nil {
+			s.buckets[bucketName] = make(map[string]*fakeObject)
+		}
+		return
+	}
+	if bucket == nil {
+		writeFakeError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	if key == "" {
+		switch r.Method {
+		case "HEAD":
+		case "GET":
+			s.list(w, r, bucketName, bucket)
+		default:
+			writeFakeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+		}
+		return
+	}
+	query := r.URL.Query()
+	switch r.Method {
+	case "HEAD", "GET":
+		s.get(w, r, bucket[key])
+	case "PUT":
+		if uploadID := query.Get("uploadId"); uploadID != "" {
+			upload := s.uploads[uploadID]
+			number, err := strconv.Atoi(query.Get("partNumber"))
+			if upload == nil || err != nil || number < 1 {
+				writeFakeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+				return
+			}
+			part := newFakeObject(body)
+			upload.parts[number] = part
+			w.Header().Set("ETag", part.etag)
+			return
+		}
+		obj := newFakeObject(body)
+		bucket[key] = obj
+		w.Header().Set("ETag", obj.etag)
+	case "POST":
+		if _, ok := query["uploads"]; ok {
+			s.nextID++
+			uploadID := strconv.Itoa(s.nextID)
+			s.uploads[uploadID] = &fakeUpload{bucket: bucketName, key: key, parts: make(map[int]*fakeObject)}
+			writeFakeXML(w, &initiateResult{Bucket: bucketName, Key: key, UploadID: uploadID})
+			return
+		}
+		uploadID := query.Get("uploadId")
+		upload := s.uploads[uploadID]
+		if upload == nil {
+			writeFakeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+			return
+		}
+		var complete completeUpload
+		if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Parts) == 0 {
+			writeFakeError(w, r, http.StatusBadRequest, "MalformedXML", "invalid CompleteMultipartUpload")
+			return
+		}
+		var data bytes.Buffer
+		for _, v := range complete.Parts {
+			part := upload.parts[v.PartNumber]
+			if part == nil || part.etag != v.ETag {
+				writeFakeError(w, r, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("invalid part %d", v.PartNumber))
+				return
+			}
+			data.Write(part.data)
+		}
+		delete(s.uploads, uploadID)
+		obj := newFakeObject(data.Bytes())
+		obj.etag = fmt.Sprintf(`"%s-%d"`, strings.Trim(obj.etag, `"`), len(complete.Parts))
+		bucket[key] = obj
+		writeFakeXML(w, &completeResult{Bucket: bucketName, Key: key, ETag: obj.etag})
+	case "DELETE":
+		if uploadID := query.Get("uploadId"); uploadID != "" {
+			delete(s.uploads, uploadID)
+		} else {
+			delete(bucket, key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (s *FakeServer) get(w http.ResponseWriter, r *http.Request, obj *fakeObject) {
+	if obj == nil {
+		writeFakeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+	if m := r.Header.Get("If-Match"); m != "" && m != obj.etag {
+		writeFakeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed", "If-Match does not match")
+		return
+	}
+	w.Header().Set("ETag", obj.etag)
+	w.Header().Set("Last-Modified", obj.modTime.Format(http.TimeFormat))
+	data := obj.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var start, end int64
+		end = -1
+		spec := strings.TrimPrefix(rng, "bytes=")
+		sep := strings.IndexByte(spec, '-')
+		var err error
+		if sep > 0 {
+			start, err = strconv.ParseInt(spec[:sep], 10, 64)
+			if err == nil && sep < len(spec)-1 {
+				end, err = strconv.ParseInt(spec[sep+1:], 10, 64)
+			}
+		}
+		if sep <= 0 || err != nil || start >= int64(len(data)) {
+			writeFakeError(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		}
+		if end < 0 || end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(data)
+	}
+}
+
+func (s *FakeServer) list(w http.ResponseWriter, r *http.Request, name string, bucket map[string]*fakeObject) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		writeFakeError(w, r, http.StatusNotImplemented, "NotImplemented", "only ListObjectsV2 is supported")
+		return
+	}
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	maxKeys := fakeMaxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeFakeError(w, r, http.StatusBadRequest, "InvalidArgument", "invalid max-keys")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	// Continuation tokens contain the last returned key or common
+	// prefix, preceded by a 'k' or a 'p' respectively, since all the
+	// keys in a returned common prefix must be skipped.
+	var after string
+	var afterPrefix bool
+	if token := query.Get("continuation-token"); token != "" {
+		data, err := base64.URLEncoding.DecodeString(token)
+		if err != nil || len(data) == 0 {
+			writeFakeError(w, r, http.StatusBadRequest, "InvalidArgument", "invalid continuation token")
+			return
+		}
+		after = string(data[1:])
+		afterPrefix = data[0] == 'p'
+	} else {
+		after = query.Get("start-after")
+	}
+	var keys []string
+	for k := range bucket {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	res := &listResult{
+		Name:              name,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		ContinuationToken: query.Get("continuation-token"),
+	}
+	var last string
+	var lastPrefix bool
+	for _, k := range keys {
+		if k <= after || (afterPrefix && strings.HasPrefix(k, after)) {
+			continue
+		}
+		item, isPrefix := k, false
+		if delimiter != "" {
+			if p := strings.Index(k[len(prefix):], delimiter); p >= 0 {
+				item, isPrefix = k[:len(prefix)+p+len(delimiter)], true
+				if item == last && lastPrefix {
+					continue
+				}
+			}
+		}
+		if res.KeyCount == maxKeys {
+			res.IsTruncated = true
+			kind := "k"
+			if lastPrefix {
+				kind = "p"
+			}
+			res.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(kind + last))
+			break
+		}
+		res.KeyCount++
+		last = item
+		lastPrefix = isPrefix
+		if isPrefix {
+			res.CommonPrefixes = append(res.CommonPrefixes, listPrefix{Prefix: item})
+			continue
+		}
+		obj := bucket[k]
+		res.Contents = append(res.Contents, listObject{
+			Key:          k,
+			LastModified: obj.modTime,
+			ETag:         obj.etag,
+			Size:         int64(len(obj.data)),
+		})
+	}
+	writeFakeXML(w, res)
+}
@@ -0,0 +1,790 @@
+// Package s3fs implements a VFS backed by a bucket in an object storage
+// service compatible with the Amazon S3 REST API.
+//
+// Object keys are mapped to paths by using / as the separator. Since
+// object stores have no directories, they're synthesized from the key
+// prefixes. Mkdir stores an empty object with a trailing slash as a
+// marker, so empty directories can exist. Directories without a marker
+// disappear once all the objects in them are removed.
+package s3fs
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rainycape/vfs"
+)
+
+const (
+	defaultRegion   = "us-east-1"
+	defaultPartSize = 5 << 20
+)
+
+var (
+	// ErrObjectChanged is returned when reading from an object which
+	// has been replaced after it was opened.
+	ErrObjectChanged = errors.New("s3fs: object changed while reading")
+	// ErrUploaded is returned when seeking back and then reading or
+	// writing data from a file which has already been uploaded as
+	// part of a multipart upload.
+	ErrUploaded    = errors.New("s3fs: data has already been uploaded")
+	errInvalidSeek = errors.New("s3fs: invalid seek offset")
+)
+
+// Options specifies the options for accessing a bucket.
+type Options struct {
+	// Region is the region used for signing the requests. If empty,
+	// us-east-1 is used.
+	Region string
+	// AccessKey, SecretKey and SessionToken are the credentials used
+	// for signing the requests. SessionToken is only required for
+	// temporary credentials. If AccessKey is empty, requests are sent
+	// without signing them.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Client is the HTTP client used to make the requests. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+	// PartSize is the size of each part when writing files. Files
+	// smaller than PartSize are uploaded with a single request, while
+	// larger ones use a multipart upload. If zero, 5MiB is used, which
+	// is the minimum part size allowed by S3.
+	PartSize int
+	// PageSize is the maximum number of keys requested in each listing
+	// request. If zero, the server default is used.
+	PageSize int
+}
+
+func (o *Options) withDefaults() Options {
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	if opts.Region == "" {
+		opts.Region = defaultRegion
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.PartSize <= 0 {
+		opts.PartSize = defaultPartSize
+	}
+	return opts
+}
+
+// Error represents an error returned by the server. Note that
+// responses with a 404 status are returned as os.ErrNotExist.
+type Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+	Resource   string `xml:"Resource"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3fs: unexpected status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3fs: %s: %s (status %d)", e.Code, e.Message, e.StatusCode)
+}
+
+type listObject struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+}
+
+type listPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listResult struct {
+	XMLName               xml.Name     `xml:"ListBucketResult"`
+	Name                  string       `xml:"Name"`
+	Prefix                string       `xml:"Prefix"`
+	Delimiter             string       `xml:"Delimiter,omitempty"`
+	MaxKeys               int          `xml:"MaxKeys"`
+	KeyCount              int          `xml:"KeyCount"`
+	IsTruncated           bool         `xml:"IsTruncated"`
+	ContinuationToken     string       `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string       `xml:"NextContinuationToken,omitempty"`
+	Contents              []listObject `xml:"Contents"`
+	CommonPrefixes        []listPrefix `xml:"CommonPrefixes"`
+}
+
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+// objectInfo implements os.FileInfo for objects and synthesized
+// directories.
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *objectInfo) Name() string { return i.name }
+func (i *objectInfo) Size() int64  { return i.size }
+func (i *objectInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+func (i *objectInfo) ModTime() time.Time { return i.modTime }
+func (i *objectInfo) IsDir() bool        { return i.dir }
+func (i *objectInfo) Sys() interface{}   { return nil }
+
+type s3FileSystem struct {
+	scheme string
+	host   string
+	// base is the path of the bucket, including the
+	// path in the endpoint, without a trailing slash
+	base string
+	opts Options
+}
+
+// objectKey returns the key for the given path. The root
+// directory has an empty key.
+func objectKey(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// do sends a request for the given key, which might be empty to send
+// a request for the bucket. If the response status is not 2xx, the
+// error sent by the server is returned.
+func (fs *s3FileSystem) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	uri := uriEncode(fs.base, false)
+	if key != "" {
+		uri += "/" + uriEncode(key, false)
+	}
+	u := fs.scheme + "://" + fs.host + uri
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		// Don't send a chunked empty body
+		req.Body = http.NoBody
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if fs.opts.AccessKey != "" {
+		sign(req, uri, fs.opts.AccessKey, fs.opts.SecretKey, fs.opts.SessionToken, fs.opts.Region, hashHex(body), time.Now())
+	}
+	resp, err := fs.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	e := &Error{StatusCode: resp.StatusCode}
+	if data, err := ioutil.ReadAll(resp.Body); err == nil && len(data) > 0 {
+		xml.Unmarshal(data, e)
+	}
+	return nil, e
+}
+
+// doXML sends a request and decodes the XML response into out.
+func (fs *s3FileSystem) doXML(method string, key string, query url.Values, body []byte, out interface{}) error {
+	resp, err := fs.do(method, key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(out)
+}
+
+func (fs *s3FileSystem) list(prefix string, delimiter string, maxKeys int, token string) (*listResult, error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	var res listResult
+	if err := fs.doXML("GET", "", query, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+type objectHead struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func (fs *s3FileSystem) head(key string) (*objectHead, error) {
+	resp, err := fs.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	h := &objectHead{
+		size: resp.ContentLength,
+		etag: resp.Header.Get("ETag"),
+	}
+	h.modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return h, nil
+}
+
+// isDir returns true iff there are objects with the given key
+// followed by a slash as their prefix.
+func (fs *s3FileSystem) isDir(key string) (bool, error) {
+	if key == "" {
+		return true, nil
+	}
+	res, err := fs.list(key+"/", "", 1, "")
+	if err != nil {
+		return false, err
+	}
+	return len(res.Contents) > 0, nil
+}
+
+// checkParent returns an error if the parent directory of the given
+// key doesn't exist.
+func (fs *s3FileSystem) checkParent(p string, key string) error {
+	parent := path.Dir(key)
+	if parent == "." {
+		return nil
+	}
+	info, err := fs.stat(parent)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path.Dir(p))
+	}
+	return nil
+}
+
+func (fs *s3FileSystem) stat(key string) (os.FileInfo, error) {
+	if key == "" {
+		return &objectInfo{name: "/", dir: true}, nil
+	}
+	h, err := fs.head(key)
+	if err == nil {
+		return &objectInfo{name: path.Base(key), size: h.size, modTime: h.modTime}, nil
+	}
+	if !vfs.IsNotExist(err) {
+		return nil, err
+	}
+	dir, err := fs.isDir(key)
+	if err != nil {
+		return nil, err
+	}
+	if !dir {
+		return nil, os.ErrNotExist
+	}
+	return &objectInfo{name: path.Base(key), dir: true}, nil
+}
+
+func (fs *s3FileSystem) open(p string, key string) (*objectReader, error) {
+	if key == "" {
+		return nil, fmt.Errorf("%s is a directory", p)
+	}
+	h, err := fs.head(key)
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			if dir, _ := fs.isDir(key); dir {
+				return nil, fmt.Errorf("%s is a directory", p)
+			}
+		}
+		return nil, err
+	}
+	return &objectReader{fs: fs, key: key, size: h.size, etag: h.etag}, nil
+}
+
+func (fs *s3FileSystem) Open(p string) (vfs.RFile, error) {
+	return fs.open(p, objectKey(p))
+}
+
+func (fs *s3FileSystem) OpenFile(p string, flag int, perm os.FileMode) (vfs.WFile, error) {
+	key := objectKey(p)
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		r, err := fs.open(p, key)
+		if err != nil {
+			return nil, err
+		}
+		return readOnlyFile{r}, nil
+	}
+	if key == "" {
+		return nil, fmt.Errorf("%s is a directory", p)
+	}
+	_, err := fs.head(key)
+	exists := err == nil
+	if err != nil && !vfs.IsNotExist(err) {
+		return nil, err
+	}
+	if exists && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, os.ErrExist
+	}
+	if !exists {
+		dir, err := fs.isDir(key)
+		if err != nil {
+			return nil, err
+		}
+		if dir {
+			return nil, fmt.Errorf("%s is a directory", p)
+		}
+		if flag&os.O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+		if err := fs.checkParent(p, key); err != nil {
+			return nil, err
+		}
+	}
+	w := &objectWriter{
+		fs:    fs,
+		key:   key,
+		flag:  flag,
+		dirty: !exists || flag&os.O_TRUNC != 0,
+	}
+	if exists && flag&os.O_TRUNC == 0 {
+		// Objects can't be modified in place, so load the current
+		// contents in order to upload them again.
+		resp, err := fs.do("GET", key, nil, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		w.buf, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (fs *s3FileSystem) Lstat(p string) (os.FileInfo, error) {
+	return fs.stat(objectKey(p))
+}
+
+func (fs *s3FileSystem) Stat(p string) (os.FileInfo, error) {
+	return fs.stat(objectKey(p))
+}
+
+func (fs *s3FileSystem) ReadDir(p string) ([]os.FileInfo, error) {
+	key := objectKey(p)
+	var prefix string
+	if key != "" {
+		prefix = key + "/"
+	}
+	var infos []os.FileInfo
+	found := key == ""
+	var token string
+	for {
+		res, err := fs.list(prefix, "/", fs.opts.PageSize, token)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range res.Contents {
+			found = true
+			if v.Key == prefix {
+				// Directory marker
+				continue
+			}
+			infos = append(infos, &objectInfo{
+				name:    v.Key[len(prefix):],
+				size:    v.Size,
+				modTime: v.LastModified,
+			})
+		}
+		for _, v := range res.CommonPrefixes {
+			found = true
+			name := strings.TrimSuffix(v.Prefix[len(prefix):], "/")
+			if name != "" {
+				infos = append(infos, &objectInfo{name: name, dir: true})
+			}
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			break
+		}
+		token = res.NextContinuationToken
+	}
+	if !found {
+		if _, err := fs.head(key); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s is not a directory", p)
+	}
+	sort.Sort(vfs.FileInfos(infos))
+	return infos, nil
+}
+
+func (fs *s3FileSystem) Mkdir(p string, perm os.FileMode) error {
+	key := objectKey(p)
+	if key == "" {
+		return os.ErrExist
+	}
+	if _, err := fs.stat(key); err == nil {
+		return os.ErrExist
+	} else if !vfs.IsNotExist(err) {
+		return err
+	}
+	if err := fs.checkParent(p, key); err != nil {
+		return err
+	}
+	resp, err := fs.do("PUT", key+"/", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (fs *s3FileSystem) Remove(p string) error {
+	key := objectKey(p)
+	if key == "" {
+		return fmt.Errorf("can't remove %s", p)
+	}
+	info, err := fs.stat(key)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		res, err := fs.list(key+"/", "", 2, "")
+		if err != nil {
+			return err
+		}
+		for _, v := range res.Contents {
+			if v.Key != key+"/" {
+				return fmt.Errorf("directory %s not empty", p)
+			}
+		}
+		key += "/"
+	}
+	resp, err := fs.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (fs *s3FileSystem) String() string {
+	return fmt.Sprintf("S3 %s://%s%s", fs.scheme, fs.host, fs.base)
+}
+
+// New returns a VFS for the given bucket, accessed with path style
+// requests at the given endpoint (e.g. https://s3.us-west-2.amazonaws.com).
+// If opts is nil, the default options are used, which send unsigned
+// requests. New checks that the bucket exists before returning.
+func New(endpoint string, bucket string, opts *Options) (vfs.VFS, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return nil, fmt.Errorf("invalid bucket name %q", bucket)
+	}
+	fs := &s3FileSystem{
+		scheme: u.Scheme,
+		host:   u.Host,
+		base:   strings.TrimSuffix(u.Path, "/") + "/" + bucket,
+		opts:   opts.withDefaults(),
+	}
+	resp, err := fs.do("HEAD", "", nil, nil, nil)
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			return nil, fmt.Errorf("bucket %s does not exist", bucket)
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+	return fs, nil
+}
+
+// objectReader reads an object using ranged GET requests. The response
+// body is kept open for sequential reads and only discarded on Seek.
+type objectReader struct {
+	fs     *s3FileSystem
+	key    string
+	size   int64
+	etag   string
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		header := make(http.Header)
+		if r.offset > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		}
+		if r.etag != "" {
+			header.Set("If-Match", r.etag)
+		}
+		resp, err := r.fs.do("GET", r.key, nil, header, nil)
+		if err != nil {
+			if e, ok := err.(*Error); ok && e.StatusCode == http.StatusPreconditionFailed {
+				return 0, ErrObjectChanged
+			}
+			return 0, err
+		}
+		if r.offset > 0 && resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return 0, fmt.Errorf("s3fs: expecting partial content, got status %d", resp.StatusCode)
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF {
+		r.body.Close()
+		r.body = nil
+		if r.offset < r.size {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (r *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.offset, os.ErrInvalid
+	}
+	if offset < 0 {
+		return r.offset, errInvalidSeek
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *objectReader) Close() error {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	return nil
+}
+
+type readOnlyFile struct {
+	*objectReader
+}
+
+func (f readOnlyFile) Write(p []byte) (int, error) {
+	return 0, vfs.ErrReadOnly
+}
+
+// objectWriter buffers the data written to a file and uploads it on
+// Close. Once the buffered data exceeds the part size and the file is
+// being written sequentially, the data is uploaded as a part of a
+// multipart upload.
+type objectWriter struct {
+	fs   *s3FileSystem
+	key  string
+	flag int
+	// buf contains the data which hasn't been uploaded yet,
+	// starting at base
+	buf      []byte
+	base     int64
+	pos      int64
+	dirty    bool
+	closed   bool
+	uploadID string
+	parts    []completedPart
+}
+
+func (w *objectWriter) Read(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.flag&os.O_RDWR == 0 {
+		return 0, vfs.ErrWriteOnly
+	}
+	if w.pos < w.base {
+		return 0, ErrUploaded
+	}
+	off := w.pos - w.base
+	if off >= int64(len(w.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, w.buf[off:])
+	w.pos += int64(n)
+	return n, nil
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	end := w.base + int64(len(w.buf))
+	if w.flag&os.O_APPEND != 0 {
+		w.pos = end
+	}
+	if w.pos < w.base {
+		return 0, ErrUploaded
+	}
+	off := int(w.pos - w.base)
+	if n := off + len(p); n > len(w.buf) {
+		w.buf = append(w.buf, make([]byte, n-len(w.buf))...)
+	}
+	copy(w.buf[off:], p)
+	w.pos += int64(len(p))
+	w.dirty = true
+	if w.pos == w.base+int64(len(w.buf)) && len(w.buf) >= w.fs.opts.PartSize {
+		// p is already in the buffer, which is uploaded again
+		// by the next Write or by Close if this upload fails.
+		if err := w.uploadPart(); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *objectWriter) Seek(offset int64, whence int) (int64, error) {
+	end := w.base + int64(len(w.buf))
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += w.pos
+	case io.SeekEnd:
+		offset += end
+	default:
+		return w.pos, os.ErrInvalid
+	}
+	if offset < 0 {
+		return w.pos, errInvalidSeek
+	}
+	if offset > end {
+		offset = end
+	}
+	w.pos = offset
+	return offset, nil
+}
+
+// uploadPart uploads the buffered data as a new part, starting
+// the multipart upload if needed.
+func (w *objectWriter) uploadPart() error {
+	if w.uploadID == "" {
+		var res initiateResult
+		if err := w.fs.doXML("POST", w.key, url.Values{"uploads": {""}}, nil, &res); err != nil {
+			return err
+		}
+		w.uploadID = res.UploadID
+	}
+	number := len(w.parts) + 1
+	resp, err := w.fs.do("PUT", w.key, url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {w.uploadID},
+	}, nil, w.buf)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	w.base += int64(len(w.buf))
+	w.buf = nil
+	return nil
+}
+
+func (w *objectWriter) upload() error {
+	if w.uploadID == "" {
+		resp, err := w.fs.do("PUT", w.key, nil, nil, w.buf)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if len(w.buf) > 0 {
+		if err := w.uploadPart(); err != nil {
+			return err
+		}
+	}
+	body, err := xml.Marshal(&completeUpload{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	var res completeResult
+	return w.fs.doXML("POST", w.key, url.Values{"uploadId": {w.uploadID}}, body, &res)
+}
+
+func (w *objectWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	if !w.dirty {
+		return nil
+	}
+	err := w.upload()
+	if err != nil && w.uploadID != "" {
+		if resp, err := w.fs.do("DELETE", w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil); err == nil {
+			resp.Body.Close()
+		}
+	}
+	w.buf = nil
+	return err
+}
@@ -0,0 +1,350 @@
+package s3fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rainycape/vfs"
+	"github.com/rainycape/vfs/vfstest"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testBucket    = "test-bucket"
+)
+
+func newTestFS(t *testing.T, opts *Options) (vfs.VFS, *FakeServer) {
+	fake := NewFakeServer(testAccessKey, testSecretKey)
+	fake.CreateBucket(testBucket)
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.AccessKey == "" {
+		opts.AccessKey = testAccessKey
+		opts.SecretKey = testSecretKey
+	}
+	fs, err := New(srv.URL, testBucket, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, fake
+}
+
+func TestSignature(t *testing.T) {
+	fake := NewFakeServer(testAccessKey, testSecretKey)
+	fake.CreateBucket(testBucket)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	if _, err := New(srv.URL, testBucket, &Options{AccessKey: testAccessKey, SecretKey: "wrong"}); err == nil {
+		t.Error("expecting an error with the wrong secret key")
+	}
+	if _, err := New(srv.URL, testBucket, nil); err == nil {
+		t.Error("expecting an error without credentials")
+	}
+	if _, err := New(srv.URL, "missing", &Options{AccessKey: testAccessKey, SecretKey: testSecretKey}); err == nil {
+		t.Error("expecting an error for a missing bucket")
+	}
+	fs, err := New(srv.URL, testBucket, &Options{AccessKey: testAccessKey, SecretKey: testSecretKey, Region: "eu-west-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys which need escaping must be signed correctly
+	name := "/dir with spaces/ü+&=?%.txt"
+	if err := vfs.MkdirAll(fs, "/dir with spaces", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(fs, name, []byte("escaped"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := vfs.ReadFile(fs, name)
+	if err != nil || string(data) != "escaped" {
+		t.Errorf("unexpected contents %q, %v", string(data), err)
+	}
+}
+
+func TestSignatureVector(t *testing.T) {
+	// get-vanilla from the AWS SigV4 test suite
+	header := http.Header{}
+	header.Set("X-Amz-Date", "20150830T123600Z")
+	ts, err := time.Parse(amzDateFormat, "20150830T123600Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := signature(testSecretKey, "us-east-1", "service", ts, "GET", "/", nil,
+		"example.amazonaws.com", header, []string{"host", "x-amz-date"}, hashHex(nil))
+	if exp := "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"; sig != exp {
+		t.Errorf("expecting signature %s, got %s", exp, sig)
+	}
+}
+
+func TestVFS(t *testing.T) {
+	fs, _ := newTestFS(t, nil)
+	vfstest.TestVFS(t, fs)
+}
+
+func TestFileSystem(t *testing.T) {
+	fs, fake := newTestFS(t, nil)
+	if err := vfs.MkdirAll(fs, "/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(fs, "/a/b/file.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(fs, "/a/z.txt", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectedKeys := []string{"a/", "a/b/", "a/b/file.txt", "a/z.txt"}
+	if keys := fake.Keys(testBucket); !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("expecting keys %v, got %v", expectedKeys, keys)
+	}
+	data, err := vfs.ReadFile(fs, "/a/b/file.txt")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected contents %q, %v", string(data), err)
+	}
+	info, err := fs.Stat("/a/b/file.txt")
+	if err != nil || info.Name() != "file.txt" || info.Size() != 5 || info.IsDir() {
+		t.Errorf("unexpected info %v, %v", info, err)
+	}
+	if info, err := fs.Stat("/a/b"); err != nil || !info.IsDir() {
+		t.Errorf("expecting /a/b to be a directory, got %v, %v", info, err)
+	}
+	infos, err := fs.ReadDir("/a")
+	if err != nil || len(infos) != 2 || infos[0].Name() != "b" || !infos[0].IsDir() || infos[1].Name() != "z.txt" || infos[1].IsDir() {
+		t.Errorf("unexpected entries %v, %v", infos, err)
+	}
+	if _, err := fs.Stat("/missing"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting not exist error, got %v", err)
+	}
+	if _, err := fs.ReadDir("/a/z.txt"); err == nil {
+		t.Error("expecting an error when listing a file")
+	}
+	if err := fs.Mkdir("/a", 0755); !vfs.IsExist(err) {
+		t.Errorf("expecting exist error, got %v", err)
+	}
+	if err := fs.Mkdir("/missing/dir", 0755); !vfs.IsNotExist(err) {
+		t.Errorf("expecting not exist error for missing parent, got %v", err)
+	}
+	if err := vfs.WriteFile(fs, "/missing/file", nil, 0644); !vfs.IsNotExist(err) {
+		t.Errorf("expecting not exist error for missing parent, got %v", err)
+	}
+	if _, err := fs.OpenFile("/a/z.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); !vfs.IsExist(err) {
+		t.Errorf("expecting exist error with O_EXCL, got %v", err)
+	}
+	if _, err := fs.Open("/a"); err == nil {
+		t.Error("expecting an error when opening a directory")
+	}
+	if err := fs.Remove("/a"); err == nil {
+		t.Error("expecting an error when removing a non-empty directory")
+	}
+	f, err := fs.OpenFile("/a/b/file.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" world"))
+	if _, err := f.Read(make([]byte, 1)); err != vfs.ErrWriteOnly {
+		t.Errorf("expecting ErrWriteOnly, got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = vfs.ReadFile(fs, "/a/b/file.txt")
+	if string(data) != "hello world" {
+		t.Errorf("unexpected contents after append %q", string(data))
+	}
+	if err := vfs.RemoveAll(fs, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := fake.Keys(testBucket); len(keys) != 0 {
+		t.Errorf("expecting no keys after removing, got %v", keys)
+	}
+}
+
+func TestSynthesizedDirectories(t *testing.T) {
+	fs, fake := newTestFS(t, &Options{PageSize: 2})
+	// Upload objects directly, without directory markers
+	for ii := 0; ii < 5; ii++ {
+		for _, dir := range []string{"x", "y"} {
+			f, err := fs.OpenFile(fmt.Sprintf("/%s%d", dir, ii), os.O_WRONLY|os.O_CREATE, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+		}
+	}
+	fake.mu.Lock()
+	for ii := 0; ii < 3; ii++ {
+		fake.buckets[testBucket][fmt.Sprintf("deep/nested/file%d", ii)] = newFakeObject([]byte("data"))
+	}
+	fake.mu.Unlock()
+	infos, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range infos {
+		names = append(names, v.Name())
+	}
+	expected := []string{"deep", "x0", "x1", "x2", "x3", "x4", "y0", "y1", "y2", "y3", "y4"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expecting entries %v, got %v", expected, names)
+	}
+	if !infos[0].IsDir() {
+		t.Error("expecting deep to be a directory")
+	}
+	infos, err = fs.ReadDir("/deep/nested")
+	if err != nil || len(infos) != 3 {
+		t.Errorf("unexpected entries in synthesized directory %v, %v", infos, err)
+	}
+	if err := vfs.WriteFile(fs, "/deep/nested/new", []byte("new"), 0644); err != nil {
+		t.Errorf("error writing to synthesized directory: %v", err)
+	}
+}
+
+func TestRangedReads(t *testing.T) {
+	fs, fake := newTestFS(t, nil)
+	data := make([]byte, 100000)
+	for ii := range data {
+		data[ii] = byte(ii * 7)
+	}
+	if err := vfs.WriteFile(fs, "/large", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(90000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(f, buf); err != nil || !bytes.Equal(buf, data[90000:90010]) {
+		t.Errorf("unexpected data after Seek %v, %v", buf, err)
+	}
+	if pos, err := f.Seek(-5, io.SeekEnd); err != nil || pos != int64(len(data)-5) {
+		t.Fatalf("unexpected Seek result %d, %v", pos, err)
+	}
+	rest, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(rest, data[len(data)-5:]) {
+		t.Errorf("unexpected data at the end %v, %v", rest, err)
+	}
+	if pos, err := f.Seek(0, 42); err != os.ErrInvalid || pos != int64(len(data)) {
+		t.Errorf("expecting os.ErrInvalid and unchanged offset for invalid whence, got %d, %v", pos, err)
+	}
+	// Replace the object while it's open
+	f.Seek(0, io.SeekStart)
+	fake.mu.Lock()
+	fake.buckets[testBucket]["large"] = newFakeObject([]byte("replaced"))
+	fake.mu.Unlock()
+	if _, err := f.Read(buf); err != ErrObjectChanged {
+		t.Errorf("expecting ErrObjectChanged, got %v", err)
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	const partSize = 1024
+	fs, fake := newTestFS(t, &Options{PartSize: partSize})
+	data := bytes.Repeat([]byte("0123456789"), 350)
+	f, err := fs.OpenFile("/multipart", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ii := 0; ii < len(data); ii += 100 {
+		if _, err := f.Write(data[ii : ii+100]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("x")); err != ErrUploaded {
+		t.Errorf("expecting ErrUploaded, got %v", err)
+	}
+	f.Seek(0, io.SeekEnd)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	obj := fake.buckets[testBucket]["multipart"]
+	uploads := len(fake.uploads)
+	fake.mu.Unlock()
+	if obj == nil || !bytes.HasSuffix([]byte(obj.etag), []byte(`-4"`)) {
+		t.Errorf("expecting an object uploaded in 4 parts, got %+v", obj)
+	}
+	if uploads != 0 {
+		t.Errorf("expecting no pending uploads, got %d", uploads)
+	}
+	read, err := vfs.ReadFile(fs, "/multipart")
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("unexpected contents after multipart upload, %v", err)
+	}
+}
+
+func TestMultipartUploadError(t *testing.T) {
+	const partSize = 1024
+	fake := NewFakeServer(testAccessKey, testSecretKey)
+	fake.CreateBucket(testBucket)
+	var failed atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("partNumber") != "" && failed.CompareAndSwap(false, true) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	fs, err := New(srv.URL, testBucket, &Options{AccessKey: testAccessKey, SecretKey: testSecretKey, PartSize: partSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 150)
+	f, err := fs.OpenFile("/multipart", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := f.Write(data)
+	if err == nil || n != len(data) {
+		t.Errorf("expecting an error with all the data written, got %d bytes and %v", n, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	read, err := vfs.ReadFile(fs, "/multipart")
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("unexpected contents after a failed part upload (%d bytes), %v", len(read), err)
+	}
+}
+
+func TestMounter(t *testing.T) {
+	fs, _ := newTestFS(t, nil)
+	m := &vfs.Mounter{}
+	mem := vfs.Memory()
+	if err := mem.Mkdir("/bucket", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(mem, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(fs, "/bucket"); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(m, "/bucket/file", []byte("mounted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := vfs.ReadFile(fs, "/file")
+	if err != nil || string(data) != "mounted" {
+		t.Errorf("unexpected contents %q, %v", string(data), err)
+	}
+}
@@ -0,0 +1,109 @@
+package s3fs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	signAlgorithm  = "AWS4-HMAC-SHA256"
+	signService    = "s3"
+	amzDateFormat  = "20060102T150405Z"
+	amzShortFormat = "20060102"
+)
+
+// uriEncode encodes s as required by the SigV4 canonical request,
+// which only leaves unreserved characters unescaped.
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var buf strings.Builder
+	for ii := 0; ii < len(s); ii++ {
+		c := s[ii]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+			continue
+		}
+		buf.WriteByte('%')
+		buf.WriteByte(hexDigits[c>>4])
+		buf.WriteByte(hexDigits[c&15])
+	}
+	return buf.String()
+}
+
+// canonicalQuery returns the query string sorted by key, with both
+// keys and values encoded with uriEncode.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hashHex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signature returns the SigV4 signature for the request to the given
+// service with the given canonical URI, which must already be encoded,
+// and the given signed headers, which must be lowercase and sorted.
+func signature(secretKey string, region string, service string, t time.Time, method string, uri string, query url.Values, host string, header http.Header, signedHeaders []string, payloadHash string) string {
+	var canonical strings.Builder
+	canonical.WriteString(method + "\n" + uri + "\n" + canonicalQuery(query) + "\n")
+	for _, h := range signedHeaders {
+		value := header.Get(h)
+		if h == "host" {
+			value = host
+		}
+		canonical.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonical.WriteString("\n" + strings.Join(signedHeaders, ";") + "\n" + payloadHash)
+	date := t.Format(amzShortFormat)
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := signAlgorithm + "\n" + t.Format(amzDateFormat) + "\n" + scope + "\n" + hashHex([]byte(canonical.String()))
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+// sign adds the SigV4 authentication headers to req. uri must be the
+// encoded path used in req.URL.
+func sign(req *http.Request, uri string, accessKey string, secretKey string, sessionToken string, region string, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+	sig := signature(secretKey, region, signService, t, req.Method, uri, req.URL.Query(), req.URL.Host, req.Header, signedHeaders, payloadHash)
+	scope := t.Format(amzShortFormat) + "/" + region + "/" + signService + "/aws4_request"
+	req.Header.Set("Authorization", signAlgorithm+" Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signedHeaders, ";")+", Signature="+sig)
+}
@@ -0,0 +1,122 @@
+package sftpfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pkg/sftp"
+	"github.com/rainycape/vfs"
+)
+
+// ClientVFS is the interface implemented by the VFS returned
+// from NewClient.
+type ClientVFS interface {
+	vfs.VFS
+	// Client returns the underlying *sftp.Client.
+	Client() *sftp.Client
+	// Close closes the underlying *sftp.Client.
+	Close() error
+}
+
+type clientFileSystem struct {
+	c *sftp.Client
+}
+
+// sshFxFileAlreadyExists is the SSH_FX_FILE_ALREADY_EXISTS status code.
+const sshFxFileAlreadyExists = 11
+
+// clientError converts the errors returned by the sftp client to the
+// errors used by VFS whenever possible. The sftp client already converts
+// the status codes defined by version 3 of the protocol.
+func clientError(err error) error {
+	var st *sftp.StatusError
+	if errors.As(err, &st) && st.Code == sshFxFileAlreadyExists {
+		return os.ErrExist
+	}
+	return err
+}
+
+func (fs *clientFileSystem) Open(path string) (vfs.RFile, error) {
+	f, err := fs.c.Open(path)
+	if err != nil {
+		return nil, clientError(err)
+	}
+	return f, nil
+}
+
+func (fs *clientFileSystem) OpenFile(path string, flag int, perm os.FileMode) (vfs.WFile, error) {
+	f, err := fs.c.OpenFile(path, flag)
+	if err != nil {
+		return nil, clientError(err)
+	}
+	if flag&os.O_APPEND != 0 {
+		// The sftp client always writes at its own offset
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, clientError(err)
+		}
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == os.O_WRONLY {
+		return writeOnlyFile{f}, nil
+	}
+	return f, nil
+}
+
+// writeOnlyFile is used for files opened with O_WRONLY, since reading
+// them with the sftp client returns no data rather than an error.
+type writeOnlyFile struct {
+	*sftp.File
+}
+
+func (f writeOnlyFile) Read(p []byte) (int, error) {
+	return 0, vfs.ErrWriteOnly
+}
+
+func (fs *clientFileSystem) Lstat(path string) (os.FileInfo, error) {
+	info, err := fs.c.Lstat(path)
+	return info, clientError(err)
+}
+
+func (fs *clientFileSystem) Stat(path string) (os.FileInfo, error) {
+	info, err := fs.c.Stat(path)
+	return info, clientError(err)
+}
+
+func (fs *clientFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	infos, err := fs.c.ReadDir(path)
+	if err != nil {
+		return nil, clientError(err)
+	}
+	sort.Sort(vfs.FileInfos(infos))
+	return infos, nil
+}
+
+func (fs *clientFileSystem) Mkdir(path string, perm os.FileMode) error {
+	return clientError(fs.c.Mkdir(path))
+}
+
+func (fs *clientFileSystem) Remove(path string) error {
+	return clientError(fs.c.Remove(path))
+}
+
+func (fs *clientFileSystem) Client() *sftp.Client {
+	return fs.c
+}
+
+func (fs *clientFileSystem) Close() error {
+	return fs.c.Close()
+}
+
+func (fs *clientFileSystem) String() string {
+	return "sftpfs"
+}
+
+// NewClient returns a VFS which accesses the files on the server
+// the given *sftp.Client is connected to. Note that the permissions
+// passed to OpenFile and Mkdir are ignored, the server decides the
+// permissions of new files and directories.
+func NewClient(c *sftp.Client) ClientVFS {
+	return &clientFileSystem{c: c}
+}
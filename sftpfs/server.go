@@ -0,0 +1,264 @@
+// Package sftpfs integrates VFS with github.com/pkg/sftp. It allows serving
+// a VFS with a sftp.RequestServer, as well as using a remote SFTP server
+// as a VFS.
+package sftpfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/rainycape/vfs"
+)
+
+// fileAt adapts a VFS file to io.ReaderAt and io.WriterAt.
+type fileAt struct {
+	mu sync.Mutex
+	rf vfs.RFile
+	// wf is non-nil only for files opened for writing
+	wf vfs.WFile
+}
+
+func (f *fileAt) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.rf.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(f.rf, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *fileAt) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.wf == nil {
+		return 0, vfs.ErrReadOnly
+	}
+	// Not all files support seeking past the end, so
+	// fill the gap with zeroes.
+	size, err := f.wf.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if off > size {
+		if _, err := f.wf.Write(make([]byte, off-size)); err != nil {
+			return 0, serverError(err)
+		}
+	} else if _, err := f.wf.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := f.wf.Write(p)
+	return n, serverError(err)
+}
+
+func (f *fileAt) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rf.Close()
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type handlers struct {
+	fs vfs.VFS
+}
+
+// errFileExists is the SSH_FX_FILE_ALREADY_EXISTS status. It's only
+// defined by newer versions of the protocol, so pkg/sftp doesn't
+// export it.
+var errFileExists = (&sftp.StatusError{Code: sshFxFileAlreadyExists}).FxCode()
+
+// statusError is reported by the sftp server with the given status
+// code and the message of the wrapped error.
+type statusError struct {
+	error
+	code error
+}
+
+func (e statusError) Unwrap() error {
+	return e.code
+}
+
+// serverError converts errors from the VFS to errors which are
+// properly reported by the sftp server.
+func serverError(err error) error {
+	switch {
+	case errors.Is(err, vfs.ErrReadOnlyFileSystem):
+		return sftp.ErrSSHFxPermissionDenied
+	case errors.Is(err, vfs.ErrQuotaExceeded):
+		// SFTP has no status code for quotas
+		return statusError{err, sftp.ErrSSHFxFailure}
+	case errors.Is(err, os.ErrExist):
+		return statusError{err, errFileExists}
+	}
+	return err
+}
+
+func (h *handlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.fs.Open(r.Filepath)
+	if err != nil {
+		return nil, serverError(err)
+	}
+	return &fileAt{rf: f}, nil
+}
+
+// openPerm returns the permissions sent with an open request, or 0644
+// if there are none. Since pkg/sftp stores the open flags rather than the
+// attribute flags in open requests, the attributes can only be decoded
+// when they consist of just the permissions, which is what clients like
+// OpenSSH send.
+func openPerm(r *sftp.Request) os.FileMode {
+	if len(r.Attrs) != 4 {
+		return 0644
+	}
+	return os.FileMode(binary.BigEndian.Uint32(r.Attrs)).Perm()
+}
+
+func (h *handlers) openFile(r *sftp.Request) (*fileAt, error) {
+	pflags := r.Pflags()
+	var flag int
+	switch {
+	case pflags.Read && pflags.Write:
+		flag = os.O_RDWR
+	case pflags.Write:
+		flag = os.O_WRONLY
+	default:
+		flag = os.O_RDONLY
+	}
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+	// O_APPEND is not passed down, since the sftp client
+	// always sends the offset to write at.
+	f, err := h.fs.OpenFile(r.Filepath, flag, openPerm(r))
+	if err != nil {
+		return nil, serverError(err)
+	}
+	return &fileAt{rf: f, wf: f}, nil
+}
+
+func (h *handlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.openFile(r)
+}
+
+func (h *handlers) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return h.openFile(r)
+}
+
+// rename follows the SFTP semantics, failing if dst exists.
+func (h *handlers) rename(src string, dst string) error {
+	if _, err := h.fs.Lstat(dst); err == nil {
+		return os.ErrExist
+	}
+	return vfs.Rename(h.fs, src, dst)
+}
+
+func (h *handlers) filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		// Only truncation is supported, other attributes are
+		// ignored.
+		if r.AttrFlags().Size {
+			return vfs.Truncate(h.fs, r.Filepath, int64(r.Attributes().Size))
+		}
+		return nil
+	case "Rename":
+		return h.rename(r.Filepath, r.Target)
+	case "Mkdir":
+		perm := os.FileMode(0755)
+		if r.AttrFlags().Permissions {
+			perm = r.Attributes().FileMode().Perm()
+		}
+		return h.fs.Mkdir(r.Filepath, perm)
+	case "Rmdir", "Remove":
+		info, err := h.fs.Lstat(r.Filepath)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() != (r.Method == "Rmdir") {
+			if info.IsDir() {
+				return errors.New(r.Filepath + " is a directory")
+			}
+			return errors.New(r.Filepath + " is not a directory")
+		}
+		return h.fs.Remove(r.Filepath)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *handlers) Filecmd(r *sftp.Request) error {
+	return serverError(h.filecmd(r))
+}
+
+func (h *handlers) list(r *sftp.Request, stat func(string) (os.FileInfo, error)) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		infos, err := h.fs.ReadDir(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		info, err := stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *handlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	return h.list(r, h.fs.Stat)
+}
+
+func (h *handlers) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	r.Method = "Stat"
+	return h.list(r, h.fs.Lstat)
+}
+
+// Handlers returns the sftp.Handlers for serving the given VFS with a
+// sftp.RequestServer. Since the VFS interface has no means of renaming
+// files, renames are implemented by copying the files and then removing
+// the originals. File attributes can't be changed, with the exception of
+// the size, which is implemented by rewriting the file. Symlinks and
+// hard links can't be created.
+func Handlers(fs vfs.VFS) sftp.Handlers {
+	h := &handlers{fs: fs}
+	return sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	}
+}
+
+// NewServer returns a sftp.RequestServer which serves the given VFS on
+// the given connection, usually an SSH channel. See Handlers.
+func NewServer(rwc io.ReadWriteCloser, fs vfs.VFS, options ...sftp.RequestServerOption) *sftp.RequestServer {
+	return sftp.NewRequestServer(rwc, Handlers(fs), options...)
+}
@@ -0,0 +1,247 @@
+package sftpfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/rainycape/vfs"
+	"github.com/rainycape/vfs/vfstest"
+)
+
+func newTestClient(t *testing.T, fs vfs.VFS) ClientVFS {
+	client, server := net.Pipe()
+	srv := NewServer(server, fs)
+	go srv.Serve()
+	c, err := sftp.NewClientPipe(client, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfs := NewClient(c)
+	t.Cleanup(func() {
+		cfs.Close()
+		srv.Close()
+	})
+	return cfs
+}
+
+func TestClient(t *testing.T) {
+	fs := vfs.Memory()
+	c := newTestClient(t, fs)
+	if err := vfs.MkdirAll(c, "/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(c, "/a/b/file.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := vfs.ReadFile(fs, "/a/b/file.txt")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected contents in backing fs %q, %v", string(data), err)
+	}
+	data, err = vfs.ReadFile(c, "/a/b/file.txt")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected contents %q, %v", string(data), err)
+	}
+	info, err := c.Stat("/a/b/file.txt")
+	if err != nil || info.Name() != "file.txt" || info.Size() != 5 || info.IsDir() {
+		t.Errorf("unexpected info %v, %v", info, err)
+	}
+	if err := vfs.WriteFile(c, "/a/z.txt", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := c.ReadDir("/a")
+	if err != nil || len(infos) != 2 || infos[0].Name() != "b" || !infos[0].IsDir() || infos[1].Name() != "z.txt" {
+		t.Errorf("unexpected entries %v, %v", infos, err)
+	}
+	if _, err := c.Stat("/missing"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting not exist error, got %v", err)
+	}
+	if err := c.Mkdir("/a", 0755); !vfs.IsExist(err) {
+		t.Errorf("expecting exist error, got %v", err)
+	}
+	f, err := c.OpenFile("/a/b/file.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" world"))
+	if _, err := f.Read(make([]byte, 1)); err != vfs.ErrWriteOnly {
+		t.Errorf("expecting ErrWriteOnly, got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = vfs.ReadFile(c, "/a/b/file.txt")
+	if string(data) != "hello world" {
+		t.Errorf("unexpected contents after append %q", string(data))
+	}
+	if err := vfs.RemoveAll(c, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/a"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting /a to be removed, got %v", err)
+	}
+}
+
+func TestVFS(t *testing.T) {
+	vfstest.TestVFS(t, newTestClient(t, vfs.Memory()))
+}
+
+func TestServerCommands(t *testing.T) {
+	fs := vfs.Memory()
+	c := newTestClient(t, fs)
+	sc := c.Client()
+	if err := vfs.MkdirAll(fs, "/src/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(fs, "/src/sub/file", []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.Rename("/src", "/src/sub/dst"); err == nil {
+		t.Error("expecting an error when renaming a directory into itself")
+	}
+	if err := sc.Rename("/src", "/dst"); err != nil {
+		t.Fatal(err)
+	}
+	var serr *sftp.StatusError
+	if err := sc.Mkdir("/dst"); !errors.As(err, &serr) || serr.Code != sshFxFileAlreadyExists {
+		t.Errorf("expecting SSH_FX_FILE_ALREADY_EXISTS, got %v", err)
+	}
+	if _, err := fs.Stat("/src"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting /src to be removed after rename, got %v", err)
+	}
+	if err := sc.Truncate("/dst/sub/file", 5); err != nil {
+		t.Fatal(err)
+	}
+	data, err := vfs.ReadFile(fs, "/dst/sub/file")
+	if err != nil || string(data) != "hello" {
+		t.Errorf("unexpected contents after truncating %q, %v", string(data), err)
+	}
+	f, err := sc.OpenFile("/dst/sub/file", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("!"), 7); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	data, _ = vfs.ReadFile(fs, "/dst/sub/file")
+	if !bytes.Equal(data, []byte("hello\x00\x00!")) {
+		t.Errorf("unexpected contents after writing past the end %q", string(data))
+	}
+	if err := sc.RemoveDirectory("/dst/sub/file"); err == nil {
+		t.Error("expecting an error when removing a file with rmdir")
+	}
+	if err := sc.Symlink("/dst", "/link"); err == nil {
+		t.Error("expecting an error when creating a symlink")
+	}
+}
+
+func TestMkdirPerm(t *testing.T) {
+	fs := vfs.Memory()
+	h := Handlers(fs)
+	r := sftp.NewRequest("Mkdir", "/dir")
+	// SSH_FILEXFER_ATTR_PERMISSIONS
+	r.Flags = 0x4
+	r.Attrs = []byte{0, 0, 0x01, 0xc0} // 0700
+	if err := h.FileCmd.Filecmd(r); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0700 {
+		t.Errorf("expecting a directory with mode 0700, got %s", info.Mode())
+	}
+}
+
+func TestCreatePerm(t *testing.T) {
+	// Memory doesn't keep the permissions of files
+	fs, err := vfs.TmpFS("vfs-sftpfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	h := Handlers(fs)
+	r := sftp.NewRequest("Put", "/file")
+	// SSH_FXF_WRITE|SSH_FXF_CREAT, pkg/sftp only keeps the
+	// attributes themselves
+	r.Flags = 0x2 | 0x8
+	r.Attrs = []byte{0, 0, 0x01, 0xc0} // 0700
+	w, err := h.FilePut.Filewrite(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := w.(io.Closer); ok {
+		c.Close()
+	}
+	info, err := fs.Stat("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("expecting a file with mode 0700, got %s", info.Mode())
+	}
+}
+
+func TestQuota(t *testing.T) {
+	root := vfs.Memory()
+	if err := vfs.MkdirAll(root, "/partners/acme", 0755); err != nil {
+		t.Fatal(err)
+	}
+	chroot, err := vfs.Chroot("/partners/acme", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := vfs.Quota(chroot, vfs.Limits{MaxBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, fs)
+	if err := vfs.WriteFile(c, "/report.csv", bytes.Repeat([]byte("a"), 512), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.Stat("/partners/acme/report.csv"); err != nil {
+		t.Errorf("upload did not land in the chroot: %v", err)
+	}
+	err = vfs.WriteFile(c, "/large.bin", bytes.Repeat([]byte("b"), 1024), 0644)
+	var serr *sftp.StatusError
+	if !errors.As(err, &serr) || serr.FxCode() != sftp.ErrSSHFxFailure || !strings.Contains(err.Error(), vfs.ErrQuotaExceeded.Error()) {
+		t.Errorf("expecting a failure status for exceeding the quota, got %v", err)
+	}
+	if fs.Usage().Bytes > 1024 {
+		t.Errorf("quota exceeded, using %d bytes", fs.Usage().Bytes)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	fs := vfs.Memory()
+	if err := vfs.WriteFile(fs, "/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, vfs.ReadOnly(fs))
+	f, err := c.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "hello" {
+		t.Errorf("unexpected contents %q, %v", string(data), err)
+	}
+	if err := vfs.WriteFile(c, "/other", nil, 0644); !os.IsPermission(err) {
+		t.Errorf("expecting permission error, got %v", err)
+	}
+	if err := c.Mkdir("/dir", 0755); !os.IsPermission(err) {
+		t.Errorf("expecting permission error, got %v", err)
+	}
+}
@@ -6,4 +6,6 @@ zip -r ../fs.zip *
 tar cvvf ../fs.tar *
 tar cvvzf ../fs.tar.gz *
 tar cvvjf ../fs.tar.bz2 *
+tar cvvJf ../fs.tar.xz *
+tar --zstd -cvvf ../fs.tar.zst *
 cd -
@@ -0,0 +1,104 @@
+package tmplfs
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rainycape/vfs"
+)
+
+func hasMeta(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
+
+// matchParts returns true iff the path elements in name match
+// the pattern elements in pat.
+func matchParts(pat []string, name []string) bool {
+	if len(pat) == 0 {
+		return len(name) == 0
+	}
+	if pat[0] == "**" {
+		for ii := 0; ii <= len(name); ii++ {
+			if matchParts(pat[1:], name[ii:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pat[0], name[0]); !ok {
+		return false
+	}
+	return matchParts(pat[1:], name[1:])
+}
+
+// matchPrefix returns true iff the directory with the given
+// path elements might contain files matching pat.
+func matchPrefix(pat []string, name []string) bool {
+	if len(name) == 0 {
+		return true
+	}
+	if len(pat) == 0 {
+		return false
+	}
+	if pat[0] == "**" {
+		return true
+	}
+	if ok, _ := path.Match(pat[0], name[0]); !ok {
+		return false
+	}
+	return matchPrefix(pat[1:], name[1:])
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// Glob returns the absolute paths of the files in fs matching the given
+// pattern, sorted by name. The pattern syntax is the same used by
+// path.Match, with the addition of "**" as a path element, which matches
+// zero or more directories. Directories are never included in the results.
+// Like path/filepath.Glob, the only possible returned error is
+// path.ErrBadPattern.
+func Glob(fs vfs.VFS, pattern string) ([]string, error) {
+	pat := splitPath(path.Clean("/" + pattern))
+	for _, v := range pat {
+		if _, err := path.Match(v, ""); err != nil {
+			return nil, err
+		}
+	}
+	// Start walking from the deepest directory without
+	// meta characters.
+	root := "/"
+	for ii := 0; ii < len(pat)-1 && !hasMeta(pat[ii]); ii++ {
+		root = path.Join(root, pat[ii])
+	}
+	var matches []string
+	vfs.Walk(fs, root, func(fs vfs.VFS, p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if info != nil && info.IsDir() {
+				return vfs.SkipDir
+			}
+			return nil
+		}
+		name := splitPath(p)
+		if info.IsDir() {
+			if !matchPrefix(pat, name) {
+				return vfs.SkipDir
+			}
+			return nil
+		}
+		if matchParts(pat, name) {
+			matches = append(matches, p)
+		}
+		return nil
+	})
+	return matches, nil
+}
@@ -0,0 +1,64 @@
+package tmplfs
+
+import (
+	"html/template"
+	"io"
+
+	"github.com/rainycape/vfs"
+)
+
+// HTML holds html/template templates loaded from a VFS.
+type HTML struct {
+	l *loader
+}
+
+// Template returns the parsed templates. The returned template is
+// named after the first file, while the rest of them can be retrieved
+// using its Lookup method. If reloading is enabled and the files have
+// changed, they're parsed again before returning.
+func (h *HTML) Template() (*template.Template, error) {
+	t, err := h.l.template()
+	if err != nil {
+		return nil, err
+	}
+	return t.(*template.Template), nil
+}
+
+// ExecuteTemplate applies the template with the given name, which
+// must be the absolute path of its file in the VFS, to data and
+// writes the output to w.
+func (h *HTML) ExecuteTemplate(w io.Writer, name string, data interface{}) error {
+	t, err := h.Template()
+	if err != nil {
+		return err
+	}
+	return t.ExecuteTemplate(w, name, data)
+}
+
+// ParseHTML parses the files in fs matching the given patterns as
+// html/template templates. See Glob for the pattern syntax.
+func ParseHTML(fs vfs.VFS, opts *Options, patterns ...string) (*HTML, error) {
+	o := opts.withDefaults()
+	l, err := newLoader(fs, o.Reload, patterns, func(paths []string) (interface{}, error) {
+		var t *template.Template
+		for _, p := range paths {
+			data, err := vfs.ReadFile(fs, p)
+			if err != nil {
+				return nil, err
+			}
+			if t == nil {
+				t = template.New(p).Funcs(o.Funcs).Delims(o.LeftDelim, o.RightDelim)
+			} else {
+				t = t.New(p)
+			}
+			if _, err := t.Parse(string(data)); err != nil {
+				return nil, err
+			}
+		}
+		return t.Lookup(paths[0]), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &HTML{l: l}, nil
+}
@@ -0,0 +1,64 @@
+package tmplfs
+
+import (
+	"io"
+	"text/template"
+
+	"github.com/rainycape/vfs"
+)
+
+// Text holds text/template templates loaded from a VFS.
+type Text struct {
+	l *loader
+}
+
+// Template returns the parsed templates. The returned template is
+// named after the first file, while the rest of them can be retrieved
+// using its Lookup method. If reloading is enabled and the files have
+// changed, they're parsed again before returning.
+func (txt *Text) Template() (*template.Template, error) {
+	t, err := txt.l.template()
+	if err != nil {
+		return nil, err
+	}
+	return t.(*template.Template), nil
+}
+
+// ExecuteTemplate applies the template with the given name, which
+// must be the absolute path of its file in the VFS, to data and
+// writes the output to w.
+func (txt *Text) ExecuteTemplate(w io.Writer, name string, data interface{}) error {
+	t, err := txt.Template()
+	if err != nil {
+		return err
+	}
+	return t.ExecuteTemplate(w, name, data)
+}
+
+// ParseText parses the files in fs matching the given patterns as
+// text/template templates. See Glob for the pattern syntax.
+func ParseText(fs vfs.VFS, opts *Options, patterns ...string) (*Text, error) {
+	o := opts.withDefaults()
+	l, err := newLoader(fs, o.Reload, patterns, func(paths []string) (interface{}, error) {
+		var t *template.Template
+		for _, p := range paths {
+			data, err := vfs.ReadFile(fs, p)
+			if err != nil {
+				return nil, err
+			}
+			if t == nil {
+				t = template.New(p).Funcs(o.Funcs).Delims(o.LeftDelim, o.RightDelim)
+			} else {
+				t = t.New(p)
+			}
+			if _, err := t.Parse(string(data)); err != nil {
+				return nil, err
+			}
+		}
+		return t.Lookup(paths[0]), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Text{l: l}, nil
+}
@@ -0,0 +1,153 @@
+// Package tmplfs implements loading html/template and text/template
+// templates from a VFS.
+//
+// Files are selected using glob patterns, which might include "**" to
+// match any number of directories (see Glob), and each template is named
+// after the absolute VFS path of its file, e.g. "/views/index.html".
+// Templates can optionally be reloaded when the files change, which
+// is useful during development.
+package tmplfs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rainycape/vfs"
+)
+
+// Options specifies the options used for parsing the templates.
+// A nil *Options is valid and represents the default options.
+type Options struct {
+	// Funcs are added to the templates before parsing them.
+	Funcs map[string]interface{}
+	// LeftDelim and RightDelim set the action delimiters. If empty,
+	// the default ones are used.
+	LeftDelim  string
+	RightDelim string
+	// Reload makes the templates check if any file has been added,
+	// removed or modified every time they're used, parsing all of them
+	// again if there were any changes.
+	Reload bool
+}
+
+// file stores the information used for detecting changes
+// in the template files.
+type file struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// loader handles the reloading and it's shared by the HTML and
+// Text types. The parse function is called with the paths of
+// the files to parse.
+type loader struct {
+	fs       vfs.VFS
+	patterns []string
+	reload   bool
+	parse    func(paths []string) (interface{}, error)
+	mu       sync.Mutex
+	files    []file
+	tmpl     interface{}
+}
+
+// glob returns the files matching all the patterns, returning an
+// error if any pattern matches no files. Files matched by multiple
+// patterns are only returned once.
+func (l *loader) glob() ([]file, error) {
+	var files []file
+	seen := make(map[string]bool)
+	for _, pattern := range l.patterns {
+		matches, err := Glob(l.fs, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("tmplfs: pattern matches no files: %#q", pattern)
+		}
+		for _, v := range matches {
+			if seen[v] {
+				continue
+			}
+			seen[v] = true
+			info, err := l.fs.Stat(v)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file{path: v, size: info.Size(), modTime: info.ModTime()})
+		}
+	}
+	return files, nil
+}
+
+func sameFiles(a []file, b []file) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for ii, v := range a {
+		if v.path != b[ii].path || v.size != b[ii].size || !v.modTime.Equal(b[ii].modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *loader) load() error {
+	files, err := l.glob()
+	if err != nil {
+		return err
+	}
+	if l.tmpl != nil && sameFiles(files, l.files) {
+		return nil
+	}
+	paths := make([]string, len(files))
+	for ii, v := range files {
+		paths[ii] = v.path
+	}
+	tmpl, err := l.parse(paths)
+	if err != nil {
+		return err
+	}
+	l.files = files
+	l.tmpl = tmpl
+	return nil
+}
+
+// template returns the current template, reloading it if needed. If
+// reloading fails, the error is returned and the previous template is
+// kept, so it's used again once the files are fixed.
+func (l *loader) template() (interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.reload || l.tmpl == nil {
+		if err := l.load(); err != nil {
+			return nil, err
+		}
+	}
+	return l.tmpl, nil
+}
+
+func newLoader(fs vfs.VFS, reload bool, patterns []string, parse func([]string) (interface{}, error)) (*loader, error) {
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("tmplfs: no patterns")
+	}
+	l := &loader{
+		fs:       fs,
+		patterns: patterns,
+		reload:   reload,
+		parse:    parse,
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (o *Options) withDefaults() Options {
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	return opts
+}
@@ -0,0 +1,146 @@
+package tmplfs
+
+import (
+	"bytes"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rainycape/vfs"
+)
+
+func newTestFS(t *testing.T, files map[string]string) vfs.VFS {
+	fs := vfs.Memory()
+	for k, v := range files {
+		if err := vfs.MkdirAll(fs, path.Dir(k), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := vfs.WriteFile(fs, k, []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs
+}
+
+func TestGlob(t *testing.T) {
+	fs := newTestFS(t, map[string]string{
+		"/a.html":             "",
+		"/views/b.html":       "",
+		"/views/c.txt":        "",
+		"/views/x/d.html":     "",
+		"/views/x/y/e.html":   "",
+		"/views/x/y/f.txt":    "",
+		"/other/x/g.html":     "",
+		"/views/z.html/h.txt": "",
+	})
+	cases := map[string][]string{
+		"/*.html":             {"/a.html"},
+		"views/*.html":        {"/views/b.html"},
+		"/views/**/*.html":    {"/views/b.html", "/views/x/d.html", "/views/x/y/e.html"},
+		"/**/x/*.html":        {"/other/x/g.html", "/views/x/d.html"},
+		"/views/**":           {"/views/b.html", "/views/c.txt", "/views/x/d.html", "/views/x/y/e.html", "/views/x/y/f.txt", "/views/z.html/h.txt"},
+		"/views/?/y/[e-f].*":  {"/views/x/y/e.html", "/views/x/y/f.txt"},
+		"/views/x/y/e.html":   {"/views/x/y/e.html"},
+		"/missing/**/*.html":  nil,
+		"/views/**/**/f.txt":  {"/views/x/y/f.txt"},
+		"/views/*/*/*.html":   {"/views/x/y/e.html"},
+		"/views/z.html":       nil,
+		"/views/**/z.html/**": {"/views/z.html/h.txt"},
+	}
+	for k, v := range cases {
+		matches, err := Glob(fs, k)
+		if err != nil {
+			t.Errorf("error globbing %q: %v", k, err)
+			continue
+		}
+		if !reflect.DeepEqual(matches, v) {
+			t.Errorf("expecting %q to match %v, got %v", k, v, matches)
+		}
+	}
+	if _, err := Glob(fs, "/views/[.html"); err != path.ErrBadPattern {
+		t.Errorf("expecting ErrBadPattern, got %v", err)
+	}
+}
+
+func TestHTML(t *testing.T) {
+	fs := newTestFS(t, map[string]string{
+		"/views/index.html":          `{{ template "/views/partials/title.html" . }}<p>{{ . }}</p>`,
+		"/views/partials/title.html": `<h1>{{ upper . }}</h1>`,
+		"/views/readme.txt":          "ignored",
+	})
+	opts := &Options{Funcs: map[string]interface{}{"upper": strings.ToUpper}}
+	h, err := ParseHTML(fs, opts, "/views/**/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := h.Template()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := tmpl.Name(); name != "/views/index.html" {
+		t.Errorf("unexpected template name %q", name)
+	}
+	var buf bytes.Buffer
+	if err := h.ExecuteTemplate(&buf, "/views/index.html", "<b>"); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "<h1>&lt;B&gt;</h1><p>&lt;b&gt;</p>"; buf.String() != exp {
+		t.Errorf("expecting %q, got %q", exp, buf.String())
+	}
+	if tmpl.Lookup("/views/readme.txt") != nil {
+		t.Error("readme.txt should not be parsed")
+	}
+	if _, err := ParseHTML(fs, nil, "/views/*.tmpl"); err == nil {
+		t.Error("expecting an error for a pattern which matches no files")
+	}
+}
+
+func TestTextReload(t *testing.T) {
+	fs := newTestFS(t, map[string]string{
+		"/t/a.txt": "a[[ . ]]",
+	})
+	opts := &Options{LeftDelim: "[[", RightDelim: "]]", Reload: true}
+	txt, err := ParseText(fs, opts, "/t/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	execute := func(name string) string {
+		var buf bytes.Buffer
+		if err := txt.ExecuteTemplate(&buf, name, 1); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	if s := execute("/t/a.txt"); s != "a1" {
+		t.Errorf("unexpected output %q", s)
+	}
+	if err := vfs.WriteFile(fs, "/t/a.txt", []byte("A[[ . ]]!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(fs, "/t/b.txt", []byte(`[[ template "/t/a.txt" . ]]b`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s := execute("/t/a.txt"); s != "A1!" {
+		t.Errorf("unexpected output after reloading %q", s)
+	}
+	if s := execute("/t/b.txt"); s != "A1!b" {
+		t.Errorf("unexpected output from new template %q", s)
+	}
+	if err := vfs.WriteFile(fs, "/t/b.txt", []byte("[[ broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := txt.Template(); err == nil {
+		t.Error("expecting an error after breaking a template")
+	}
+	if err := fs.Remove("/t/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if s := execute("/t/a.txt"); s != "A1!" {
+		t.Errorf("unexpected output after removing b.txt %q", s)
+	}
+	tmpl, err := txt.Template()
+	if err != nil || tmpl.Lookup("/t/b.txt") != nil {
+		t.Errorf("b.txt should not be parsed after removing it, %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package vfs
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	pathpkg "path"
@@ -17,6 +18,10 @@ var (
 	ErrReadOnly = errors.New("can't write to read only file")
 	// ErrWriteOnly is returned from Read() on a write-only file.
 	ErrWriteOnly = errors.New("can't read from write only file")
+	// ErrNotSupported is returned by the functions which only work
+	// with the VFS implementations which keep their files in memory,
+	// like Chmod, when used with any other ones.
+	ErrNotSupported = errors.New("operation not supported by the VFS")
 )
 
 // WalkFunc is the function type used by Walk to iterate over a VFS.
@@ -184,6 +189,261 @@ func Clone(dst VFS, src VFS) error {
 	return err
 }
 
+// copyPath copies the file, directory or symlink at src to dst, which
+// must not exist. Symlinks are never followed.
+func copyPath(fs VFS, src string, dst string) error {
+	info, err := fs.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return copySymlink(fs, info, dst)
+	}
+	if info.IsDir() {
+		if err := fs.Mkdir(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		infos, err := fs.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, v := range infos {
+			if err := copyPath(fs, pathpkg.Join(src, v.Name()), pathpkg.Join(dst, v.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	data, err := ReadFile(fs, src)
+	if err != nil {
+		return err
+	}
+	return WriteFile(fs, dst, data, info.Mode().Perm())
+}
+
+// copySymlink creates a symlink at dst with the same target as the
+// one described by info. Only symlinks stored in memory can be copied.
+func copySymlink(fs VFS, info os.FileInfo, dst string) error {
+	src, ok := info.Sys().(*File)
+	if !ok {
+		return fmt.Errorf("can't copy symlink %s in %s", info.Name(), fs)
+	}
+	src.RLock()
+	target := src.Data
+	src.RUnlock()
+	if err := WriteFile(fs, dst, target, info.Mode().Perm()); err != nil {
+		return err
+	}
+	st, err := fs.Lstat(dst)
+	if err != nil {
+		return err
+	}
+	f, ok := st.Sys().(*File)
+	if !ok {
+		// dst is in a VFS which doesn't keep its files in memory
+		fs.Remove(dst)
+		return fmt.Errorf("can't create symlink %s in %s", dst, fs)
+	}
+	f.Lock()
+	f.Mode = f.Mode&os.ModePerm | os.ModeSymlink
+	f.Unlock()
+	return nil
+}
+
+// Symlink creates a symbolic link at link pointing to target. Symlinks
+// can only be stored by the VFS implementations which keep their files
+// in memory, so Symlink returns ErrNotSupported for the rest of them.
+// Absolute targets are converted to paths relative to the directory
+// of link, since that's how the in-memory file systems resolve them.
+func Symlink(fs VFS, target string, link string) error {
+	dir := pathpkg.Dir(pathpkg.Clean("/" + link))
+	if pathpkg.IsAbs(target) {
+		target = relPath(dir, target)
+	}
+	if info, err := fs.Lstat(dir); err != nil {
+		return err
+	} else if _, ok := info.Sys().(*Dir); !ok {
+		return ErrNotSupported
+	}
+	// Like os.Symlink, fail if link already exists
+	f, err := fs.OpenFile(link, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0777)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(target)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	info, err := fs.Lstat(link)
+	if err != nil {
+		return err
+	}
+	e, ok := info.Sys().(*File)
+	if !ok {
+		fs.Remove(link)
+		return ErrNotSupported
+	}
+	e.Lock()
+	e.Mode = e.Mode&os.ModePerm | os.ModeSymlink
+	e.Unlock()
+	return nil
+}
+
+// Rename moves the file or directory at oldPath to newPath. Since the
+// VFS interface has no means of renaming files, Rename copies them and
+// then removes the originals, which also allows moving files between
+// the file systems in a *Mounter. Symlinks are copied rather than
+// followed, which is only supported by the in-memory file systems.
+// Like os.Rename, an existing file at newPath is replaced, but an
+// existing directory is not.
+func Rename(fs VFS, oldPath string, newPath string) error {
+	src := pathpkg.Clean("/" + oldPath)
+	dst := pathpkg.Clean("/" + newPath)
+	if src == dst {
+		return nil
+	}
+	if src == "/" || dst == "/" || strings.HasPrefix(dst, src+"/") {
+		return os.ErrInvalid
+	}
+	srcInfo, err := fs.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if dstInfo, err := fs.Lstat(dst); err == nil {
+		if dstInfo.IsDir() || srcInfo.IsDir() {
+			return os.ErrExist
+		}
+		if err := fs.Remove(dst); err != nil {
+			return err
+		}
+	}
+	if err := copyPath(fs, src, dst); err != nil {
+		return err
+	}
+	return RemoveAll(fs, src)
+}
+
+// Truncate changes the size of the file at the given path, either cutting
+// its data or extending it with zeroes. Since the VFS interface has no
+// means of truncating files, the file is rewritten with its new contents.
+// Note that files open for writing at the same path might overwrite the
+// truncated file when they're closed.
+func Truncate(fs VFS, path string, size int64) error {
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	info, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	if info.Size() == size {
+		return nil
+	}
+	var data []byte
+	if size > 0 {
+		if data, err = ReadFile(fs, path); err != nil {
+			return err
+		}
+		if int64(len(data)) > size {
+			data = data[:size]
+		} else {
+			data = append(data, make([]byte, size-int64(len(data)))...)
+		}
+	}
+	return WriteFile(fs, path, data, info.Mode().Perm())
+}
+
+// TruncateFile truncates the file at path, which f has open with the given
+// flag, to size. Since open files can't be truncated through the VFS
+// interface, f is closed, the file is truncated with Truncate and then
+// opened again, keeping the offset of f. TruncateFile returns the new
+// file, which replaces f even if there's an error, or nil if the file
+// couldn't be opened again, in which case f is closed too.
+func TruncateFile(fs VFS, path string, f WFile, flag int, size int64) (WFile, error) {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return f, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	// Open the file again even if truncating fails, so
+	// the caller still has a valid file.
+	terr := Truncate(fs, path, size)
+	nf, err := fs.OpenFile(path, flag&^(os.O_CREATE|os.O_EXCL|os.O_TRUNC), 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := nf.Seek(pos, io.SeekStart); err != nil {
+		return nf, err
+	}
+	return nf, terr
+}
+
+// ReadAt reads len(p) bytes from f starting at offset off, with the same
+// semantics as io.ReaderAt. Since RFile has no ReadAt method, f is seeked
+// to off and then back to its previous offset, so ReadAt must not be
+// called concurrently with other operations on f.
+func ReadAt(f RFile, p []byte, off int64) (int, error) {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Seek(pos, io.SeekStart)
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(f, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Chmod changes the permissions of the file or directory at path, as
+// well as its setuid, setgid and sticky bits. It's only supported by the
+// VFS implementations which keep their files in memory, like Memory or
+// the ones returned by Zip, and returns ErrNotSupported for the rest.
+func Chmod(fs VFS, path string, mode os.FileMode) error {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	const mask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	switch e := info.Sys().(type) {
+	case *File:
+		e.Lock()
+		e.Mode = e.Mode&^mask | mode&mask
+		e.Unlock()
+	case *Dir:
+		e.Lock()
+		e.Mode = e.Mode&^mask | mode&mask
+		e.Unlock()
+	default:
+		return ErrNotSupported
+	}
+	return nil
+}
+
+// WrapPathError returns err wrapped in an *os.PathError with the given
+// operation and path, unless it's nil or already an *os.PathError. It's
+// intended for adapting a VFS to interfaces modeled after the os package.
+func WrapPathError(op string, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*os.PathError); ok {
+		return err
+	}
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
 // IsExist returns wheter the error indicates that the file or directory
 // already exists.
 func IsExist(err error) bool {
@@ -1,6 +1,7 @@
 package vfs
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
@@ -398,3 +399,202 @@ func TestZipSymlinks(t *testing.T) {
 	}
 
 }
+
+func TestRemoveSymlink(t *testing.T) {
+	fs, err := Open(filepath.Join("testdata", "fs2.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Removing a symlink must remove the link, not its target
+	if err := fs.Remove("f3.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Lstat("f3.bin"); !IsNotExist(err) {
+		t.Errorf("expecting f3.bin to be removed, got %v", err)
+	}
+	if _, err := fs.Stat("f2.bin"); err != nil {
+		t.Errorf("f2.bin should still exist, got %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	fs, err := Open(filepath.Join("testdata", "fs2.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Symlinks must be moved rather than followed
+	if err := Rename(fs, "f3.bin", "link.bin"); err != nil {
+		t.Fatal(err)
+	}
+	st, err := fs.Lstat("link.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&os.ModeSymlink == 0 {
+		t.Error("link.bin isn't a symlink, it should be")
+	}
+	data1, err1 := ReadFile(fs, "link.bin")
+	data2, err2 := ReadFile(fs, "f2.bin")
+	if err1 != nil || err2 != nil || !bytes.Equal(data1, data2) {
+		t.Errorf("link.bin should point to f2.bin, %v, %v", err1, err2)
+	}
+	if _, err := fs.Lstat("f3.bin"); !IsNotExist(err) {
+		t.Errorf("expecting f3.bin to be removed, got %v", err)
+	}
+	if err := MkdirAll(fs, "/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "/a/b/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rename(fs, "/a", "/c"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "/c/b/file"); err != nil || string(data) != "data" {
+		t.Errorf("unexpected contents after rename %q, %v", string(data), err)
+	}
+	// Existing files are replaced, but not directories
+	if err := Rename(fs, "/c/b/file", "/f1.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "/f1.bin"); err != nil || string(data) != "data" {
+		t.Errorf("unexpected contents after replacing %q, %v", string(data), err)
+	}
+	if err := Rename(fs, "/f1.bin", "/c"); err != os.ErrExist {
+		t.Errorf("expecting ErrExist replacing a directory, got %v", err)
+	}
+	if err := Rename(fs, "/c", "/c/b/d"); err != os.ErrInvalid {
+		t.Errorf("expecting ErrInvalid renaming into itself, got %v", err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	fs := Memory()
+	if err := WriteFile(fs, "f", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"he", "he\x00\x00", ""} {
+		if err := Truncate(fs, "f", int64(len(v))); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := ReadFile(fs, "f"); err != nil || string(data) != v {
+			t.Errorf("expecting f to contain %q, got %q (%v)", v, string(data), err)
+		}
+	}
+	if err := Truncate(fs, "f", -1); err != os.ErrInvalid {
+		t.Errorf("expecting ErrInvalid with a negative size, got %v", err)
+	}
+	if err := Truncate(fs, "/", 0); err == nil {
+		t.Error("expecting an error truncating a directory")
+	}
+}
+
+func TestTruncateFile(t *testing.T) {
+	fs := Memory()
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	f, err := fs.OpenFile("f", flag, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = TruncateFile(fs, "f", f, flag, 7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadFile(fs, "f"); err != nil || string(data) != "hello!\x00" {
+		t.Errorf("expecting the offset to be kept after truncating, got %q (%v)", string(data), err)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	fs := Memory()
+	if err := MkdirAll(fs, "/a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "/f", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(fs, "/f", "/a/b/link"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Lstat("/a/b/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 || string(info.Sys().(*File).Data) != "../../f" {
+		t.Errorf("expecting a symlink to ../../f, got %s %q", info.Mode(), info.Sys().(*File).Data)
+	}
+	if data, err := ReadFile(fs, "/a/b/link"); err != nil || string(data) != "data" {
+		t.Errorf("expecting link to point to f, got %q (%v)", string(data), err)
+	}
+	if err := Symlink(fs, "f", "/a/b/link"); !IsExist(err) {
+		t.Errorf("expecting an error for an existing link, got %v", err)
+	}
+	tmp, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmp.Close()
+	if err := Symlink(tmp, "/f", "/link"); err != ErrNotSupported {
+		t.Errorf("expecting ErrNotSupported, got %v", err)
+	}
+	if _, err := tmp.Lstat("/link"); !IsNotExist(err) {
+		t.Errorf("expecting no file for an unsupported symlink, got %v", err)
+	}
+}
+
+func TestChmod(t *testing.T) {
+	fs := Memory()
+	if err := WriteFile(fs, "f", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Chmod(fs, "f", 0600|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fs.Stat("f"); err != nil || info.Mode() != 0600|os.ModeSetuid {
+		t.Errorf("expecting mode %s, got %v (%v)", 0600|os.ModeSetuid, info.Mode(), err)
+	}
+	tmp, err := TmpFS("vfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmp.Close()
+	if err := WriteFile(tmp, "f", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Chmod(tmp, "f", 0600); err != ErrNotSupported {
+		t.Errorf("expecting ErrNotSupported, got %v", err)
+	}
+}
+
+func TestMountPoint(t *testing.T) {
+	root := Memory()
+	if err := root.Mkdir("/mnt", 0755); err != nil {
+		t.Fatal(err)
+	}
+	mnt := Memory()
+	if err := WriteFile(mnt, "/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &Mounter{}
+	if err := m.Mount(root, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(mnt, "/mnt"); err != nil {
+		t.Fatal(err)
+	}
+	// The mount point itself must be resolved to the mounted fs
+	for _, v := range []string{"/mnt", "mnt", "/mnt/"} {
+		infos, err := m.ReadDir(v)
+		if err != nil || len(infos) != 1 || infos[0].Name() != "file" {
+			t.Errorf("unexpected entries in %s %v, %v", v, infos, err)
+		}
+	}
+}
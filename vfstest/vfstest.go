@@ -0,0 +1,116 @@
+// Package vfstest implements a conformance test for VFS implementations,
+// so they can check that their behavior matches the one of vfs.Memory.
+package vfstest
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/rainycape/vfs"
+)
+
+// TestVFS tests the basic operations of the given VFS, which must be
+// writable and empty. It creates the files a and b and the directories
+// c and c/d, removing the directories before returning.
+func TestVFS(t *testing.T, fs vfs.VFS) {
+	if err := vfs.WriteFile(fs, "a", []byte("A"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := vfs.ReadFile(fs, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "A" {
+		t.Errorf("expecting file a to contain \"A\" got %q instead", string(data))
+	}
+	if err := vfs.WriteFile(fs, "b", []byte("B"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.OpenFile("b", os.O_CREATE|os.O_TRUNC|os.O_EXCL|os.O_WRONLY, 0755); err == nil || !vfs.IsExist(err) {
+		t.Errorf("error should be ErrExist, it's %v", err)
+	}
+	fb, err := fs.OpenFile("b", os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		t.Fatalf("error opening b: %s", err)
+	}
+	if _, err := fb.Write([]byte("BB")); err != nil {
+		t.Errorf("error writing to b: %s", err)
+	}
+	if _, err := fb.Seek(0, io.SeekStart); err != nil {
+		t.Errorf("error seeking b: %s", err)
+	}
+	if _, err := fb.Read(make([]byte, 2)); err == nil {
+		t.Error("allowed reading WRONLY file b")
+	}
+	if err := fb.Close(); err != nil {
+		t.Errorf("error closing b: %s", err)
+	}
+	files, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("expecting 2 files, got %d", len(files))
+	}
+	if n := files[0].Name(); n != "a" {
+		t.Errorf("expecting first file named \"a\", got %q", n)
+	}
+	if n := files[1].Name(); n != "b" {
+		t.Errorf("expecting first file named \"b\", got %q", n)
+	}
+	for ii, v := range files {
+		es := int64(ii + 1)
+		if s := v.Size(); es != s {
+			t.Errorf("expecting file %s to have size %d, has %d", v.Name(), es, s)
+		}
+	}
+	if err := vfs.MkdirAll(fs, "a/b/c/d", 0); err == nil {
+		t.Error("should not allow dir over file")
+	}
+	if err := vfs.MkdirAll(fs, "c/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Idempotent
+	if err := vfs.MkdirAll(fs, "c/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("c", 0755); err == nil || !vfs.IsExist(err) {
+		t.Errorf("err should be ErrExist, it's %v", err)
+	}
+	// Should fail to remove, c is not empty
+	if err := fs.Remove("c"); err == nil {
+		t.Fatalf("removed non-empty directory")
+	}
+	var walked []os.FileInfo
+	var walkedNames []string
+	err = vfs.Walk(fs, "c", func(fs vfs.VFS, path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, info)
+		walkedNames = append(walkedNames, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"c", "c/d"}; !reflect.DeepEqual(exp, walkedNames) {
+		t.Errorf("expecting walked names %v, got %v", exp, walkedNames)
+	}
+	for _, v := range walked {
+		if !v.IsDir() {
+			t.Errorf("%s should be a dir", v.Name())
+		}
+	}
+	if err := vfs.RemoveAll(fs, "c"); err != nil {
+		t.Fatal(err)
+	}
+	err = vfs.Walk(fs, "c", func(fs vfs.VFS, path string, info os.FileInfo, err error) error {
+		return err
+	})
+	if err == nil || !vfs.IsNotExist(err) {
+		t.Errorf("error should be ErrNotExist, it's %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+// Package webdav allows serving a VFS over WebDAV, using the server
+// implementation in golang.org/x/net/webdav.
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/rainycape/vfs"
+	"github.com/rainycape/vfs/httpfs"
+	"golang.org/x/net/webdav"
+)
+
+// Options specifies the options for Handler.
+type Options struct {
+	// Prefix is the URL path prefix to strip from WebDAV resource
+	// paths.
+	Prefix string
+	// Logger is an optional error logger. If non-nil, it will be
+	// called for all HTTP requests.
+	Logger func(*http.Request, error)
+}
+
+type fileSystem struct {
+	fs vfs.VFS
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func (fs *fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return fs.fs.Mkdir(cleanPath(name), perm)
+}
+
+func (fs *fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = cleanPath(name)
+	writing := flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0
+	if info, err := fs.fs.Stat(name); err == nil && info.IsDir() {
+		if writing {
+			return nil, fmt.Errorf("%s is a directory", name)
+		}
+		return &file{File: httpfs.NewFile(fs.fs, name, nil)}, nil
+	}
+	if !writing {
+		f, err := fs.fs.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return &file{File: httpfs.NewFile(fs.fs, name, f)}, nil
+	}
+	f, err := fs.fs.OpenFile(name, flag&^os.O_APPEND, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_APPEND != 0 {
+		// Not all VFS implementations support O_APPEND, so
+		// position the file at the end instead.
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &file{File: httpfs.NewFile(fs.fs, name, f), wf: f}, nil
+}
+
+func (fs *fileSystem) RemoveAll(ctx context.Context, name string) error {
+	name = cleanPath(name)
+	if name == "/" {
+		return os.ErrInvalid
+	}
+	if _, err := fs.fs.Lstat(name); err != nil {
+		return err
+	}
+	return vfs.RemoveAll(fs.fs, name)
+}
+
+func (fs *fileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return vfs.Rename(fs.fs, cleanPath(oldName), cleanPath(newName))
+}
+
+func (fs *fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return fs.fs.Stat(cleanPath(name))
+}
+
+// file implements webdav.File using the http.File
+// from httpfs, which can also be written if wf is
+// non-nil.
+type file struct {
+	http.File
+	wf vfs.WFile
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if f.wf == nil {
+		return 0, vfs.ErrReadOnly
+	}
+	return f.wf.Write(p)
+}
+
+// FileSystem returns a webdav.FileSystem which uses the given VFS. Since
+// MOVE requests are handled by vfs.Rename, moving a collection copies
+// all the files inside it.
+func FileSystem(fs vfs.VFS) webdav.FileSystem {
+	return &fileSystem{fs: fs}
+}
+
+// Handler returns an http.Handler which serves the given VFS over
+// WebDAV, using an in-memory lock system. The opts argument might
+// be nil.
+func Handler(fs vfs.VFS, opts *Options) http.Handler {
+	h := &webdav.Handler{
+		FileSystem: FileSystem(fs),
+		LockSystem: webdav.NewMemLS(),
+	}
+	if opts != nil {
+		h.Prefix = opts.Prefix
+		h.Logger = opts.Logger
+	}
+	return h
+}
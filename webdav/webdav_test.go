@@ -0,0 +1,175 @@
+package webdav
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rainycape/vfs"
+)
+
+func request(t *testing.T, method string, url string, body string, headers map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+func expectStatus(t *testing.T, resp *http.Response, status int) {
+	t.Helper()
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: expecting status %d, got %d", resp.Request.Method, resp.Request.URL.Path, status, resp.StatusCode)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	fs := vfs.Memory()
+	srv := httptest.NewServer(Handler(fs, nil))
+	defer srv.Close()
+	resp, _ := request(t, "MKCOL", srv.URL+"/dir", "", nil)
+	expectStatus(t, resp, http.StatusCreated)
+	resp, _ = request(t, "MKCOL", srv.URL+"/missing/dir", "", nil)
+	expectStatus(t, resp, http.StatusConflict)
+	resp, _ = request(t, "PUT", srv.URL+"/dir/a.txt", "hello", nil)
+	expectStatus(t, resp, http.StatusCreated)
+	resp, body := request(t, "GET", srv.URL+"/dir/a.txt", "", nil)
+	expectStatus(t, resp, http.StatusOK)
+	if body != "hello" {
+		t.Errorf("expecting hello, got %q", body)
+	}
+	resp, body = request(t, "PROPFIND", srv.URL+"/dir/", "", map[string]string{"Depth": "1"})
+	expectStatus(t, resp, http.StatusMultiStatus)
+	if !strings.Contains(body, "/dir/a.txt") {
+		t.Errorf("expecting a.txt in PROPFIND response %q", body)
+	}
+	resp, _ = request(t, "COPY", srv.URL+"/dir", "", map[string]string{"Destination": srv.URL + "/copy"})
+	expectStatus(t, resp, http.StatusCreated)
+	resp, _ = request(t, "MOVE", srv.URL+"/dir", "", map[string]string{"Destination": srv.URL + "/moved"})
+	expectStatus(t, resp, http.StatusCreated)
+	for _, v := range []string{"/copy/a.txt", "/moved/a.txt"} {
+		data, err := vfs.ReadFile(fs, v)
+		if err != nil || string(data) != "hello" {
+			t.Errorf("unexpected contents for %s: %q, %v", v, string(data), err)
+		}
+	}
+	if _, err := fs.Stat("/dir"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting /dir to be moved, got %v", err)
+	}
+	resp, _ = request(t, "DELETE", srv.URL+"/moved", "", nil)
+	expectStatus(t, resp, http.StatusNoContent)
+	if _, err := fs.Stat("/moved"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting /moved to be removed, got %v", err)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	fs := vfs.Memory()
+	srv := httptest.NewServer(Handler(fs, nil))
+	defer srv.Close()
+	lockBody := `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+	resp, _ := request(t, "LOCK", srv.URL+"/locked.txt", lockBody, map[string]string{"Timeout": "Second-60"})
+	expectStatus(t, resp, http.StatusCreated)
+	token := resp.Header.Get("Lock-Token")
+	if token == "" {
+		t.Fatal("expecting a lock token")
+	}
+	resp, _ = request(t, "PUT", srv.URL+"/locked.txt", "data", nil)
+	expectStatus(t, resp, http.StatusLocked)
+	resp, _ = request(t, "PUT", srv.URL+"/locked.txt", "data", map[string]string{"If": "(" + token + ")"})
+	expectStatus(t, resp, http.StatusCreated)
+	resp, _ = request(t, "UNLOCK", srv.URL+"/locked.txt", "", map[string]string{"Lock-Token": token})
+	expectStatus(t, resp, http.StatusNoContent)
+	resp, _ = request(t, "PUT", srv.URL+"/locked.txt", "more", nil)
+	expectStatus(t, resp, http.StatusCreated)
+}
+
+func TestMounter(t *testing.T) {
+	root := vfs.Memory()
+	if err := root.Mkdir("/mnt", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.WriteFile(root, "/a.txt", []byte("root"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mounted := vfs.Memory()
+	m := &vfs.Mounter{}
+	if err := m.Mount(root, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(mounted, "/mnt"); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(Handler(m, &Options{Prefix: "/dav"}))
+	defer srv.Close()
+	resp, _ := request(t, "MOVE", srv.URL+"/dav/a.txt", "", map[string]string{"Destination": srv.URL + "/dav/mnt/b.txt"})
+	expectStatus(t, resp, http.StatusCreated)
+	data, err := vfs.ReadFile(mounted, "/b.txt")
+	if err != nil || string(data) != "root" {
+		t.Errorf("unexpected contents in mounted fs %q, %v", string(data), err)
+	}
+	if _, err := root.Stat("/a.txt"); !vfs.IsNotExist(err) {
+		t.Errorf("expecting /a.txt to be moved, got %v", err)
+	}
+}
+
+func TestOpenFileFlags(t *testing.T) {
+	ctx := context.Background()
+	fs := FileSystem(vfs.Memory())
+	f, err := fs.OpenFile(ctx, "/a.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+	if _, err := fs.OpenFile(ctx, "/a.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+		t.Errorf("expecting exist error with O_EXCL, got %v", err)
+	}
+	f, err = fs.OpenFile(ctx, "/a.txt", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" world"))
+	f.Close()
+	f, err = fs.OpenFile(ctx, "/a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("unexpected contents %q, %v", string(data), err)
+	}
+	if _, err := f.Write([]byte("x")); err != vfs.ErrReadOnly {
+		t.Errorf("expecting ErrReadOnly writing read only file, got %v", err)
+	}
+	f.Close()
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.OpenFile(ctx, "/dir", os.O_RDWR, 0); err == nil {
+		t.Error("expecting an error opening a directory for writing")
+	}
+	if err := fs.Rename(ctx, "/dir", "/dir/sub"); err != os.ErrInvalid {
+		t.Errorf("expecting ErrInvalid renaming into itself, got %v", err)
+	}
+	if err := fs.RemoveAll(ctx, "/"); err != os.ErrInvalid {
+		t.Errorf("expecting ErrInvalid removing the root, got %v", err)
+	}
+}
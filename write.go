@@ -5,14 +5,42 @@ import (
 	"archive/zip"
 	"compress/gzip"
 	"io"
+	"io/ioutil"
 	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 )
 
+// readlink returns the target of the symlink with the given
+// info, or false if fs doesn't expose it.
+func readlink(info os.FileInfo) (string, bool) {
+	f, ok := info.Sys().(*File)
+	if !ok {
+		return "", false
+	}
+	f.RLock()
+	defer f.RUnlock()
+	return string(f.Data), true
+}
+
+// copyVFS calls copier for every file in fs. Symlinks are passed with
+// their target as the data when it's available, otherwise they're
+// followed.
 func copyVFS(fs VFS, copier func(p string, info os.FileInfo, f io.Reader) error) error {
 	return Walk(fs, "/", func(vfs VFS, p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, ok := readlink(info); ok {
+				return copier(p[1:], info, strings.NewReader(target))
+			}
+			if info, err = fs.Stat(p); err != nil {
+				return err
+			}
+		}
 		if info.IsDir() {
 			return nil
 		}
@@ -51,7 +79,15 @@ func WriteZip(w io.Writer, fs VFS) error {
 func WriteTar(w io.Writer, fs VFS) error {
 	tw := tar.NewWriter(w)
 	err := copyVFS(fs, func(p string, info os.FileInfo, f io.Reader) error {
-		hdr, err := tar.FileInfoHeader(info, "")
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			data, err := ioutil.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			link = string(data)
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
 		if err != nil {
 			return err
 		}
@@ -59,6 +95,9 @@ func WriteTar(w io.Writer, fs VFS) error {
 		if err := tw.WriteHeader(hdr); err != nil {
 			return err
 		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			return nil
+		}
 		_, err = io.Copy(tw, f)
 		return err
 	})
@@ -79,3 +118,28 @@ func WriteTarGzip(w io.Writer, fs VFS) error {
 	}
 	return gw.Close()
 }
+
+// WriteTarXz writes the given VFS as a tar.xz file to the given io.Writer.
+func WriteTarXz(w io.Writer, fs VFS) error {
+	xw, err := xz.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if err := WriteTar(xw, fs); err != nil {
+		return err
+	}
+	return xw.Close()
+}
+
+// WriteTarZstd writes the given VFS as a tar.zst file to the given io.Writer.
+func WriteTarZstd(w io.Writer, fs VFS) error {
+	zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return err
+	}
+	if err := WriteTar(zw, fs); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
@@ -19,6 +19,8 @@ func TestWrite(t *testing.T) {
 			{"zip", WriteZip, func(r io.Reader) (VFS, error) { return Zip(r, 0) }},
 			{"tar", WriteTar, Tar},
 			{"tar.gz", WriteTarGzip, TarGzip},
+			{"tar.xz", WriteTarXz, TarXz},
+			{"tar.zst", WriteTarZstd, TarZstd},
 		}
 	)
 	p := filepath.Join("testdata", "fs.zip")
@@ -0,0 +1,456 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrWriteBackClosed is returned by write-back file systems
+	// when they're used after being closed.
+	ErrWriteBackClosed = errors.New("write-back filesystem is closed")
+)
+
+// WriteBackOptions specifies the options for WriteBack.
+type WriteBackOptions struct {
+	// Workers is the number of goroutines which write to the backing
+	// VFS. Operations on the same path are always performed by the
+	// same worker, in the same order they were issued. If zero,
+	// 4 workers are used.
+	Workers int
+	// QueueSize is the number of pending operations each worker
+	// can hold. When a worker queue is full, closing a file blocks
+	// until there's room in it. If zero, a size of 128 is used.
+	QueueSize int
+	// ErrorsSize is the capacity of the channel returned by Errors.
+	// Errors which don't fit in it are still reported by Flush.
+	// If zero, a size of 16 is used.
+	ErrorsSize int
+}
+
+// WriteBackError represents an error which happened while writing
+// a file back to the backing VFS.
+type WriteBackError struct {
+	// Path is the path of the file which couldn't be written.
+	Path string
+	// Err is the error returned by the backing VFS.
+	Err error
+}
+
+func (e *WriteBackError) Error() string {
+	return fmt.Sprintf("error writing back %s: %s", e.Path, e.Err)
+}
+
+// WriteBackVFS is the interface implemented by the VFS returned from
+// WriteBack.
+type WriteBackVFS interface {
+	VFS
+	// Flush waits until all the files closed before calling it have
+	// been written to the backing VFS, or until ctx is done. It returns
+	// the first error which happened since the previous call to Flush,
+	// or the error from ctx.
+	Flush(ctx context.Context) error
+	// Errors returns a channel which receives the errors that happen
+	// while writing files back, as *WriteBackError.
+	Errors() <-chan error
+	// Close flushes all pending writes and stops the workers. It
+	// returns the same error Flush would.
+	Close() error
+}
+
+type writeBackJob struct {
+	seq  uint64
+	path string
+	file *File
+	perm os.FileMode
+	// fn, if non-nil, is called instead of writing the file and
+	// its result is sent to done.
+	fn   func() error
+	done chan error
+}
+
+type writeBackFileSystem struct {
+	fs      VFS
+	workers []chan *writeBackJob
+	errors  chan error
+	// sending holds a read lock on closeMu, so workers
+	// are not closed while jobs are being sent to them.
+	closeMu sync.RWMutex
+	mu      sync.Mutex
+	pending map[string]*File
+	// seq is the sequence number of the last enqueued job, while
+	// done is the highest one such that it and all the previous
+	// jobs have finished. Jobs finished out of order are kept
+	// in finished until done reaches them.
+	seq      uint64
+	done     uint64
+	finished map[uint64]bool
+	// progress is closed and replaced every time done advances
+	progress chan struct{}
+	err      error
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func (fs *writeBackFileSystem) VFS() VFS {
+	return fs.fs
+}
+
+func (fs *writeBackFileSystem) work(jobs chan *writeBackJob) {
+	defer fs.wg.Done()
+	for job := range jobs {
+		if job.fn != nil {
+			job.done <- job.fn()
+		} else {
+			fs.write(job)
+		}
+		fs.finish(job.seq)
+	}
+}
+
+func (fs *writeBackFileSystem) finish(seq uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.finished[seq] = true
+	advanced := false
+	for fs.finished[fs.done+1] {
+		delete(fs.finished, fs.done+1)
+		fs.done++
+		advanced = true
+	}
+	if advanced {
+		close(fs.progress)
+		fs.progress = make(chan struct{})
+	}
+}
+
+// wait waits until the job with the given sequence number
+// and all the previous ones have finished.
+func (fs *writeBackFileSystem) wait(ctx context.Context, seq uint64) error {
+	for {
+		fs.mu.Lock()
+		done := fs.done
+		progress := fs.progress
+		fs.mu.Unlock()
+		if done >= seq {
+			return nil
+		}
+		select {
+		case <-progress:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (fs *writeBackFileSystem) write(job *writeBackJob) {
+	job.file.RLock()
+	data := job.file.Data
+	job.file.RUnlock()
+	err := WriteFile(fs.fs, job.path, data, job.perm)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.pending[job.path] == job.file {
+		delete(fs.pending, job.path)
+	}
+	if err != nil {
+		werr := &WriteBackError{Path: job.path, Err: err}
+		if fs.err == nil {
+			fs.err = werr
+		}
+		select {
+		case fs.errors <- werr:
+		default:
+		}
+	}
+}
+
+func (fs *writeBackFileSystem) enqueue(job *writeBackJob) error {
+	fs.closeMu.RLock()
+	defer fs.closeMu.RUnlock()
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return ErrWriteBackClosed
+	}
+	fs.seq++
+	job.seq = fs.seq
+	fs.mu.Unlock()
+	h := fnv.New32a()
+	h.Write([]byte(job.path))
+	fs.workers[int(h.Sum32()%uint32(len(fs.workers)))] <- job
+	return nil
+}
+
+// run performs fn by the worker which handles the given path, after
+// all the previous operations on that path, and waits for it.
+func (fs *writeBackFileSystem) run(path string, fn func() error) error {
+	job := &writeBackJob{path: cleanPath(path), fn: fn, done: make(chan error, 1)}
+	if err := fs.enqueue(job); err != nil {
+		return err
+	}
+	return <-job.done
+}
+
+func (fs *writeBackFileSystem) pendingFile(path string) *File {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.pending[cleanPath(path)]
+}
+
+func (fs *writeBackFileSystem) Flush(ctx context.Context) error {
+	// Wait only for the jobs enqueued so far, so Flush returns
+	// even if files keep being written.
+	fs.mu.Lock()
+	seq := fs.seq
+	fs.mu.Unlock()
+	if err := fs.wait(ctx, seq); err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	err := fs.err
+	fs.err = nil
+	return err
+}
+
+func (fs *writeBackFileSystem) Errors() <-chan error {
+	return fs.errors
+}
+
+func (fs *writeBackFileSystem) Close() error {
+	fs.closeMu.Lock()
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		fs.closeMu.Unlock()
+		return ErrWriteBackClosed
+	}
+	fs.closed = true
+	fs.mu.Unlock()
+	for _, v := range fs.workers {
+		close(v)
+	}
+	fs.closeMu.Unlock()
+	fs.wg.Wait()
+	return fs.Flush(context.Background())
+}
+
+func (fs *writeBackFileSystem) Open(path string) (RFile, error) {
+	if f := fs.pendingFile(path); f != nil {
+		return NewRFile(f)
+	}
+	return fs.fs.Open(path)
+}
+
+func (fs *writeBackFileSystem) OpenFile(path string, flag int, perm os.FileMode) (WFile, error) {
+	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR|os.O_TRUNC) == 0 {
+		if f := fs.pendingFile(path); f != nil {
+			return NewWFile(f, true, false)
+		}
+		return fs.fs.OpenFile(path, flag, perm)
+	}
+	f := &File{Mode: perm, ModTime: time.Now()}
+	if pf := fs.pendingFile(path); pf != nil {
+		if flag&os.O_EXCL != 0 {
+			return nil, os.ErrExist
+		}
+		f.Mode = pf.Mode
+		if flag&os.O_TRUNC == 0 {
+			pf.RLock()
+			f.Data = append([]byte(nil), pf.Data...)
+			pf.RUnlock()
+		}
+	} else {
+		st, err := fs.fs.Stat(path)
+		switch {
+		case err == nil:
+			if flag&os.O_EXCL != 0 {
+				return nil, os.ErrExist
+			}
+			if !st.Mode().IsRegular() {
+				return nil, fmt.Errorf("%s is not a file", path)
+			}
+			// Existing files keep their mode
+			f.Mode = st.Mode().Perm()
+			if flag&os.O_TRUNC == 0 {
+				if f.Data, err = ReadFile(fs.fs, path); err != nil {
+					return nil, err
+				}
+			}
+		case IsNotExist(err) && flag&os.O_CREATE != 0:
+			dir, err := fs.fs.Stat(pathpkg.Dir("/" + cleanPath(path)))
+			if err != nil {
+				return nil, err
+			}
+			if !dir.IsDir() {
+				return nil, fmt.Errorf("%s is not a directory", pathpkg.Dir(path))
+			}
+		default:
+			return nil, err
+		}
+	}
+	w, err := NewWFile(f, flag&os.O_RDWR != 0, true)
+	if err != nil {
+		return nil, err
+	}
+	return &writeBackFile{WFile: w, fs: fs, path: cleanPath(path), file: f, perm: f.Mode.Perm()}, nil
+}
+
+func (fs *writeBackFileSystem) stat(path string, stat func(string) (os.FileInfo, error)) (os.FileInfo, error) {
+	if f := fs.pendingFile(path); f != nil {
+		return &EntryInfo{Path: path, Entry: f}, nil
+	}
+	return stat(path)
+}
+
+func (fs *writeBackFileSystem) Lstat(path string) (os.FileInfo, error) {
+	return fs.stat(path, fs.fs.Lstat)
+}
+
+func (fs *writeBackFileSystem) Stat(path string) (os.FileInfo, error) {
+	return fs.stat(path, fs.fs.Stat)
+}
+
+func (fs *writeBackFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	infos, err := fs.fs.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := cleanPath(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	added := false
+	for k, f := range fs.pending {
+		if cleanPath(pathpkg.Dir("/"+k)) != dir {
+			continue
+		}
+		info := &EntryInfo{Path: k, Entry: f}
+		found := false
+		for ii, v := range infos {
+			if v.Name() == info.Name() {
+				infos[ii] = info
+				found = true
+				break
+			}
+		}
+		if !found {
+			infos = append(infos, info)
+			added = true
+		}
+	}
+	if added {
+		sort.Sort(FileInfos(infos))
+	}
+	return infos, nil
+}
+
+func (fs *writeBackFileSystem) Mkdir(path string, perm os.FileMode) error {
+	return fs.run(path, func() error {
+		return fs.fs.Mkdir(path, perm)
+	})
+}
+
+func (fs *writeBackFileSystem) Remove(path string) error {
+	// Files inside a directory might be written by other workers,
+	// so wait for them before removing it.
+	p := cleanPath(path)
+	fs.mu.Lock()
+	seq := fs.seq
+	children := false
+	for k := range fs.pending {
+		if p == "" || strings.HasPrefix(k, p+"/") {
+			children = true
+			break
+		}
+	}
+	fs.mu.Unlock()
+	if children {
+		if err := fs.wait(context.Background(), seq); err != nil {
+			return err
+		}
+	}
+	return fs.run(path, func() error {
+		return fs.fs.Remove(path)
+	})
+}
+
+func (fs *writeBackFileSystem) String() string {
+	return fmt.Sprintf("WriteBack %s", fs.fs.String())
+}
+
+type writeBackFile struct {
+	WFile
+	fs     *writeBackFileSystem
+	path   string
+	file   *File
+	perm   os.FileMode
+	closed bool
+}
+
+func (f *writeBackFile) Close() error {
+	if f.closed {
+		return errFileClosed
+	}
+	f.closed = true
+	if err := f.WFile.Close(); err != nil {
+		return err
+	}
+	f.fs.mu.Lock()
+	f.fs.pending[f.path] = f.file
+	f.fs.mu.Unlock()
+	err := f.fs.enqueue(&writeBackJob{path: f.path, file: f.file, perm: f.perm})
+	if err != nil {
+		f.fs.mu.Lock()
+		if f.fs.pending[f.path] == f.file {
+			delete(f.fs.pending, f.path)
+		}
+		f.fs.mu.Unlock()
+	}
+	return err
+}
+
+// WriteBack returns a VFS which buffers the files written to it in
+// memory and writes them to fs asynchronously, after they're closed.
+// Reads see the buffered data until it has been written. Mkdir and
+// Remove are performed synchronously, but after any pending operations
+// on the same path and, for Remove, after the pending writes inside the
+// removed directory. Errors writing files back are reported by the
+// Errors channel and by Flush. The opts argument might be nil.
+func WriteBack(fs VFS, opts *WriteBackOptions) WriteBackVFS {
+	var o WriteBackOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Workers <= 0 {
+		o.Workers = 4
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = 128
+	}
+	if o.ErrorsSize <= 0 {
+		o.ErrorsSize = 16
+	}
+	wfs := &writeBackFileSystem{
+		fs:       fs,
+		errors:   make(chan error, o.ErrorsSize),
+		pending:  make(map[string]*File),
+		finished: make(map[uint64]bool),
+		progress: make(chan struct{}),
+	}
+	for ii := 0; ii < o.Workers; ii++ {
+		jobs := make(chan *writeBackJob, o.QueueSize)
+		wfs.workers = append(wfs.workers, jobs)
+		wfs.wg.Add(1)
+		go wfs.work(jobs)
+	}
+	return wfs
+}
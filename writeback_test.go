@@ -0,0 +1,192 @@
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWriteBack(t *testing.T) {
+	fs := WriteBack(Memory(), nil)
+	defer fs.Close()
+	testVFS(t, fs)
+	if err := fs.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteBackOrdering(t *testing.T) {
+	backing := Memory()
+	slow := Faulty(backing, []FaultRule{{Op: OpOpenFile, Latency: 5 * time.Millisecond}}, 1)
+	fs := WriteBack(slow, &WriteBackOptions{Workers: 2})
+	start := time.Now()
+	for ii := 0; ii < 20; ii++ {
+		name := fmt.Sprintf("f%d", ii%4)
+		if err := WriteFile(fs, name, []byte(fmt.Sprintf("%d", ii)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 25*time.Millisecond {
+		t.Errorf("writing took %s, it should not wait for the backing VFS", d)
+	}
+	// Reads must see the buffered data
+	if data, err := ReadFile(fs, "f3"); err != nil || string(data) != "19" {
+		t.Errorf("expecting f3 to contain \"19\", got %q (%v)", string(data), err)
+	}
+	if err := fs.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for ii := 16; ii < 20; ii++ {
+		name := fmt.Sprintf("f%d", ii%4)
+		data, err := ReadFile(backing, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := fmt.Sprintf("%d", ii); string(data) != exp {
+			t.Errorf("expecting %s to contain %q, got %q", name, exp, string(data))
+		}
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "a", nil, 0644); err != ErrWriteBackClosed {
+		t.Errorf("expecting ErrWriteBackClosed, got %v", err)
+	}
+}
+
+func TestWriteBackErrors(t *testing.T) {
+	failing := Faulty(Memory(), []FaultRule{{Op: OpOpenFile, Path: "bad", Err: syscall.EIO}}, 1)
+	fs := WriteBack(failing, nil)
+	defer fs.Close()
+	if err := WriteFile(fs, "bad", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "good", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := fs.Flush(context.Background())
+	werr, ok := err.(*WriteBackError)
+	if !ok || werr.Path != "bad" || werr.Err != syscall.EIO {
+		t.Fatalf("expecting a *WriteBackError for bad, got %v", err)
+	}
+	select {
+	case err := <-fs.Errors():
+		if err.(*WriteBackError).Path != "bad" {
+			t.Errorf("unexpected error %v", err)
+		}
+	default:
+		t.Error("expecting an error in the channel")
+	}
+	if err := fs.Flush(context.Background()); err != nil {
+		t.Errorf("errors should be reported only once, got %v", err)
+	}
+}
+
+func TestWriteBackFlushTimeout(t *testing.T) {
+	slow := Faulty(Memory(), []FaultRule{{Op: OpOpenFile, Latency: 50 * time.Millisecond}}, 1)
+	fs := WriteBack(slow, nil)
+	defer fs.Close()
+	if err := WriteFile(fs, "a", []byte("A"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := fs.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expecting context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestWriteBackFlushSteadyWrites(t *testing.T) {
+	slow := Faulty(Memory(), []FaultRule{{Op: OpOpenFile, Latency: time.Millisecond}}, 1)
+	fs := WriteBack(slow, &WriteBackOptions{Workers: 2})
+	defer fs.Close()
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for ii := 0; ; ii++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := WriteFile(fs, fmt.Sprintf("f%d", ii%8), []byte("data"), 0644); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// Flush must only wait for the files written before calling it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := fs.Flush(ctx); err != nil {
+		t.Errorf("Flush should return while files are being written, got %v", err)
+	}
+}
+
+func TestWriteBackMode(t *testing.T) {
+	// Memory doesn't keep the permissions
+	backing, err := TmpFS("vfs-test-writeback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backing.Close()
+	if err := WriteFile(backing, "a", []byte("A"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Keep the file pending while it's checked
+	slow := Faulty(backing, []FaultRule{{Op: OpOpenFile, Latency: 50 * time.Millisecond}}, 1)
+	fs := WriteBack(slow, nil)
+	defer fs.Close()
+	f, err := fs.OpenFile("a", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("B")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.Stat("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expecting pending file to keep mode 0600, got %s", info.Mode())
+	}
+}
+
+func TestWriteBackRemoveDir(t *testing.T) {
+	backing := Memory()
+	slow := Faulty(backing, []FaultRule{{Op: OpOpenFile, Latency: 5 * time.Millisecond}}, 1)
+	fs := WriteBack(slow, &WriteBackOptions{Workers: 8})
+	defer fs.Close()
+	if err := fs.Mkdir("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for ii := 0; ii < 8; ii++ {
+		if err := WriteFile(fs, fmt.Sprintf("dir/f%d", ii), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Removing the directory must happen after its
+	// files have been written and removed.
+	if err := RemoveAll(fs, "dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backing.Stat("dir"); !IsNotExist(err) {
+		t.Errorf("expecting dir to be removed, got %v", err)
+	}
+}